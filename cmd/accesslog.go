@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDKey is the gin context key of the request ID
+const requestIDKey = "request_id"
+
+// requestIDHeader is the header request IDs are read from and returned in
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches the incoming request IDs we honor
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestIDContextKey is the context.Context key carrying the request ID into S3 calls
+type requestIDContextKey struct{}
+
+// withRequestID returns a copy of ctx carrying the request ID of c
+func withRequestID(ctx context.Context, c *gin.Context) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID(c))
+}
+
+// contextRequestID returns the request ID carried by ctx, if any
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// incomingRequestID returns the request ID sent by the client or a load balancer
+// in h, or a new one if there is none or it doesn't look like an ID
+func incomingRequestID(h http.Header) string {
+	if id := h.Get(requestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// newRequestID returns a random 128 bit request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// requestID returns the ID of the request
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// openAccessLog opens the access log sink: stdout, stderr, off or a file path
+func openAccessLog(sink string) (io.Writer, error) {
+	switch sink {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "off":
+		return nil, nil
+	default:
+		return os.OpenFile(sink, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	}
+}
+
+// defaultAccessLogExclude are the routes of load balancer probes and metrics scrapes,
+// not access logged unless access_log_exclude is set
+var defaultAccessLogExclude = []string{"/healthz", "/readyz", "/metrics"}
+
+// accessLog writes one JSON line per request to w, or nothing if w is nil
+func accessLog(w io.Writer) gin.HandlerFunc {
+	if w == nil {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	access := slog.New(slog.NewJSONHandler(w, nil))
+	exclude := config.AccessLogExclude
+	if exclude == nil {
+		exclude = defaultAccessLogExclude
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, route := range exclude {
+		excluded[route] = true
+	}
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		if excluded[c.FullPath()] {
+			return
+		}
+
+		access.Info("request",
+			"request_id", requestID(c),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"bytes", c.Writer.Size(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"client_ip", c.ClientIP(),
+			"user_agent", c.Request.UserAgent(),
+		)
+	}
+}
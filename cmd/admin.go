@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth only lets requests through that carry the configured admin token as
+// bearer token, or as basic auth password so browsers can open the dashboard.
+// Browsers send cached basic auth credentials along with requests other sites
+// trigger, so those may only change something when they come from the same origin.
+// Without an admin token in the config the admin routes are disabled.
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.AdminToken == "" {
+			abortWithError(c, http.StatusNotFound, codeFeatureDisabled, "Admin API disabled")
+			return
+		}
+		token, bearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		_, password, basic := c.Request.BasicAuth()
+		if basic {
+			token = password
+		}
+		if !bearer && !basic || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="admin"`)
+			abortWithError(c, http.StatusUnauthorized, codeUnauthorized, "invalid admin token")
+			return
+		}
+		if basic && !safeMethod(c.Request.Method) && crossSite(c.Request) {
+			abortWithError(c, http.StatusForbidden, codeCrossSiteRequest, "admin changes must come from the dashboard or carry a bearer token")
+			return
+		}
+		c.Next()
+	}
+}
+
+// safeMethod reports whether requests of a method only read
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// crossSite reports whether a browser sent the request on behalf of another
+// origin. Sec-Fetch-Site is trusted when present, otherwise the Origin is compared
+// with the host. Requests with neither header don't come from a browser page.
+func crossSite(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+func registerAdminRoutes(router *gin.Engine) {
+	admin := router.Group("/admin", adminAuth())
+
+	registerDebugRoutes(admin.Group("/debug"))
+	admin.GET("/analytics", getAnalytics)
+	admin.GET("/catalog/snapshots", searchCatalog)
+	registerRegistryRoutes(admin)
+	admin.GET("/reports/usage", getUsageReport)
+	admin.GET("/costs", getCostEstimate)
+	admin.POST("/export", triggerStaticExport)
+	registerJobRoutes(admin)
+	registerSnapshotJobRoutes(router, admin)
+	registerTaskRoutes(router, admin)
+	admin.GET("/diagnostics", getDiagnostics)
+	registerDashboardRoutes(admin)
+	registerUploadRoutes(admin)
+}
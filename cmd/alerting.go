@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// staleAlert is sent when a network goes stale, and again when it recovers
+type staleAlert struct {
+	Protocol         string    `json:"protocol"`
+	Network          string    `json:"network"`
+	Resolved         bool      `json:"resolved"`
+	LatestKey        string    `json:"latest_key"`
+	LastModified     time.Time `json:"last_modified"`
+	AgeSeconds       int64     `json:"age_seconds"`
+	ThresholdSeconds int64     `json:"threshold_seconds"`
+}
+
+func (a staleAlert) summary() string {
+	if a.Resolved {
+		return fmt.Sprintf("%s/%s is fresh again, latest snapshot %s is %s old",
+			a.Protocol, a.Network, a.LatestKey, time.Duration(a.AgeSeconds)*time.Second)
+	}
+	return fmt.Sprintf("%s/%s is stale, latest snapshot %s is %s old (threshold %s)",
+		a.Protocol, a.Network, a.LatestKey, time.Duration(a.AgeSeconds)*time.Second, time.Duration(a.ThresholdSeconds)*time.Second)
+}
+
+// Define the networks currently alerted as stale, keyed by protocol/network and
+// the index of the notifier that was alerted
+var staleNetworks = sync.Map{}
+
+// evaluateStaleness compares the age of the latest snapshot of a network against
+// its stale_after_seconds threshold and notifies the alert notifiers when the
+// network goes stale or recovers. A notifier that couldn't be reached is notified
+// again on the next evaluation.
+func evaluateStaleness(protocol, network string, latest *s3.Object) {
+	threshold, ok := staleThreshold(protocol, network)
+	if !ok || len(config.AlertNotifiers) == 0 {
+		return
+	}
+
+	age := time.Since(*latest.LastModified)
+	stale := age > threshold
+	alert := staleAlert{
+		Protocol:         protocol,
+		Network:          network,
+		Resolved:         !stale,
+		LatestKey:        *latest.Key,
+		LastModified:     *latest.LastModified,
+		AgeSeconds:       int64(age.Seconds()),
+		ThresholdSeconds: int64(threshold.Seconds()),
+	}
+	for i, notifier := range config.AlertNotifiers {
+		key := fmt.Sprintf("%s/%s#%d", protocol, network, i)
+		if _, wasStale := staleNetworks.Load(key); stale == wasStale {
+			continue
+		}
+		if err := sendStaleAlert(notifier, alert); err != nil {
+			logger.Error("Sending staleness alert failed", "notifier", notifier.Type, "protocol", protocol, "network", network, "error", err)
+			continue
+		}
+		if stale {
+			staleNetworks.Store(key, true)
+		} else {
+			staleNetworks.Delete(key)
+		}
+	}
+}
+
+// sendStaleAlert delivers an alert to one notifier
+func sendStaleAlert(notifier NotifierConfig, alert staleAlert) error {
+	switch notifier.Type {
+	case "webhook":
+		return postJSON(notifier.URL, alert)
+	case "slack":
+		return postJSON(notifier.URL, map[string]string{"text": alert.summary()})
+	case "discord":
+		return postJSON(notifier.URL, map[string]string{"content": alert.summary()})
+	case "pagerduty":
+		action := "trigger"
+		if alert.Resolved {
+			action = "resolve"
+		}
+		url := notifier.URL
+		if url == "" {
+			url = pagerDutyEventsURL
+		}
+		return postJSON(url, map[string]interface{}{
+			"routing_key":  notifier.RoutingKey,
+			"event_action": action,
+			"dedup_key":    "snapshot-stale/" + alert.Protocol + "/" + alert.Network,
+			"payload": map[string]interface{}{
+				"summary":        alert.summary(),
+				"source":         "snapshot-service-api",
+				"severity":       "warning",
+				"custom_details": alert,
+			},
+		})
+	default:
+		return fmt.Errorf("unknown notifier type %q", notifier.Type)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestStaleAlertRetried(t *testing.T) {
+	var received atomic.Int32
+	failing := atomic.Bool{}
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	newTestAPI(t)
+	hook := server.URL + "/hooks/secret-token"
+	config.StaleAfterSeconds = map[string]int{"*": 60}
+	config.AlertNotifiers = []NotifierConfig{{Type: "slack", URL: hook}}
+	t.Cleanup(func() { staleNetworks.Delete("nimiq/mainnet#0") })
+	latest := &s3.Object{Key: aws.String("nimiq/mainnet/2024-01-01.tar.zst"), LastModified: aws.Time(time.Now().Add(-time.Hour))}
+
+	// Connection errors name the URL, which carries the credential of the webhook
+	if err := postJSON("http://127.0.0.1:1/hooks/secret-token", nil); err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("error %v, want one without the URL", err)
+	}
+
+	evaluateStaleness("nimiq", "mainnet", latest)
+	failing.Store(false)
+	evaluateStaleness("nimiq", "mainnet", latest)
+	evaluateStaleness("nimiq", "mainnet", latest)
+	if n := received.Load(); n != 1 {
+		t.Errorf("%d alerts delivered, want the failed one delivered once on the next evaluation", n)
+	}
+}
+
+func TestCheckNotifiers(t *testing.T) {
+	if err := checkNotifiers([]NotifierConfig{{Type: "pagerduty", RoutingKey: "key"}, {Type: "webhook", URL: "https://example.com"}}, alertNotifierTypes); err != nil {
+		t.Errorf("valid notifiers rejected: %v", err)
+	}
+	if err := checkNotifiers([]NotifierConfig{{Type: "teams", URL: "https://example.com"}}, alertNotifierTypes); err == nil {
+		t.Error("unknown type accepted")
+	}
+	if err := checkNotifiers([]NotifierConfig{{Type: "webhook", URL: "https://example.com"}}, announcementNotifierTypes); err == nil {
+		t.Error("webhook accepted for announcements")
+	}
+	if err := checkNotifiers([]NotifierConfig{{Type: "pagerduty"}}, alertNotifierTypes); err == nil {
+		t.Error("pagerduty without routing_key accepted")
+	}
+}
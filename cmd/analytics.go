@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// analyticsQueueSize bounds the events waiting to be written
+const analyticsQueueSize = 1024
+
+// downloadEvent is one download URL handed out or one proxied download
+type downloadEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Protocol string    `json:"protocol"`
+	Network  string    `json:"network"`
+	Key      string    `json:"key"`
+	Client   string    `json:"client"`
+	// Bytes is the size of the presigned object or of the proxied response
+	Bytes int64 `json:"bytes,omitempty"`
+	// Resumed is set for proxied ranges not starting at the beginning of the
+	// object, they count towards the bytes served but not as downloads
+	Resumed bool `json:"resumed,omitempty"`
+}
+
+// analyticsStore persists download events as JSON lines in append-only files, one
+// per UTC day next to the configured path, so reads only open the days they cover
+type analyticsStore struct {
+	path   string
+	events chan downloadEvent
+
+	mu sync.Mutex
+	// file is the file of day events are being written to
+	file *os.File
+	day  string
+}
+
+// Define the analytics store, nil when analytics_path is not configured
+var analytics *analyticsStore
+
+// openAnalyticsStore starts writing events to the day files of path. Events stored
+// in path itself before they were split by day are moved to their day files.
+func openAnalyticsStore(path string) (*analyticsStore, error) {
+	s := &analyticsStore{path: path, events: make(chan downloadEvent, analyticsQueueSize)}
+	if err := s.splitByDay(); err != nil {
+		return nil, fmt.Errorf("splitting %s by day: %w", path, err)
+	}
+	// Fail early when the directory isn't writable
+	if err := s.rotate(time.Now().UTC().Format(analyticsDayFormat)); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// analyticsDayFormat is the date of the day files
+const analyticsDayFormat = "2006-01-02"
+
+// dayPath returns the file of the events of day, e.g. analytics.2024-01-31.jsonl
+// for analytics.jsonl
+func (s *analyticsStore) dayPath(day string) string {
+	ext := filepath.Ext(s.path)
+	return strings.TrimSuffix(s.path, ext) + "." + day + ext
+}
+
+// days returns the days with a day file, oldest first
+func (s *analyticsStore) days() ([]string, error) {
+	ext := filepath.Ext(s.path)
+	prefix := filepath.Base(strings.TrimSuffix(s.path, ext)) + "."
+	entries, err := os.ReadDir(filepath.Dir(s.path))
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, entry := range entries {
+		day, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		if day, ok = strings.CutSuffix(day, ext); !ok {
+			continue
+		}
+		if _, err := time.Parse(analyticsDayFormat, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// rotate switches writing to the file of day, the caller holds mu unless the
+// store isn't running yet
+func (s *analyticsStore) rotate(day string) error {
+	file, err := os.OpenFile(s.dayPath(day), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, s.day = file, day
+	return nil
+}
+
+// splitByDay moves the events of the file at path, written before events were
+// stored by day, to their day files and removes it
+func (s *analyticsStore) splitByDay() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	days := make(map[string]*os.File)
+	defer func() {
+		for _, f := range days {
+			f.Close()
+		}
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event downloadEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		day := event.Time.UTC().Format(analyticsDayFormat)
+		f, ok := days[day]
+		if !ok {
+			if f, err = os.OpenFile(s.dayPath(day), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err != nil {
+				return err
+			}
+			days[day] = f
+		}
+		if _, err := f.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for day, f := range days {
+		delete(days, day)
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(s.path)
+}
+
+func (s *analyticsStore) run() {
+	for event := range s.events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		if day := event.Time.UTC().Format(analyticsDayFormat); day != s.day {
+			err = s.rotate(day)
+		}
+		if err == nil {
+			_, err = s.file.Write(append(line, '\n'))
+		}
+		s.mu.Unlock()
+		if err != nil {
+			logger.Error("Writing analytics event failed", "error", err)
+		}
+	}
+}
+
+// scan calls fn for every event between from and to stored when it is called,
+// reading only the files of the days in between. Only the sizes of the files are
+// taken under the lock, events keep being written while they are read.
+func (s *analyticsStore) scan(from, to time.Time, fn func(downloadEvent)) error {
+	s.mu.Lock()
+	files, err := s.dayFiles(from.UTC().Format(analyticsDayFormat), to.UTC().Format(analyticsDayFormat))
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err := s.scanFile(f.path, f.size, func(event downloadEvent) {
+			if !event.Time.Before(from) && event.Time.Before(to) {
+				fn(event)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyticsDayFile is a day file and its size when it was listed
+type analyticsDayFile struct {
+	path string
+	size int64
+}
+
+// dayFiles returns the files of the days from first to last, oldest first
+func (s *analyticsStore) dayFiles(first, last string) ([]analyticsDayFile, error) {
+	days, err := s.days()
+	if err != nil {
+		return nil, err
+	}
+	var files []analyticsDayFile
+	for _, day := range days {
+		if day < first || day > last {
+			continue
+		}
+		info, err := os.Stat(s.dayPath(day))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, analyticsDayFile{path: s.dayPath(day), size: info.Size()})
+	}
+	return files, nil
+}
+
+// scanFile calls fn for the events in the first size bytes of the file at path.
+// Events are written a whole line at a time, so a size taken under the lock ends
+// with a line.
+func (s *analyticsStore) scanFile(path string, size int64, fn func(downloadEvent)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(file, size))
+	for scanner.Scan() {
+		var event downloadEvent
+		if json.Unmarshal(scanner.Bytes(), &event) == nil {
+			fn(event)
+		}
+	}
+	return scanner.Err()
+}
+
+// recordDownload stores a download event for key, if analytics are enabled. HEAD
+// requests only check a download and aren't recorded.
+func recordDownload(c *gin.Context, kind, protocol, network, key string, bytes int64, resumed bool) {
+	if analytics == nil || c.Request.Method == http.MethodHead {
+		return
+	}
+	event := downloadEvent{
+		Time:     time.Now().UTC(),
+		Kind:     kind,
+		Protocol: protocol,
+		Network:  network,
+		Key:      key,
+		Client:   c.ClientIP(),
+		Bytes:    bytes,
+		Resumed:  resumed,
+	}
+	select {
+	case analytics.events <- event:
+	default:
+		requestLogger(c).Warn("Analytics event dropped, queue is full")
+	}
+}
+
+// analyticsGroups are the dimensions events can be grouped by
+var analyticsGroups = map[string]func(downloadEvent) string{
+	"network": func(e downloadEvent) string { return e.Protocol + "/" + e.Network },
+	"day":     func(e downloadEvent) string { return e.Time.Format("2006-01-02") },
+	"client":  func(e downloadEvent) string { return e.Client },
+	"kind":    func(e downloadEvent) string { return e.Kind },
+}
+
+// getAnalytics counts download events between from and to (dates, inclusive),
+// grouped by the comma separated group_by dimensions, as JSON or as CSV with format=csv
+func getAnalytics(c *gin.Context) {
+	if analytics == nil {
+		respondError(c, http.StatusNotFound, codeFeatureDisabled, "Analytics are disabled")
+		return
+	}
+
+	groups := strings.Split(c.DefaultQuery("group_by", "network,day"), ",")
+	for _, g := range groups {
+		if _, ok := analyticsGroups[g]; !ok {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("unknown group %q", g))
+			return
+		}
+	}
+	from, to, err := parseDateRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	counts := make(map[string]int)
+	err = analytics.scan(from, to, func(e downloadEvent) {
+		if e.Resumed {
+			return
+		}
+		values := make([]string, len(groups))
+		for i, g := range groups {
+			values[i] = analyticsGroups[g](e)
+		}
+		counts[strings.Join(values, "\x00")]++
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if c.Query("format") == "csv" {
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", `attachment; filename="analytics.csv"`)
+		w := csv.NewWriter(c.Writer)
+		w.Write(append(groups, "count"))
+		for _, k := range keys {
+			w.Write(append(strings.Split(k, "\x00"), strconv.Itoa(counts[k])))
+		}
+		w.Flush()
+		return
+	}
+
+	rows := make([]gin.H, 0, len(keys))
+	for _, k := range keys {
+		row := gin.H{"count": counts[k]}
+		for i, v := range strings.Split(k, "\x00") {
+			row[groups[i]] = v
+		}
+		rows = append(rows, row)
+	}
+	c.JSON(http.StatusOK, gin.H{"rows": rows})
+}
+
+// parseDateRange parses the optional YYYY-MM-DD from and to query parameters into
+// a half-open time range, covering everything when they are not set
+func parseDateRange(fromParam, toParam string) (time.Time, time.Time, error) {
+	from := time.Time{}
+	to := time.Now().Add(24 * time.Hour)
+	if fromParam != "" {
+		t, err := time.Parse("2006-01-02", fromParam)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid from date %q", fromParam)
+		}
+		from = t
+	}
+	if toParam != "" {
+		t, err := time.Parse("2006-01-02", toParam)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to date %q", toParam)
+		}
+		to = t.Add(24 * time.Hour)
+	}
+	return from, to, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnalyticsScanDoesntBlockWrites(t *testing.T) {
+	store, err := openAnalyticsStore(filepath.Join(t.TempDir(), "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(store.events)
+	now := time.Now().UTC()
+	path := store.dayPath(now.Format(analyticsDayFormat))
+
+	// waitForSize waits for the events queued so far to be written
+	waitForSize := func(larger int64) int64 {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if info, err := os.Stat(path); err == nil && info.Size() > larger {
+				return info.Size()
+			}
+		}
+		t.Fatal("analytics event not written")
+		return 0
+	}
+	store.events <- downloadEvent{Time: now, Key: "nimiq/mainnet/2024-01-01.tar.zst"}
+	size := waitForSize(0)
+
+	var scanned int
+	err = store.scan(now.Add(-time.Hour), now.Add(time.Hour), func(downloadEvent) {
+		scanned++
+		store.events <- downloadEvent{Time: now, Key: "nimiq/mainnet/2024-02-01.tar.zst"}
+		waitForSize(size)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned != 1 {
+		t.Errorf("scanned %d events, want only the one stored before the scan", scanned)
+	}
+}
+
+func TestAnalyticsDays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	// Events stored before they were split by day
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+	var lines []byte
+	for _, d := range []int{1, 2, 2} {
+		line, _ := json.Marshal(downloadEvent{Time: day(d), Key: "nimiq/mainnet/2024-01-01.tar.zst"})
+		lines = append(append(lines, line...), '\n')
+	}
+	if err := os.WriteFile(path, lines, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openAnalyticsStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(store.events)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("events not split by day: %v", err)
+	}
+	store.events <- downloadEvent{Time: day(3), Key: "nimiq/mainnet/2024-01-01.tar.zst"}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if info, err := os.Stat(store.dayPath("2024-01-03")); err == nil && info.Size() > 0 {
+			break
+		}
+	}
+
+	count := func(from, to time.Time) int {
+		var n int
+		if err := store.scan(from, to, func(downloadEvent) { n++ }); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(day(2).Truncate(24*time.Hour), day(3).Truncate(24*time.Hour)); n != 2 {
+		t.Errorf("%d events on the 2nd, want 2", n)
+	}
+	if n := count(time.Time{}, day(4)); n != 4 {
+		t.Errorf("%d events, want 4", n)
+	}
+	if files, err := store.dayFiles("2024-01-02", "2024-01-03"); err != nil || len(files) != 2 {
+		t.Errorf("day files %v, %v", files, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// announcementURLTTL is how long the links in new snapshot announcements stay valid
+const announcementURLTTL = 24 * time.Hour
+
+// announceSnapshots posts new snapshots to the configured Slack and Discord webhooks
+func announceSnapshots(e snapshotEvent) {
+	if e.Type != eventSnapshotPublished || len(config.SnapshotNotifiers) == 0 {
+		return
+	}
+	message := snapshotAnnouncement(e)
+
+	for _, notifier := range config.SnapshotNotifiers {
+		var err error
+		switch notifier.Type {
+		case "slack":
+			err = postJSON(notifier.URL, map[string]string{"text": message})
+		case "discord":
+			err = postJSON(notifier.URL, map[string]string{"content": message})
+		default:
+			err = fmt.Errorf("unknown notifier type %q", notifier.Type)
+		}
+		if err != nil {
+			logger.Error("Announcing new snapshot failed", "notifier", notifier.Type, "key", e.Key, "error", err)
+		}
+	}
+}
+
+// snapshotAnnouncement formats the message describing a snapshot
+func snapshotAnnouncement(e snapshotEvent) string {
+	title := "Latest snapshot"
+	if e.Type == eventSnapshotPublished {
+		title = "New snapshot"
+	}
+	lines := []string{
+		fmt.Sprintf("%s for %s/%s", title, e.Protocol, e.Network),
+		fmt.Sprintf("File: %s", e.Key),
+		fmt.Sprintf("Size: %s", humanSize(e.Size)),
+	}
+	if height, ok := snapshotHeight(e.Protocol, e.Network); ok {
+		lines = append(lines, fmt.Sprintf("Height: %v", height))
+	}
+	if url, err := downloadURL(storageClient(), e.Key, announcementURLTTL); err == nil {
+		lines = append(lines, fmt.Sprintf("Download: %s", url))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// snapshotHeight returns the block height from the snapshot-latest.json of a network, if it has one
+func snapshotHeight(protocol, network string) (interface{}, bool) {
+	item, err := loadSnapshotInfo(context.Background(), protocol, network)
+	if err != nil {
+		return nil, false
+	}
+	info, ok := item.content.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	for _, field := range []string{"height", "block_height", "block_number"} {
+		if height, ok := info[field]; ok {
+			return height, true
+		}
+	}
+	return nil, false
+}
+
+// humanSize formats a byte count with binary units
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,1113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gin-gonic/gin"
+)
+
+const testAdminToken = "test-admin-token"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	backgroundJobs = newWorkerPool(1)
+	cacheWarm.Store(true)
+	os.Exit(m.Run())
+}
+
+// Times the snapshots of the test bucket were written at
+var (
+	olderTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newerTime = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// newTestAPI configures the service for a fake bucket holding two snapshots of
+// nimiq/mainnet and returns the router serving the API from it
+func newTestAPI(t *testing.T) (http.Handler, *fakeStorage) {
+	t.Helper()
+	derivedDir := t.TempDir()
+	// Derived files are generated in the background from the fake of the test,
+	// the cleanup runs before the directory is removed
+	t.Cleanup(waitForDerivedJobs)
+	config = &Config{
+		BucketName:       "snapshots",
+		Region:           "us-east-1",
+		Endpoint:         "http://127.0.0.1:1",
+		AccessKey:        "AKIDTEST",
+		SecretKey:        "secret",
+		AdminToken:       testAdminToken,
+		DerivedCachePath: derivedDir,
+		// Fail right away, storage calls that aren't faked are never expected
+		S3MaxRetries: -1,
+	}
+	var err error
+	if sess, err = newSession(); err != nil {
+		t.Fatal(err)
+	}
+	storage := newFakeStorage()
+	storageClient = func() s3iface.S3API { return storage }
+	resetState()
+
+	storage.put("nimiq/mainnet/2024-01-01.tar.zst", "older snapshot", olderTime)
+	storage.put("nimiq/mainnet/2024-02-01.tar.zst", "newer snapshot", newerTime)
+	storage.put("nimiq/mainnet/snapshot-latest.json", `{"filename": "nimiq/mainnet/2024-02-01.tar.zst", "block_height": 42}`, newerTime)
+	return newRouter(io.Discard), storage
+}
+
+// resetState forgets everything cached by earlier tests
+func resetState() {
+	for _, m := range []*sync.Map{&cache, &infoCache, &latestCache, &presignCache, &checksumCache, &sniffedCompressions, &mirrorReports, &peerLatests, &chainHeads, &bucketSessions, &bucketRegions, &regionSessions, &missingCache, &tenantStates} {
+		m.Range(func(key, _ interface{}) bool {
+			m.Delete(key)
+			return true
+		})
+	}
+	knownNetworks.Store(nil)
+	registry.Store(nil)
+	scheduledJobs = nil
+	snapshotJobs = &snapshotJobStore{jobs: make(map[string]*snapshotJob)}
+	tasks = newTaskQueue(defaultTaskWorkers)
+	storageBreaker.mu.Lock()
+	storageBreaker.failures, storageBreaker.openUntil = 0, time.Time{}
+	storageBreaker.mu.Unlock()
+}
+
+// waitForDerivedJobs waits until no derived file is being generated
+func waitForDerivedJobs() {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if countEntries(&derivedJobs) == 0 {
+			waitForIdleWorkers()
+			return
+		}
+	}
+	panic("derived files still being generated")
+}
+
+// waitForIdleWorkers returns once the only worker of the test pool finished its
+// jobs, so the next job handed to it with TrySubmit isn't turned away
+func waitForIdleWorkers() {
+	idle := make(chan struct{})
+	backgroundJobs.Submit(func() { close(idle) })
+	<-idle
+}
+
+// serve sends a request to the API, as admin if admin is set
+func serve(r http.Handler, method, target, body string, admin bool) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if admin {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// decode unmarshals a JSON response body
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+// errStorageDown is what a fakeStorage returns during a simulated outage
+var errStorageDown = awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), 500, "")
+
+func TestEndpoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		admin  bool
+		// setup prepares the bucket before the request
+		setup  func(*fakeStorage)
+		status int
+		// code is the error code expected in the body of an error response
+		code string
+		// contains is expected in the body of a successful response
+		contains string
+	}{
+		{name: "healthz", method: "GET", target: "/healthz", status: 200},
+		{name: "readyz", method: "GET", target: "/readyz", status: 200, contains: `"ready":true`},
+		{name: "readyz storage down", method: "GET", target: "/readyz", setup: func(s *fakeStorage) { s.fail(errStorageDown) }, status: 503, code: codeNotReady},
+		{name: "version", method: "GET", target: "/version", status: 200, contains: `"features"`},
+		{name: "openapi", method: "GET", target: "/openapi.json", status: 200, contains: `"/files/{protocol}/{network}/latest"`},
+		{name: "metrics", method: "GET", target: "/metrics", status: 200},
+		{name: "docs", method: "GET", target: "/docs", status: 302},
+		{name: "docs ui", method: "GET", target: "/docs/index.html", status: 200, contains: "swagger-ui"},
+		{name: "unknown route", method: "GET", target: "/swagger/index.html", status: 404, code: codeRouteNotFound},
+
+		{name: "keys", method: "GET", target: "/keys", status: 200, contains: `nimiq/mainnet`},
+		{name: "keys invalid limit", method: "GET", target: "/keys?limit=0", status: 400, code: codeInvalidRequest},
+		{name: "stats", method: "GET", target: "/stats", status: 200, contains: `{"network":"nimiq/mainnet","snapshots":2,"total_bytes":28,"total_size_human":"28 B","latest":"nimiq/mainnet/2024-02-01.tar.zst"`},
+		{name: "stats invalid cursor", method: "GET", target: "/stats?cursor=%25", status: 400, code: codeInvalidRequest},
+		{name: "keys storage down", method: "GET", target: "/keys", setup: func(s *fakeStorage) { s.fail(errStorageDown) }, status: 500, code: codeStorageUnavailable},
+
+		{name: "files", method: "GET", target: "/files/nimiq/mainnet", status: 200, contains: `"url":"http://127.0.0.1:1/snapshots/nimiq/mainnet/2024-01-01.tar.zst?`},
+		{name: "files without urls", method: "GET", target: "/files/nimiq/mainnet?urls=false", status: 200, contains: `"filename":"nimiq/mainnet/2024-02-01.tar.zst"`},
+		{name: "files by format", method: "GET", target: "/files/nimiq/mainnet?format=zst&urls=false", status: 200, contains: `2024-01-01.tar.zst`},
+		{name: "files unknown format", method: "GET", target: "/files/nimiq/mainnet?format=rar", status: 400, code: codeUnknownFormat},
+		{name: "files invalid cursor", method: "GET", target: "/files/nimiq/mainnet?cursor=%25", status: 400, code: codeInvalidRequest},
+		{name: "files storage down", method: "GET", target: "/files/nimiq/mainnet", setup: func(s *fakeStorage) { s.fail(errStorageDown) }, status: 500, code: codeStorageUnavailable},
+
+		{name: "latest", method: "GET", target: "/files/nimiq/mainnet/latest", status: 200, contains: `"key":"nimiq/mainnet/2024-02-01.tar.zst"`},
+		{name: "latest by format", method: "GET", target: "/files/nimiq/mainnet/latest?format=zst", status: 200, contains: `2024-02-01.tar.zst`},
+		{name: "latest missing format", method: "GET", target: "/files/nimiq/mainnet/latest?format=gz", status: 404, code: codeNetworkNotFound},
+		{name: "latest unknown format", method: "GET", target: "/files/nimiq/mainnet/latest?format=rar", status: 400, code: codeUnknownFormat},
+		{name: "latest unknown network", method: "GET", target: "/files/nimiq/testnet/latest", status: 404, code: codeNetworkNotFound},
+		{name: "latest storage down", method: "GET", target: "/files/nimiq/mainnet/latest", setup: func(s *fakeStorage) { s.fail(errStorageDown) }, status: 500, code: codeStorageUnavailable},
+		{name: "latest script", method: "GET", target: "/files/nimiq/mainnet/latest/script", status: 200, contains: `2024-02-01.tar.zst`},
+		{name: "latest script unknown network", method: "GET", target: "/files/nimiq/testnet/latest/script", status: 404, code: codeNetworkNotFound},
+
+		{name: "info", method: "GET", target: "/files/nimiq/mainnet/info", status: 200, contains: `"block_height":42`},
+		{name: "info unknown network", method: "GET", target: "/files/nimiq/testnet/info", status: 404, code: codeSnapshotNotFound},
+		{name: "info storage down", method: "GET", target: "/files/nimiq/mainnet/info", setup: func(s *fakeStorage) { s.fail(errStorageDown) }, status: 500, code: codeStorageUnavailable},
+
+		{name: "checksums", method: "GET", target: "/files/nimiq/mainnet/checksums.txt", setup: func(s *fakeStorage) {
+			s.objects["nimiq/mainnet/2024-01-01.tar.zst"] = fakeObject{data: []byte("older snapshot"), lastModified: olderTime, metadata: map[string]*string{"Sha256": aws.String(strings.Repeat("ab", 32))}}
+		}, status: 200, contains: strings.Repeat("ab", 32) + "  2024-01-01.tar.zst\n"},
+		{name: "checksums unknown network", method: "GET", target: "/files/nimiq/testnet/checksums.txt", status: 404, code: codeNetworkNotFound},
+
+		{name: "torrent", method: "GET", target: "/files/nimiq/mainnet/2024-02-01.tar.zst/torrent", status: 202},
+		{name: "torrent missing file", method: "GET", target: "/files/nimiq/mainnet/missing.tar.zst/torrent", status: 404, code: codeFileNotFound},
+		{name: "metalink", method: "GET", target: "/files/nimiq/mainnet/2024-02-01.tar.zst/metalink", status: 200, contains: `<metalink`},
+		{name: "metalink missing file", method: "GET", target: "/files/nimiq/mainnet/missing.tar.zst/metalink", status: 404, code: codeFileNotFound},
+		{name: "zsync", method: "GET", target: "/files/nimiq/mainnet/2024-02-01.tar.zst/zsync", status: 202},
+		{name: "zsync missing file", method: "GET", target: "/files/nimiq/mainnet/missing.tar.zst/zsync", status: 404, code: codeFileNotFound},
+		{name: "contents", method: "GET", target: "/files/nimiq/mainnet/2024-02-01.tar.zst/contents", status: 202},
+		{name: "contents invalid depth", method: "GET", target: "/files/nimiq/mainnet/2024-02-01.tar.zst/contents?depth=0", status: 400, code: codeInvalidRequest},
+		{name: "contents not a tar archive", method: "GET", target: "/files/nimiq/mainnet/snapshot.zip/contents", status: 404, code: codeContentsUnavailable},
+
+		{name: "download", method: "GET", target: "/download/nimiq/mainnet/2024-02-01.tar.zst", status: 200, contains: "newer snapshot"},
+		{name: "download missing file", method: "GET", target: "/download/nimiq/mainnet/missing.tar.zst", status: 404, code: codeFileNotFound},
+		{name: "download latest", method: "GET", target: "/download/nimiq/mainnet/latest", status: 302},
+		{name: "download latest unknown network", method: "GET", target: "/download/nimiq/testnet/latest", status: 404, code: codeNetworkNotFound},
+
+		{name: "mirrors", method: "GET", target: "/mirrors/nimiq/mainnet", status: 200, contains: `"name":"s3","url":"s3://snapshots/nimiq/mainnet/2024-02-01.tar.zst","available":true,"in_sync":true`},
+		{name: "mirrors unknown network", method: "GET", target: "/mirrors/nimiq/testnet", status: 404, code: codeNetworkNotFound},
+
+		{name: "graphql", method: "POST", target: "/graphql", body: `{"query": "{ protocols { name networks { name latest { key } } } }"}`, status: 200, contains: `"key":"nimiq/mainnet/2024-02-01.tar.zst"`},
+		{name: "graphql invalid query", method: "POST", target: "/graphql", body: `{"query": "{ protocols {"}`, status: 400, code: codeInvalidQuery},
+		{name: "graphql nested too deep", method: "POST", target: "/graphql", body: `{"query": "` + strings.Repeat("{a", 10000) + `"}`, status: 400, code: codeInvalidQuery, contains: "nested deeper"},
+		{name: "graphql argument nested too deep", method: "POST", target: "/graphql", body: `{"query": "{ protocol(name: ` + strings.Repeat("[", 10000) + `) { name } }"}`, status: 400, code: codeInvalidQuery, contains: "nested deeper"},
+		{name: "graphql variable type nested too deep", method: "POST", target: "/graphql", body: `{"query": "query q($v: ` + strings.Repeat("[", 10000) + `) { protocols { name } }"}`, status: 400, code: codeInvalidQuery, contains: "nested deeper"},
+		{name: "graphql too large", method: "POST", target: "/graphql", body: `{"query": "{ protocols { name } }` + strings.Repeat(" ", maxGraphQLBodyBytes) + `"}`, status: 413, code: codeRequestTooLarge},
+		{name: "graphql too expensive", method: "POST", target: "/graphql", body: `{"query": "{ ` + strings.Repeat("protocols { networks { snapshots { url } } } ", 5) + `}"}`, status: 400, code: codeInvalidQuery, contains: "too expensive"},
+		{name: "graphql limited snapshots", method: "POST", target: "/graphql", body: `{"query": "{ ` + strings.Repeat("protocols { networks { snapshots(limit: 1) { url } } } ", 5) + `}"}`, status: 200, contains: `"url":`},
+
+		{name: "admin without token", method: "GET", target: "/admin/overview", status: 401, code: codeUnauthorized},
+		{name: "admin overview", method: "GET", target: "/admin/overview", admin: true, status: 200, contains: `"latest_key":"nimiq/mainnet/2024-02-01.tar.zst"`},
+		{name: "admin diagnostics", method: "GET", target: "/admin/diagnostics", admin: true, status: 200, contains: `"name":"presigned download"`},
+		{name: "admin analytics disabled", method: "GET", target: "/admin/analytics", admin: true, status: 404, code: codeFeatureDisabled},
+		{name: "admin catalog disabled", method: "GET", target: "/admin/catalog/snapshots", admin: true, status: 404, code: codeFeatureDisabled},
+		{name: "admin protocols disabled", method: "GET", target: "/admin/protocols", admin: true, status: 404, code: codeFeatureDisabled},
+		{name: "admin networks disabled", method: "POST", target: "/admin/networks", body: `{"protocol": "nimiq", "network": "mainnet"}`, admin: true, status: 404, code: codeFeatureDisabled},
+		{name: "admin costs disabled", method: "GET", target: "/admin/costs", admin: true, status: 404, code: codeFeatureDisabled},
+		{name: "admin usage report invalid month", method: "GET", target: "/admin/reports/usage?month=2024-13", admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin jobs", method: "GET", target: "/admin/jobs", admin: true, status: 200, contains: `"jobs":[]`},
+		{name: "admin job not configured", method: "POST", target: "/admin/jobs/prune/run", admin: true, status: 404, code: codeJobNotFound},
+		{name: "admin export disabled", method: "POST", target: "/admin/export", admin: true, status: 404, code: codeFeatureDisabled},
+		{name: "admin copy onto itself", method: "POST", target: "/admin/copy", body: `{"key": "nimiq/mainnet/2024-01-01.tar.zst"}`, admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin restore invalid tier", method: "POST", target: "/admin/restore", body: `{"key": "nimiq/mainnet/2024-01-01.tar.zst", "tier": "Fast"}`, admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin invalidate", method: "POST", target: "/admin/networks/nimiq/mainnet/invalidate", admin: true, status: 204},
+		{name: "admin prune", method: "POST", target: "/admin/networks/nimiq/mainnet/prune?keep=1", admin: true, status: 200, contains: `"deleted":["nimiq/mainnet/2024-01-01.tar.zst"]`},
+		{name: "admin prune invalid keep", method: "POST", target: "/admin/networks/nimiq/mainnet/prune?keep=0", admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin promote", method: "POST", target: "/admin/networks/nimiq/mainnet/promote?key=nimiq/mainnet/2024-01-01.tar.zst", admin: true, status: 200, contains: `"filename":"nimiq/mainnet/2024-01-01.tar.zst"`},
+		{name: "admin promote other network", method: "POST", target: "/admin/networks/nimiq/mainnet/promote?key=nimiq/testnet/2024-01-01.tar.zst", admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin promote missing snapshot", method: "POST", target: "/admin/networks/nimiq/mainnet/promote?key=nimiq/mainnet/missing.tar.zst", admin: true, status: 404, code: codeSnapshotNotFound},
+		{name: "admin create upload", method: "POST", target: "/admin/uploads", body: `{"protocol": "nimiq", "network": "mainnet", "filename": "2024-03-01.tar.zst", "size": 1048576}`, admin: true, status: 201, contains: `"upload_id":"upload-1"`},
+		{name: "admin create upload with slash", method: "POST", target: "/admin/uploads", body: `{"protocol": "nimiq", "network": "main/net", "filename": "2024-03-01.tar.zst", "size": 1}`, admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin upload parts", method: "POST", target: "/admin/uploads/upload-1/parts", body: `{"key": "nimiq/mainnet/2024-03-01.tar.zst", "part_numbers": [1, 2]}`, admin: true, status: 200, contains: `"expires_in":3600`},
+		{name: "admin upload part out of range", method: "POST", target: "/admin/uploads/upload-1/parts", body: `{"key": "nimiq/mainnet/2024-03-01.tar.zst", "part_numbers": [0]}`, admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin complete upload invalid key", method: "POST", target: "/admin/uploads/upload-1/complete", body: `{"key": "2024-03-01.tar.zst", "parts": []}`, admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin abort upload without key", method: "DELETE", target: "/admin/uploads/upload-1", admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin abort upload invalid key", method: "DELETE", target: "/admin/uploads/upload-1?key=nimiq/../2024-03-01.tar.zst", admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin abort upload of snapshot-latest.json", method: "DELETE", target: "/admin/uploads/upload-1?key=nimiq/mainnet/snapshot-latest.json", admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin upload parts invalid key", method: "POST", target: "/admin/uploads/upload-1/parts", body: `{"key": "2024-03-01.tar.zst", "part_numbers": [1]}`, admin: true, status: 400, code: codeInvalidRequest},
+		{name: "admin abort unknown upload", method: "DELETE", target: "/admin/uploads/upload-9?key=nimiq/mainnet/2024-03-01.tar.zst", admin: true, status: 404, code: codeUploadNotFound},
+		{name: "admin abort upload dry run", method: "DELETE", target: "/admin/uploads/upload-1?key=nimiq/mainnet/2024-03-01.tar.zst&dry_run=true", setup: func(s *fakeStorage) {
+			s.uploads["upload-1"] = &fakeUpload{key: "nimiq/mainnet/2024-03-01.tar.zst", parts: map[int64][]byte{}, initiated: time.Now()}
+		}, admin: true, status: 200, contains: `"dry_run":true`},
+		{name: "admin abort unknown upload dry run", method: "DELETE", target: "/admin/uploads/upload-9?key=nimiq/mainnet/2024-03-01.tar.zst&dry_run=true", admin: true, status: 404, code: codeUploadNotFound},
+		{name: "admin goroutines", method: "GET", target: "/admin/debug/goroutines", admin: true, status: 200, contains: "goroutine"},
+
+		{name: "jobs without token", method: "GET", target: "/jobs", status: 401, code: codeUnauthorized},
+		{name: "jobs", method: "GET", target: "/jobs", admin: true, status: 200, contains: `"jobs":[]`},
+		{name: "job unknown", method: "GET", target: "/jobs/unknown", admin: true, status: 404, code: codeJobNotFound},
+
+		{name: "webhooks without token", method: "GET", target: "/webhooks", status: 401, code: codeUnauthorized},
+		{name: "webhooks", method: "GET", target: "/webhooks", admin: true, status: 200},
+		{name: "webhook unknown", method: "GET", target: "/webhooks/unknown", admin: true, status: 404, code: codeWebhookNotFound},
+		{name: "webhook invalid", method: "POST", target: "/webhooks", body: `{"url": 1}`, admin: true, status: 400, code: codeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, storage := newTestAPI(t)
+			if tt.setup != nil {
+				tt.setup(storage)
+			}
+			w := serve(r, tt.method, tt.target, tt.body, tt.admin)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.code != "" {
+				var body apiError
+				decode(t, w, &body)
+				if body.Code != tt.code {
+					t.Errorf("code %q, want %q: %s", body.Code, tt.code, w.Body.String())
+				}
+				if body.RequestID == "" || body.RequestID != w.Header().Get(requestIDHeader) {
+					t.Errorf("request_id %q, want the %s header %q", body.RequestID, requestIDHeader, w.Header().Get(requestIDHeader))
+				}
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("body %s does not contain %s", w.Body.String(), tt.contains)
+			}
+		})
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	r, _ := newTestAPI(t)
+	config.AdminToken = ""
+	w := serve(r, "GET", "/admin/overview", "", true)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", w.Code)
+	}
+	var body apiError
+	decode(t, w, &body)
+	if body.Code != codeFeatureDisabled {
+		t.Errorf("code %q, want %q", body.Code, codeFeatureDisabled)
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"Bearer " + testAdminToken, http.StatusOK},
+		{testAdminToken, http.StatusUnauthorized},
+		{"bearer " + testAdminToken, http.StatusUnauthorized},
+		{"Token " + testAdminToken, http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r, _ := newTestAPI(t)
+		req := httptest.NewRequest("GET", "/admin/overview", nil)
+		req.Header.Set("Authorization", tt.header)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.header, w.Code, tt.status)
+		}
+	}
+}
+
+func TestAdminCrossSite(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		basic   bool
+		headers map[string]string
+		status  int
+	}{
+		{"cross-site form", "POST", true, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same-site form", "POST", true, map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"other allowed origin", "POST", true, map[string]string{"Origin": "http://localhost:8080"}, http.StatusForbidden},
+		{"dashboard", "POST", true, map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://example.com"}, http.StatusOK},
+		{"same origin without fetch metadata", "POST", true, map[string]string{"Origin": "http://example.com"}, http.StatusOK},
+		{"not from a browser", "POST", true, nil, http.StatusOK},
+		{"cross-site read", "GET", true, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+		{"bearer token from another origin", "POST", false, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestAPI(t)
+			target := "/admin/networks/nimiq/mainnet/prune?keep=1&dry_run=true"
+			if tt.method == "GET" {
+				target = "/admin/overview"
+			}
+			req := httptest.NewRequest(tt.method, target, nil)
+			if tt.basic {
+				req.SetBasicAuth("admin", testAdminToken)
+			} else {
+				req.Header.Set("Authorization", "Bearer "+testAdminToken)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status == http.StatusForbidden {
+				var body apiError
+				decode(t, w, &body)
+				if body.Code != codeCrossSiteRequest {
+					t.Errorf("code %q, want %q", body.Code, codeCrossSiteRequest)
+				}
+			}
+		})
+	}
+}
+
+func TestFilesPagination(t *testing.T) {
+	r, _ := newTestAPI(t)
+
+	w := serve(r, "GET", "/files/nimiq/mainnet?limit=1&urls=false", "", false)
+	var page []map[string]interface{}
+	decode(t, w, &page)
+	if len(page) != 1 || page[0]["filename"] != "nimiq/mainnet/2024-01-01.tar.zst" {
+		t.Fatalf("first page %v", page)
+	}
+	cursor := w.Header().Get("X-Next-Cursor")
+	if cursor == "" {
+		t.Fatal("no cursor for the next page")
+	}
+
+	w = serve(r, "GET", "/files/nimiq/mainnet?limit=1&urls=false&cursor="+cursor, "", false)
+	decode(t, w, &page)
+	if len(page) != 1 || page[0]["filename"] != "nimiq/mainnet/2024-02-01.tar.zst" {
+		t.Fatalf("second page %v", page)
+	}
+}
+
+func TestRequestsDontWaitForBackgroundJobs(t *testing.T) {
+	r, _ := newTestAPI(t)
+	// Occupy the only worker of the test pool
+	release := make(chan struct{})
+	backgroundJobs.Submit(func() { <-release })
+	defer close(release)
+
+	for _, target := range []string{"/stats", "/admin/overview", "/admin/reports/usage"} {
+		done := make(chan int)
+		go func() { done <- serve(r, "GET", target, "", true).Code }()
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("%s: status %d, want 200", target, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s waits for the background jobs", target)
+		}
+	}
+}
+
+func TestRouteLimitOfZero(t *testing.T) {
+	newTestAPI(t)
+	config.MaxInFlightPerRoute = map[string]int{"/stats": 0}
+	if w := serve(newRouter(io.Discard), "GET", "/stats", "", false); w.Code != http.StatusOK {
+		t.Errorf("status %d with a route limit of 0, want 200: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFanOutCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	err := fanOut(ctx, 10, 1, func(i int) {
+		calls.Add(1)
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) || calls.Load() != 1 {
+		t.Errorf("error %v after %d calls, want canceled after 1", err, calls.Load())
+	}
+}
+
+func TestStatsPagination(t *testing.T) {
+	r, storage := newTestAPI(t)
+	storage.put("nimiq/testnet/2024-01-01.tar.zst", "testnet snapshot", olderTime)
+
+	var page struct {
+		Networks   []networkStats `json:"networks"`
+		NextCursor string         `json:"next_cursor"`
+	}
+	decode(t, serve(r, "GET", "/stats?limit=1", "", false), &page)
+	if len(page.Networks) != 1 || page.Networks[0].Network != "nimiq/mainnet" || page.NextCursor == "" {
+		t.Fatalf("first page %+v", page)
+	}
+	decode(t, serve(r, "GET", "/stats?limit=1&cursor="+page.NextCursor, "", false), &page)
+	if len(page.Networks) != 1 || page.Networks[0].Network != "nimiq/testnet" || page.Networks[0].Snapshots != 1 {
+		t.Fatalf("second page %+v", page)
+	}
+}
+
+func TestFilesOffset(t *testing.T) {
+	r, _ := newTestAPI(t)
+	tests := []struct {
+		query string
+		want  []string
+		next  string
+	}{
+		{"limit=2&offset=0", []string{"nimiq/mainnet/2024-01-01.tar.zst", "nimiq/mainnet/2024-02-01.tar.zst"}, "2"},
+		{"limit=2&offset=2", []string{"nimiq/mainnet/snapshot-latest.json"}, ""},
+		{"offset=5", nil, ""},
+		{"limit=2&order=desc&format=zst", []string{"nimiq/mainnet/2024-02-01.tar.zst", "nimiq/mainnet/2024-01-01.tar.zst"}, ""},
+		{"limit=1&order=desc", []string{"nimiq/mainnet/2024-02-01.tar.zst"}, "1"},
+		{"limit=1&offset=1&order=desc", []string{"nimiq/mainnet/2024-01-01.tar.zst"}, "2"},
+		// Files that aren't snapshots come after the snapshots, newest first or not
+		{"offset=2&order=desc", []string{"nimiq/mainnet/snapshot-latest.json"}, ""},
+	}
+	for _, tt := range tests {
+		w := serve(r, "GET", "/files/nimiq/mainnet?urls=false&"+tt.query, "", false)
+		var page []map[string]interface{}
+		decode(t, w, &page)
+		var got []string
+		for _, f := range page {
+			got = append(got, f["filename"].(string))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: files %v, want %v", tt.query, got, tt.want)
+		}
+		if next := w.Header().Get("X-Next-Offset"); next != tt.next {
+			t.Errorf("%s: next offset %q, want %q", tt.query, next, tt.next)
+		}
+	}
+
+	for _, query := range []string{"offset=-1", "offset=x", "order=newest", "offset=1&cursor=abc"} {
+		if w := serve(r, "GET", "/files/nimiq/mainnet?"+query, "", false); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestFilesEnvelope(t *testing.T) {
+	r, _ := newTestAPI(t)
+	var envelope struct {
+		Files          []map[string]interface{} `json:"files"`
+		TotalCount     int                      `json:"total_count"`
+		TotalSizeBytes int64                    `json:"total_size_bytes"`
+		Truncated      bool                     `json:"truncated"`
+		NextCursor     string                   `json:"next_cursor"`
+		NextOffset     *int                     `json:"next_offset"`
+	}
+	var files []map[string]interface{}
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet?urls=false", "", false), &files)
+	var size int64
+	for _, f := range files {
+		size += int64(f["size"].(float64))
+	}
+
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet?envelope=true&limit=2&urls=false", "", false), &envelope)
+	if len(envelope.Files) != 2 || envelope.TotalCount != len(files) || envelope.TotalSizeBytes != size || !envelope.Truncated || envelope.NextCursor == "" {
+		t.Errorf("first page: %d files, total %d, size %d, truncated %v, cursor %q; want 2 of %d files of %d bytes, truncated",
+			len(envelope.Files), envelope.TotalCount, envelope.TotalSizeBytes, envelope.Truncated, envelope.NextCursor, len(files), size)
+	}
+
+	envelope.NextCursor = ""
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet?envelope=true&offset=2&urls=false", "", false), &envelope)
+	if len(envelope.Files) != 1 || envelope.TotalCount != len(files) || envelope.Truncated || envelope.NextOffset != nil {
+		t.Errorf("last page: %d files, total %d, truncated %v; want 1 of %d files, not truncated",
+			len(envelope.Files), envelope.TotalCount, envelope.Truncated, len(files))
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	r, _ := newTestAPI(t)
+	tests := []struct {
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{"", http.StatusOK, "newer snapshot"},
+		{"bytes=0-4", http.StatusPartialContent, "newer"},
+		{"bytes=6-", http.StatusPartialContent, "snapshot"},
+		{"bytes=-8", http.StatusPartialContent, "snapshot"},
+		{"bytes=100-", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"bytes=-0", http.StatusRequestedRangeNotSatisfiable, ""},
+		// A range ending before it starts is invalid and ignored
+		{"bytes=5-3", http.StatusOK, "newer snapshot"},
+		{"bytes=200-100", http.StatusOK, "newer snapshot"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/download/nimiq/mainnet/2024-02-01.tar.zst", nil)
+		if tt.rangeHeader != "" {
+			req.Header.Set("Range", tt.rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("Range %q: status %d, want %d", tt.rangeHeader, w.Code, tt.status)
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("Range %q: body %q, want %q", tt.rangeHeader, w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestLatestServedStaleDuringOutage(t *testing.T) {
+	r, storage := newTestAPI(t)
+	if w := serve(r, "GET", "/files/nimiq/mainnet/latest", "", false); w.Code != http.StatusOK {
+		t.Fatalf("status %d before the outage", w.Code)
+	}
+
+	storage.fail(errStorageDown)
+	w := serve(r, "GET", "/files/nimiq/mainnet/latest", "", false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d during the outage, want the last good latest snapshot", w.Code)
+	}
+	var response latestResponse
+	decode(t, w, &response)
+	if !response.Stale || response.Key != "nimiq/mainnet/2024-02-01.tar.zst" {
+		t.Errorf("got %+v, want the stale latest snapshot", response)
+	}
+}
+
+func TestStorageTimeout(t *testing.T) {
+	r, storage := newTestAPI(t)
+	storage.fail(awserr.New("RequestCanceled", "request context canceled", context.DeadlineExceeded))
+	w := serve(r, "GET", "/keys", "", false)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504", w.Code)
+	}
+	var body apiError
+	decode(t, w, &body)
+	if body.Code != codeStorageTimeout {
+		t.Errorf("code %q, want %q", body.Code, codeStorageTimeout)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	r, storage := newTestAPI(t)
+
+	w := serve(r, "POST", "/admin/uploads", `{"protocol": "nimiq", "network": "mainnet", "filename": "2024-03-01.tar.zst", "size": 20}`, true)
+	var created struct {
+		Key      string `json:"key"`
+		UploadID string `json:"upload_id"`
+	}
+	decode(t, w, &created)
+
+	etag := storage.uploadPart(created.UploadID, 1, "uploaded snapshot")
+	sha := strings.Repeat("cd", 32)
+	w = serve(r, "POST", "/admin/uploads/"+created.UploadID+"/complete",
+		`{"key": "`+created.Key+`", "parts": [{"part_number": 1, "etag": `+strconv.Quote(etag)+`}], "sha256": "`+sha+`"}`, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", w.Code, w.Body.String())
+	}
+
+	w = serve(r, "GET", "/files/nimiq/mainnet/latest", "", false)
+	var latest latestResponse
+	decode(t, w, &latest)
+	if latest.Key != "nimiq/mainnet/2024-03-01.tar.zst" || latest.SHA256 == nil || *latest.SHA256 != sha {
+		t.Errorf("latest after the upload %+v", latest)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	r, storage := newTestAPI(t)
+	latestKey := func() string {
+		t.Helper()
+		var latest latestResponse
+		decode(t, serve(r, "GET", "/files/nimiq/mainnet/latest", "", false), &latest)
+		return latest.Key
+	}
+
+	w := serve(r, "POST", "/admin/networks/nimiq/mainnet/promote?key=nimiq/mainnet/2024-01-01.tar.zst", "", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("promote: status %d: %s", w.Code, w.Body.String())
+	}
+	if key := latestKey(); key != "nimiq/mainnet/2024-01-01.tar.zst" {
+		t.Errorf("latest %s after the promotion, want the promoted snapshot", key)
+	}
+
+	// Pruning keeps the promoted snapshot although it isn't among the newest
+	w = serve(r, "POST", "/admin/networks/nimiq/mainnet/prune?keep=1", "", true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"deleted":[]`) {
+		t.Fatalf("prune: status %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := storage.objects["nimiq/mainnet/2024-01-01.tar.zst"]; !ok {
+		t.Fatal("the promoted snapshot was pruned")
+	}
+
+	// A snapshot uploaded after the promotion is the latest again
+	storage.put("nimiq/mainnet/2024-03-01.tar.zst", "newest snapshot", time.Now().Add(time.Minute))
+	serve(r, "POST", "/admin/networks/nimiq/mainnet/invalidate", "", true)
+	if key := latestKey(); key != "nimiq/mainnet/2024-03-01.tar.zst" {
+		t.Errorf("latest %s after an upload, want the uploaded snapshot", key)
+	}
+}
+
+func TestBootstrapScriptComments(t *testing.T) {
+	r, storage := newTestAPI(t)
+	storage.put("nimiq/mainnet/2024-03-01\nrm -rf $HOME\n.tar.zst", "newest snapshot", time.Now().Add(time.Minute))
+
+	w := serve(r, "GET", "/files/nimiq/mainnet/latest/script", "", false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	// The header is comments up to set, the quoted filename may span lines
+	for _, line := range strings.Split(w.Body.String(), "\n")[1:] {
+		if line == "set -eu" {
+			break
+		}
+		if !strings.HasPrefix(line, "#") {
+			t.Fatalf("key broke out of the comment:\n%s", w.Body.String())
+		}
+	}
+}
+
+func TestMeasureOnUpload(t *testing.T) {
+	r, storage := newTestAPI(t)
+
+	// Requests only report measurements, they never read the snapshot
+	serve(r, "GET", "/files/nimiq/mainnet/latest", "", false)
+	waitForDerivedJobs()
+	storage.mu.Lock()
+	reads := storage.reads["nimiq/mainnet/2024-02-01.tar.zst"]
+	storage.mu.Unlock()
+	if reads != 0 {
+		t.Errorf("latest read the snapshot %d times", reads)
+	}
+
+	w := serve(r, "POST", "/admin/uploads", `{"protocol": "nimiq", "network": "mainnet", "filename": "2024-03-01.tar", "size": 20}`, true)
+	var created struct {
+		Key      string `json:"key"`
+		UploadID string `json:"upload_id"`
+	}
+	decode(t, w, &created)
+	etag := storage.uploadPart(created.UploadID, 1, "uploaded snapshot")
+	w = serve(r, "POST", "/admin/uploads/"+created.UploadID+"/complete",
+		`{"key": "`+created.Key+`", "parts": [{"part_number": 1, "etag": `+strconv.Quote(etag)+`}]}`, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", w.Code, w.Body.String())
+	}
+	waitForDerivedJobs()
+
+	resetState()
+	var latest latestResponse
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet/latest", "", false), &latest)
+	if latest.UncompressedSize == nil || *latest.UncompressedSize != int64(len("uploaded snapshot")) {
+		t.Errorf("uncompressed_size %v after the upload was measured", latest.UncompressedSize)
+	}
+}
+
+func TestMeasureOnRefresh(t *testing.T) {
+	_, storage := newTestAPI(t)
+	key := "nimiq/mainnet/2024-03-01.tar"
+	storage.put(key, "newest snapshot", newerTime.AddDate(0, 1, 0))
+	refreshNetwork("nimiq", "mainnet")
+	waitForDerivedJobs()
+	storage.mu.Lock()
+	etag := storage.objects[key].etag()
+	storage.mu.Unlock()
+	if _, ok := measuredSnapshot(key, etag); !ok {
+		t.Error("latest snapshot not measured after the refresh")
+	}
+}
+
+func TestMeasureWhenWorkersBusy(t *testing.T) {
+	newTestAPI(t)
+	// Occupy the only worker of the test pool
+	release := make(chan struct{})
+	backgroundJobs.Submit(func() { <-release })
+	defer close(release)
+
+	done := make(chan struct{})
+	go func() {
+		measureInBackground("nimiq/mainnet/2024-02-01.tar.zst", "etag")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("measureInBackground waits for a worker")
+	}
+	if n := countEntries(&derivedJobs); n != 0 {
+		t.Errorf("%d derived jobs left after the measurement was skipped", n)
+	}
+}
+
+func TestDerivedFiles(t *testing.T) {
+	r, _ := newTestAPI(t)
+	for _, kind := range []string{"torrent", "zsync"} {
+		target := "/files/nimiq/mainnet/2024-02-01.tar.zst/" + kind
+		if w := serve(r, "GET", target, "", false); w.Code != http.StatusAccepted {
+			t.Fatalf("%s: status %d before it was generated, want 202", kind, w.Code)
+		}
+		waitForDerivedJobs()
+		if w := serve(r, "GET", target, "", false); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d once generated, want 200: %s", kind, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestDerivedFilesBusy(t *testing.T) {
+	r, _ := newTestAPI(t)
+	// Occupy the only worker of the test pool
+	release := make(chan struct{})
+	backgroundJobs.Submit(func() { <-release })
+	defer close(release)
+
+	w := serve(r, "GET", "/files/nimiq/mainnet/2024-02-01.tar.zst/torrent", "", false)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("status %d, Retry-After %q with no free worker, want 503 and a Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if n := countEntries(&derivedJobs); n != 0 {
+		t.Errorf("%d derived jobs left behind by a refused generation", n)
+	}
+}
+
+func TestPublicNetwork(t *testing.T) {
+	r, _ := newTestAPI(t)
+	config.Public = map[string]bool{"nimiq/": true, "nimiq/testnet/": false}
+
+	var latest latestResponse
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet/latest", "", false), &latest)
+	if want := "http://127.0.0.1:1/snapshots/nimiq/mainnet/2024-02-01.tar.zst"; latest.URL != want {
+		t.Errorf("public snapshot URL %s, want %s", latest.URL, want)
+	}
+
+	config.Public = map[string]bool{"nimiq/": true, "nimiq/mainnet/": false}
+	resetState()
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet/latest", "", false), &latest)
+	if !strings.Contains(latest.URL, "X-Amz-Signature=") {
+		t.Errorf("snapshot URL of a network excluded from public is not presigned: %s", latest.URL)
+	}
+}
+
+func TestPublicURLOfNetworkBucket(t *testing.T) {
+	newTestAPI(t)
+	config.Public = map[string]bool{"ethereum/": true}
+	n := registeredNetwork{Protocol: "ethereum", Network: "holesky", Bucket: "eth-snapshots"}
+	registry.Store(&networkRegistry{networks: []registeredNetwork{n}, byName: map[string]registeredNetwork{"ethereum/holesky": n}})
+
+	u, err := objectURL(storageClient(), "ethereum/holesky/2024-01-01.tar.zst", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://127.0.0.1:1/eth-snapshots/ethereum/holesky/2024-01-01.tar.zst"; u != want {
+		t.Errorf("public URL %s, want %s in the bucket of the network", u, want)
+	}
+}
+
+func TestNetworkBucket(t *testing.T) {
+	r, _ := newTestAPI(t)
+	other := newFakeStorage()
+	other.put("ethereum/holesky/2024-01-01.tar.zst", "holesky snapshot", olderTime)
+	other.put("ethereum/holesky/snapshot-latest.json", `{"filename": "ethereum/holesky/2024-01-01.tar.zst"}`, olderTime)
+	bucketClient = func(bucket string) s3iface.S3API {
+		if bucket == "eth-snapshots" {
+			return other
+		}
+		return storageClient()
+	}
+	t.Cleanup(func() { bucketClient = defaultBucketClient })
+	n := registeredNetwork{Protocol: "ethereum", Network: "holesky", Bucket: "eth-snapshots"}
+	registry.Store(&networkRegistry{networks: []registeredNetwork{n}, byName: map[string]registeredNetwork{"ethereum/holesky": n}})
+
+	w := serve(r, "GET", "/files/ethereum/holesky/info", "", false)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "2024-01-01.tar.zst") {
+		t.Errorf("info: status %d: %s", w.Code, w.Body.String())
+	}
+	w = serve(r, "GET", "/download/ethereum/holesky/2024-01-01.tar.zst", "", false)
+	if w.Code != http.StatusOK || w.Body.String() != "holesky snapshot" {
+		t.Errorf("download: status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCDNAndOriginURLs(t *testing.T) {
+	r, _ := newTestAPI(t)
+	config.CDN = map[string]string{"nimiq/": "https://cdn.example.com/nimiq/"}
+
+	var latest latestResponse
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet/latest", "", false), &latest)
+	if want := "https://cdn.example.com/nimiq/mainnet/2024-02-01.tar.zst"; latest.CDNURL != want {
+		t.Errorf("cdn_url %s, want %s", latest.CDNURL, want)
+	}
+	if !strings.Contains(latest.URL, "X-Amz-Signature=") {
+		t.Errorf("url is not the presigned origin URL: %s", latest.URL)
+	}
+
+	var files []listedFile
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet", "", false), &files)
+	for _, f := range files {
+		if !strings.HasPrefix(f.CDNURL, "https://cdn.example.com/") || !strings.Contains(f.URL, "X-Amz-Signature=") {
+			t.Errorf("%s: url %s, cdn_url %s", f.Filename, f.URL, f.CDNURL)
+		}
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	r, storage := newTestAPI(t)
+	for _, target := range []string{"/files/nimiq/testnet/latest", "/files/nimiq/testnet/info"} {
+		serve(r, "GET", target, "", false)
+		storage.mu.Lock()
+		calls := storage.calls
+		storage.mu.Unlock()
+		for i := 0; i < 3; i++ {
+			if w := serve(r, "GET", target, "", false); w.Code != http.StatusNotFound {
+				t.Fatalf("%s: status %d, want 404", target, w.Code)
+			}
+		}
+		storage.mu.Lock()
+		if storage.calls != calls {
+			t.Errorf("%s: %d storage calls for a known missing network, want none", target, storage.calls-calls)
+		}
+		storage.mu.Unlock()
+	}
+
+	// A refresh, e.g. after an upload, forgets that the network was missing
+	storage.put("nimiq/testnet/2024-02-01.tar.zst", "snapshot", newerTime)
+	refreshNetwork("nimiq", "testnet")
+	if w := serve(r, "GET", "/files/nimiq/testnet/latest", "", false); w.Code != http.StatusOK {
+		t.Errorf("status %d after the refresh, want 200", w.Code)
+	}
+}
+
+func TestMiddlewareConfig(t *testing.T) {
+	if err := checkMiddleware([]string{"recovery", "rate_limit"}); err == nil {
+		t.Error("unknown middleware accepted")
+	}
+	if err := checkMiddleware([]string{"cors", "cors"}); err == nil {
+		t.Error("middleware listed twice accepted")
+	}
+	if err := setGinMode("verbose"); err == nil {
+		t.Error("unknown gin mode accepted")
+	}
+
+	newTestAPI(t)
+	config.Middleware = []string{"recovery"}
+	r := newRouter(io.Discard)
+	req := httptest.NewRequest("OPTIONS", "/healthz", nil)
+	req.Header.Set("Origin", "http://localhost:8080")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("CORS headers set without the cors middleware")
+	}
+	if w := serve(r, "GET", "/healthz", "", false); w.Header().Get(requestIDHeader) == "" {
+		t.Error("no request ID without the default middleware")
+	}
+}
+
+func TestAccessLogExclude(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []string
+		want    int
+	}{
+		{"default", nil, 1},
+		{"configured", []string{"/version"}, 2},
+		{"none", []string{}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestAPI(t)
+			config.AccessLogExclude = tt.exclude
+			var log bytes.Buffer
+			r := newRouter(&log)
+			for _, target := range []string{"/healthz", "/metrics", "/version"} {
+				serve(r, "GET", target, "", false)
+			}
+			if lines := strings.Count(log.String(), "\n"); lines != tt.want {
+				t.Errorf("%d requests logged, want %d: %s", lines, tt.want, log.String())
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	if err := checkTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "loadbalancer"}); err == nil {
+		t.Error("trusted proxy that isn't an IP accepted")
+	}
+
+	tests := []struct {
+		name       string
+		trusted    []string
+		remoteAddr string
+		want       string
+	}{
+		{"no trusted proxies", nil, "192.0.2.1:1234", "192.0.2.1"},
+		{"trusted proxy", []string{"192.0.2.0/24"}, "192.0.2.1:1234", "203.0.113.7"},
+		{"untrusted proxy", []string{"192.0.2.0/24"}, "198.51.100.1:1234", "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestAPI(t)
+			config.TrustedProxies = tt.trusted
+			var log bytes.Buffer
+			r := newRouter(&log)
+			req := httptest.NewRequest("GET", "/version", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			r.ServeHTTP(httptest.NewRecorder(), req)
+
+			var line struct {
+				ClientIP string `json:"client_ip"`
+			}
+			if err := json.Unmarshal(log.Bytes(), &line); err != nil {
+				t.Fatal(err)
+			}
+			if line.ClientIP != tt.want {
+				t.Errorf("client IP %s, want %s", line.ClientIP, tt.want)
+			}
+		})
+	}
+}
+
+func TestHead(t *testing.T) {
+	r, storage := newTestAPI(t)
+	for _, target := range []string{"/healthz", "/keys", "/files/nimiq/mainnet", "/files/nimiq/mainnet/latest", "/files/nimiq/mainnet/info", "/files/nimiq/testnet/latest"} {
+		get := serve(r, "GET", target, "", false)
+		head := serve(r, "HEAD", target, "", false)
+		if head.Code != get.Code || head.Header().Get("Content-Type") != get.Header().Get("Content-Type") {
+			t.Errorf("HEAD %s: status %d, content type %s, want %d, %s like GET",
+				target, head.Code, head.Header().Get("Content-Type"), get.Code, get.Header().Get("Content-Type"))
+		}
+	}
+
+	calls := storage.calls
+	w := serve(r, "HEAD", "/download/nimiq/mainnet/2024-02-01.tar.zst", "", false)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(len("newer snapshot")) || w.Body.Len() != 0 {
+		t.Errorf("HEAD download: status %d, content length %s, %d bytes of body", w.Code, w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	if storage.calls-calls != 1 {
+		t.Errorf("HEAD download made %d storage calls, want only the HEAD of the object", storage.calls-calls)
+	}
+
+	// With cold caches HEAD answers without listing, presigning or generating anything
+	resetState()
+	storage.mu.Lock()
+	storage.lists, storage.reads = 0, map[string]int{}
+	storage.mu.Unlock()
+	snapshot := "/files/nimiq/mainnet/2024-02-01.tar.zst"
+	for target, status := range map[string]int{
+		"/keys":                              http.StatusOK,
+		"/stats":                             http.StatusOK,
+		"/files/nimiq/mainnet":               http.StatusOK,
+		"/files/nimiq/mainnet/latest":        http.StatusOK,
+		"/files/nimiq/mainnet/info":          http.StatusOK,
+		"/files/nimiq/mainnet/checksums.txt": http.StatusOK,
+		"/files/nimiq/testnet/latest":        http.StatusNotFound,
+		"/download/nimiq/mainnet/latest":     http.StatusFound,
+		"/download/nimiq/testnet/latest":     http.StatusNotFound,
+		snapshot + "/torrent":                http.StatusAccepted,
+		snapshot + "/zsync":                  http.StatusAccepted,
+		snapshot + "/contents":               http.StatusAccepted,
+		snapshot + "/metalink":               http.StatusOK,
+	} {
+		if w := serve(r, "HEAD", target, "", false); w.Code != status {
+			t.Errorf("cold HEAD %s: status %d, want %d", target, w.Code, status)
+		}
+	}
+	if n := countEntries(&derivedJobs); n != 0 {
+		t.Errorf("cold HEAD started generating %d derived files", n)
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.lists != 0 || len(storage.reads) != 0 {
+		t.Errorf("cold HEAD made %d list calls and read %v", storage.lists, storage.reads)
+	}
+	if n := countEntries(&presignCache); n != 0 {
+		t.Errorf("cold HEAD presigned %d URLs", n)
+	}
+}
+
+func TestFilesStreamed(t *testing.T) {
+	r, storage := newTestAPI(t)
+	for i := 0; i < 3000; i++ {
+		storage.put(fmt.Sprintf("nimiq/mainnet/2023-%04d.tar.zst", i), "snapshot", olderTime)
+	}
+
+	var files []map[string]interface{}
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet", "", false), &files)
+	if len(files) != 3003 || files[0]["url"] == nil {
+		t.Errorf("streamed %d files, want 3003 with URLs", len(files))
+	}
+
+	var envelope struct {
+		Files      []map[string]interface{} `json:"files"`
+		TotalCount int                      `json:"total_count"`
+	}
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet?envelope=true&limit=10&urls=false", "", false), &envelope)
+	if len(envelope.Files) != 10 || envelope.TotalCount != 3003 {
+		t.Errorf("envelope of %d files of %d, want 10 of 3003", len(envelope.Files), envelope.TotalCount)
+	}
+}
+
+func TestCostEstimate(t *testing.T) {
+	r, _ := newTestAPI(t)
+	// 96 bytes of snapshots and snapshot-latest.json at a cent per byte
+	config.Costs = CostSettings{Currency: "USD", CostPrices: CostPrices{StoragePerGBMonth: bytesPerGB / 100, EgressPerGB: 1}}
+
+	if w := serve(r, "GET", "/admin/costs?days=0", "", true); w.Code != http.StatusBadRequest {
+		t.Errorf("days=0 status %d", w.Code)
+	}
+	w := serve(r, "GET", "/admin/costs", "", true)
+	var estimate struct {
+		Currency string        `json:"currency"`
+		Networks []networkCost `json:"networks"`
+	}
+	decode(t, w, &estimate)
+	if estimate.Currency != "USD" || len(estimate.Networks) != 1 {
+		t.Fatalf("estimate %+v", estimate)
+	}
+	if n := estimate.Networks[0]; n.Network != "nimiq/mainnet" || n.Bucket != config.BucketName || n.StorageBytes != 96 || n.StorageCost != 0.96 || n.TotalCost != 0.96 {
+		t.Errorf("network %+v", n)
+	}
+}
+
+func TestEventSubscriberDrops(t *testing.T) {
+	newTestAPI(t)
+	subscribersMu.Lock()
+	saved := subscribers
+	subscribers = nil
+	subscribersMu.Unlock()
+	defer func() {
+		subscribersMu.Lock()
+		subscribers = saved
+		subscribersMu.Unlock()
+	}()
+
+	release := make(chan struct{})
+	received := make(chan string, eventSubscriberBuffer+10)
+	subscribeEvents("test", func(e snapshotEvent) {
+		<-release
+		received <- e.Key
+	})
+	dropped := eventsDropped.Value("test")
+	for i := 0; i < eventSubscriberBuffer+10; i++ {
+		publishEvent(snapshotEvent{Type: eventSnapshotPublished, Key: strconv.Itoa(i)})
+	}
+	close(release)
+
+	// The subscriber took one event before blocking and buffered as many as fit
+	if got := eventsDropped.Value("test") - dropped; got < 9 || got > 10 {
+		t.Errorf("%v events dropped, want 9 or 10", got)
+	}
+	for i := 0; i < eventSubscriberBuffer; i++ {
+		if key := <-received; key != strconv.Itoa(i) {
+			t.Fatalf("event %d is %s, events out of order", i, key)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultBreakerThreshold is used when breaker_failure_threshold is not set in the config
+	defaultBreakerThreshold = 5
+	// defaultBreakerOpenTime is used when breaker_open_seconds is not set in the config
+	defaultBreakerOpenTime = 30 * time.Second
+)
+
+// errStorageUnavailable is returned instead of calling S3 while the breaker is open
+var errStorageUnavailable = errors.New("storage backend unavailable")
+
+// circuitBreaker stops calling the storage backend for a while after it failed a
+// number of times in a row. Once that time is over calls are let through again,
+// and the first failure opens the breaker right away.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// Allow reports whether the backend may be called
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// Record counts the outcome of a backend call
+func (b *circuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isStorageFailure(err) {
+		b.failures = 0
+		return
+	}
+
+	threshold := config.BreakerFailureThreshold
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	openTime := time.Duration(config.BreakerOpenSeconds) * time.Second
+	if openTime <= 0 {
+		openTime = defaultBreakerOpenTime
+	}
+
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = time.Now().Add(openTime)
+	}
+}
+
+// Define the breaker guarding all storage calls made on behalf of requests
+var storageBreaker circuitBreaker
+
+// sharedStorageCall runs fn through the circuit breaker, coalesced with concurrent
+// calls for the same key. fn is given a context that is canceled once every request
+// waiting for it went away, and bounded by request_timeout_seconds.
+func sharedStorageCall(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	return storageFlight.DoContext(ctx, key, func(ctx context.Context) (interface{}, error) {
+		if !storageBreaker.Allow() {
+			return nil, errStorageUnavailable
+		}
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout())
+		defer cancel()
+		v, err := fn(ctx)
+		// Nobody waiting anymore says nothing about the backend
+		if !isCanceled(err) {
+			storageBreaker.Record(err)
+		}
+		return v, err
+	})
+}
+
+// isCanceled reports whether err is a storage call aborted because its caller
+// went away, as opposed to one that timed out
+func isCanceled(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == request.CanceledErrorCode && errors.Is(aerr.OrigErr(), context.Canceled)
+}
+
+// isTimeout reports whether err is a storage call that ran out of the request timeout
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == request.CanceledErrorCode && errors.Is(aerr.OrigErr(), context.DeadlineExceeded)
+}
+
+// isStorageFailure reports whether err means the backend is unhealthy, as opposed
+// to a regular answer like a missing key
+func isStorageFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == errStorageUnavailable || isTimeout(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+	// Everything that didn't produce an HTTP response: connection errors, timeouts, ...
+	_, ok := err.(awserr.Error)
+	return ok
+}
+
+// markStale flags a response served from the last good cache while the backend is failing
+func markStale(c *gin.Context) {
+	requestLogger(c).Warn("Serving stale response, storage backend is failing")
+	c.Header("Warning", `110 - "Response is Stale"`)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// s3Notification is an S3 event notification, see
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/notification-content-structure.html
+type s3Notification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsEnvelope wraps notifications delivered to SQS through an SNS topic
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// parseBucketNotification parses an SQS message body holding an S3
+// notification, directly or wrapped by SNS
+func parseBucketNotification(body string) (s3Notification, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+	var n s3Notification
+	err := json.Unmarshal([]byte(body), &n)
+	return n, err
+}
+
+// startBucketEvents consumes S3 bucket notifications from the configured SQS
+// queue, so changes are picked up the moment objects land instead of when
+// the caches expire
+func startBucketEvents() {
+	if config.SQSQueueURL == "" {
+		return
+	}
+	// Long polls wait up to 20s for a response, which the S3 transport's
+	// response header timeout may not allow
+	svc := sqs.New(sess, aws.NewConfig().WithHTTPClient(&http.Client{}))
+	go consumeBucketEvents(svc, config.SQSQueueURL)
+}
+
+func consumeBucketEvents(svc *sqs.SQS, queueURL string) {
+	backoff := time.Second
+	for {
+		out, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+		})
+		if err != nil {
+			logger.Error("Error receiving bucket events", "queue", queueURL, "error", err)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		for _, msg := range out.Messages {
+			n, err := parseBucketNotification(aws.StringValue(msg.Body))
+			if err != nil {
+				logger.Warn("Dropping malformed bucket event", "message_id", aws.StringValue(msg.MessageId), "error", err)
+			} else {
+				handleBucketNotification(n)
+			}
+			// Processing only refreshes caches, so a failed refresh is not retried
+			// through the queue, the next request or event refreshes again
+			if _, err := svc.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(queueURL), ReceiptHandle: msg.ReceiptHandle}); err != nil {
+				logger.Warn("Error deleting bucket event", "message_id", aws.StringValue(msg.MessageId), "error", err)
+			}
+		}
+	}
+}
+
+// handleBucketNotification refreshes every network touched by n once, in any of
+// the buckets snapshots are kept in
+func handleBucketNotification(n s3Notification) {
+	networks := make(map[[2]string]bool)
+	buckets := snapshotBuckets()
+	for _, r := range n.Records {
+		if !slices.Contains(buckets, r.S3.Bucket.Name) {
+			continue
+		}
+		if !strings.HasPrefix(r.EventName, "ObjectCreated:") && !strings.HasPrefix(r.EventName, "ObjectRemoved:") {
+			continue
+		}
+		// Keys are URL encoded in notifications, with spaces as +
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			continue
+		}
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		networks[[2]string{parts[0], parts[1]}] = true
+	}
+
+	for n := range networks {
+		protocol, network := n[0], n[1]
+		backgroundJobs.Submit(func() { refreshNetwork(protocol, network) })
+	}
+}
+
+// refreshNetwork invalidates the caches of a network and reloads its listing
+// and latest snapshot, which publishes the resulting snapshot events
+func refreshNetwork(protocol, network string) {
+	cacheKey := protocol + "/" + network
+	// Expire the listing rather than dropping it, so deleted files are still detected
+	if v, ok := cache.Load(cacheKey); ok {
+		cache.Store(cacheKey, cacheItem{content: v.(cacheItem).content})
+	}
+	infoCache.Delete(cacheKey)
+	forgetMissing(protocol, network)
+
+	// Not bound to the request that triggered the refresh, if any
+	ctx := context.Background()
+	if _, err := loadFiles(ctx, protocol, network); err != nil {
+		logger.Warn("Error refreshing listing", "protocol", protocol, "network", network, "error", err)
+	}
+	latest, err := findLatest(ctx, protocol, network)
+	if err != nil {
+		logger.Warn("Error refreshing latest snapshot", "protocol", protocol, "network", network, "error", err)
+	} else if latest != nil {
+		measureInBackground(*latest.Key, aws.StringValue(latest.ETag))
+	}
+}
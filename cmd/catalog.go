@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+	_ "github.com/lib/pq"
+)
+
+// defaultCatalogSyncInterval is used when catalog_sync_interval_seconds is not set in the config
+const defaultCatalogSyncInterval = 15 * time.Minute
+
+// Lifecycle states of the snapshots in the catalog
+const (
+	snapshotInProgress = "in_progress"
+	snapshotAvailable  = "available"
+	snapshotDeleted    = "deleted"
+)
+
+// catalogSchema creates the tables of the catalog, it is applied on every start
+const catalogSchema = `
+CREATE TABLE IF NOT EXISTS catalog_networks (
+	protocol   text NOT NULL,
+	network    text NOT NULL,
+	latest_key text,
+	synced_at  timestamptz NOT NULL,
+	PRIMARY KEY (protocol, network)
+);
+CREATE TABLE IF NOT EXISTS catalog_snapshots (
+	key           text PRIMARY KEY,
+	protocol      text NOT NULL,
+	network       text NOT NULL,
+	size          bigint NOT NULL,
+	etag          text NOT NULL,
+	last_modified timestamptz NOT NULL,
+	compression   text NOT NULL,
+	sha256        text,
+	block_height  bigint,
+	state         text NOT NULL,
+	first_seen    timestamptz NOT NULL,
+	deleted_at    timestamptz
+);
+CREATE INDEX IF NOT EXISTS catalog_snapshots_network ON catalog_snapshots (protocol, network, last_modified);
+`
+
+// catalogSnapshot is a snapshot in the catalog, current or deleted
+type catalogSnapshot struct {
+	Key          string     `json:"key"`
+	Protocol     string     `json:"protocol"`
+	Network      string     `json:"network"`
+	Size         int64      `json:"size"`
+	ETag         string     `json:"etag"`
+	LastModified time.Time  `json:"last_modified"`
+	Compression  string     `json:"compression"`
+	SHA256       *string    `json:"sha256"`
+	BlockHeight  *int64     `json:"block_height"`
+	State        string     `json:"state"`
+	FirstSeen    time.Time  `json:"first_seen"`
+	DeletedAt    *time.Time `json:"deleted_at"`
+}
+
+// catalogStore keeps the snapshot catalog in PostgreSQL, the bucket stays the
+// source of truth and the catalog is synced with it
+type catalogStore struct {
+	db *sql.DB
+}
+
+// Define the catalog, nil when catalog_dsn is not configured
+var catalog *catalogStore
+
+// openCatalog connects to the catalog database at dsn and creates its tables
+func openCatalog(dsn string) (*catalogStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout())
+	defer cancel()
+	if _, err := db.ExecContext(ctx, catalogSchema+registrySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating catalog tables: %w", err)
+	}
+	return &catalogStore{db: db}, nil
+}
+
+// snapshots returns the snapshots of a network in the catalog by key, deleted ones included
+func (s *catalogStore) snapshots(ctx context.Context, protocol, network string) (map[string]catalogSnapshot, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+catalogColumns+` FROM catalog_snapshots WHERE protocol = $1 AND network = $2`, protocol, network)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := make(map[string]catalogSnapshot)
+	for rows.Next() {
+		snapshot, err := scanCatalogSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		snapshots[snapshot.Key] = snapshot
+	}
+	return snapshots, rows.Err()
+}
+
+// catalogColumns are the columns of catalog_snapshots in the order of scanCatalogSnapshot
+const catalogColumns = `key, protocol, network, size, etag, last_modified, compression, sha256, block_height, state, first_seen, deleted_at`
+
+func scanCatalogSnapshot(rows *sql.Rows) (catalogSnapshot, error) {
+	var s catalogSnapshot
+	err := rows.Scan(&s.Key, &s.Protocol, &s.Network, &s.Size, &s.ETag, &s.LastModified, &s.Compression,
+		&s.SHA256, &s.BlockHeight, &s.State, &s.FirstSeen, &s.DeletedAt)
+	return s, err
+}
+
+// save writes the synced snapshots of a network and its latest snapshot in one transaction
+func (s *catalogStore) save(ctx context.Context, protocol, network string, snapshots []catalogSnapshot, latestKey string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, snapshot := range snapshots {
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO catalog_snapshots (`+catalogColumns+`)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (key) DO UPDATE SET
+	size = EXCLUDED.size, etag = EXCLUDED.etag, last_modified = EXCLUDED.last_modified,
+	compression = EXCLUDED.compression, sha256 = EXCLUDED.sha256, block_height = EXCLUDED.block_height,
+	state = EXCLUDED.state, deleted_at = EXCLUDED.deleted_at`,
+			snapshot.Key, snapshot.Protocol, snapshot.Network, snapshot.Size, snapshot.ETag, snapshot.LastModified,
+			snapshot.Compression, snapshot.SHA256, snapshot.BlockHeight, snapshot.State, snapshot.FirstSeen, snapshot.DeletedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	var latest *string
+	if latestKey != "" {
+		latest = &latestKey
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO catalog_networks (protocol, network, latest_key, synced_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (protocol, network) DO UPDATE SET latest_key = EXCLUDED.latest_key, synced_at = EXCLUDED.synced_at`,
+		protocol, network, latest, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// catalogQuery selects snapshots of the catalog, empty fields match everything
+type catalogQuery struct {
+	Protocol string
+	Network  string
+	State    string
+	// Search matches keys containing it, ignoring case
+	Search string
+	// After is the key the page follows
+	After string
+	Limit int
+}
+
+// search returns the snapshots matching q ordered by key
+func (s *catalogStore) search(ctx context.Context, q catalogQuery) ([]catalogSnapshot, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if q.Protocol != "" {
+		where("protocol = $%d", q.Protocol)
+	}
+	if q.Network != "" {
+		where("network = $%d", q.Network)
+	}
+	if q.State != "" {
+		where("state = $%d", q.State)
+	}
+	if q.Search != "" {
+		where("key ILIKE '%%' || $%d || '%%'", q.Search)
+	}
+	if q.After != "" {
+		where("key > $%d", q.After)
+	}
+
+	query := `SELECT ` + catalogColumns + ` FROM catalog_snapshots`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY key`
+	if q.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, q.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snapshots := make([]catalogSnapshot, 0)
+	for rows.Next() {
+		snapshot, err := scanCatalogSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+// catalogChanges compares the snapshots of a network in the bucket with those in the
+// catalog and returns the rows to write: new and changed snapshots, and snapshots
+// gone from the bucket, which are kept as deleted. Checksums and heights already
+// recorded are kept when the bucket no longer tells them.
+func catalogChanges(existing map[string]catalogSnapshot, current []catalogSnapshot, now time.Time) []catalogSnapshot {
+	var changes []catalogSnapshot
+	seen := make(map[string]bool, len(current))
+	for _, snapshot := range current {
+		seen[snapshot.Key] = true
+		snapshot.FirstSeen = now
+		if old, ok := existing[snapshot.Key]; ok {
+			snapshot.FirstSeen = old.FirstSeen
+			if old.ETag == snapshot.ETag {
+				if snapshot.SHA256 == nil {
+					snapshot.SHA256 = old.SHA256
+				}
+				if snapshot.BlockHeight == nil {
+					snapshot.BlockHeight = old.BlockHeight
+				}
+			}
+			if catalogUnchanged(old, snapshot) {
+				continue
+			}
+		}
+		changes = append(changes, snapshot)
+	}
+	for key, old := range existing {
+		if seen[key] || old.State == snapshotDeleted {
+			continue
+		}
+		deletedAt := now
+		old.State = snapshotDeleted
+		old.DeletedAt = &deletedAt
+		changes = append(changes, old)
+	}
+	return changes
+}
+
+// catalogUnchanged reports whether writing b over a would change nothing
+func catalogUnchanged(a, b catalogSnapshot) bool {
+	return a.Size == b.Size && a.ETag == b.ETag && a.LastModified.Equal(b.LastModified) &&
+		a.Compression == b.Compression && a.State == b.State && a.DeletedAt == nil &&
+		aws.StringValue(a.SHA256) == aws.StringValue(b.SHA256) && aws.Int64Value(a.BlockHeight) == aws.Int64Value(b.BlockHeight)
+}
+
+// syncCatalogNetwork brings the catalog of a network in line with the bucket
+func syncCatalogNetwork(ctx context.Context, protocol, network string) error {
+	prefix := protocol + "/" + network + "/"
+	svc := storageClient()
+	v, err := sharedStorageCall(ctx, "list:"+prefix, func(ctx context.Context) (interface{}, error) {
+		return listObjects(ctx, svc, prefix)
+	})
+	if err != nil {
+		return err
+	}
+	objects := v.([]*s3.Object)
+
+	existing, err := catalog.snapshots(ctx, protocol, network)
+	if err != nil {
+		return err
+	}
+
+	snapshotRow := func(object *s3.Object, state string) catalogSnapshot {
+		return catalogSnapshot{
+			Key:          *object.Key,
+			Protocol:     protocol,
+			Network:      network,
+			Size:         aws.Int64Value(object.Size),
+			ETag:         aws.StringValue(object.ETag),
+			LastModified: aws.TimeValue(object.LastModified).UTC(),
+			Compression:  nameCompression(*object.Key),
+			State:        state,
+		}
+	}
+
+	var current []catalogSnapshot
+	for _, object := range snapshotObjects(objects) {
+		snapshot := snapshotRow(object, snapshotAvailable)
+		// Only look up checksums not recorded yet, every lookup is a HEAD
+		if old, ok := existing[snapshot.Key]; !ok || old.SHA256 == nil || old.ETag != snapshot.ETag {
+			if sum, err := knownSHA256(ctx, svc, object); err == nil && sum != "" {
+				snapshot.SHA256 = &sum
+			}
+		}
+		if height, _, ok := snapshotBlockHeight(ctx, protocol, network, snapshot.Key); ok {
+			snapshot.BlockHeight = &height
+		}
+		current = append(current, snapshot)
+	}
+	keys := make([]string, len(objects))
+	for i, object := range objects {
+		keys[i] = *object.Key
+	}
+	inProgress := inProgressSnapshots(keys)
+	for _, object := range objects {
+		if inProgress[*object.Key] {
+			current = append(current, snapshotRow(object, snapshotInProgress))
+		}
+	}
+
+	var latestKey string
+	if latest, err := findLatest(ctx, protocol, network); err == nil && latest != nil {
+		latestKey = *latest.Key
+		measureInBackground(latestKey, aws.StringValue(latest.ETag))
+	}
+	return catalog.save(ctx, protocol, network, catalogChanges(existing, current, time.Now().UTC()), latestKey)
+}
+
+// runCatalogSync syncs the catalog with every network of the bucket at a fixed
+// interval, networks are synced right away on their snapshot events as well
+func runCatalogSync() {
+	if catalog == nil {
+		return
+	}
+	subscribeEvents("catalog", func(e snapshotEvent) {
+		if err := syncCatalogNetwork(context.Background(), e.Protocol, e.Network); err != nil {
+			logger.Error("Catalog sync failed", "protocol", e.Protocol, "network", e.Network, "error", err)
+		}
+	})
+
+	interval := time.Duration(config.CatalogSyncIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultCatalogSyncInterval
+	}
+	for ; ; time.Sleep(interval) {
+		if err := reloadRegistry(context.Background()); err != nil {
+			logger.Error("Reloading the network registry failed", "error", err)
+		}
+		networks, err := discoverNetworks(context.Background())
+		if err != nil {
+			logger.Error("Catalog sync failed to discover networks", "error", err)
+			continue
+		}
+		for _, n := range networks {
+			protocol, network, _ := strings.Cut(n, "/")
+			backgroundJobs.Submit(func() {
+				if err := syncCatalogNetwork(context.Background(), protocol, network); err != nil {
+					logger.Error("Catalog sync failed", "protocol", protocol, "network", network, "error", err)
+				}
+			})
+		}
+	}
+}
+
+// searchCatalog returns the snapshots of the catalog, deleted ones included, filtered
+// by the protocol, network, state and q (part of the key) query parameters
+func searchCatalog(c *gin.Context) {
+	if catalog == nil {
+		respondError(c, http.StatusNotFound, codeFeatureDisabled, "Catalog is disabled")
+		return
+	}
+	after, limit, err := pageParams(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	switch state := c.Query("state"); state {
+	case "", snapshotInProgress, snapshotAvailable, snapshotDeleted:
+	default:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "state must be in_progress, available or deleted")
+		return
+	}
+	if limit == 0 {
+		limit = maxPageLimit
+	}
+
+	snapshots, err := catalog.search(withRequestID(c.Request.Context(), c), catalogQuery{
+		Protocol: c.Query("protocol"),
+		Network:  c.Query("network"),
+		State:    c.Query("state"),
+		Search:   c.Query("q"),
+		After:    after,
+		// One more to know if there is a next page
+		Limit: limit + 1,
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	response := gin.H{"snapshots": snapshots}
+	if len(snapshots) > limit {
+		response["snapshots"] = snapshots[:limit]
+		response["next_cursor"] = encodeCursor(snapshots[limit-1].Key)
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestCatalogChanges(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := func(key, etag, state string, firstSeen time.Time) catalogSnapshot {
+		return catalogSnapshot{Key: key, Protocol: "nimiq", Network: "mainnet", Size: 10, ETag: etag, LastModified: olderTime, Compression: "zstd", State: state, FirstSeen: firstSeen}
+	}
+	withSum := func(s catalogSnapshot, sum string, height int64) catalogSnapshot {
+		s.SHA256, s.BlockHeight = aws.String(sum), aws.Int64(height)
+		return s
+	}
+	deleted := func(s catalogSnapshot) catalogSnapshot {
+		s.State, s.DeletedAt = snapshotDeleted, &now
+		return s
+	}
+
+	existing := map[string]catalogSnapshot{
+		"unchanged":    withSum(snapshot("unchanged", "a", snapshotAvailable, olderTime), "ab", 1),
+		"rewritten":    withSum(snapshot("rewritten", "a", snapshotAvailable, olderTime), "ab", 1),
+		"finished":     snapshot("finished", "a", snapshotInProgress, olderTime),
+		"gone":         snapshot("gone", "a", snapshotAvailable, olderTime),
+		"already gone": deleted(snapshot("already gone", "a", snapshotAvailable, olderTime)),
+	}
+	current := []catalogSnapshot{
+		// The checksum and height are no longer known to the bucket, e.g. after a
+		// newer snapshot-latest.json, and are kept
+		snapshot("unchanged", "a", snapshotAvailable, time.Time{}),
+		snapshot("rewritten", "b", snapshotAvailable, time.Time{}),
+		snapshot("finished", "a", snapshotAvailable, time.Time{}),
+		snapshot("new", "a", snapshotAvailable, time.Time{}),
+	}
+	want := []catalogSnapshot{
+		snapshot("finished", "a", snapshotAvailable, olderTime),
+		deleted(snapshot("gone", "a", snapshotAvailable, olderTime)),
+		snapshot("new", "a", snapshotAvailable, now),
+		snapshot("rewritten", "b", snapshotAvailable, olderTime),
+	}
+
+	got := catalogChanges(existing, current, now)
+	sort.Slice(got, func(i, j int) bool { return got[i].Key < got[j].Key })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestValidateNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		network registeredNetwork
+		valid   bool
+	}{
+		{"minimal", registeredNetwork{Protocol: "nimiq", Network: "mainnet"}, true},
+		{"complete", registeredNetwork{Protocol: "ethereum", Network: "holesky", Bucket: "eth-snapshots", ExpectedIntervalSeconds: 3600, Flavors: []string{"pruned", "archive"}}, true},
+		{"slash in network", registeredNetwork{Protocol: "nimiq", Network: "main/net"}, false},
+		{"no protocol", registeredNetwork{Network: "mainnet"}, false},
+		{"invalid bucket", registeredNetwork{Protocol: "nimiq", Network: "mainnet", Bucket: "Snapshots_Bucket"}, false},
+		{"negative interval", registeredNetwork{Protocol: "nimiq", Network: "mainnet", ExpectedIntervalSeconds: -1}, false},
+		{"duplicate flavor", registeredNetwork{Protocol: "nimiq", Network: "mainnet", Flavors: []string{"pruned", "pruned"}}, false},
+	}
+	for _, tt := range tests {
+		n := tt.network
+		if err := validateNetwork(&n); (err == nil) != tt.valid {
+			t.Errorf("%s: error %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if tt.valid && (n.DisplayName != n.Network || n.Flavors == nil || !sort.StringsAreSorted(n.Flavors)) {
+			t.Errorf("%s: display name %q, flavors %v", tt.name, n.DisplayName, n.Flavors)
+		}
+	}
+}
+
+func TestRegisteredNetworks(t *testing.T) {
+	r, storage := newTestAPI(t)
+	storage.put("cosmos/hub/2024-01-01.tar.zst", "unregistered snapshot", olderTime)
+	n := registeredNetwork{Protocol: "nimiq", Network: "mainnet", ExpectedIntervalSeconds: 3600}
+	registry.Store(&networkRegistry{networks: []registeredNetwork{n}, byName: map[string]registeredNetwork{"nimiq/mainnet": n}})
+
+	w := serve(r, "GET", "/keys", "", false)
+	var keys struct {
+		Dirs []string `json:"dirs"`
+	}
+	decode(t, w, &keys)
+	if !reflect.DeepEqual(keys.Dirs, []string{"nimiq/mainnet"}) {
+		t.Errorf("dirs %v, want only the registered network", keys.Dirs)
+	}
+	if w := serve(r, "GET", "/files/cosmos/hub", "", false); w.Code != http.StatusNotFound {
+		t.Errorf("unregistered network: status %d, want 404", w.Code)
+	}
+	if interval, ok := expectedInterval("nimiq", "mainnet"); !ok || interval != time.Hour {
+		t.Errorf("expected interval %v, %v, want the registered 1h", interval, ok)
+	}
+	if bucket := keyBucket("nimiq/mainnet/2024-02-01.tar.zst"); bucket != config.BucketName {
+		t.Errorf("bucket %s, want the configured one", bucket)
+	}
+}
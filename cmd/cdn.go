@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// cloudFrontSigner signs CDN URLs when a CloudFront key pair is configured
+var cloudFrontSigner *sign.URLSigner
+
+// loadCloudFrontSigner creates the CloudFront URL signer from the configured key pair,
+// it returns nil if no key pair is configured
+func loadCloudFrontSigner(keyPairID, privateKeyPath string) (*sign.URLSigner, error) {
+	if keyPairID == "" || privateKeyPath == "" {
+		return nil, nil
+	}
+	privateKey, err := sign.LoadPEMPrivKeyFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return sign.NewURLSigner(keyPairID, privateKey), nil
+}
+
+// cdnURL returns the CDN URL of key if a CDN base URL is configured for one of its
+// prefixes. The longest matching prefix wins and is replaced by the base URL.
+func cdnURL(key string) (string, bool) {
+	var match string
+	for prefix := range config.CDN {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(match) {
+			match = prefix
+		}
+	}
+	base, ok := config.CDN[match]
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(key[len(match):], "/"), true
+}
+
+// signCDNURL signs a CDN URL with the CloudFront key pair, valid for ttl. URLs are
+// returned unchanged when no key pair is configured.
+func signCDNURL(u string, ttl time.Duration) (string, error) {
+	if cloudFrontSigner == nil {
+		return u, nil
+	}
+	return reuseSignedURL("cloudfront|"+u, ttl, func() (string, error) {
+		presignsIssued.Inc("cloudfront")
+		return cloudFrontSigner.Sign(u, time.Now().Add(ttl))
+	})
+}
+
+// signedCDNURL returns the CDN URL of key if a CDN is configured for it, CloudFront
+// signed for ttl unless key is public
+func signedCDNURL(key string, ttl time.Duration) (string, bool, error) {
+	u, ok := cdnURL(key)
+	if !ok || isPublic(key) {
+		return u, ok, nil
+	}
+	u, err := signCDNURL(u, ttl)
+	return u, true, err
+}
+
+// downloadURL returns the URL clients should download key from: the CDN URL when a
+// CDN is configured for the key, its S3 URL otherwise
+func downloadURL(svc s3iface.S3API, key string, ttl time.Duration) (string, error) {
+	if u, ok, err := signedCDNURL(key, ttl); ok || err != nil {
+		return u, err
+	}
+	return objectURL(svc, key, ttl)
+}
+
+// downloadURLs returns both URLs of key, so clients can prefer the CDN and fall back
+// to the origin while the CDN is purging or stale: origin is its S3 URL and cdn its
+// CDN URL, empty when no CDN is configured for the key
+func downloadURLs(svc s3iface.S3API, key string, ttl time.Duration) (origin, cdn string, err error) {
+	if cdn, _, err = signedCDNURL(key, ttl); err != nil {
+		return "", "", err
+	}
+	origin, err = objectURL(svc, key, ttl)
+	return origin, cdn, err
+}
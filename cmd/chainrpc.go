@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// chainRPCTimeout bounds a chain RPC call, they are made while serving requests
+	chainRPCTimeout = 5 * time.Second
+	// chainHeightTTL is how long the current height of a chain is cached
+	chainHeightTTL = 30 * time.Second
+)
+
+// ChainRPC is the RPC endpoint of a chain, used to record the block height
+// snapshots are registered at
+type ChainRPC struct {
+	URL string `json:"url"`
+	// Type is "tendermint" for the CometBFT /status endpoint or "evm" for eth_blockNumber
+	Type string `json:"type"`
+}
+
+// chainHead is the state of a chain at some point in time
+type chainHead struct {
+	Height  int64
+	AppHash string
+	Time    time.Time
+	checked time.Time
+}
+
+// chainHeads caches the current head of a chain by protocol/network
+var chainHeads sync.Map
+
+// chainRPC returns the RPC endpoint configured for a network
+func chainRPC(protocol, network string) (ChainRPC, bool) {
+	rpc, ok := config.ChainRPC[protocol+"/"+network]
+	return rpc, ok && rpc.URL != ""
+}
+
+// currentChainHead returns the head of the chain of a network, cached for chainHeightTTL
+func currentChainHead(ctx context.Context, protocol, network string) (chainHead, error) {
+	rpc, ok := chainRPC(protocol, network)
+	if !ok {
+		return chainHead{}, fmt.Errorf("no chain RPC configured for %s/%s", protocol, network)
+	}
+	if v, ok := chainHeads.Load(protocol + "/" + network); ok && time.Since(v.(chainHead).checked) < chainHeightTTL {
+		return v.(chainHead), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, chainRPCTimeout)
+	defer cancel()
+	var head chainHead
+	var err error
+	switch rpc.Type {
+	case "evm":
+		head, err = evmHead(ctx, rpc.URL)
+	case "tendermint", "":
+		head, err = tendermintHead(ctx, rpc.URL)
+	default:
+		err = fmt.Errorf("unknown chain RPC type %q", rpc.Type)
+	}
+	if err != nil {
+		return chainHead{}, err
+	}
+	head.checked = time.Now()
+	chainHeads.Store(protocol+"/"+network, head)
+	return head, nil
+}
+
+// tendermintHead reads the latest block from the /status endpoint of a CometBFT node
+func tendermintHead(ctx context.Context, rpcURL string) (chainHead, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(rpcURL, "/")+"/status", nil)
+	if err != nil {
+		return chainHead{}, err
+	}
+	var status struct {
+		Result struct {
+			SyncInfo struct {
+				LatestBlockHeight string    `json:"latest_block_height"`
+				LatestAppHash     string    `json:"latest_app_hash"`
+				LatestBlockTime   time.Time `json:"latest_block_time"`
+			} `json:"sync_info"`
+		} `json:"result"`
+	}
+	if err := doChainRPC(req, &status); err != nil {
+		return chainHead{}, err
+	}
+	info := status.Result.SyncInfo
+	height, err := strconv.ParseInt(info.LatestBlockHeight, 10, 64)
+	if err != nil {
+		return chainHead{}, fmt.Errorf("invalid block height %q", info.LatestBlockHeight)
+	}
+	return chainHead{Height: height, AppHash: info.LatestAppHash, Time: info.LatestBlockTime}, nil
+}
+
+// evmHead reads the latest block number over Ethereum JSON-RPC
+func evmHead(ctx context.Context, rpcURL string) (chainHead, error) {
+	body := []byte(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rpcURL, bytes.NewReader(body))
+	if err != nil {
+		return chainHead{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var resp struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := doChainRPC(req, &resp); err != nil {
+		return chainHead{}, err
+	}
+	if resp.Error != nil {
+		return chainHead{}, fmt.Errorf("eth_blockNumber: %s", resp.Error.Message)
+	}
+	height, err := strconv.ParseInt(strings.TrimPrefix(resp.Result, "0x"), 16, 64)
+	if err != nil {
+		return chainHead{}, fmt.Errorf("invalid block number %q", resp.Result)
+	}
+	return chainHead{Height: height, Time: time.Now().UTC()}, nil
+}
+
+func doChainRPC(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("chain RPC: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// recordChainHead adds the current head of the chain of a network to the
+// snapshot-latest.json doc being registered, if a chain RPC is configured. A
+// failing RPC doesn't keep the snapshot from being registered.
+func recordChainHead(ctx context.Context, protocol, network string, doc map[string]interface{}) {
+	if _, ok := chainRPC(protocol, network); !ok {
+		return
+	}
+	head, err := currentChainHead(ctx, protocol, network)
+	if err != nil {
+		logger.Warn("Error getting chain height for snapshot", "protocol", protocol, "network", network, "error", err)
+		return
+	}
+	doc["block_height"] = head.Height
+	if head.AppHash != "" {
+		doc["app_hash"] = head.AppHash
+	}
+	if !head.Time.IsZero() {
+		doc["block_time"] = head.Time
+	}
+}
+
+// snapshotBlockHeight returns the block height recorded for the snapshot at key
+// when it was registered
+func snapshotBlockHeight(ctx context.Context, protocol, network, key string) (int64, string, bool) {
+	item, err := loadSnapshotInfo(ctx, protocol, network)
+	if err != nil {
+		return 0, "", false
+	}
+	doc, ok := item.content.(map[string]interface{})
+	if !ok || doc["filename"] != key {
+		return 0, "", false
+	}
+	// Read back from JSON, so a float64
+	height, ok := doc["block_height"].(float64)
+	if !ok {
+		return 0, "", false
+	}
+	appHash, _ := doc["app_hash"].(string)
+	return int64(height), appHash, true
+}
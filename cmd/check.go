@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// selfCheckTimeout bounds each check that talks to a remote service
+const selfCheckTimeout = 10 * time.Second
+
+// selfCheck is one check of the startup self-check, it returns a short detail on success
+type selfCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// runSelfCheck validates the configuration at path and the credentials and keys
+// it refers to, prints a report and exits with status 1 if any check failed
+func runSelfCheck(path string) {
+	failed := 0
+	report := func(name, detail string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %-22s %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok    %-22s %s\n", name, detail)
+	}
+
+	// The report says everything there is to say, keep log lines out of it
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var err error
+	config, err = loadConfig(path)
+	report("config", path, err)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	// Everything below needs the session, the remaining checks are independent
+	sess, err = newSession()
+	report("session", config.Region, err)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	svc := storageClient()
+	var sampleKey string
+	checks := []selfCheck{
+		{"logging", func() (string, error) {
+			_, err := newLogger(config.LogLevel, config.LogFormat)
+			return fmt.Sprintf("level %q, format %q", config.LogLevel, config.LogFormat), err
+		}},
+		{"notifiers", func() (string, error) {
+			if err := checkNotifiers(config.AlertNotifiers, alertNotifierTypes); err != nil {
+				return "", fmt.Errorf("alert_notifiers: %w", err)
+			}
+			if err := checkNotifiers(config.SnapshotNotifiers, announcementNotifierTypes); err != nil {
+				return "", fmt.Errorf("snapshot_notifiers: %w", err)
+			}
+			return fmt.Sprintf("%d alert, %d snapshot", len(config.AlertNotifiers), len(config.SnapshotNotifiers)), nil
+		}},
+		{"static export", func() (string, error) {
+			if err := checkStaticExportPrefix(config.StaticExportPrefix); err != nil {
+				return "", err
+			}
+			if config.StaticExportPrefix == "" {
+				return "disabled", nil
+			}
+			return config.StaticExportPrefix, nil
+		}},
+		{"bucket listing", func() (string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+			defer cancel()
+			out, err := svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+				Bucket:  aws.String(config.BucketName),
+				MaxKeys: aws.Int64(1),
+			})
+			if err != nil {
+				return "", err
+			}
+			if len(out.Contents) == 0 {
+				return fmt.Sprintf("bucket %s is empty", config.BucketName), nil
+			}
+			sampleKey = *out.Contents[0].Key
+			return fmt.Sprintf("bucket %s", config.BucketName), nil
+		}},
+		{"presigned download", func() (string, error) {
+			if sampleKey == "" {
+				return "skipped, no object to sign", nil
+			}
+			// Fetch a single byte with a presigned URL, which fails if the signing key is wrong
+			url, err := presignGetObject(svc, sampleKey, time.Minute)
+			if err != nil {
+				return "", err
+			}
+			return sampleKey, checkURL(context.Background(), url)
+		}},
+		{"cloudfront signing", func() (string, error) {
+			if config.CloudFrontKeyPairID == "" && config.CloudFrontPrivateKey == "" {
+				return "not configured", nil
+			}
+			if config.CloudFrontKeyPairID == "" || config.CloudFrontPrivateKey == "" {
+				return "", fmt.Errorf("cloudfront_key_pair_id and cloudfront_private_key must both be set")
+			}
+			signer, err := loadCloudFrontSigner(config.CloudFrontKeyPairID, config.CloudFrontPrivateKey)
+			if err != nil {
+				return "", err
+			}
+			cloudFrontSigner = signer
+			if sampleKey == "" {
+				return "key loaded", nil
+			}
+			if _, ok := cdnURL(sampleKey); !ok {
+				return "key loaded, no CDN configured for " + sampleKey, nil
+			}
+			url, err := downloadURL(svc, sampleKey, time.Minute)
+			if err != nil {
+				return "", err
+			}
+			return sampleKey, checkURL(context.Background(), url)
+		}},
+		{"geoip database", func() (string, error) {
+			if config.GeoIPDatabase == "" {
+				return "not configured", nil
+			}
+			ranges, err := loadGeoIP(config.GeoIPDatabase)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d ranges", len(ranges)), nil
+		}},
+		{"analytics", func() (string, error) {
+			if config.AnalyticsPath == "" {
+				return "not configured", nil
+			}
+			f, err := os.OpenFile(config.AnalyticsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+			if err != nil {
+				return "", err
+			}
+			return config.AnalyticsPath, f.Close()
+		}},
+		{"webhooks", func() (string, error) {
+			if config.WebhooksPath == "" {
+				return "not configured", nil
+			}
+			store := &webhookStore{hooks: make(map[string]*webhook)}
+			if err := store.load(config.WebhooksPath); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d registered", len(store.hooks)), nil
+		}},
+		{"error reporting", func() (string, error) {
+			if config.SentryDSN == "" {
+				return "not configured", nil
+			}
+			_, err := newSentryReporter(config.SentryDSN, config.SentryEnvironment)
+			return "dsn valid", err
+		}},
+		{"bucket events", func() (string, error) {
+			if config.SQSQueueURL == "" {
+				return "not configured", nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+			defer cancel()
+			_, err := sqs.New(sess).GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+				QueueUrl:       aws.String(config.SQSQueueURL),
+				AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+			})
+			return config.SQSQueueURL, err
+		}},
+	}
+	for _, check := range checks {
+		detail, err := check.run()
+		report(check.name, detail, err)
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d check(s) failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("\nall checks passed")
+	os.Exit(0)
+}
+
+// checkURL fetches the first byte of a download URL
+func checkURL(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		// S3 explains why it rejected a signature, e.g. SignatureDoesNotMatch or AccessDenied
+		var body struct {
+			Code    string
+			Message string
+		}
+		if xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil && body.Code != "" {
+			return fmt.Errorf("download URL responded with %s: %s: %s", resp.Status, body.Code, body.Message)
+		}
+		return fmt.Errorf("download URL responded with %s", resp.Status)
+	}
+	return nil
+}
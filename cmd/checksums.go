@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gin-gonic/gin"
+)
+
+// checksumLookups bounds the concurrent HEADs when collecting the checksums of a network
+const checksumLookups = 8
+
+// knownSHA256 returns the checksum of a snapshot from its metadata, the
+// snapshot-latest.json or its measurement, without measuring it
+func knownSHA256(ctx context.Context, svc s3iface.S3API, object *s3.Object) (string, error) {
+	sum, err := snapshotSHA256(ctx, svc, object)
+	if err != nil || sum != "" {
+		return sum, err
+	}
+	data, err := os.ReadFile(derivedCachePath(*object.Key, aws.StringValue(object.ETag), ".measure"))
+	if err != nil {
+		return "", nil
+	}
+	var m snapshotMeasurement
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", nil
+	}
+	return m.SHA256, nil
+}
+
+// @Summary Get the checksums of a network
+// @Description Get the known SHA-256 checksums of all snapshots of a network, current and past, in the format of sha256sum -c
+// @Produce plain
+// @Success 200 {string} string
+// @Router /files/{protocol}/{network}/checksums.txt [get]
+func networkChecksums(c *gin.Context) {
+	if isHead(c) {
+		respondSnapshotsHead(c, http.StatusOK, "text/plain; charset=utf-8")
+		return
+	}
+	prefix := fmt.Sprintf("%s/%s/", c.Param("protocol"), c.Param("network"))
+	svc := storageClient()
+	ctx := withRequestID(c.Request.Context(), c)
+
+	v, err := sharedStorageCall(ctx, "list:"+prefix, func(ctx context.Context) (interface{}, error) {
+		return listObjects(ctx, svc, prefix)
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	objects := snapshotObjects(v.([]*s3.Object))
+	if len(objects) == 0 {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+	sort.Slice(objects, func(i, j int) bool { return *objects[i].Key < *objects[j].Key })
+
+	sums := make([]string, len(objects))
+	sem := make(chan struct{}, checksumLookups)
+	var wg sync.WaitGroup
+	for i, object := range objects {
+		i, object := i, object
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			sum, err := knownSHA256(ctx, svc, object)
+			if err != nil {
+				// A snapshot deleted since the listing has no checksum to report
+				requestLogger(c).Warn("Error looking up snapshot checksum", "key", *object.Key, "error", err)
+			}
+			sums[i] = sum
+		}()
+	}
+	wg.Wait()
+
+	// Names relative to the network, the directory the snapshots are downloaded to
+	var body strings.Builder
+	for i, object := range objects {
+		if sums[i] != "" {
+			fmt.Fprintf(&body, "%s  %s\n", sums[i], path.Base(*object.Key))
+		}
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(body.String()))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// call is an in-flight or completed flightGroup.Do call
+type call struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	// waiters are the callers still waiting for the call, it is canceled once none are left
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces concurrent calls with the same key into a single execution,
+// so a burst of requests for one network results in one backend call
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do executes fn for key, unless a call for key is already in flight, in which case
+// it waits for that call and returns its result instead
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.DoContext(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// DoContext is Do for callers that may give up. A caller whose ctx is done stops
+// waiting and the call is canceled once every caller waiting for it gave up, but
+// not before: it isn't bound to the ctx of the caller that started it.
+func (g *flightGroup) DoContext(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	c, ok := g.calls[key]
+	if ok {
+		c.waiters++
+	} else {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &call{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			// A panic in fn fails the call instead of the process, the recovery
+			// middleware only covers the goroutines of requests
+			defer func() {
+				if r := recover(); r != nil {
+					c.val, c.err = nil, fmt.Errorf("panic in call %s: %v", key, r)
+					logger.Error("Panic in coalesced call", "key", key, "panic", r, "stack", string(debug.Stack()))
+				}
+				cancel()
+				g.forget(key, c)
+				close(c.done)
+			}()
+			c.val, c.err = fn(callCtx)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// Later callers start over rather than join a canceled call
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes a finished call, unless it was already replaced
+func (g *flightGroup) forget(key string, c *call) {
+	g.mu.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+}
+
+// Define the group all storage calls made on behalf of requests go through
+var storageFlight flightGroup
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// tarEntry is a file in the index of the contents of a tar snapshot
+type tarEntry struct {
+	Path string `json:"path"`
+	// Type is file, dir, symlink, hardlink or other
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// Offset is where the data of the file starts in the decompressed archive
+	Offset int64  `json:"offset"`
+	Link   string `json:"link,omitempty"`
+	// Files is the number of files rolled up into a directory when listing to a depth
+	Files int64 `json:"files,omitempty"`
+}
+
+// tarIndexer indexes a tar stream written to it
+type tarIndexer struct {
+	pw      *io.PipeWriter
+	done    chan struct{}
+	entries []tarEntry
+	err     error
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func newTarIndexer() *tarIndexer {
+	pr, pw := io.Pipe()
+	t := &tarIndexer{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		// Whatever follows the archive, or all of it if it isn't one, is drained
+		// so that the writer never blocks
+		defer io.Copy(io.Discard, pr)
+
+		cr := &countingReader{r: pr}
+		tr := tar.NewReader(cr)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				t.err = err
+				return
+			}
+			if header.Typeflag == tar.TypeXGlobalHeader {
+				continue
+			}
+			// The reader stops at the start of the data of the entry
+			entry := tarEntry{Path: header.Name, Size: header.Size, Offset: cr.n}
+			switch header.Typeflag {
+			case tar.TypeReg:
+				entry.Type = "file"
+			case tar.TypeDir:
+				entry.Type = "dir"
+			case tar.TypeSymlink:
+				entry.Type, entry.Link = "symlink", header.Linkname
+			case tar.TypeLink:
+				entry.Type, entry.Link = "hardlink", header.Linkname
+			default:
+				entry.Type = "other"
+			}
+			t.entries = append(t.entries, entry)
+		}
+	}()
+	return t
+}
+
+func (t *tarIndexer) Write(p []byte) (int, error) {
+	return t.pw.Write(p)
+}
+
+// Close ends the stream without waiting for the index
+func (t *tarIndexer) Close() error {
+	return t.pw.Close()
+}
+
+// finish ends the stream and returns the JSON index of its contents
+func (t *tarIndexer) finish() ([]byte, error) {
+	t.pw.Close()
+	<-t.done
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.entries == nil {
+		t.entries = []tarEntry{}
+	}
+	return json.Marshal(t.entries)
+}
+
+// rollUp lists entries to depth path components, the contents of deeper
+// directories are counted into their ancestor at depth
+func rollUp(entries []tarEntry, depth int) []tarEntry {
+	rolled := []tarEntry{}
+	dirs := map[string]int{}
+	for _, e := range entries {
+		parts := strings.Split(strings.Trim(e.Path, "/"), "/")
+		if len(parts) <= depth {
+			if e.Type == "dir" {
+				if i, ok := dirs[e.Path]; ok {
+					// Already rolled up from its contents
+					rolled[i].Offset = e.Offset
+					continue
+				}
+				dirs[e.Path] = len(rolled)
+			}
+			rolled = append(rolled, e)
+			continue
+		}
+		dir := strings.Join(parts[:depth], "/") + "/"
+		i, ok := dirs[dir]
+		if !ok {
+			i = len(rolled)
+			dirs[dir] = i
+			rolled = append(rolled, tarEntry{Path: dir, Type: "dir", Offset: e.Offset})
+		}
+		rolled[i].Size += e.Size
+		if e.Type == "file" {
+			rolled[i].Files++
+		}
+	}
+	return rolled
+}
+
+// @Summary List the contents of a snapshot
+// @Description List the files of a tar snapshot with their sizes and offsets in the decompressed archive. The index is built when the snapshot is measured, until it is ready 202 is returned.
+// @Param prefix query string false "Only paths starting with this prefix"
+// @Param depth query int false "Roll the contents of deeper directories up into their ancestor at this depth"
+// @Produce json
+// @Success 200 {array} tarEntry
+// @Success 202 {object} map[string]string
+// @Router /files/{protocol}/{network}/{filename}/contents [get]
+func snapshotContents(c *gin.Context) {
+	key := fmt.Sprintf("%s/%s/%s", c.Param("protocol"), c.Param("network"), c.Param("filename"))
+	if detectFormat(key).Archive != "tar" {
+		respondError(c, http.StatusNotFound, codeContentsUnavailable, "Not a tar archive")
+		return
+	}
+	depth := 0
+	if d := c.Query("depth"); d != "" {
+		var err error
+		if depth, err = strconv.Atoi(d); err != nil || depth <= 0 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "depth must be a positive integer")
+			return
+		}
+	}
+
+	svc, bucket := keyClient(storageClient(), key)
+	head, err := svc.HeadObjectWithContext(withRequestID(c.Request.Context(), c), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		respondDownloadError(c, err)
+		return
+	}
+	etag := aws.StringValue(head.ETag)
+	if isHead(c) {
+		respondDerivedHead(c, derivedCachePath(key, etag, ".contents"), "contents index", jsonContentType)
+		return
+	}
+
+	// The index is written along with the measurement, don't read the snapshot twice
+	if _, running := derivedJobs.Load(derivedCachePath(key, etag, ".measure")); running {
+		respondDerivedPending(c, "contents index")
+		return
+	}
+	data, err := readDerived(derivedCachePath(key, etag, ".contents"), func() ([]byte, error) {
+		// Not measured, or measured before contents were indexed
+		m, contents, err := measureSnapshot(context.Background(), key, etag)
+		if err != nil {
+			return nil, err
+		}
+		if measured, err := json.Marshal(m); err == nil {
+			if err := writeDerived(derivedCachePath(key, etag, ".measure"), measured); err != nil {
+				logger.Warn("Error writing snapshot measurement", "key", key, "error", err)
+			}
+		}
+		return contents, nil
+	})
+	if respondDerived(c, "contents index", err) {
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	var entries []tarEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	if entries == nil {
+		respondError(c, http.StatusNotFound, codeContentsUnavailable, "The contents of the snapshot can't be read")
+		return
+	}
+	if prefix := c.Query("prefix"); prefix != "" {
+		filtered := entries[:0]
+		for _, e := range entries {
+			if strings.HasPrefix(e.Path, prefix) {
+				filtered = append(filtered, e)
+			}
+		}
+		entries = filtered
+	}
+	if depth > 0 {
+		entries = rollUp(entries, depth)
+	}
+	c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gin-gonic/gin"
+)
+
+// recentUploadsLimit is how many of the newest files the dashboard overview lists
+const recentUploadsLimit = 20
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// networkOverview is the freshness and storage usage of one network
+type networkOverview struct {
+	Protocol         string     `json:"protocol"`
+	Network          string     `json:"network"`
+	Files            int        `json:"files"`
+	Bytes            int64      `json:"bytes"`
+	LatestKey        string     `json:"latest_key,omitempty"`
+	LatestModified   *time.Time `json:"latest_modified,omitempty"`
+	AgeSeconds       int64      `json:"age_seconds,omitempty"`
+	IntervalSeconds  int64      `json:"expected_interval_seconds,omitempty"`
+	ThresholdSeconds int64      `json:"stale_after_seconds,omitempty"`
+	Overdue          bool       `json:"overdue"`
+	Stale            bool       `json:"stale"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// overviewNetwork summarizes the listing of a network
+func overviewNetwork(ctx context.Context, protocol, network string) (networkOverview, []map[string]interface{}) {
+	o := networkOverview{Protocol: protocol, Network: network}
+	files, err := loadFiles(ctx, protocol, network)
+	if err != nil {
+		o.Error = err.Error()
+		return o, nil
+	}
+
+	for _, f := range files {
+		o.Files++
+		o.Bytes += f["size"].(int64)
+	}
+	latestKey := ""
+	var latest map[string]interface{}
+	for _, f := range snapshotFiles(files) {
+		if key := f["filename"].(string); key > latestKey {
+			latestKey, latest = key, f
+		}
+	}
+	if latest == nil {
+		return o, files
+	}
+
+	o.LatestKey = latestKey
+	if lastModified, ok := latest["last_modified"].(*time.Time); ok && lastModified != nil && !lastModified.IsZero() {
+		age := time.Since(*lastModified)
+		o.LatestModified = lastModified
+		o.AgeSeconds = int64(age.Seconds())
+		if interval, ok := expectedInterval(protocol, network); ok {
+			o.IntervalSeconds = int64(interval.Seconds())
+			o.Overdue = age > interval
+		}
+		if threshold, ok := staleThreshold(protocol, network); ok {
+			o.ThresholdSeconds = int64(threshold.Seconds())
+			o.Stale = age > threshold
+		}
+	}
+	return o, files
+}
+
+// countEntries returns the number of entries in a cache
+func countEntries(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// getOverview reports per-network freshness and storage usage, the most recent
+// uploads and cache statistics for the dashboard
+func getOverview(c *gin.Context) {
+	ctx := withRequestID(c.Request.Context(), c)
+	names, err := discoverNetworks(ctx)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	overviews := make([]networkOverview, len(names))
+	listings := make([][]map[string]interface{}, len(names))
+	err = fanOut(ctx, len(names), requestFanOut, func(i int) {
+		protocol, network, _ := strings.Cut(names[i], "/")
+		overviews[i], listings[i] = overviewNetwork(ctx, protocol, network)
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	var recent []map[string]interface{}
+	for _, files := range listings {
+		recent = append(recent, files...)
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		a, _ := recent[i]["last_modified"].(*time.Time)
+		b, _ := recent[j]["last_modified"].(*time.Time)
+		return a != nil && (b == nil || a.After(*b))
+	})
+	if len(recent) > recentUploadsLimit {
+		recent = recent[:recentUploadsLimit]
+	}
+
+	caches := gin.H{}
+	for name, m := range map[string]*sync.Map{"files": &cache, "info": &infoCache, "latest": &latestCache, "presign": &presignCache} {
+		caches[name] = gin.H{
+			"entries": countEntries(m),
+			"hits":    cacheLookups.Value(name, "hit"),
+			"misses":  cacheLookups.Value(name, "miss"),
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":        config.DryRun,
+		"networks":       overviews,
+		"recent_uploads": recent,
+		"caches":         caches,
+	})
+}
+
+// invalidateNetwork drops the cached listing, latest snapshot and snapshot info
+// of a network and reloads them
+func invalidateNetwork(c *gin.Context) {
+	refreshNetwork(c.Param("protocol"), c.Param("network"))
+	c.Status(http.StatusNoContent)
+}
+
+// pruneNetwork deletes all but the newest keep snapshots of a network. In dry
+// run it reports the snapshots it would delete.
+func pruneNetwork(c *gin.Context) {
+	protocol, network := c.Param("protocol"), c.Param("network")
+	keep, err := strconv.Atoi(c.Query("keep"))
+	if err != nil || keep < 1 {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "keep must be a number of at least 1")
+		return
+	}
+
+	dry := dryRun(c)
+	deleted, err := pruneSnapshots(c.Request.Context(), requestLogger(c), protocol, network, keep, dry)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	if dry {
+		c.JSON(http.StatusOK, gin.H{"deleted": deleted, "dry_run": true})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// pruneSnapshots deletes all but the newest keep snapshots of a network and returns
+// the deleted keys. In dry run it returns the keys it would delete.
+func pruneSnapshots(ctx context.Context, log *slog.Logger, protocol, network string, keep int, dry bool) ([]string, error) {
+	prefix := fmt.Sprintf("%s/%s/", protocol, network)
+	bucket := keyBucket(prefix)
+	svc := bucketClient(bucket)
+	objects, err := listObjects(ctx, svc, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are named with a timestamp prefix, so the newest sort last
+	var keys []string
+	for _, o := range snapshotObjects(objects) {
+		keys = append(keys, *o.Key)
+	}
+	sort.Strings(keys)
+	if len(keys) <= keep {
+		return []string{}, nil
+	}
+	// Whatever snapshot-latest.json points at stays, it may have been promoted
+	// over newer snapshots
+	current, _, err := latestDocumentKey(ctx, protocol, network)
+	if err != nil {
+		return nil, err
+	}
+	pruned := []string{}
+	for _, key := range keys[:len(keys)-keep] {
+		if key != current {
+			pruned = append(pruned, key)
+		}
+	}
+	if len(pruned) == 0 {
+		return pruned, nil
+	}
+	if dry {
+		log.Info("Dry run, skipping prune", "protocol", protocol, "network", network, "keys", pruned)
+		return pruned, nil
+	}
+
+	// DeleteObjects takes at most 1000 keys per call
+	deleted := make([]string, 0, len(pruned))
+	for start := 0; start < len(pruned); start += 1000 {
+		end := start + 1000
+		if end > len(pruned) {
+			end = len(pruned)
+		}
+		ids := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range pruned[start:end] {
+			ids = append(ids, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: ids, Quiet: aws.Bool(false)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range out.Deleted {
+			deleted = append(deleted, aws.StringValue(d.Key))
+		}
+		for _, e := range out.Errors {
+			log.Warn("Error pruning snapshot", "key", aws.StringValue(e.Key), "code", aws.StringValue(e.Code), "error", aws.StringValue(e.Message))
+		}
+	}
+	log.Info("Pruned snapshots", "protocol", protocol, "network", network, "deleted", len(deleted))
+
+	refreshNetwork(protocol, network)
+	return deleted, nil
+}
+
+// promoteSnapshot points the snapshot-latest.json of a network at the snapshot
+// given as key, keeping the other fields of the document. The promoted snapshot
+// is the latest one of the network until a snapshot is uploaded after it was
+// promoted. In dry run it returns the document it would write.
+func promoteSnapshot(c *gin.Context) {
+	protocol, network := c.Param("protocol"), c.Param("network")
+	prefix := fmt.Sprintf("%s/%s/", protocol, network)
+	key := c.Query("key")
+	if !strings.HasPrefix(key, prefix) || key == prefix+"snapshot-latest.json" {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "key must be a snapshot of "+protocol+"/"+network)
+		return
+	}
+
+	svc, bucket := keyClient(storageClient(), key)
+	ctx := c.Request.Context()
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		respondSnapshotInfoError(c, err)
+		return
+	}
+
+	promoted := latestDocument(ctx, protocol, network, key, head)
+	promoted["promoted_at"] = time.Now().UTC()
+
+	if dryRun(c) {
+		logDryRun(c, "promote", "protocol", protocol, "network", network, "key", key)
+		promoted["dry_run"] = true
+		c.JSON(http.StatusOK, promoted)
+		return
+	}
+
+	if err := putLatestDocument(c.Request.Context(), svc, protocol, network, promoted); err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	requestLogger(c).Info("Promoted snapshot", "protocol", protocol, "network", network, "key", key)
+
+	refreshNetwork(protocol, network)
+	c.JSON(http.StatusOK, promoted)
+}
+
+// latestDocumentKey returns the key the snapshot-latest.json of a network points
+// at and when it was promoted there, zero if the publisher wrote it. The key is
+// empty when the network has no snapshot-latest.json.
+func latestDocumentKey(ctx context.Context, protocol, network string) (string, time.Time, error) {
+	item, err := loadSnapshotInfo(ctx, protocol, network)
+	if err != nil {
+		if isNotFound(err) {
+			return "", time.Time{}, nil
+		}
+		return "", time.Time{}, err
+	}
+	doc, _ := item.content.(map[string]interface{})
+	key, _ := doc["filename"].(string)
+	promotedAt, _ := doc["promoted_at"].(string)
+	at, _ := time.Parse(time.RFC3339, promotedAt)
+	return key, at, nil
+}
+
+// promotedSnapshot returns the snapshot of a listing that snapshot-latest.json was
+// promoted to, or nil when it wasn't promoted, the snapshot is gone or a snapshot
+// was uploaded since. The promotion can't be read while storage fails, the
+// newest snapshot is the latest one then.
+func promotedSnapshot(ctx context.Context, protocol, network string, objects []*s3.Object) *s3.Object {
+	key, promotedAt, err := latestDocumentKey(ctx, protocol, network)
+	if err != nil || key == "" || promotedAt.IsZero() {
+		return nil
+	}
+	var promoted *s3.Object
+	for _, o := range snapshotObjects(objects) {
+		if o.LastModified != nil && o.LastModified.After(promotedAt) {
+			return nil
+		}
+		if *o.Key == key {
+			promoted = o
+		}
+	}
+	return promoted
+}
+
+// snapshotFields are the fields of a snapshot-latest.json that describe the
+// snapshot it points at rather than the network
+var snapshotFields = []string{"sha256", "block_height", "app_hash", "block_time"}
+
+// latestDocument returns a snapshot-latest.json pointing at the snapshot key,
+// keeping whatever else the publisher put in the current document except the
+// fields describing another snapshot
+func latestDocument(ctx context.Context, protocol, network, key string, head *s3.HeadObjectOutput) map[string]interface{} {
+	doc := map[string]interface{}{}
+	if item, err := loadSnapshotInfo(ctx, protocol, network); err == nil {
+		if m, ok := item.content.(map[string]interface{}); ok {
+			doc = m
+		}
+	}
+	latest := make(map[string]interface{}, len(doc)+4)
+	for k, v := range doc {
+		latest[k] = v
+	}
+	if latest["filename"] != key {
+		for _, field := range snapshotFields {
+			delete(latest, field)
+		}
+	}
+	latest["filename"] = key
+	latest["size"] = aws.Int64Value(head.ContentLength)
+	latest["last_modified"] = aws.TimeValue(head.LastModified)
+	return latest
+}
+
+// putLatestDocument writes the snapshot-latest.json of a network
+func putLatestDocument(ctx context.Context, svc s3iface.S3API, protocol, network string, doc map[string]interface{}) error {
+	body, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s/%s/snapshot-latest.json", protocol, network)
+	svc, bucket := keyClient(svc, key)
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func serveDashboard(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+}
+
+func registerDashboardRoutes(admin *gin.RouterGroup) {
+	admin.GET("/", serveDashboard)
+	admin.GET("/overview", getOverview)
+	networks := admin.Group("/networks/:protocol/:network")
+	networks.POST("/invalidate", invalidateNetwork)
+	networks.POST("/prune", pruneNetwork)
+	networks.POST("/promote", promoteSnapshot)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"expvar"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerDebugRoutes exposes the pprof profiles, expvar and a goroutine dump
+func registerDebugRoutes(debug *gin.RouterGroup) {
+	debug.GET("/pprof/", gin.WrapF(pprof.Index))
+	debug.GET("/pprof/cmdline", gin.WrapF(pprof.Cmdline))
+	debug.GET("/pprof/profile", gin.WrapF(pprof.Profile))
+	debug.GET("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/pprof/trace", gin.WrapF(pprof.Trace))
+	debug.GET("/pprof/:profile", func(c *gin.Context) {
+		pprof.Handler(c.Param("profile")).ServeHTTP(c.Writer, c.Request)
+	})
+
+	debug.GET("/vars", gin.WrapH(expvar.Handler()))
+
+	// Full stack traces of all goroutines, in the same format as an unrecovered panic
+	debug.GET("/goroutines", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(c.Writer, 2)
+	})
+}
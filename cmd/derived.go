@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errDerivedPending is returned by readDerived while a derived file is being generated
+var errDerivedPending = errors.New("derived file is being generated")
+
+// errDerivedBusy is returned by readDerived when no worker is free to generate a derived file
+var errDerivedBusy = errors.New("no worker free to generate derived file")
+
+// derivedJobs are the derived files being generated, keyed by cache path
+var derivedJobs = sync.Map{}
+
+// derivedCachePath returns where a file derived from an object version, like the
+// piece hashes of its torrent, is cached. Keying by ETag regenerates derived files
+// when an object is replaced.
+func derivedCachePath(key, etag, ext string) string {
+	dir := config.DerivedCachePath
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "snapshot-service-api")
+	}
+	sum := sha256.Sum256([]byte(key + "\x00" + etag))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+ext)
+}
+
+// readDerived returns the derived file at path. If it doesn't exist yet, generate
+// is started on the background worker pool, once, and errDerivedPending is returned.
+// errDerivedBusy is returned instead when every worker is busy.
+func readDerived(path string, generate func() ([]byte, error)) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if !os.IsNotExist(err) {
+		return data, err
+	}
+	if _, running := derivedJobs.LoadOrStore(path, true); running {
+		return nil, errDerivedPending
+	}
+	submitted := backgroundJobs.TrySubmit(func() {
+		defer derivedJobs.Delete(path)
+		data, err := generate()
+		if err == nil {
+			err = writeDerived(path, data)
+		}
+		if err != nil {
+			logger.Error("Error generating derived file", "path", path, "error", err)
+		}
+	})
+	if !submitted {
+		derivedJobs.Delete(path)
+		return nil, errDerivedBusy
+	}
+	return nil, errDerivedPending
+}
+
+// writeDerived writes a derived file atomically, so readers never see a partial file
+func writeDerived(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// respondDerivedPending tells the client to retry once the derived file is generated
+func respondDerivedPending(c *gin.Context, what string) {
+	c.Header("Retry-After", "60")
+	c.JSON(http.StatusAccepted, gin.H{"message": what + " is being generated, retry later"})
+}
+
+// respondDerived answers the errors of readDerived that ask the client to retry,
+// reporting whether it did
+func respondDerived(c *gin.Context, what string, err error) bool {
+	switch err {
+	case errDerivedPending:
+		respondDerivedPending(c, what)
+	case errDerivedBusy:
+		c.Header("Retry-After", "60")
+		respondError(c, http.StatusServiceUnavailable, codeOverloaded, what+" can't be generated right now, retry later")
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// diagnosticTimeout bounds each storage call of the diagnostics
+	diagnosticTimeout = 5 * time.Second
+	// maxClockSkew is the clock offset to the storage backend the diagnostics
+	// tolerate. S3 rejects signatures more than 15 minutes off, and presigned
+	// URLs expire early by as much as the clock is behind.
+	maxClockSkew = time.Minute
+)
+
+// diagnostic is the result of one check of the storage diagnostics
+type diagnostic struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// diagnosticsReport is the result of all checks of the storage diagnostics
+type diagnosticsReport struct {
+	OK      bool         `json:"ok"`
+	Checked time.Time    `json:"checked"`
+	Checks  []diagnostic `json:"checks"`
+}
+
+// awsErrorCode returns the code of an S3 error, empty for other errors
+func awsErrorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// runDiagnostics checks the storage backend live, bypassing the caches and the
+// circuit breaker, one check after the other since later checks need the key
+// found by the listing
+func runDiagnostics(ctx context.Context) diagnosticsReport {
+	svc := storageClient()
+	var serverDate time.Time
+	var listErr error
+	var sampleKey string
+
+	checks := []selfCheck{
+		{"bucket reachable", func() (string, error) {
+			ctx, cancel := context.WithTimeout(ctx, diagnosticTimeout)
+			defer cancel()
+			req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(config.BucketName)})
+			req.SetContext(ctx)
+			err := req.Send()
+			if req.HTTPResponse != nil {
+				serverDate, _ = http.ParseTime(req.HTTPResponse.Header.Get("Date"))
+			}
+			switch code := awsErrorCode(err); {
+			case err == nil:
+				return fmt.Sprintf("bucket %s at %s", config.BucketName, bucketEndpoint(config.BucketName)), nil
+			case code == "Forbidden":
+				// The bucket exists, whether the credentials may use it is checked below
+				return fmt.Sprintf("bucket %s at %s, access denied", config.BucketName, bucketEndpoint(config.BucketName)), nil
+			case code == "NotFound":
+				return "", fmt.Errorf("bucket %s does not exist at %s", config.BucketName, bucketEndpoint(config.BucketName))
+			}
+			return "", err
+		}},
+		{"clock skew", func() (string, error) {
+			if serverDate.IsZero() {
+				return "", fmt.Errorf("the storage backend sent no Date header")
+			}
+			// The Date header has a resolution of a second
+			skew := time.Since(serverDate).Round(time.Second)
+			relation := fmt.Sprintf("local clock is %s ahead of the storage backend", skew)
+			if skew < 0 {
+				relation = fmt.Sprintf("local clock is %s behind the storage backend", -skew)
+			}
+			if skew > maxClockSkew || skew < -maxClockSkew {
+				return "", fmt.Errorf("%s, presigned URLs will be rejected", relation)
+			}
+			return relation, nil
+		}},
+		{"credentials", func() (string, error) {
+			ctx, cancel := context.WithTimeout(ctx, diagnosticTimeout)
+			defer cancel()
+			out, err := svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+				Bucket:  aws.String(config.BucketName),
+				MaxKeys: aws.Int64(1),
+			})
+			listErr = err
+			if err == nil && len(out.Contents) > 0 {
+				sampleKey = *out.Contents[0].Key
+			}
+			switch awsErrorCode(err) {
+			case "InvalidAccessKeyId":
+				return "", fmt.Errorf("access key %s is not known to the storage backend", config.AccessKey)
+			case "SignatureDoesNotMatch":
+				return "", fmt.Errorf("secret key does not match access key %s", config.AccessKey)
+			case "RequestTimeTooSkewed":
+				return "", fmt.Errorf("signatures are rejected because of the clock skew")
+			case "AccessDenied":
+				// Authenticated, but without the permission checked below
+			default:
+				if err != nil {
+					return "", err
+				}
+			}
+			return fmt.Sprintf("access key %s accepted", config.AccessKey), nil
+		}},
+		{"list permission", func() (string, error) {
+			if listErr != nil {
+				return "", listErr
+			}
+			if sampleKey == "" {
+				return fmt.Sprintf("bucket %s is empty", config.BucketName), nil
+			}
+			return fmt.Sprintf("bucket %s", config.BucketName), nil
+		}},
+		{"get permission", func() (string, error) {
+			if sampleKey == "" {
+				return "skipped, no object to read", nil
+			}
+			ctx, cancel := context.WithTimeout(ctx, diagnosticTimeout)
+			defer cancel()
+			out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(config.BucketName),
+				Key:    aws.String(sampleKey),
+				Range:  aws.String("bytes=0-0"),
+			})
+			if err != nil {
+				return "", err
+			}
+			out.Body.Close()
+			return sampleKey, nil
+		}},
+		{"presigned download", func() (string, error) {
+			if sampleKey == "" {
+				return "skipped, no object to sign", nil
+			}
+			// Signed afresh, a cached URL would hide a change of the credentials
+			req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+				Bucket: aws.String(config.BucketName),
+				Key:    aws.String(sampleKey),
+			})
+			url, err := req.Presign(time.Minute)
+			if err != nil {
+				return "", err
+			}
+			return sampleKey, checkURL(ctx, url)
+		}},
+	}
+
+	report := diagnosticsReport{OK: true, Checked: time.Now().UTC()}
+	for _, check := range checks {
+		start := time.Now()
+		detail, err := check.run()
+		d := diagnostic{Name: check.name, OK: err == nil, Detail: detail, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			d.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, d)
+	}
+	return report
+}
+
+// getDiagnostics runs live checks of the storage backend and reports each result,
+// for debugging failing downloads and presigned URLs
+func getDiagnostics(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, runDiagnostics(withRequestID(c.Request.Context(), c)))
+}
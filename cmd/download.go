@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultProxyPartSize is used when proxy_part_size_mb is not set in the config
+	defaultProxyPartSize = 16 << 20
+	// defaultProxyConcurrency is used when proxy_concurrency is not set in the config
+	defaultProxyConcurrency = 4
+)
+
+// errUnsatisfiableRange is returned by parseRange for ranges outside of the object
+var errUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+// downloadFile streams an object through the API, for clients that can't reach the
+// S3 endpoint directly. Clients in a region served by a mirror are redirected to
+// it instead. Range and If-Range requests are supported. Objects larger than one
+// part are fetched in concurrent ranged parts and written in order. HEAD requests
+// only get the headers of the object.
+func downloadFile(c *gin.Context) {
+	key := fmt.Sprintf("%s/%s/%s", c.Param("protocol"), c.Param("network"), c.Param("filename"))
+
+	// Send clients to the mirror of their region instead, if there is one
+	if mirror, ok := closestMirror(c, c.Param("protocol"), c.Param("network"), key); ok {
+		mirrorRedirects.Inc(mirror.Name)
+		recordDownload(c, "mirror", c.Param("protocol"), c.Param("network"), key, 0, false)
+		c.Redirect(http.StatusFound, mirror.URL)
+		return
+	}
+
+	svc, bucket := keyClient(storageClient(), key)
+
+	// Only the HEAD is bounded by the request timeout, streaming takes as long as it takes
+	ctx := withRequestID(c.Request.Context(), c)
+	headCtx, cancel := context.WithTimeout(ctx, requestTimeout())
+	head, err := svc.HeadObjectWithContext(headCtx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	cancel()
+	if err != nil {
+		respondDownloadError(c, err)
+		return
+	}
+	size := aws.Int64Value(head.ContentLength)
+
+	// Serve the whole object unless a range was requested and, if the client sent
+	// a validator, the object still matches it
+	start, end := int64(0), size-1
+	partial := false
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" {
+		ifRange := c.GetHeader("If-Range")
+		if ifRange == "" || ifRangeMatches(ifRange, head.ETag, head.LastModified) {
+			start, end, err = parseRange(rangeHeader, size)
+			if err == errUnsatisfiableRange {
+				c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+				respondError(c, http.StatusRequestedRangeNotSatisfiable, codeRangeNotSatisfiable, err.Error())
+				return
+			}
+			// Ranges we don't understand, e.g. multiple ranges, are ignored
+			partial = err == nil
+			if !partial {
+				start, end = 0, size-1
+			}
+		}
+	}
+
+	header := c.Writer.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.Param("filename")))
+	header.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if head.ContentType != nil {
+		header.Set("Content-Type", *head.ContentType)
+	}
+	if head.ETag != nil {
+		header.Set("ETag", *head.ETag)
+	}
+	if head.LastModified != nil {
+		header.Set("Last-Modified", head.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	status := http.StatusOK
+	if partial {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		status = http.StatusPartialContent
+	}
+	c.Status(status)
+	// Resumed ranges count towards the bytes served, but not as downloads
+	recordDownload(c, "proxy", c.Param("protocol"), c.Param("network"), key, end-start+1, start > 0)
+	if size == 0 || c.Request.Method == http.MethodHead {
+		return
+	}
+
+	// The client may go away in the middle of a multi-GB download, there is nobody
+	// left to report an error to at that point
+	_ = streamParts(ctx, svc, key, aws.StringValue(head.ETag), start, end, c.Writer)
+}
+
+// @Summary Redirect to the latest snapshot
+// @Description Redirect to the download URL of the latest snapshot of a network, so that it can be fetched in one step
+// @Param protocol path string true "Protocol"
+// @Param network path string true "Network"
+// @Param format query string false "Only snapshots in this compression"
+// @Success 302
+// @Router /download/{protocol}/{network}/latest [get]
+func downloadLatest(c *gin.Context) {
+	protocol, network := c.Param("protocol"), c.Param("network")
+	if isHead(c) {
+		if _, ok := parseCompression(c.Query("format")); c.Query("format") != "" && !ok {
+			respondError(c, http.StatusBadRequest, codeUnknownFormat, "unknown format "+c.Query("format"))
+			return
+		}
+		// The redirect target is presigned, so HEAD only gets the status
+		respondSnapshotsHead(c, http.StatusFound, "")
+		return
+	}
+	svc := storageClient()
+	ctx := withRequestID(c.Request.Context(), c)
+
+	var latest *s3.Object
+	var err error
+	if format := c.Query("format"); format != "" {
+		compression, ok := parseCompression(format)
+		if !ok {
+			respondError(c, http.StatusBadRequest, codeUnknownFormat, "unknown format "+format)
+			return
+		}
+		latest, err = findLatestCompression(ctx, svc, protocol, network, compression)
+	} else {
+		latest, err = findLatest(ctx, protocol, network)
+	}
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	if latest == nil {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+
+	// The redirect expires with the URL it points to
+	c.Header("Cache-Control", "no-store")
+	if mirror, ok := closestMirror(c, protocol, network, *latest.Key); ok {
+		mirrorRedirects.Inc(mirror.Name)
+		recordDownload(c, "mirror", protocol, network, *latest.Key, 0, false)
+		c.Redirect(http.StatusFound, mirror.URL)
+		return
+	}
+	u, err := downloadURL(svc, *latest.Key, presignTTL(c.FullPath(), protocol, network, defaultPresignTTL))
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	recordDownload(c, "redirect", protocol, network, *latest.Key, aws.Int64Value(latest.Size), false)
+	c.Redirect(http.StatusFound, u)
+}
+
+// streamParts writes the bytes start to end (inclusive) of key to w. Up to
+// proxy_concurrency parts are fetched ahead of the writer, which bounds memory to
+// proxy_concurrency * proxy_part_size_mb per download. Every part is pinned to the
+// ETag seen by the caller, so a concurrently replaced object can't be mixed in.
+func streamParts(ctx context.Context, svc s3iface.S3API, key, etag string, start, end int64, w io.Writer) error {
+	svc, bucket := keyClient(svc, key)
+	partSize := int64(config.ProxyPartSizeMB) << 20
+	if partSize <= 0 {
+		partSize = defaultProxyPartSize
+	}
+	concurrency := config.ProxyConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultProxyConcurrency
+	}
+
+	type partResult struct {
+		data []byte
+		err  error
+	}
+
+	var parts []chan partResult
+	for offset := start; offset <= end; offset += partSize {
+		parts = append(parts, make(chan partResult, 1))
+	}
+
+	sem := make(chan struct{}, concurrency)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := range parts {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			partStart := start + int64(i)*partSize
+			partEnd := partStart + partSize - 1
+			if partEnd > end {
+				partEnd = end
+			}
+			go func(i int, partStart, partEnd int64) {
+				input := &s3.GetObjectInput{
+					Bucket: aws.String(bucket),
+					Key:    aws.String(key),
+					Range:  aws.String(fmt.Sprintf("bytes=%d-%d", partStart, partEnd)),
+				}
+				if etag != "" {
+					input.IfMatch = aws.String(etag)
+				}
+				result, err := svc.GetObjectWithContext(ctx, input)
+				if err != nil {
+					parts[i] <- partResult{err: err}
+					return
+				}
+				defer result.Body.Close()
+				var buf bytes.Buffer
+				buf.Grow(int(partEnd - partStart + 1))
+				_, err = io.Copy(&buf, result.Body)
+				parts[i] <- partResult{data: buf.Bytes(), err: err}
+			}(i, partStart, partEnd)
+		}
+	}()
+
+	for _, part := range parts {
+		result := <-part
+		<-sem
+		if result.err != nil {
+			return result.err
+		}
+		if _, err := w.Write(result.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRange parses a single "bytes=" range of an object of the given size into
+// inclusive start and end offsets
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, errors.New("unsupported range")
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	// A suffix range, i.e. the last n bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return 0, 0, err
+		}
+		// An end before the start makes the header invalid, it is ignored rather
+		// than unsatisfiable (RFC 7233 section 2.1)
+		if end < start {
+			return 0, 0, errors.New("invalid range")
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+	return start, end, nil
+}
+
+// ifRangeMatches reports whether an If-Range validator (an ETag or an HTTP date)
+// still matches the object
+func ifRangeMatches(ifRange string, etag *string, lastModified *time.Time) bool {
+	if etag != nil && ifRange == *etag {
+		return true
+	}
+	if t, err := http.ParseTime(ifRange); err == nil && lastModified != nil {
+		return !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// respondDownloadError writes the response for a failed HEAD of a download
+func respondDownloadError(c *gin.Context, err error) {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			respondError(c, http.StatusNotFound, codeFileNotFound, "File not found")
+			return
+		}
+	}
+	respondInternalError(c, err)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// downloaderURLTTL is how long the URL the downloader fetches from the bucket directly
+	// is valid, long enough to resume a slow download
+	downloaderURLTTL = 24 * time.Hour
+	// downloaderRetries is how often the downloader resumes a download that broke off
+	downloaderRetries = 5
+	// bootstrapMarker is written to the destination once a snapshot is extracted,
+	// so restarted init containers don't download it again
+	bootstrapMarker = ".snapshot-bootstrap"
+)
+
+// runDownloader implements the download subcommand: it downloads the latest snapshot
+// of a network through the API or directly from the bucket, resuming partial
+// downloads, verifies its checksum, extracts it into the destination and exits
+func runDownloader(args []string) {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	protocol := fs.String("protocol", "", "Protocol of the snapshot")
+	network := fs.String("network", "", "Network of the snapshot")
+	dest := fs.String("dest", ".", "Directory to extract the snapshot into")
+	api := fs.String("api", "", "Base URL of the snapshot service API to get the snapshot from")
+	configFilePath := fs.String("config", "", "Configuration file to get the snapshot from the bucket directly instead of the API")
+	noExtract := fs.Bool("no-extract", false, "Only download and verify the snapshot")
+	force := fs.Bool("force", false, "Download even if the destination was already bootstrapped")
+	fs.Parse(args)
+
+	if *protocol == "" || *network == "" || (*api == "") == (*configFilePath == "") {
+		fmt.Fprintln(os.Stderr, "Usage: snapshot-service download --protocol X --network Y --dest DIR (--api URL | --config FILE)")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	marker := filepath.Join(*dest, bootstrapMarker)
+	if previous, err := os.ReadFile(marker); err == nil && !*force {
+		logger.Info("Destination is already bootstrapped, skipping", "dest", *dest, "snapshot", strings.TrimSpace(string(previous)))
+		os.Exit(0)
+	}
+
+	var latest latestResponse
+	var err error
+	if *api != "" {
+		latest, err = fetchLatest(*api, *protocol, *network)
+	} else {
+		latest, err = resolveLatest(*configFilePath, *protocol, *network)
+	}
+	if err != nil {
+		fatal("Error looking up the latest snapshot", "protocol", *protocol, "network", *network, "error", err)
+	}
+	logger.Info("Latest snapshot", "key", latest.Key, "size", latest.Size, "estimated_disk_bytes", latest.EstimatedDiskBytes)
+
+	// The filename comes from the API or the bucket, only its base is used so the
+	// snapshot can't be written outside the destination
+	name := filepath.Base(latest.Filename)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		fatal("Invalid snapshot filename", "filename", latest.Filename)
+	}
+	if err := os.MkdirAll(*dest, 0o755); err != nil {
+		fatal("Error creating destination", "dest", *dest, "error", err)
+	}
+	archive := filepath.Join(*dest, name)
+	// Prefer the CDN, S3 still serves the snapshot while the CDN is purging or stale
+	sources := []string{latest.URL}
+	if latest.CDNURL != "" {
+		sources = []string{latest.CDNURL, latest.URL}
+	}
+	for i, u := range sources {
+		err = resumeDownload(u, archive, latest.Size)
+		if err == nil || i == len(sources)-1 {
+			break
+		}
+		logger.Warn("Error downloading snapshot from the CDN, falling back to S3", "key", latest.Key, "error", err)
+	}
+	if err != nil {
+		fatal("Error downloading snapshot", "key", latest.Key, "error", err)
+	}
+
+	if latest.SHA256 != nil {
+		if err := verifySHA256(archive, *latest.SHA256); err != nil {
+			// Start over next time rather than resuming a corrupt file
+			os.Remove(archive)
+			fatal("Error verifying snapshot", "key", latest.Key, "error", err)
+		}
+		logger.Info("Verified checksum", "sha256", *latest.SHA256)
+	} else {
+		logger.Warn("No checksum is published for the snapshot, skipping verification", "key", latest.Key)
+	}
+
+	if *noExtract || latest.DecompressCommand == nil {
+		logger.Info("Downloaded snapshot", "path", archive)
+		os.Exit(0)
+	}
+
+	logger.Info("Extracting snapshot", "command", *latest.DecompressCommand)
+	cmd := exec.Command("sh", "-c", *latest.DecompressCommand)
+	cmd.Dir = *dest
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatal("Error extracting snapshot", "key", latest.Key, "error", err)
+	}
+	os.Remove(archive)
+	if err := os.WriteFile(marker, []byte(latest.Key+"\n"), 0o644); err != nil {
+		fatal("Error writing bootstrap marker", "error", err)
+	}
+	logger.Info("Bootstrapped from snapshot", "key", latest.Key, "dest", *dest)
+	os.Exit(0)
+}
+
+// fetchLatest gets the latest snapshot of a network from the API at base
+func fetchLatest(base, protocol, network string) (latestResponse, error) {
+	u := strings.TrimSuffix(base, "/") + "/files/" + url.PathEscape(protocol) + "/" + url.PathEscape(network) + "/latest"
+	resp, err := http.Get(u)
+	if err != nil {
+		return latestResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return latestResponse{}, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	var latest latestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&latest); err != nil {
+		return latestResponse{}, err
+	}
+	if latest.Filename == "" {
+		return latestResponse{}, fmt.Errorf("GET %s: no filename in response, is the API too old?", u)
+	}
+	return latest, nil
+}
+
+// resolveLatest looks up the latest snapshot of a network in the bucket of the
+// configuration at path
+func resolveLatest(path, protocol, network string) (latestResponse, error) {
+	var err error
+	if config, err = loadConfig(path); err != nil {
+		return latestResponse{}, err
+	}
+	if sess, err = newSession(); err != nil {
+		return latestResponse{}, err
+	}
+	if cloudFrontSigner, err = loadCloudFrontSigner(config.CloudFrontKeyPairID, config.CloudFrontPrivateKey); err != nil {
+		return latestResponse{}, err
+	}
+	ctx := context.Background()
+	latest, err := findLatest(ctx, protocol, network)
+	if err != nil {
+		return latestResponse{}, err
+	}
+	if latest == nil {
+		return latestResponse{}, errors.New("no snapshots found")
+	}
+	return describeLatest(ctx, storageClient(), latest, downloaderURLTTL, logger)
+}
+
+// resumeDownload downloads u to path, continuing from whatever part of the file
+// is already there and resuming again when the connection breaks off
+func resumeDownload(u, path string, size int64) error {
+	for attempt := 0; ; attempt++ {
+		err := downloadRange(u, path, size)
+		if err == nil || attempt == downloaderRetries {
+			return err
+		}
+		logger.Warn("Download broke off, resuming", "attempt", attempt+1, "error", err)
+		time.Sleep(time.Duration(attempt+1) * 5 * time.Second)
+	}
+}
+
+// downloadRange fetches the part of u that is missing from path
+func downloadRange(u, path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset == size {
+		return nil
+	}
+	if offset > size {
+		// Left over from an older snapshot of the same name
+		offset = 0
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		logger.Info("Resuming download", "offset", offset)
+	case http.StatusOK:
+		offset = 0
+	default:
+		return fmt.Errorf("download: %s", resp.Status)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		return err
+	}
+	if offset+n != size {
+		return fmt.Errorf("download: got %d of %d bytes", offset+n, size)
+	}
+	return nil
+}
+
+// verifySHA256 checks the SHA-256 of the file at path against the hex checksum want
+func verifySHA256(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != strings.ToLower(want) {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dryRun reports whether a destructive request should only report what it would
+// do. It is on for every request with dry_run in the config or the --dry-run
+// flag, and can be requested per call with the dry_run=true query parameter.
+func dryRun(c *gin.Context) bool {
+	if config.DryRun {
+		return true
+	}
+	on, _ := strconv.ParseBool(c.Query("dry_run"))
+	return on
+}
+
+// logDryRun logs an action skipped because of dry run
+func logDryRun(c *gin.Context, action string, args ...any) {
+	requestLogger(c).Info("Dry run, skipping "+action, args...)
+}
+
+type dryRunKey struct{}
+
+// withDryRun marks ctx for a dry run if dry is set, for background work started
+// by a request like a job run
+func withDryRun(ctx context.Context, dry bool) context.Context {
+	if !dry {
+		return ctx
+	}
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// dryRunContext is dryRun for background work, which only reports what it would
+// do with dry run in the config or when started by a dry run request
+func dryRunContext(ctx context.Context) bool {
+	if config.DryRun {
+		return true
+	}
+	on, _ := ctx.Value(dryRunKey{}).(bool)
+	return on
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+)
+
+// Binary encodings of listings, for clients where parsing JSON of large listings
+// is a measurable CPU cost. Struct fields are named by their json tags.
+var (
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func init() {
+	typeInfos := codec.NewTypeInfos([]string{"codec", "json"})
+	msgpackHandle.TypeInfos = typeInfos
+	msgpackHandle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	cborHandle.TypeInfos = typeInfos
+}
+
+// listingEncodings maps the media types a listing can be encoded in to their codec
+var listingEncodings = map[string]codec.Handle{
+	"application/msgpack":   msgpackHandle,
+	"application/x-msgpack": msgpackHandle,
+	"application/cbor":      cborHandle,
+}
+
+// listingEncoding returns the media type and codec of the binary encoding the client
+// accepts before JSON, a nil codec for JSON
+func listingEncoding(c *gin.Context) (string, codec.Handle) {
+	for _, accepted := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || mediaType == "*/*" {
+			break
+		}
+		if h, ok := listingEncodings[mediaType]; ok {
+			return mediaType, h
+		}
+	}
+	return "", nil
+}
+
+// respondListing writes obj as MessagePack or CBOR if the client accepts one of
+// them before JSON, and as JSON otherwise
+func respondListing(c *gin.Context, status int, obj interface{}) {
+	c.Writer.Header().Add("Vary", "Accept")
+	mediaType, h := listingEncoding(c)
+	if h == nil {
+		c.JSON(status, obj)
+		return
+	}
+	var body []byte
+	if err := codec.NewEncoderBytes(&body, h).Encode(obj); err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	c.Data(status, mediaType, body)
+}
+
+// streamBufferSize is how much of a streamed listing is buffered between writes
+const streamBufferSize = 64 << 10
+
+// streamJSON writes a JSON array of n entries between prefix and suffix, encoding the
+// entries one at a time. An error of the first entry is answered with a 500, later
+// ones cut the response short, which clients notice as invalid JSON.
+func streamJSON(c *gin.Context, prefix []byte, n int, entry func(i int) (interface{}, error), suffix []byte) {
+	c.Writer.Header().Add("Vary", "Accept")
+	var first []byte
+	if n > 0 {
+		v, err := entry(0)
+		if err == nil {
+			first, err = json.Marshal(v)
+		}
+		if err != nil {
+			respondInternalError(c, err)
+			return
+		}
+	}
+
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := bufio.NewWriterSize(c.Writer, streamBufferSize)
+	defer w.Flush()
+	w.Write(prefix)
+	w.WriteByte('[')
+	w.Write(first)
+	for i := 1; i < n; i++ {
+		v, err := entry(i)
+		var b []byte
+		if err == nil {
+			b, err = json.Marshal(v)
+		}
+		if err != nil {
+			requestLogger(c).Error("Listing cut short", "error", err)
+			return
+		}
+		w.WriteByte(',')
+		w.Write(b)
+	}
+	w.WriteByte(']')
+	w.Write(suffix)
+}
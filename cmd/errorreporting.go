@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorReporterQueueSize bounds the events waiting to be sent, events are dropped
+// rather than slowing down requests when Sentry can't keep up
+const errorReporterQueueSize = 100
+
+// sentryReporter sends error events to Sentry's store endpoint
+type sentryReporter struct {
+	storeURL    string
+	auth        string
+	environment string
+	events      chan map[string]interface{}
+	client      *http.Client
+}
+
+// Define the error reporter, nil when no Sentry DSN is configured
+var errorReporter *sentryReporter
+
+// newSentryReporter parses a DSN of the form https://<key>@<host>/<project> and
+// starts sending events in the background
+func newSentryReporter(dsn, environment string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("sentry DSN has no public key")
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if project == "" {
+		return nil, fmt.Errorf("sentry DSN has no project ID")
+	}
+
+	r := &sentryReporter{
+		storeURL:    fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=snapshot-service-api/1.0, sentry_key=%s", u.User.Username()),
+		environment: environment,
+		events:      make(chan map[string]interface{}, errorReporterQueueSize),
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *sentryReporter) run() {
+	for event := range r.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodPost, r.storeURL, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", r.auth)
+		resp, err := r.client.Do(req)
+		if err != nil {
+			logger.Warn("Error reporting to Sentry failed", "error", err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// capture queues an event for err that happened while serving c
+func (r *sentryReporter) capture(c *gin.Context, err error, stack []byte) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       "error",
+		"platform":    "go",
+		"server_name": hostname,
+		"environment": r.environment,
+		"exception": []map[string]interface{}{{
+			"type":  fmt.Sprintf("%T", err),
+			"value": err.Error(),
+		}},
+		"request": map[string]interface{}{
+			"url":          c.Request.URL.String(),
+			"method":       c.Request.Method,
+			"query_string": c.Request.URL.RawQuery,
+		},
+		"tags": map[string]string{
+			"route":      c.FullPath(),
+			"request_id": requestID(c),
+		},
+	}
+	if stack != nil {
+		event["extra"] = map[string]interface{}{"stack": string(stack)}
+	}
+
+	select {
+	case r.events <- event:
+	default:
+		logger.Warn("Error report dropped, queue is full")
+	}
+}
+
+// reportError sends err to the error reporter, if one is configured
+func reportError(c *gin.Context, err error) {
+	if errorReporter != nil {
+		errorReporter.capture(c, err, nil)
+	}
+}
+
+// errorReportingRecovery reports handler panics before responding with a 500
+func errorReportingRecovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				err, ok := p.(error)
+				if !ok {
+					err = fmt.Errorf("panic: %v", p)
+				}
+				stack := debug.Stack()
+				requestLogger(c).Error("Handler panicked", "error", err, "stack", string(stack))
+				if errorReporter != nil {
+					errorReporter.capture(c, err, stack)
+				}
+				abortWithError(c, http.StatusInternalServerError, codeInternalError, "internal server error")
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes of the API. They are part of the API contract, unlike the error
+// messages, so automation can branch on them: never change or reuse one.
+const (
+	codeInvalidRequest      = "invalid_request"
+	codeInvalidQuery        = "invalid_query"
+	codeRequestTooLarge     = "request_too_large"
+	codeUnknownFormat       = "unknown_format"
+	codeRangeNotSatisfiable = "range_not_satisfiable"
+	codeUnauthorized        = "unauthorized"
+	codeCrossSiteRequest    = "cross_site_request"
+	codeFeatureDisabled     = "feature_disabled"
+	codeNetworkNotFound     = "network_not_found"
+	codeProtocolNotFound    = "protocol_not_found"
+	codeSnapshotNotFound    = "snapshot_not_found"
+	codeFileNotFound        = "file_not_found"
+	codeWebhookNotFound     = "webhook_not_found"
+	codeJobNotFound         = "job_not_found"
+	codeJobRunning          = "job_running"
+	codeJobFinished         = "job_finished"
+	codeSnapshotJobNotFound = "snapshot_job_not_found"
+	codeUploadNotFound      = "upload_not_found"
+	codeRouteNotFound       = "route_not_found"
+	codeAlreadyExists       = "already_exists"
+	codeProtocolInUse       = "protocol_in_use"
+	codeContentsUnavailable = "contents_unavailable"
+	codeOverloaded          = "overloaded"
+	codeQuotaExceeded       = "quota_exceeded"
+	codeNotReady            = "not_ready"
+	codeStorageUnavailable  = "storage_unavailable"
+	codeStorageTimeout      = "storage_timeout"
+	codeInternalError       = "internal_error"
+)
+
+// apiError is the body of every error response
+type apiError struct {
+	// Code identifies the kind of error and is stable
+	Code string `json:"code"`
+	// Error describes the error for humans and may change
+	Error string `json:"error"`
+	// RequestID correlates the response with the logs of the request
+	RequestID string `json:"request_id"`
+	// Suggestions are close matches of a protocol/network that was not found
+	Suggestions []string `json:"suggestions,omitempty"`
+	// ValidNetworks are the protocol/network pairs served, when the networks allowlist
+	// doesn't contain the one requested
+	ValidNetworks []string `json:"valid_networks,omitempty"`
+}
+
+// respondError writes an error response with its code and the ID of the request
+func respondError(c *gin.Context, status int, code, message string) {
+	c.JSON(status, apiError{Code: code, Error: message, RequestID: requestID(c)})
+}
+
+// abortWithError writes an error response and stops the handler chain
+func abortWithError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, apiError{Code: code, Error: message, RequestID: requestID(c)})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published on the event bus
+const (
+	eventSnapshotPublished = "snapshot.published"
+	eventSnapshotDeleted   = "snapshot.deleted"
+	eventLatestChanged     = "latest.changed"
+)
+
+// snapshotEvent describes a change in the catalog
+type snapshotEvent struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	Protocol     string    `json:"protocol"`
+	Network      string    `json:"network"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// eventStreamBuffer is how many events a stream buffers before events are dropped for it
+const eventStreamBuffer = 64
+
+// eventSubscriberBuffer is how many events wait for a subscriber before events are
+// dropped for it
+const eventSubscriberBuffer = 256
+
+// eventSubscriber receives the published events in order on its own goroutine
+type eventSubscriber struct {
+	name   string
+	events chan snapshotEvent
+}
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   []*eventSubscriber
+
+	streamsMu sync.Mutex
+	streams   = make(map[chan snapshotEvent]bool)
+)
+
+// subscribeEvents registers fn to be called for every published event, one after
+// the other in the order they were published. fn may block, events published
+// meanwhile are buffered and dropped once the buffer is full.
+func subscribeEvents(name string, fn func(snapshotEvent)) {
+	s := &eventSubscriber{name: name, events: make(chan snapshotEvent, eventSubscriberBuffer)}
+	go func() {
+		for e := range s.events {
+			fn(e)
+		}
+	}()
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers = append(subscribers, s)
+}
+
+// publishEvent hands e to all subscribers
+func publishEvent(e snapshotEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	subscribersMu.RLock()
+	for _, s := range subscribers {
+		select {
+		case s.events <- e:
+		default:
+			eventsDropped.Inc(s.name)
+			logger.Warn("Event dropped, the subscriber does not keep up", "subscriber", s.name, "type", e.Type, "key", e.Key)
+		}
+	}
+	subscribersMu.RUnlock()
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	for ch := range streams {
+		select {
+		case ch <- e:
+		default:
+			// The client does not keep up, drop the event rather than block publishing
+		}
+	}
+}
+
+// openEventStream returns a channel receiving every event published from now on,
+// and a function to close it. The channel is closed when the stream or the
+// server is shut down.
+func openEventStream() (<-chan snapshotEvent, func()) {
+	ch := make(chan snapshotEvent, eventStreamBuffer)
+	streamsMu.Lock()
+	streams[ch] = true
+	streamsMu.Unlock()
+
+	return ch, func() {
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		if streams[ch] {
+			delete(streams, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeEventStreams closes all open event streams so long-lived connections
+// do not hold up a graceful shutdown
+func closeEventStreams() {
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+	for ch := range streams {
+		delete(streams, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultPeerRefresh is used when peer_refresh_seconds is not set in the config
+	defaultPeerRefresh = 5 * time.Minute
+	// peerLatestTTL is how long the latest snapshot of a network hosted by a peer is cached
+	peerLatestTTL = time.Minute
+	// peerTimeout bounds a request to a peer
+	peerTimeout = 10 * time.Second
+	// federatedHeader marks requests between peers, they are answered from the
+	// local catalog only so that peers listing each other don't loop
+	federatedHeader = "X-Snapshot-Federated"
+)
+
+// Peer is another instance of this service whose snapshots are presented in the catalog
+type Peer struct {
+	// Name identifies the provider in the responses, it defaults to the host of URL
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// peerCatalog is the protocol/network directories listed by each peer, by peer name
+type peerCatalog map[string][]string
+
+// peerCatalogs is the last catalog fetched from the peers, nil until the first fetch
+var peerCatalogs atomic.Pointer[peerCatalog]
+
+// peerLatests caches the /latest of the networks only hosted by peers by protocol/network
+var peerLatests sync.Map
+
+type peerLatestItem struct {
+	response latestResponse
+	fetched  time.Time
+}
+
+func (p Peer) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	if u, err := url.Parse(p.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return p.URL
+}
+
+// isFederated reports whether a request comes from a peer
+func isFederated(c *gin.Context) bool {
+	return c.GetHeader(federatedHeader) != ""
+}
+
+// runFederation fetches the catalogs of the peers at the configured interval
+func runFederation() {
+	if len(config.Peers) == 0 {
+		return
+	}
+	interval := time.Duration(config.PeerRefreshSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultPeerRefresh
+	}
+	for ; ; time.Sleep(interval) {
+		refreshPeerCatalogs()
+	}
+}
+
+// refreshPeerCatalogs fetches the catalog of every peer. A peer that fails keeps
+// its previous catalog, so one provider being down doesn't empty the listing.
+func refreshPeerCatalogs() {
+	catalogs := peerCatalog{}
+	if previous := peerCatalogs.Load(); previous != nil {
+		for name, dirs := range *previous {
+			catalogs[name] = dirs
+		}
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range config.Peers {
+		peer := peer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dirs, err := fetchPeerKeys(peer)
+			if err != nil {
+				logger.Warn("Error fetching peer catalog", "peer", peer.name(), "error", err)
+				return
+			}
+			mu.Lock()
+			catalogs[peer.name()] = dirs
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	peerCatalogs.Store(&catalogs)
+}
+
+// fetchPeer GETs path from a peer and decodes its JSON response into v
+func fetchPeer(ctx context.Context, peer Peer, path string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(peer.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(federatedHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchPeerKeys lists all the protocol/network directories of a peer, page by page
+func fetchPeerKeys(peer Peer) ([]string, error) {
+	var dirs []string
+	cursor := ""
+	for {
+		path := "/keys?limit=" + fmt.Sprint(maxPageLimit)
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		var page struct {
+			Dirs       []string `json:"dirs"`
+			NextCursor string   `json:"next_cursor"`
+		}
+		if err := fetchPeer(context.Background(), peer, path, &page); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, page.Dirs...)
+		if page.NextCursor == "" {
+			sort.Strings(dirs)
+			return dirs, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// peerDirs returns the directories listed by the peers, without duplicates
+func peerDirs() []string {
+	catalogs := peerCatalogs.Load()
+	if catalogs == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var dirs []string
+	for _, peerDirs := range *catalogs {
+		for _, dir := range peerDirs {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// mergePeerDirs adds the allowed directories of the peers missing from the local ones
+func mergePeerDirs(dirs []string) []string {
+	local := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		local[dir] = true
+	}
+	for _, dir := range peerDirs() {
+		if !local[dir] && networkAllowed(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// peersHosting returns the peers listing a network, in the configured order
+func peersHosting(protocol, network string) []Peer {
+	catalogs := peerCatalogs.Load()
+	if catalogs == nil {
+		return nil
+	}
+	dir := protocol + "/" + network
+	var peers []Peer
+	for _, peer := range config.Peers {
+		dirs := (*catalogs)[peer.name()]
+		if i := sort.SearchStrings(dirs, dir); i < len(dirs) && dirs[i] == dir {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// peerLatest returns the latest snapshot of a network hosted by the peers, from
+// the first one that has it, cached for peerLatestTTL
+func peerLatest(ctx context.Context, protocol, network string) (latestResponse, bool) {
+	cacheKey := protocol + "/" + network
+	if v, ok := peerLatests.Load(cacheKey); ok && time.Since(v.(peerLatestItem).fetched) < peerLatestTTL {
+		return v.(peerLatestItem).response, true
+	}
+	for _, peer := range peersHosting(protocol, network) {
+		var response latestResponse
+		path := "/files/" + url.PathEscape(protocol) + "/" + url.PathEscape(network) + "/latest"
+		if err := fetchPeer(ctx, peer, path, &response); err != nil {
+			logger.Warn("Error fetching latest snapshot from peer", "peer", peer.name(), "protocol", protocol, "network", network, "error", err)
+			continue
+		}
+		response.Provider = peer.name()
+		peerLatests.Store(cacheKey, peerLatestItem{response: response, fetched: time.Now()})
+		return response, true
+	}
+	return latestResponse{}, false
+}
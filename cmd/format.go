@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// snapshotFormat describes how a snapshot is packed, judged by its file name
+type snapshotFormat struct {
+	// Compression is gzip, zstd, lz4, xz, bzip2, zip or none
+	Compression string
+	// Archive is tar, zip or none
+	Archive string
+	// Extract is the shell command that extracts the snapshot into the current
+	// directory when given its file name, empty if it isn't an archive
+	Extract string
+	// expansion is the typical ratio of extracted to compressed size of chain data
+	expansion float64
+}
+
+// snapshotFormats maps file name suffixes to formats, longest suffixes first
+var snapshotFormats = []struct {
+	suffix string
+	format snapshotFormat
+}{
+	{".tar.gz", snapshotFormat{"gzip", "tar", "tar -xzf", 2.5}},
+	{".tgz", snapshotFormat{"gzip", "tar", "tar -xzf", 2.5}},
+	{".tar.zst", snapshotFormat{"zstd", "tar", "tar --use-compress-program=unzstd -xf", 3}},
+	{".tar.zstd", snapshotFormat{"zstd", "tar", "tar --use-compress-program=unzstd -xf", 3}},
+	{".tar.lz4", snapshotFormat{"lz4", "tar", "tar --use-compress-program=unlz4 -xf", 2}},
+	{".tar.xz", snapshotFormat{"xz", "tar", "tar -xJf", 3.5}},
+	{".tar.bz2", snapshotFormat{"bzip2", "tar", "tar -xjf", 3}},
+	{".tar", snapshotFormat{"none", "tar", "tar -xf", 1}},
+	{".zip", snapshotFormat{"zip", "zip", "unzip -o", 2.5}},
+}
+
+// detectFormat returns the format of a snapshot from its file name
+func detectFormat(filename string) snapshotFormat {
+	name := strings.ToLower(filename)
+	for _, f := range snapshotFormats {
+		if strings.HasSuffix(name, f.suffix) {
+			return f.format
+		}
+	}
+	return snapshotFormat{Compression: "none", Archive: "none", expansion: 1}
+}
+
+// fileExtension returns the extension of a snapshot file name, both parts of
+// double extensions like .tar.zst
+func fileExtension(filename string) string {
+	name := strings.ToLower(filename)
+	for _, f := range snapshotFormats {
+		if strings.HasSuffix(name, f.suffix) {
+			return f.suffix
+		}
+	}
+	return path.Ext(name)
+}
+
+// snapshotTypes are the kinds of snapshots, recognized by a word of the file name
+var snapshotTypes = []string{"archive", "pruned", "full", "light", "state"}
+
+// snapshotType returns the kind of a snapshot inferred from its file name, e.g.
+// "pruned" for mainnet-pruned-2024-01-01.tar.zst, or "unknown"
+func snapshotType(filename string) string {
+	words := strings.FieldsFunc(strings.ToLower(path.Base(filename)), func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < '0' || r > '9')
+	})
+	for _, word := range words {
+		for _, t := range snapshotTypes {
+			if word == t {
+				return t
+			}
+		}
+	}
+	return "unknown"
+}
+
+// estimatedDiskBytes is the disk space needed to download and extract a snapshot
+// of size bytes, the archive is only removed once it is extracted
+func (f snapshotFormat) estimatedDiskBytes(size int64) int64 {
+	if f.Archive == "none" {
+		return size
+	}
+	return size + int64(float64(size)*f.expansion)
+}
+
+// checksumCache holds the SHA-256 of snapshots by key and ETag, "" when none is
+// published. A new upload under the same key changes the ETag.
+var checksumCache sync.Map
+
+// snapshotSHA256 returns the SHA-256 of a snapshot if it is published, see objectSHA256
+func snapshotSHA256(ctx context.Context, svc s3iface.S3API, object *s3.Object) (string, error) {
+	cacheKey := aws.StringValue(object.Key) + "\x00" + aws.StringValue(object.ETag)
+	if v, ok := checksumCache.Load(cacheKey); ok {
+		return v.(string), nil
+	}
+	svc, bucket := keyClient(svc, aws.StringValue(object.Key))
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    object.Key,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := objectSHA256(ctx, aws.StringValue(object.Key), head)
+	checksumCache.Store(cacheKey, sum)
+	return sum, nil
+}
+
+// compressionAliases maps the names accepted by ?format= to compressions
+var compressionAliases = map[string]string{
+	"zst": "zstd", "zstd": "zstd",
+	"lz4": "lz4",
+	"gz":  "gzip", "gzip": "gzip", "tgz": "gzip",
+	"xz":  "xz",
+	"bz2": "bzip2", "bzip2": "bzip2",
+	"zip":  "zip",
+	"none": "none", "tar": "none",
+}
+
+// parseCompression returns the compression named by a ?format= value
+func parseCompression(format string) (string, bool) {
+	compression, ok := compressionAliases[strings.ToLower(format)]
+	return compression, ok
+}
+
+// compressionMagic are the leading bytes of the compressions, tar is recognized
+// by the "ustar" magic of its first header at offset 257
+var compressionMagic = []struct {
+	magic       string
+	compression string
+}{
+	{"\x1f\x8b", "gzip"},
+	{"\x28\xb5\x2f\xfd", "zstd"},
+	{"\x04\x22\x4d\x18", "lz4"},
+	{"\xfd7zXZ\x00", "xz"},
+	{"BZh", "bzip2"},
+	{"PK\x03\x04", "zip"},
+}
+
+// sniffedCompressions caches the compression read from the first bytes of
+// snapshots by key and ETag, "" if it wasn't recognized
+var sniffedCompressions sync.Map
+
+// nameCompression returns the compression of a snapshot from its file name, "unknown" if the name doesn't tell
+func nameCompression(key string) string {
+	if f := detectFormat(key); f.Archive != "none" {
+		return f.Compression
+	}
+	return "unknown"
+}
+
+// snapshotCompression returns the compression of a snapshot from its file name,
+// or from its first bytes if the name doesn't tell
+func snapshotCompression(ctx context.Context, svc s3iface.S3API, object *s3.Object) string {
+	if compression := nameCompression(*object.Key); compression != "unknown" {
+		return compression
+	}
+	cacheKey := aws.StringValue(object.Key) + "\x00" + aws.StringValue(object.ETag)
+	if v, ok := sniffedCompressions.Load(cacheKey); ok {
+		return v.(string)
+	}
+	svc, bucket := keyClient(svc, *object.Key)
+	out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    object.Key,
+		Range:  aws.String("bytes=0-261"),
+	})
+	if err != nil {
+		logger.Warn("Error reading snapshot to detect its compression", "key", *object.Key, "error", err)
+		return "unknown"
+	}
+	defer out.Body.Close()
+	head, _ := io.ReadAll(io.LimitReader(out.Body, 262))
+
+	compression := "unknown"
+	for _, m := range compressionMagic {
+		if strings.HasPrefix(string(head), m.magic) {
+			compression = m.compression
+			break
+		}
+	}
+	if compression == "unknown" && len(head) >= 262 && string(head[257:262]) == "ustar" {
+		compression = "none"
+	}
+	sniffedCompressions.Store(cacheKey, compression)
+	return compression
+}
+
+// findLatestCompression returns the latest snapshot of a network in the given compression
+func findLatestCompression(ctx context.Context, svc s3iface.S3API, protocol, network, compression string) (*s3.Object, error) {
+	prefix := protocol + "/" + network + "/"
+	v, err := sharedStorageCall(ctx, "list:"+prefix, func(ctx context.Context) (interface{}, error) {
+		return listObjects(ctx, storageClient(), prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Sorted by key, and the snapshots are named with a timestamp prefix
+	objects := snapshotObjects(v.([]*s3.Object))
+	for i := len(objects) - 1; i >= 0; i-- {
+		if snapshotCompression(ctx, svc, objects[i]) == compression {
+			return objects[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// filterCompression returns the files of a listing in the given compression
+func filterCompression(ctx context.Context, files []map[string]interface{}, compression string) []map[string]interface{} {
+	svc := storageClient()
+	filtered := make([]map[string]interface{}, 0, len(files))
+	for _, f := range files {
+		c, _ := f["compression"].(string)
+		if c == "unknown" {
+			c = snapshotCompression(ctx, svc, &s3.Object{Key: aws.String(f["filename"].(string))})
+		}
+		if c == compression {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
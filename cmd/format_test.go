@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileExtension(t *testing.T) {
+	tests := map[string]string{
+		"nimiq/mainnet/2024-01-01.tar.zst": ".tar.zst",
+		"nimiq/mainnet/2024-01-01.TAR.GZ":  ".tar.gz",
+		"nimiq/mainnet/2024-01-01.tgz":     ".tgz",
+		"nimiq/mainnet/2024-01-01.db":      ".db",
+		"nimiq/mainnet/2024-01-01":         "",
+	}
+	for name, want := range tests {
+		if got := fileExtension(name); got != want {
+			t.Errorf("fileExtension(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSnapshotType(t *testing.T) {
+	tests := map[string]string{
+		"ethereum/mainnet/mainnet-pruned-2024-01-01.tar.zst": "pruned",
+		"ethereum/mainnet/archive_2024-01-01.tar.lz4":        "archive",
+		"cosmos/hub/2024-01-01.FULL.tar.gz":                  "full",
+		"ethereum/mainnet/state.tar":                         "state",
+		// Words are matched whole
+		"ethereum/fullnode/2024-01-01.tar.zst": "unknown",
+		"nimiq/mainnet/2024-01-01.tar.zst":     "unknown",
+	}
+	for name, want := range tests {
+		if got := snapshotType(name); got != want {
+			t.Errorf("snapshotType(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLatestDerivedFields(t *testing.T) {
+	r, storage := newTestAPI(t)
+	modified := time.Now().Add(-time.Hour).In(time.FixedZone("CEST", 2*60*60))
+	storage.put("nimiq/mainnet/2024-03-01-pruned.tar.zst", string(make([]byte, 1536)), modified)
+
+	var latest latestResponse
+	decode(t, serve(r, "GET", "/files/nimiq/mainnet/latest", "", false), &latest)
+	if latest.SizeHuman != "1.5 KiB" || latest.Extension != ".tar.zst" || latest.Type != "pruned" {
+		t.Errorf("size_human %q, extension %q, type %q", latest.SizeHuman, latest.Extension, latest.Type)
+	}
+	if latest.AgeSeconds == nil || *latest.AgeSeconds < 3600 || *latest.AgeSeconds > 3660 {
+		t.Errorf("age_seconds %v, want about an hour", latest.AgeSeconds)
+	}
+	if latest.LastModified.Location() != time.UTC {
+		t.Errorf("last_modified %s is not in UTC", latest.LastModified)
+	}
+}
+
+func TestObjectAgeUnknown(t *testing.T) {
+	if _, ok := objectAgeSeconds(nil, time.Now()); ok {
+		t.Error("age of an object without last modified")
+	}
+	if _, ok := objectAgeSeconds(&time.Time{}, time.Now()); ok {
+		t.Error("age of an object with a zero last modified")
+	}
+	idx := &inventoryIndex{objects: []inventoryObject{{key: "nimiq/mainnet/2024-01-01.tar.zst", size: 1}}}
+	if objects := idx.list("nimiq/"); len(objects) != 1 || objects[0].LastModified != nil {
+		t.Errorf("inventory row without a date listed as %v", objects)
+	}
+}
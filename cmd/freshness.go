@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// defaultInfoCacheTTL is used when info_cache_ttl_seconds is not set in the config
+const defaultInfoCacheTTL = 10 * time.Second
+
+// infoCacheTTL returns how long a memoized snapshot info is served without a HEAD
+func infoCacheTTL() time.Duration {
+	if config.InfoCacheTTLSeconds > 0 {
+		return time.Duration(config.InfoCacheTTLSeconds) * time.Second
+	}
+	return defaultInfoCacheTTL
+}
+
+// defaultFreshnessCheckInterval is used when freshness_check_interval_seconds is not set in the config
+const defaultFreshnessCheckInterval = time.Minute
+
+// expectedInterval returns how often a new snapshot of a network is expected to
+// be published, falling back to the "*" entry for unlisted networks
+func expectedInterval(protocol, network string) (time.Duration, bool) {
+	if n, ok := lookupRegisteredNetwork(protocol, network); ok && n.ExpectedIntervalSeconds > 0 {
+		return time.Duration(n.ExpectedIntervalSeconds) * time.Second, true
+	}
+	seconds, ok := config.ExpectedIntervalSeconds[protocol+"/"+network]
+	if !ok {
+		seconds, ok = config.ExpectedIntervalSeconds["*"]
+	}
+	return time.Duration(seconds) * time.Second, ok
+}
+
+// monitorFreshness looks up the latest snapshot of every network on the background
+// worker pool at a fixed interval, keeping the freshness metrics current even for
+// networks nobody requests, unless the freshness-check job is scheduled
+func monitorFreshness() {
+	if jobScheduled("freshness-check") {
+		return
+	}
+	interval := time.Duration(config.FreshnessCheckIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultFreshnessCheckInterval
+	}
+
+	for ; ; time.Sleep(interval) {
+		networks, err := discoverNetworks(context.Background())
+		if err != nil {
+			logger.Error("Freshness check failed to discover networks", "error", err)
+			continue
+		}
+		for _, n := range networks {
+			protocol, network, _ := strings.Cut(n, "/")
+			backgroundJobs.Submit(func() {
+				checkFreshness(protocol, network)
+			})
+		}
+	}
+}
+
+// checkFreshness updates the freshness metrics of a network and fires staleness alerts
+func checkFreshness(protocol, network string) {
+	latest, err := findLatest(context.Background(), protocol, network)
+	if err != nil {
+		logger.Warn("Freshness check failed", "protocol", protocol, "network", network, "error", err)
+		return
+	}
+	// Without the time of the upload the freshness is unknown
+	if latest == nil || latest.LastModified == nil || latest.LastModified.IsZero() {
+		return
+	}
+
+	evaluateStaleness(protocol, network, latest)
+
+	interval, ok := expectedInterval(protocol, network)
+	if !ok {
+		return
+	}
+	age := time.Since(*latest.LastModified)
+	snapshotExpectedInterval.Set(interval.Seconds(), protocol, network)
+	overdue := 0.0
+	if age > interval {
+		overdue = 1
+	}
+	snapshotOverdue.Set(overdue, protocol, network)
+}
+
+// staleThreshold returns the age after which the snapshots of a network are
+// considered stale, falling back to the "*" entry for unlisted networks
+func staleThreshold(protocol, network string) (time.Duration, bool) {
+	seconds, ok := config.StaleAfterSeconds[protocol+"/"+network]
+	if !ok {
+		seconds, ok = config.StaleAfterSeconds["*"]
+	}
+	return time.Duration(seconds) * time.Second, ok
+}
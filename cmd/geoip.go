@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// continentCountries lists the ISO 3166 country codes of every continent, so that
+// mirrors can serve a whole continent
+var continentCountries = map[string]string{
+	"AF": "AO BF BI BJ BW CD CF CG CI CM CV DJ DZ EG EH ER ET GA GH GM GN GQ GW KE KM LR LS LY MA MG ML MR MU MW MZ NA NE NG RE RW SC SD SH SL SN SO SS ST SZ TD TG TN TZ UG YT ZA ZM ZW",
+	"AN": "AQ BV GS HM TF",
+	"AS": "AE AF AM AZ BD BH BN BT CC CN CX GE HK ID IL IN IO IQ IR JO JP KG KH KP KR KW KZ LA LB LK MM MN MO MV MY NP OM PH PK PS QA SA SG SY TH TJ TL TM TR TW UZ VN YE",
+	"EU": "AD AL AT AX BA BE BG BY CH CY CZ DE DK EE ES FI FO FR GB GG GI GR HR HU IE IM IS IT JE LI LT LU LV MC MD ME MK MT NL NO PL PT RO RS RU SE SI SJ SK SM UA VA XK",
+	"NA": "AG AI AW BB BL BM BQ BS BZ CA CR CU CW DM DO GD GL GP GT HN HT JM KN KY LC MF MQ MS MX NI PA PM PR SV SX TC TT US VC VG VI",
+	"OC": "AS AU CK FJ FM GU KI MH MP NC NF NR NU NZ PF PG PN PW SB TK TO TV UM VU WF WS",
+	"SA": "AR BO BR CL CO EC FK GF GY PE PY SR UY VE",
+}
+
+// countryContinent maps a country code to the code of its continent
+var countryContinent = func() map[string]string {
+	m := make(map[string]string)
+	for continent, countries := range continentCountries {
+		for _, country := range strings.Fields(countries) {
+			m[country] = continent
+		}
+	}
+	return m
+}()
+
+// countryHeaders carry the country of the client when the API is behind a CDN that
+// looks it up, they are trusted over the GeoIP database
+var countryHeaders = []string{"CloudFront-Viewer-Country", "CF-IPCountry"}
+
+// geoRange is a range of addresses located in a country
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// geoIP is the loaded GeoIP database sorted by start address, nil if none is configured
+var geoIP []geoRange
+
+// loadGeoIP reads a GeoIP database in the "start,end,country" CSV format of the
+// DB-IP and IP2Location country lite databases
+func loadGeoIP(path string) ([]geoRange, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	var ranges []geoRange
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected start,end,country", path, line)
+		}
+		start, err := netip.ParseAddr(record[0])
+		if err != nil {
+			// A header line
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		end, err := netip.ParseAddr(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ranges = append(ranges, geoRange{start: start.Unmap(), end: end.Unmap(), country: strings.ToUpper(record[2])})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	return ranges, nil
+}
+
+// lookupCountry returns the country of an address in the GeoIP database
+func lookupCountry(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	// The last range starting at or before the address
+	i := sort.Search(len(geoIP), func(i int) bool { return addr.Less(geoIP[i].start) }) - 1
+	if i < 0 || geoIP[i].end.Less(addr) {
+		return "", false
+	}
+	return geoIP[i].country, true
+}
+
+// clientCountry returns the country code of the client, from the CDN in front of
+// the API or the GeoIP database
+func clientCountry(c *gin.Context) (string, bool) {
+	for _, header := range countryHeaders {
+		// "XX" is used by the CDNs for unknown countries
+		if country := strings.ToUpper(c.GetHeader(header)); len(country) == 2 && country != "XX" {
+			return country, true
+		}
+	}
+	addr, err := netip.ParseAddr(c.ClientIP())
+	if err != nil {
+		return "", false
+	}
+	return lookupCountry(addr)
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// This file implements the subset of GraphQL the catalog needs: queries with
+// field selection, aliases, arguments and variables. Fragments, directives and
+// mutations are not supported.
+
+// gqlField is a field of a selection set
+type gqlField struct {
+	Alias     string
+	Name      string
+	Args      map[string]interface{}
+	Selection []gqlField
+}
+
+// gqlVariable is a reference to a variable in an argument
+type gqlVariable string
+
+// gqlOperation is a parsed query operation
+type gqlOperation struct {
+	Name      string
+	Defaults  map[string]interface{}
+	Selection []gqlField
+}
+
+// gqlError is an error in the errors list of a response
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlObject is a value with fields that are resolved on demand
+type gqlObject interface {
+	typeName() string
+	resolve(ctx context.Context, field string, args map[string]interface{}) (interface{}, error)
+}
+
+// Limits of a GraphQL request. The parser recurses into selection sets, list and
+// object values and list types, so the nesting has to be bounded before the stack
+// is, and the cost bounds the storage calls and presigns a query can make.
+const (
+	maxGraphQLBodyBytes = 64 << 10
+	maxGraphQLDepth     = 12
+	maxGraphQLCost      = 5000
+	// graphQLListCost is the number of items a list field is assumed to return
+	// when the query doesn't limit it
+	graphQLListCost = 10
+	// maxGraphQLResolves bounds the fields resolved for one query, whatever the
+	// lists turn out to hold
+	maxGraphQLResolves = 10000
+)
+
+// gqlParser is a recursive descent parser over a query document
+type gqlParser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func (p *gqlParser) skip() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ',' || unicode.IsSpace(rune(c)):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *gqlParser) peek() byte {
+	p.skip()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// enter descends one nesting level, leave must be called when the level ends
+func (p *gqlParser) enter() error {
+	p.depth++
+	if p.depth > maxGraphQLDepth {
+		return p.errorf("the query is nested deeper than %d levels", maxGraphQLDepth)
+	}
+	return nil
+}
+
+func (p *gqlParser) leave() {
+	p.depth--
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func (p *gqlParser) name() (string, error) {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) && isNameByte(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+// parseQuery parses a document and returns the operation named operationName,
+// or its only operation
+func parseQuery(query, operationName string) (*gqlOperation, error) {
+	p := &gqlParser{src: query}
+	var ops []*gqlOperation
+	for p.peek() != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	for _, op := range ops {
+		if op.Name == operationName || operationName == "" && len(ops) == 1 {
+			return op, nil
+		}
+	}
+	if operationName == "" {
+		return nil, fmt.Errorf("the document must contain exactly one operation or operationName must be set")
+	}
+	return nil, fmt.Errorf("unknown operation %q", operationName)
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{Defaults: map[string]interface{}{}}
+	if p.peek() != '{' {
+		kind, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if kind != "query" {
+			return nil, fmt.Errorf("%s operations are not supported", kind)
+		}
+		if isNameByte(p.peek(), true) {
+			if op.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if p.peek() == '(' {
+			if err := p.variableDefinitions(op); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var err error
+	op.Selection, err = p.selectionSet()
+	return op, err
+}
+
+// variableDefinitions parses ($name: Type = default, ...). Types are not checked,
+// only the defaults are kept.
+func (p *gqlParser) variableDefinitions(op *gqlOperation) error {
+	p.pos++
+	for p.peek() != ')' {
+		if err := p.expect('$'); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(':'); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if p.peek() == '=' {
+			p.pos++
+			if op.Defaults[name], err = p.value(); err != nil {
+				return err
+			}
+		}
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) skipType() error {
+	if err := p.enter(); err != nil {
+		return err
+	}
+	defer p.leave()
+	if p.peek() == '[' {
+		p.pos++
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect(']'); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peek() == '!' {
+		p.pos++
+	}
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	var fields []gqlField
+	for p.peek() != '}' {
+		if p.peek() == 0 {
+			return nil, p.errorf("unterminated selection set")
+		}
+		if p.peek() == '.' {
+			return nil, p.errorf("fragments are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	p.pos++
+	return fields, nil
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	var f gqlField
+	name, err := p.name()
+	if err != nil {
+		return f, err
+	}
+	f.Alias, f.Name = name, name
+	if p.peek() == ':' {
+		p.pos++
+		if f.Name, err = p.name(); err != nil {
+			return f, err
+		}
+	}
+	if p.peek() == '(' {
+		p.pos++
+		f.Args = map[string]interface{}{}
+		for p.peek() != ')' {
+			arg, err := p.name()
+			if err != nil {
+				return f, err
+			}
+			if err := p.expect(':'); err != nil {
+				return f, err
+			}
+			if f.Args[arg], err = p.value(); err != nil {
+				return f, err
+			}
+		}
+		p.pos++
+	}
+	if p.peek() == '@' {
+		return f, p.errorf("directives are not supported")
+	}
+	if p.peek() == '{' {
+		f.Selection, err = p.selectionSet()
+	}
+	return f, err
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '$':
+		p.pos++
+		name, err := p.name()
+		return gqlVariable(name), err
+	case c == '"':
+		return p.stringValue()
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		if n, err := strconv.ParseInt(p.src[start:p.pos], 10, 64); err == nil {
+			return n, nil
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return n, nil
+	case c == '[':
+		p.pos++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		list := []interface{}{}
+		for p.peek() != ']' {
+			if p.peek() == 0 {
+				return nil, p.errorf("unterminated list")
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.pos++
+		return list, nil
+	case c == '{':
+		p.pos++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		obj := map[string]interface{}{}
+		for p.peek() != '}' {
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			if obj[key], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+		return obj, nil
+	default:
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// Enum values are passed on as strings
+		return name, nil
+	}
+}
+
+func (p *gqlParser) stringValue() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) && p.src[p.pos] != '"' {
+		if p.src[p.pos] == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		return "", p.errorf("unterminated string")
+	}
+	p.pos++
+	// GraphQL string escapes are a subset of JSON's
+	var s string
+	if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+		return "", p.errorf("invalid string")
+	}
+	return s, nil
+}
+
+// gqlResult is a JSON object keeping its fields in selection order
+type gqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r *gqlResult) set(key string, v interface{}) {
+	if _, ok := r.values[key]; !ok {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = v
+}
+
+func (r *gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(r.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlExecutor resolves a selection against an object
+type gqlExecutor struct {
+	// ctx is the context of the request, the storage calls of resolvers are made with it
+	ctx       context.Context
+	variables map[string]interface{}
+	errors    []gqlError
+	// resolved counts the fields resolved so far, up to maxGraphQLResolves
+	resolved int
+}
+
+// gqlListFields are the fields of the schema returning lists, with the argument
+// limiting their length if they have one
+var gqlListFields = map[string]string{"protocols": "", "networks": "", "snapshots": "limit"}
+
+// cost estimates the fields resolving a selection takes: every field counts one,
+// and the selection of a list field counts once per item it is assumed to hold.
+// The estimate stops growing once it passes maxGraphQLCost.
+func (e *gqlExecutor) cost(selection []gqlField) int64 {
+	var cost int64
+	for _, f := range selection {
+		items := int64(1)
+		if limitArg, ok := gqlListFields[f.Name]; ok {
+			items = graphQLListCost
+			if limitArg != "" {
+				if n, ok, err := intArg(e.args(f.Args), limitArg); err == nil && ok && n >= 0 {
+					items = min(n, maxGraphQLCost+1)
+				}
+			}
+		}
+		cost += 1 + items*e.cost(f.Selection)
+		if cost > maxGraphQLCost {
+			return cost
+		}
+	}
+	return cost
+}
+
+func (e *gqlExecutor) args(args map[string]interface{}) map[string]interface{} {
+	resolved := make(map[string]interface{}, len(args))
+	for k, v := range args {
+		if name, ok := v.(gqlVariable); ok {
+			v = e.variables[string(name)]
+		}
+		resolved[k] = v
+	}
+	return resolved
+}
+
+func (e *gqlExecutor) object(obj gqlObject, selection []gqlField, path []interface{}) *gqlResult {
+	result := &gqlResult{values: map[string]interface{}{}}
+	for _, f := range selection {
+		fieldPath := append(append([]interface{}{}, path...), f.Alias)
+		if f.Name == "__typename" {
+			result.set(f.Alias, obj.typeName())
+			continue
+		}
+		if e.resolved++; e.resolved > maxGraphQLResolves {
+			if e.resolved == maxGraphQLResolves+1 {
+				e.errors = append(e.errors, gqlError{Message: fmt.Sprintf("the query resolves more than %d fields", maxGraphQLResolves), Path: fieldPath})
+			}
+			result.set(f.Alias, nil)
+			continue
+		}
+		v, err := obj.resolve(e.ctx, f.Name, e.args(f.Args))
+		if err != nil {
+			e.errors = append(e.errors, gqlError{Message: err.Error(), Path: fieldPath})
+			result.set(f.Alias, nil)
+			continue
+		}
+		result.set(f.Alias, e.value(v, f, fieldPath))
+	}
+	return result
+}
+
+func (e *gqlExecutor) value(v interface{}, f gqlField, path []interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch v := v.(type) {
+	case gqlObject:
+		if len(f.Selection) == 0 {
+			e.errors = append(e.errors, gqlError{Message: fmt.Sprintf("field %q of type %s must have a selection of subfields", f.Name, v.typeName()), Path: path})
+			return nil
+		}
+		return e.object(v, f.Selection, path)
+	case []gqlObject:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.value(item, f, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	default:
+		if len(f.Selection) > 0 {
+			e.errors = append(e.errors, gqlError{Message: fmt.Sprintf("field %q is a scalar and can't have subfields", f.Name), Path: path})
+			return nil
+		}
+		return v
+	}
+}
+
+// graphQLRequest is the body of a GraphQL POST request
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// respondGraphQLError rejects a query that can't be executed, in the GraphQL error
+// format with the code and request ID of the other error responses alongside
+func respondGraphQLError(c *gin.Context, err error) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"errors":     []gqlError{{Message: err.Error()}},
+		"code":       codeInvalidQuery,
+		"request_id": requestID(c),
+	})
+}
+
+// @Summary GraphQL query
+// @Description Query protocols, networks and snapshots with field selection and filters in one request
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} map[string]interface{}
+// @Router /graphql [post]
+func graphQL(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxGraphQLBodyBytes)
+	var req graphQLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(c, http.StatusRequestEntityTooLarge, codeRequestTooLarge, fmt.Sprintf("the request body is larger than %d bytes", maxGraphQLBodyBytes))
+			return
+		}
+		respondGraphQLError(c, err)
+		return
+	}
+	op, err := parseQuery(req.Query, req.OperationName)
+	if err != nil {
+		respondGraphQLError(c, err)
+		return
+	}
+
+	variables := op.Defaults
+	for k, v := range req.Variables {
+		variables[k] = v
+	}
+	e := &gqlExecutor{ctx: withRequestID(c.Request.Context(), c), variables: variables}
+	if cost := e.cost(op.Selection); cost > maxGraphQLCost {
+		respondGraphQLError(c, fmt.Errorf("the query is too expensive, its estimated cost is above %d: limit the snapshots and select fewer fields", maxGraphQLCost))
+		return
+	}
+	data := e.object(queryRoot{}, op.Selection, nil)
+
+	response := gin.H{"data": data}
+	if len(e.errors) > 0 {
+		response["errors"] = e.errors
+	}
+	c.JSON(http.StatusOK, response)
+}
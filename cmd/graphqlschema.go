@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The GraphQL schema of the catalog:
+//
+//	type Query {
+//	  protocols: [Protocol!]!
+//	  protocol(name: String!): Protocol!
+//	  network(protocol: String!, name: String!): Network!
+//	}
+//	type Protocol { name: String!  networks(name: String): [Network!]! }
+//	type Network {
+//	  protocol: String!  name: String!  snapshotCount: Int!
+//	  latest: Snapshot  info: JSON
+//	  snapshots(limit: Int, after: String, contains: String, since: String,
+//	            until: String, minSize: Int, order: String): [Snapshot!]!
+//	}
+//	type Snapshot { key: String!  filename: String!  size: Int!  lastModified: String  url: String!  cdnUrl: String }
+
+func stringArg(args map[string]interface{}, name string, required bool) (string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		if required {
+			return "", fmt.Errorf("argument %q is required", name)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %q must be a string", name)
+	}
+	return s, nil
+}
+
+func intArg(args map[string]interface{}, name string) (int64, bool, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return 0, false, nil
+	case int64:
+		return v, true, nil
+	case float64:
+		// Variables are decoded from JSON as floats
+		if v != float64(int64(v)) {
+			return 0, false, fmt.Errorf("argument %q must be an integer", name)
+		}
+		return int64(v), true, nil
+	default:
+		return 0, false, fmt.Errorf("argument %q must be an integer", name)
+	}
+}
+
+func timeArg(args map[string]interface{}, name string) (time.Time, error) {
+	s, err := stringArg(args, name, false)
+	if err != nil || s == "" {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("argument %q must be an RFC 3339 time", name)
+	}
+	return t, nil
+}
+
+func unknownField(typeName, field string) error {
+	return fmt.Errorf("cannot query field %q on type %s", field, typeName)
+}
+
+// listPrefixNames returns the names directly below prefix
+func listPrefixNames(ctx context.Context, prefix string) ([]string, error) {
+	v, err := sharedStorageCall(ctx, "prefixes:"+prefix, func(ctx context.Context) (interface{}, error) {
+		return listCommonPrefixes(ctx, storageClient(), prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefixes := v.([]string)
+	names := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		names[i] = strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+	}
+	return names, nil
+}
+
+type queryRoot struct{}
+
+func (queryRoot) typeName() string { return "Query" }
+
+func (queryRoot) resolve(ctx context.Context, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "protocols":
+		names, err := listPrefixNames(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		protocols := make([]gqlObject, len(names))
+		for i, name := range names {
+			protocols[i] = protocolNode{name: name}
+		}
+		return protocols, nil
+	case "protocol":
+		name, err := stringArg(args, "name", true)
+		return protocolNode{name: name}, err
+	case "network":
+		protocol, err := stringArg(args, "protocol", true)
+		if err != nil {
+			return nil, err
+		}
+		name, err := stringArg(args, "name", true)
+		return networkNode{protocol: protocol, name: name}, err
+	}
+	return nil, unknownField("Query", field)
+}
+
+type protocolNode struct {
+	name string
+}
+
+func (protocolNode) typeName() string { return "Protocol" }
+
+func (p protocolNode) resolve(ctx context.Context, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "name":
+		return p.name, nil
+	case "networks":
+		only, err := stringArg(args, "name", false)
+		if err != nil {
+			return nil, err
+		}
+		names, err := listPrefixNames(ctx, p.name+"/")
+		if err != nil {
+			return nil, err
+		}
+		networks := []gqlObject{}
+		for _, name := range names {
+			if only == "" || name == only {
+				networks = append(networks, networkNode{protocol: p.name, name: name})
+			}
+		}
+		return networks, nil
+	}
+	return nil, unknownField("Protocol", field)
+}
+
+type networkNode struct {
+	protocol, name string
+}
+
+func (networkNode) typeName() string { return "Network" }
+
+func (n networkNode) resolve(ctx context.Context, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "protocol":
+		return n.protocol, nil
+	case "name":
+		return n.name, nil
+	case "snapshotCount":
+		files, err := loadFiles(ctx, n.protocol, n.name)
+		return len(files), err
+	case "latest":
+		latest, err := findLatest(ctx, n.protocol, n.name)
+		if err != nil || latest == nil {
+			return nil, err
+		}
+		return snapshotNode{key: *latest.Key, size: *latest.Size, lastModified: latest.LastModified}, nil
+	case "info":
+		v, err := sharedStorageCall(ctx, "info:"+n.protocol+"/"+n.name, func(ctx context.Context) (interface{}, error) {
+			return loadSnapshotInfo(ctx, n.protocol, n.name)
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return v.(infoCacheItem).content, nil
+	case "snapshots":
+		return n.snapshots(ctx, args)
+	}
+	return nil, unknownField("Network", field)
+}
+
+func (n networkNode) snapshots(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	limit, hasLimit, err := intArg(args, "limit")
+	if err != nil {
+		return nil, err
+	}
+	minSize, _, err := intArg(args, "minSize")
+	if err != nil {
+		return nil, err
+	}
+	after, err := stringArg(args, "after", false)
+	if err != nil {
+		return nil, err
+	}
+	contains, err := stringArg(args, "contains", false)
+	if err != nil {
+		return nil, err
+	}
+	order, err := stringArg(args, "order", false)
+	if err != nil {
+		return nil, err
+	}
+	if order != "" && order != "asc" && order != "desc" {
+		return nil, fmt.Errorf("argument \"order\" must be asc or desc")
+	}
+	since, err := timeArg(args, "since")
+	if err != nil {
+		return nil, err
+	}
+	until, err := timeArg(args, "until")
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := loadFiles(ctx, n.protocol, n.name)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []gqlObject{}
+	for _, f := range snapshotFiles(files) {
+		s := snapshotNode{key: f["filename"].(string), size: f["size"].(int64)}
+		s.lastModified, _ = f["last_modified"].(*time.Time)
+		if after != "" && s.key <= after || contains != "" && !strings.Contains(path.Base(s.key), contains) || s.size < minSize {
+			continue
+		}
+		if s.lastModified != nil && (!since.IsZero() && s.lastModified.Before(since) || !until.IsZero() && !s.lastModified.Before(until)) {
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if order == "desc" {
+			return snapshots[i].(snapshotNode).key > snapshots[j].(snapshotNode).key
+		}
+		return snapshots[i].(snapshotNode).key < snapshots[j].(snapshotNode).key
+	})
+	if hasLimit && limit >= 0 && int64(len(snapshots)) > limit {
+		snapshots = snapshots[:limit]
+	}
+	return snapshots, nil
+}
+
+type snapshotNode struct {
+	key          string
+	size         int64
+	lastModified *time.Time
+}
+
+func (snapshotNode) typeName() string { return "Snapshot" }
+
+func (s snapshotNode) resolve(ctx context.Context, field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "key":
+		return s.key, nil
+	case "filename":
+		return path.Base(s.key), nil
+	case "size":
+		return s.size, nil
+	case "lastModified":
+		if s.lastModified == nil {
+			return nil, nil
+		}
+		return s.lastModified.UTC().Format(time.RFC3339), nil
+	case "url", "cdnUrl":
+		protocol, rest, _ := strings.Cut(s.key, "/")
+		network, _, _ := strings.Cut(rest, "/")
+		origin, cdn, err := downloadURLs(storageClient(), s.key, presignTTL("/graphql", protocol, network, defaultListingPresignTTL))
+		if field == "url" || err != nil {
+			return origin, err
+		}
+		if cdn == "" {
+			return nil, nil
+		}
+		return cdn, nil
+	}
+	return nil, unknownField("Snapshot", field)
+}
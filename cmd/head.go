@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// jsonContentType is the content type of JSON responses
+const jsonContentType = "application/json; charset=utf-8"
+
+// isHead reports whether c is a HEAD request. HEAD requests are answered from the
+// caches or the HEAD of a single object, never by listing the bucket, presigning
+// URLs or generating derived files.
+func isHead(c *gin.Context) bool {
+	return c.Request.Method == http.MethodHead
+}
+
+// respondHead answers a HEAD request with the status and content type of the GET
+func respondHead(c *gin.Context, status int, contentType string) {
+	c.Header("Content-Type", contentType)
+	c.Status(status)
+}
+
+// respondListingHead answers a HEAD request of a listing. Listings of networks
+// without files are empty rather than missing, so they are always there.
+func respondListingHead(c *gin.Context) {
+	c.Writer.Header().Add("Vary", "Accept")
+	mediaType, h := listingEncoding(c)
+	if h == nil {
+		mediaType = jsonContentType
+	}
+	respondHead(c, http.StatusOK, mediaType)
+}
+
+// respondDerivedHead answers a HEAD request of a file built from the derived file
+// at path without generating it: like the GET once it is generated, 202 before
+func respondDerivedHead(c *gin.Context, path, what, contentType string) {
+	if _, err := os.Stat(path); err != nil {
+		respondDerivedPending(c, what)
+		return
+	}
+	respondHead(c, http.StatusOK, contentType)
+}
+
+// cachedHasSnapshots reports whether a network has snapshots going by the caches
+// alone. known is false if the caches don't tell.
+func cachedHasSnapshots(protocol, network string) (found, known bool) {
+	prefix := fmt.Sprintf("%s/%s/", protocol, network)
+	if v, ok := cache.Load(protocol + "/" + network); ok {
+		return len(snapshotFiles(v.(cacheItem).content)) > 0, true
+	}
+	if knownMissing("latest:" + prefix) {
+		return false, true
+	}
+	if _, ok := latestCache.Load(prefix); ok {
+		return true, true
+	}
+	return false, false
+}
+
+// respondSnapshotsHead answers a HEAD request of a route that needs the latest
+// snapshot of a network, like /latest, with status and contentType. When the caches
+// don't tell whether the network has snapshots, its snapshot-latest.json is taken
+// as the sign.
+func respondSnapshotsHead(c *gin.Context, status int, contentType string) {
+	protocol, network := c.Param("protocol"), c.Param("network")
+	found, known := cachedHasSnapshots(protocol, network)
+	if !known {
+		key := fmt.Sprintf("%s/%s/snapshot-latest.json", protocol, network)
+		svc, bucket := keyClient(storageClient(), key)
+		_, err := svc.HeadObjectWithContext(withRequestID(c.Request.Context(), c), &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil && !isNotFound(err) {
+			respondInternalError(c, err)
+			return
+		}
+		found = err == nil
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+	respondHead(c, status, contentType)
+}
+
+// respondInfoHead answers a HEAD request of /info from the info cache or else the
+// HEAD of snapshot-latest.json
+func respondInfoHead(c *gin.Context) {
+	protocol, network := c.Param("protocol"), c.Param("network")
+	cacheKey := protocol + "/" + network
+	if _, ok := infoCache.Load(cacheKey); !ok {
+		if knownMissing("info:" + cacheKey) {
+			respondError(c, http.StatusNotFound, codeSnapshotNotFound, "Snapshot not found")
+			return
+		}
+		key := cacheKey + "/snapshot-latest.json"
+		svc, bucket := keyClient(storageClient(), key)
+		_, err := svc.HeadObjectWithContext(withRequestID(c.Request.Context(), c), &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			respondSnapshotInfoError(c, err)
+			return
+		}
+	}
+	respondHead(c, http.StatusOK, jsonContentType)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout bounds the S3 check of the readiness probe
+const readinessTimeout = 2 * time.Second
+
+var (
+	// cacheWarm is set once the startup cache warm-up finished, or right away without warm-up
+	cacheWarm atomic.Bool
+	// shuttingDown is set when the server received a termination signal
+	shuttingDown atomic.Bool
+)
+
+// healthz reports that the process is up
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz reports whether this instance should receive traffic: the bucket is
+// reachable, the caches are warm and the server isn't shutting down
+func readyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	if shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	}
+	if !cacheWarm.Load() {
+		checks["cache"] = "warming up"
+		ready = false
+	} else {
+		checks["cache"] = "ok"
+	}
+
+	_, err := sharedStorageCall(c.Request.Context(), "readyz", func(ctx context.Context) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		defer cancel()
+		return storageClient().HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(config.BucketName),
+		})
+	})
+	if err != nil {
+		checks["storage"] = err.Error()
+		ready = false
+	} else {
+		checks["storage"] = "ok"
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"ready": false, "checks": checks, "code": codeNotReady, "request_id": requestID(c)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ready": true, "checks": checks})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// defaultInventoryRefresh is used when inventory_refresh_seconds is not set in the config
+const defaultInventoryRefresh = time.Hour
+
+// inventoryDatePattern matches the dated directories S3 Inventory writes a report to
+var inventoryDatePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}-\d{2}Z/$`)
+
+// inventoryManifest is the manifest.json of an S3 Inventory report
+type inventoryManifest struct {
+	SourceBucket string `json:"sourceBucket"`
+	FileFormat   string `json:"fileFormat"`
+	FileSchema   string `json:"fileSchema"`
+	Files        []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// inventoryObject is an object of the bucket as listed in the inventory, kept
+// small as there are millions of them
+type inventoryObject struct {
+	key          string
+	etag         string
+	size         int64
+	lastModified int64
+}
+
+// inventoryIndex is a loaded inventory report, sorted by key
+type inventoryIndex struct {
+	manifestKey string
+	created     time.Time
+	objects     []inventoryObject
+}
+
+// inventory is the catalog index loaded from the latest S3 Inventory report, nil
+// until one is loaded or if inventory_prefix is not set
+var inventory atomic.Pointer[inventoryIndex]
+
+// inventoryBucket returns the bucket the inventory reports are delivered to
+func inventoryBucket() string {
+	if config.InventoryBucket != "" {
+		return config.InventoryBucket
+	}
+	return config.BucketName
+}
+
+// hiddenTopLevel reports whether a top-level prefix of the bucket holds files of
+// the service rather than a protocol
+func hiddenTopLevel(prefix string) bool {
+	if prefix == config.StaticExportPrefix {
+		return true
+	}
+	if config.InventoryPrefix != "" && inventoryBucket() == config.BucketName {
+		top, _, _ := strings.Cut(config.InventoryPrefix, "/")
+		return prefix == top+"/"
+	}
+	return false
+}
+
+// runInventory loads the latest inventory report at the configured interval, if
+// an inventory prefix is set. Until the first report is loaded the catalog is listed live.
+func runInventory() {
+	if config.InventoryPrefix == "" {
+		return
+	}
+	interval := time.Duration(config.InventoryRefreshSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultInventoryRefresh
+	}
+	for ; ; time.Sleep(interval) {
+		if err := refreshInventory(); err != nil {
+			logger.Error("Error loading inventory report", "error", err)
+		}
+	}
+}
+
+// refreshInventory loads the newest complete inventory report if it isn't loaded yet
+func refreshInventory() error {
+	svc := bucketClient(inventoryBucket())
+	prefix := strings.TrimSuffix(config.InventoryPrefix, "/") + "/"
+
+	var dates []string
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(inventoryBucket()),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			if date := strings.TrimPrefix(*p.Prefix, prefix); inventoryDatePattern.MatchString(date) {
+				dates = append(dates, *p.Prefix)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(dates) == 0 {
+		return fmt.Errorf("no inventory reports below %s", prefix)
+	}
+
+	// The manifest is written last, so a report without one is still being delivered
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	for _, date := range dates {
+		manifestKey := date + "manifest.json"
+		if current := inventory.Load(); current != nil && current.manifestKey == manifestKey {
+			return nil
+		}
+		manifest, err := loadInventoryManifest(svc, manifestKey)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		index, err := loadInventoryReport(svc, manifest)
+		if err != nil {
+			return fmt.Errorf("%s: %w", manifestKey, err)
+		}
+		index.manifestKey = manifestKey
+		index.created, _ = time.Parse("2006-01-02T15-04Z/", strings.TrimPrefix(date, prefix))
+		inventory.Store(index)
+		inventoryObjects.Set(float64(len(index.objects)))
+		inventoryReportTimestamp.Set(float64(index.created.Unix()))
+		logger.Info("Loaded inventory report", "manifest", manifestKey, "objects", len(index.objects), "duration", time.Since(start))
+		return nil
+	}
+	return fmt.Errorf("no complete inventory reports below %s", prefix)
+}
+
+// isNotFound reports whether err is S3 reporting a missing key
+func isNotFound(err error) bool {
+	var aerr interface{ Code() string }
+	return errors.As(err, &aerr) && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound")
+}
+
+func loadInventoryManifest(svc s3iface.S3API, key string) (*inventoryManifest, error) {
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(inventoryBucket()),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	var manifest inventoryManifest
+	if err := json.NewDecoder(out.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	if manifest.FileFormat != "CSV" {
+		return nil, fmt.Errorf("inventory format %s is not supported, only CSV is", manifest.FileFormat)
+	}
+	if manifest.SourceBucket != "" && manifest.SourceBucket != config.BucketName {
+		return nil, fmt.Errorf("inventory is of bucket %s, not %s", manifest.SourceBucket, config.BucketName)
+	}
+	return &manifest, nil
+}
+
+// loadInventoryReport reads the gzipped CSV files of an inventory report into an index
+func loadInventoryReport(svc s3iface.S3API, manifest *inventoryManifest) (*inventoryIndex, error) {
+	columns := map[string]int{}
+	for i, name := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	keyColumn, ok := columns["Key"]
+	if !ok {
+		return nil, errors.New("inventory has no Key column")
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	index := &inventoryIndex{}
+	for _, file := range manifest.Files {
+		out, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(inventoryBucket()),
+			Key:    aws.String(file.Key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = func() error {
+			defer out.Body.Close()
+			gz, err := gzip.NewReader(out.Body)
+			if err != nil {
+				return err
+			}
+			r := csv.NewReader(gz)
+			r.ReuseRecord = true
+			for {
+				record, err := r.Read()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				// Versioned buckets list every version, only the current one exists
+				if column(record, "IsLatest") == "false" || column(record, "IsDeleteMarker") == "true" {
+					continue
+				}
+				key, err := url.QueryUnescape(record[keyColumn])
+				if err != nil {
+					return fmt.Errorf("invalid key %q: %w", record[keyColumn], err)
+				}
+				o := inventoryObject{key: key, etag: column(record, "ETag")}
+				o.size, _ = strconv.ParseInt(column(record, "Size"), 10, 64)
+				if t, err := time.Parse(time.RFC3339, column(record, "LastModifiedDate")); err == nil {
+					o.lastModified = t.Unix()
+				}
+				index.objects = append(index.objects, o)
+			}
+		}()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Key, err)
+		}
+	}
+	sort.Slice(index.objects, func(i, j int) bool { return index.objects[i].key < index.objects[j].key })
+	return index, nil
+}
+
+// bounds returns the range of the objects below prefix
+func (idx *inventoryIndex) bounds(prefix string) (int, int) {
+	lo := sort.Search(len(idx.objects), func(i int) bool { return idx.objects[i].key >= prefix })
+	hi := lo + sort.Search(len(idx.objects)-lo, func(i int) bool { return !strings.HasPrefix(idx.objects[lo+i].key, prefix) })
+	return lo, hi
+}
+
+// list returns the objects below prefix like a ListObjectsV2 would
+func (idx *inventoryIndex) list(prefix string) []*s3.Object {
+	lo, hi := idx.bounds(prefix)
+	objects := make([]*s3.Object, 0, hi-lo)
+	for _, o := range idx.objects[lo:hi] {
+		etag := `"` + o.etag + `"`
+		object := &s3.Object{
+			Key:  aws.String(o.key),
+			Size: aws.Int64(o.size),
+			ETag: &etag,
+		}
+		// Rows without a date have none, rather than one in 1970
+		if o.lastModified != 0 {
+			object.LastModified = aws.Time(time.Unix(o.lastModified, 0).UTC())
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+// commonPrefixes returns the "directories" directly below prefix, skipping past
+// the objects of each one found instead of walking them
+func (idx *inventoryIndex) commonPrefixes(prefix string) []string {
+	var prefixes []string
+	lo, hi := idx.bounds(prefix)
+	for i := lo; i < hi; {
+		rest := idx.objects[i].key[len(prefix):]
+		slash := strings.IndexByte(rest, '/')
+		if slash < 0 {
+			i++
+			continue
+		}
+		dir := prefix + rest[:slash+1]
+		prefixes = append(prefixes, dir)
+		// The first key after the directory replaces its trailing "/" by the next byte, "0"
+		next := dir[:len(dir)-1] + "0"
+		i += sort.Search(hi-i, func(j int) bool { return idx.objects[i+j].key >= next })
+	}
+	return prefixes
+}
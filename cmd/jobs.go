@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gin-gonic/gin"
+)
+
+// JobSettings schedules a background job
+type JobSettings struct {
+	// Schedule is a cron expression evaluated in UTC, "minute hour day-of-month month
+	// day-of-week" or a shorthand like @daily. Jobs without one only run when triggered
+	// at /admin/jobs/<name>/run.
+	Schedule string `json:"schedule"`
+	// Keep is the number of snapshots per network the prune job keeps
+	Keep int `json:"keep"`
+	// Bucket is the bucket the replicate job copies the snapshots to, reached with the
+	// credentials of the bucket of the snapshots
+	Bucket string `json:"bucket"`
+	// MaxAgeHours is the age of incomplete multipart uploads the abort-uploads job
+	// aborts, a week if 0
+	MaxAgeHours int `json:"max_age_hours"`
+}
+
+// jobKinds are the jobs that can be scheduled, by name
+var jobKinds = map[string]func(ctx context.Context, settings JobSettings) error{
+	// reindex lists every network again, refreshing the caches and the catalog
+	"reindex": reindexNetworks,
+	// prune deletes all but the newest keep snapshots of every network
+	"prune": pruneNetworks,
+	// replicate copies the snapshots missing in bucket there
+	"replicate": replicateNetworks,
+	// freshness-check updates the freshness metrics of every network and fires
+	// staleness alerts, instead of every freshness_check_interval_seconds
+	"freshness-check": checkNetworksFreshness,
+	// abort-uploads aborts the multipart uploads that were never completed, whose
+	// parts are billed until then
+	"abort-uploads": abortStaleUploads,
+	// static-export exports the static site, instead of every static_export_interval_seconds
+	"static-export": func(ctx context.Context, _ JobSettings) error { return exportStaticSite(ctx) },
+}
+
+// Outcomes of a job run
+const (
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobRun is the outcome of a run of a job
+type jobRun struct {
+	// Trigger is schedule or manual
+	Trigger         string    `json:"trigger"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	// DryRun is set for runs that only logged what they would change
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// jobStatus is what /admin/jobs reports about a job
+type jobStatus struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	NextRun  *time.Time `json:"next_run"`
+	Running  bool       `json:"running"`
+	LastRun  *jobRun    `json:"last_run"`
+}
+
+// scheduledJob is a configured job and the state of its runs
+type scheduledJob struct {
+	name     string
+	settings JobSettings
+	// schedule is nil for jobs that are only triggered manually
+	schedule *cronSchedule
+	run      func(ctx context.Context, settings JobSettings) error
+
+	mu      sync.Mutex
+	running bool
+	next    time.Time
+	last    *jobRun
+}
+
+// scheduledJobs are the configured jobs by name, loaded on startup
+var scheduledJobs map[string]*scheduledJob
+
+// loadScheduledJobs checks the jobs of the config and returns them by name
+func loadScheduledJobs(jobs map[string]JobSettings) (map[string]*scheduledJob, error) {
+	loaded := make(map[string]*scheduledJob, len(jobs))
+	for name, settings := range jobs {
+		run, ok := jobKinds[name]
+		if !ok {
+			names := make([]string, 0, len(jobKinds))
+			for kind := range jobKinds {
+				names = append(names, kind)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown job %q, valid jobs are %s", name, strings.Join(names, ", "))
+		}
+		switch {
+		case name == "prune" && settings.Keep < 1:
+			return nil, fmt.Errorf("job prune must keep at least 1 snapshot")
+		case name == "replicate" && (settings.Bucket == "" || settings.Bucket == config.BucketName):
+			return nil, fmt.Errorf("job replicate needs a bucket other than the bucket of the snapshots")
+		case name == "abort-uploads" && settings.MaxAgeHours < 0:
+			return nil, fmt.Errorf("job abort-uploads max_age_hours can't be negative")
+		case name == "static-export" && config.StaticExportPrefix == "":
+			return nil, fmt.Errorf("job static-export needs static_export_prefix")
+		}
+
+		job := &scheduledJob{name: name, settings: settings, run: run}
+		if settings.Schedule != "" {
+			schedule, err := parseCron(settings.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("job %s: %w", name, err)
+			}
+			job.schedule = schedule
+			job.next = schedule.next(time.Now())
+		}
+		loaded[name] = job
+	}
+	return loaded, nil
+}
+
+// jobScheduled reports whether a job is configured with a schedule, for the loops
+// it replaces
+func jobScheduled(name string) bool {
+	job, ok := scheduledJobs[name]
+	return ok && job.schedule != nil
+}
+
+// runScheduler runs every scheduled job at the times of its schedule
+func runScheduler() {
+	for _, job := range scheduledJobs {
+		if job.schedule != nil {
+			go job.loop()
+		}
+	}
+}
+
+func (j *scheduledJob) loop() {
+	for {
+		j.mu.Lock()
+		next := j.next
+		j.mu.Unlock()
+		time.Sleep(time.Until(next))
+
+		if !j.start("schedule", false) {
+			logger.Warn("Skipping scheduled job run, the previous run is still running", "job", j.name)
+		}
+		j.mu.Lock()
+		j.next = j.schedule.next(time.Now())
+		j.mu.Unlock()
+	}
+}
+
+// start runs the job in the background unless it is running already, in dry run
+// if dry is set or the config asks for it
+func (j *scheduledJob) start(trigger string, dry bool) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return false
+	}
+	j.running = true
+	go j.execute(trigger, dry)
+	return true
+}
+
+func (j *scheduledJob) execute(trigger string, dry bool) {
+	ctx := withDryRun(context.Background(), dry)
+	run := &jobRun{Trigger: trigger, Started: time.Now().UTC(), Status: jobSucceeded, DryRun: dryRunContext(ctx)}
+	logger.Info("Running job", "job", j.name, "trigger", trigger, "dry_run", run.DryRun)
+	err := func() (err error) {
+		// A panic fails the run instead of the process and leaves the job runnable,
+		// the recovery middleware only covers the goroutines of requests
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+				logger.Error("Panic in job", "job", j.name, "panic", r, "stack", string(debug.Stack()))
+			}
+		}()
+		return j.run(ctx, j.settings)
+	}()
+	run.Finished = time.Now().UTC()
+	run.DurationSeconds = run.Finished.Sub(run.Started).Seconds()
+	if err != nil {
+		run.Status, run.Error = jobFailed, err.Error()
+		logger.Error("Job failed", "job", j.name, "duration", run.Finished.Sub(run.Started), "error", err)
+	} else {
+		jobLastSuccess.Set(float64(run.Finished.Unix()), j.name)
+		logger.Info("Job finished", "job", j.name, "duration", run.Finished.Sub(run.Started))
+	}
+	jobRuns.Inc(j.name, run.Status)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.running, j.last = false, run
+}
+
+func (j *scheduledJob) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := jobStatus{Name: j.name, Schedule: j.settings.Schedule, Running: j.running}
+	if j.schedule != nil {
+		next := j.next
+		status.NextRun = &next
+	}
+	if j.last != nil {
+		last := *j.last
+		status.LastRun = &last
+	}
+	return status
+}
+
+// forEachNetwork calls fn for every network one after the other, and returns the
+// errors of all failed calls
+func forEachNetwork(ctx context.Context, fn func(protocol, network string) error) error {
+	networks, err := discoverNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, n := range networks {
+		protocol, network, _ := strings.Cut(n, "/")
+		if err := fn(protocol, network); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", n, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func reindexNetworks(ctx context.Context, _ JobSettings) error {
+	if catalog != nil {
+		if err := reloadRegistry(ctx); err != nil {
+			return err
+		}
+	}
+	knownNetworks.Store(nil)
+	return forEachNetwork(ctx, func(protocol, network string) error {
+		refreshNetwork(protocol, network)
+		if catalog == nil {
+			return nil
+		}
+		return syncCatalogNetwork(ctx, protocol, network)
+	})
+}
+
+func pruneNetworks(ctx context.Context, settings JobSettings) error {
+	return forEachNetwork(ctx, func(protocol, network string) error {
+		_, err := pruneSnapshots(ctx, logger.With("job", "prune"), protocol, network, settings.Keep, dryRunContext(ctx))
+		return err
+	})
+}
+
+func checkNetworksFreshness(ctx context.Context, _ JobSettings) error {
+	return forEachNetwork(ctx, func(protocol, network string) error {
+		checkFreshness(protocol, network)
+		return nil
+	})
+}
+
+// replicateNetworks copies the objects of every network to settings.Bucket that are
+// missing there, or changed since they were copied. Snapshots still being written
+// are left for the next run.
+func replicateNetworks(ctx context.Context, settings JobSettings) error {
+	dst := bucketClient(settings.Bucket)
+	return forEachNetwork(ctx, func(protocol, network string) error {
+		prefix := protocol + "/" + network + "/"
+		bucket := keyBucket(prefix)
+		objects, err := listObjects(ctx, bucketClient(bucket), prefix)
+		if err != nil {
+			return err
+		}
+		replicas, err := listBucketObjects(ctx, dst, settings.Bucket, prefix)
+		if err != nil {
+			return err
+		}
+		copied := make(map[string]*s3.Object, len(replicas))
+		for _, o := range replicas {
+			copied[*o.Key] = o
+		}
+		keys := make([]string, len(objects))
+		for i, o := range objects {
+			keys[i] = *o.Key
+		}
+		inProgress := inProgressSnapshots(keys)
+
+		for _, o := range objects {
+			if inProgress[*o.Key] {
+				continue
+			}
+			if c, ok := copied[*o.Key]; ok && aws.Int64Value(c.Size) == aws.Int64Value(o.Size) &&
+				!aws.TimeValue(o.LastModified).After(aws.TimeValue(c.LastModified)) {
+				continue
+			}
+			if dryRunContext(ctx) {
+				logger.Info("Dry run, skipping replication", "key", *o.Key, "bucket", settings.Bucket)
+				continue
+			}
+			if err := copyObject(ctx, dst, bucket, *o.Key, settings.Bucket, *o.Key, aws.Int64Value(o.Size), nil); err != nil {
+				return fmt.Errorf("copying %s: %w", *o.Key, err)
+			}
+			logger.Info("Replicated object", "key", *o.Key, "bucket", settings.Bucket, "size", aws.Int64Value(o.Size))
+		}
+		return nil
+	})
+}
+
+const (
+	// maxCopyObjectSize is the largest object CopyObject copies, larger ones are
+	// copied in parts
+	maxCopyObjectSize = 5 << 30
+	// copyPartSize is the size of the parts large objects are copied in, unless
+	// they have more than the 10000 parts S3 allows
+	copyPartSize = 512 << 20
+)
+
+// copyObject copies srcKey from srcBucket to dstKey in dstBucket with server-side
+// copies, calling progress if not nil with the bytes copied after every part
+func copyObject(ctx context.Context, svc s3iface.S3API, srcBucket, srcKey, dstBucket, key string, size int64, progress func(copied, size int64)) error {
+	source := (&url.URL{Path: srcBucket + "/" + srcKey}).EscapedPath()
+	if size <= maxCopyObjectSize {
+		_, err := svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(dstBucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(source),
+		})
+		if err == nil && progress != nil {
+			progress(size, size)
+		}
+		return err
+	}
+
+	upload, err := svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(dstBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		_, abortErr := svc.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(dstBucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return errors.Join(err, abortErr)
+	}
+
+	partSize := max(int64(copyPartSize), (size+9999)/10000)
+	var parts []*s3.CompletedPart
+	for number, start := int64(1), int64(0); start < size; number, start = number+1, start+partSize {
+		end := min(start+partSize, size) - 1
+		out, err := svc.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(dstBucket),
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(number),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(number)})
+		if progress != nil {
+			progress(end+1, size)
+		}
+	}
+	_, err = svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dstBucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+// listJobs returns the configured jobs with their next and last runs
+func listJobs(c *gin.Context) {
+	jobs := make([]jobStatus, 0, len(scheduledJobs))
+	for _, job := range scheduledJobs {
+		jobs = append(jobs, job.status())
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Name < jobs[k].Name })
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+func getJob(c *gin.Context) {
+	job, ok := scheduledJobs[c.Param("name")]
+	if !ok {
+		respondError(c, http.StatusNotFound, codeJobNotFound, "Job not configured")
+		return
+	}
+	c.JSON(http.StatusOK, job.status())
+}
+
+// runJob starts a configured job right away, its outcome is reported as last run.
+// With dry_run=true it only logs what it would change.
+func runJob(c *gin.Context) {
+	job, ok := scheduledJobs[c.Param("name")]
+	if !ok {
+		respondError(c, http.StatusNotFound, codeJobNotFound, "Job not configured")
+		return
+	}
+	if !job.start("manual", dryRun(c)) {
+		respondError(c, http.StatusConflict, codeJobRunning, "Job is running already")
+		return
+	}
+	requestLogger(c).Info("Job triggered", "job", job.name)
+	c.JSON(http.StatusAccepted, job.status())
+}
+
+func registerJobRoutes(admin *gin.RouterGroup) {
+	admin.GET("/jobs", listJobs)
+	admin.GET("/jobs/:name", getJob)
+	admin.POST("/jobs/:name/run", runJob)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 1, 31, 10, 17, 30, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 1, 31, 10, 25, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 2, 1, 3, 0, 0, 0, time.UTC)},
+		{"30 9-17 * * 1-5", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * 1", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "0 0 30 2 *", "@often"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+}
+
+func TestJobs(t *testing.T) {
+	r, storage := newTestAPI(t)
+	var err error
+	if _, err = loadScheduledJobs(map[string]JobSettings{"prune": {}}); err == nil {
+		t.Error("prune without keep accepted")
+	}
+	if scheduledJobs, err = loadScheduledJobs(map[string]JobSettings{"prune": {Schedule: "0 3 * * *", Keep: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// waitForRun runs the prune job and waits for the run to finish
+	waitForRun := func(target string) jobStatus {
+		t.Helper()
+		w := serve(r, "POST", target, "", true)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+		var status jobStatus
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if status = scheduledJobs["prune"].status(); status.LastRun != nil && !status.Running {
+				break
+			}
+		}
+		return status
+	}
+
+	status := waitForRun("/admin/jobs/prune/run?dry_run=true")
+	if status.LastRun == nil || status.LastRun.Status != jobSucceeded || !status.LastRun.DryRun {
+		t.Fatalf("dry run %+v", status.LastRun)
+	}
+	if _, ok := storage.objects["nimiq/mainnet/2024-01-01.tar.zst"]; !ok {
+		t.Error("dry run pruned the older snapshot")
+	}
+
+	status = waitForRun("/admin/jobs/prune/run")
+	if status.LastRun == nil || status.LastRun.Status != jobSucceeded || status.LastRun.Trigger != "manual" || status.LastRun.DryRun {
+		t.Fatalf("last run %+v", status.LastRun)
+	}
+	if status.NextRun == nil || status.NextRun.Hour() != 3 {
+		t.Errorf("next run %v", status.NextRun)
+	}
+	if _, ok := storage.objects["nimiq/mainnet/2024-01-01.tar.zst"]; ok {
+		t.Error("older snapshot not pruned")
+	}
+}
+
+func TestJobPanic(t *testing.T) {
+	job := &scheduledJob{name: "panics", run: func(context.Context, JobSettings) error { panic("boom") }}
+	if !job.start("manual", false) {
+		t.Fatal("job not started")
+	}
+	var status jobStatus
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if status = job.status(); status.LastRun != nil {
+			break
+		}
+	}
+	if status.LastRun == nil || status.LastRun.Status != jobFailed || status.LastRun.Error != "panic: boom" || status.Running {
+		t.Fatalf("status %+v, last run %+v", status, status.LastRun)
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	_, storage := newTestAPI(t)
+	for _, key := range []string{"nimiq/mainnet/abandoned.tar.zst", "nimiq/mainnet/uploading.tar.zst"} {
+		if _, err := storage.CreateMultipartUploadWithContext(context.Background(), &s3.CreateMultipartUploadInput{Key: aws.String(key)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.uploadPart("upload-1", 1, "part")
+	storage.uploads["upload-1"].initiated = time.Now().Add(-49 * time.Hour)
+
+	if err := abortStaleUploads(context.Background(), JobSettings{MaxAgeHours: 48}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage.uploads["upload-1"]; ok {
+		t.Error("stale upload not aborted")
+	}
+	if _, ok := storage.uploads["upload-2"]; !ok {
+		t.Error("recent upload aborted")
+	}
+	if got := abortedUploadBytes.Value(config.BucketName); got < 4 {
+		t.Errorf("aborted bytes %v", got)
+	}
+}
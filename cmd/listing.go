@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// defaultListConcurrency is used when list_concurrency is not set in the config
+const defaultListConcurrency = 8
+
+// inProgressSuffix marks snapshots that are still being written. An object named
+// with it is never a snapshot, and a marker named like a snapshot plus the suffix
+// hides that snapshot until the uploader deletes the marker.
+const inProgressSuffix = ".partial"
+
+// inProgressSnapshots returns the keys marked as being written among keys
+func inProgressSnapshots(keys []string) map[string]bool {
+	inProgress := map[string]bool{}
+	for _, key := range keys {
+		if strings.HasSuffix(key, inProgressSuffix) {
+			inProgress[strings.TrimSuffix(key, inProgressSuffix)] = true
+		}
+	}
+	return inProgress
+}
+
+// isSnapshot reports whether the object at key, of size bytes, can be handed out
+// as a snapshot. Directory markers, placeholders smaller than min_snapshot_size,
+// snapshots being written and snapshot-latest.json are not snapshots.
+func isSnapshot(key string, size int64, inProgress map[string]bool) bool {
+	minSize := config.MinSnapshotSize
+	if minSize <= 0 {
+		minSize = 1
+	}
+	return !strings.HasSuffix(key, "/") &&
+		path.Base(key) != "snapshot-latest.json" &&
+		!strings.HasSuffix(key, inProgressSuffix) &&
+		!inProgress[key] &&
+		size >= minSize
+}
+
+// snapshotObjects returns the objects of a listing that are snapshots, in order
+func snapshotObjects(objects []*s3.Object) []*s3.Object {
+	keys := make([]string, len(objects))
+	for i, object := range objects {
+		keys[i] = *object.Key
+	}
+	inProgress := inProgressSnapshots(keys)
+
+	var snapshots []*s3.Object
+	for _, object := range objects {
+		if isSnapshot(*object.Key, aws.Int64Value(object.Size), inProgress) {
+			snapshots = append(snapshots, object)
+		}
+	}
+	return snapshots
+}
+
+// newestSnapshot returns the snapshot of a listing with the greatest key, nil if
+// there is none. Snapshots are named with a timestamp as the prefix.
+func newestSnapshot(objects []*s3.Object) *s3.Object {
+	var newest *s3.Object
+	for _, object := range snapshotObjects(objects) {
+		if newest == nil || *object.Key > *newest.Key {
+			newest = object
+		}
+	}
+	return newest
+}
+
+// snapshotFiles returns the files of a loadFiles listing that are snapshots, in order
+func snapshotFiles(files []map[string]interface{}) []map[string]interface{} {
+	keys := make([]string, len(files))
+	for i, f := range files {
+		keys[i] = f["filename"].(string)
+	}
+	inProgress := inProgressSnapshots(keys)
+
+	var snapshots []map[string]interface{}
+	for _, f := range files {
+		if isSnapshot(f["filename"].(string), f["size"].(int64), inProgress) {
+			snapshots = append(snapshots, f)
+		}
+	}
+	return snapshots
+}
+
+// listObjects returns every object below prefix, sorted by key.
+//
+// A plain ListObjectsV2 walk has to follow one continuation token after the other,
+// which takes seconds on our biggest networks. Instead the keys are listed in
+// ranges that are split further whenever a page is truncated, see rangeLister.
+func listObjects(ctx context.Context, svc s3iface.S3API, prefix string) ([]*s3.Object, error) {
+	// Registered networks can be kept in other buckets, which have no inventory
+	if bucket := keyBucket(prefix); bucket != config.BucketName {
+		return listBucketObjects(ctx, bucketClient(bucket), bucket, prefix)
+	}
+	if idx := inventory.Load(); idx != nil {
+		// The report can be a day old. Snapshots are named by time, so the ones
+		// uploaded since sort after its last key and are listed live from there.
+		objects := idx.list(prefix)
+		var since keyRange
+		if len(objects) > 0 {
+			since.from = *objects[len(objects)-1].Key + "\x00"
+		}
+		newer, err := listBucketRange(ctx, svc, config.BucketName, prefix, since)
+		if err != nil {
+			return nil, err
+		}
+		return append(objects, newer...), nil
+	}
+	return listBucketObjects(ctx, svc, config.BucketName, prefix)
+}
+
+// listBucketObjects lists every object below prefix in bucket like listObjects,
+// always from the bucket itself
+func listBucketObjects(ctx context.Context, svc s3iface.S3API, bucket, prefix string) ([]*s3.Object, error) {
+	return listBucketRange(ctx, svc, bucket, prefix, keyRange{})
+}
+
+// listBucketRange lists the objects below prefix in bucket within the range r
+func listBucketRange(ctx context.Context, svc s3iface.S3API, bucket, prefix string, r keyRange) ([]*s3.Object, error) {
+	concurrency := config.ListConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultListConcurrency
+	}
+	l := &rangeLister{ctx: ctx, svc: svc, bucket: bucket, prefix: prefix, slots: make(chan struct{}, concurrency)}
+	l.wg.Add(1)
+	go l.listRange(r)
+	l.wg.Wait()
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	objects := l.objects
+	if prefix == "" {
+		// Keep the static export and the inventory reports out of bucket-wide listings
+		objects = objects[:0]
+		for _, o := range l.objects {
+			if top, _, nested := strings.Cut(*o.Key, "/"); !nested || !hiddenTopLevel(top+"/") {
+				objects = append(objects, o)
+			}
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return *objects[i].Key < *objects[j].Key })
+	return objects, nil
+}
+
+// listPageSize is how many keys are requested per ListObjectsV2 call, the most S3 returns
+var listPageSize int64 = 1000
+
+// keyRange is a range of keys, from from (inclusive) to to (exclusive). Empty
+// bounds are open.
+type keyRange struct {
+	from, to string
+}
+
+// rangeLister lists the keys below a prefix in ranges, at most as many pages at a
+// time as it has slots.
+//
+// Snapshots sit directly below their network, so the prefix can't be split into
+// sub-prefixes. Instead, whenever a page of a range is truncated, the keys after it
+// are split into ranges starting at each following character at the first position
+// the keys of the page differ, like 2024-01-0, 2024-01-1, 2024-01-2 and so on. The
+// new ranges are listed concurrently and split again the same way.
+type rangeLister struct {
+	ctx    context.Context
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	objects []*s3.Object
+	err     error
+}
+
+func (l *rangeLister) listRange(r keyRange) {
+	defer l.wg.Done()
+	startAfter := l.prefix
+	if r.from != "" {
+		startAfter = before(r.from)
+	}
+
+	for {
+		// A slot is only held for a single call, so ranges waiting for their
+		// sub-ranges never block them
+		l.slots <- struct{}{}
+		page, err := l.svc.ListObjectsV2WithContext(l.ctx, &s3.ListObjectsV2Input{
+			Bucket:     aws.String(l.bucket),
+			Prefix:     aws.String(l.prefix),
+			StartAfter: aws.String(startAfter),
+			MaxKeys:    aws.Int64(listPageSize),
+		})
+		<-l.slots
+		if err != nil {
+			l.mu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.mu.Unlock()
+			return
+		}
+
+		var contents []*s3.Object
+		done := !aws.BoolValue(page.IsTruncated)
+		for _, o := range page.Contents {
+			if r.to != "" && *o.Key >= r.to {
+				done = true
+				break
+			}
+			if *o.Key >= r.from {
+				contents = append(contents, o)
+			}
+		}
+		l.mu.Lock()
+		l.objects = append(l.objects, contents...)
+		l.mu.Unlock()
+		if done || len(page.Contents) == 0 {
+			return
+		}
+
+		first, last := *page.Contents[0].Key, *page.Contents[len(page.Contents)-1].Key
+		ranges := splitKeyRange(first, last, r.to)
+		if len(ranges) == 1 {
+			// Nothing to split at, keep paging
+			startAfter = last
+			continue
+		}
+		for _, sub := range ranges {
+			l.wg.Add(1)
+			go l.listRange(sub)
+		}
+		return
+	}
+}
+
+// splitKeyRange splits the keys after last and before to into ranges starting at
+// every character following the one of last at the first position first and last
+// differ, of the same class: digits, upper or lower case letters. The first range
+// starts right after last.
+func splitKeyRange(first, last, to string) []keyRange {
+	stem := 0
+	for stem < len(first) && stem < len(last) && first[stem] == last[stem] {
+		stem++
+	}
+	ranges := []keyRange{{from: last + "\x00", to: to}}
+	if stem == len(last) {
+		return ranges
+	}
+
+	var limit byte
+	switch c := last[stem]; {
+	case c >= '0' && c <= '9':
+		limit = '9'
+	case c >= 'A' && c <= 'Z':
+		limit = 'Z'
+	case c >= 'a' && c <= 'z':
+		limit = 'z'
+	default:
+		return ranges
+	}
+	// The last range takes everything after the class, like the next year
+	for b := last[stem] + 1; b <= limit+1; b++ {
+		from := last[:stem] + string(b)
+		if to != "" && from >= to {
+			break
+		}
+		ranges[len(ranges)-1].to = from
+		ranges = append(ranges, keyRange{from: from, to: to})
+	}
+	return ranges
+}
+
+// before returns a key right before key, to list from key with StartAfter. Keys
+// between it and key, only possible with invalid UTF-8, are filtered out by the
+// lower bound of the range.
+func before(key string) string {
+	last := len(key) - 1
+	if key[last] == 0 {
+		return key[:last]
+	}
+	return key[:last] + string([]byte{key[last] - 1}) + "\U0010FFFF"
+}
+
+// listCommonPrefixes returns the "directories" directly below prefix, without
+// enumerating the objects inside them
+func listCommonPrefixes(ctx context.Context, svc s3iface.S3API, prefix string) ([]string, error) {
+	var prefixes []string
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(config.BucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	if idx := inventory.Load(); idx != nil {
+		for _, p := range idx.commonPrefixes(prefix) {
+			if prefix != "" || !hiddenTopLevel(p) {
+				prefixes = append(prefixes, p)
+			}
+		}
+		// Like listObjects, the directories created since the report are listed
+		// live after its last key
+		if lo, hi := idx.bounds(prefix); hi > lo {
+			input.StartAfter = aws.String(idx.objects[hi-1].key)
+		}
+	}
+
+	err := svc.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			if prefix == "" && hiddenTopLevel(*p.Prefix) {
+				continue
+			}
+			// The directory of the last key of the report is listed again
+			if n := len(prefixes); n > 0 && prefixes[n-1] == *p.Prefix {
+				continue
+			}
+			prefixes = append(prefixes, *p.Prefix)
+		}
+		return true
+	})
+	return prefixes, err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestIsSnapshot(t *testing.T) {
+	inProgress := map[string]bool{"nimiq/mainnet/2024-03-01.tar.zst": true}
+	tests := []struct {
+		name    string
+		key     string
+		size    int64
+		minSize int64
+		want    bool
+	}{
+		{"snapshot", "nimiq/mainnet/2024-02-01.tar.zst", 100, 0, true},
+		{"directory marker", "nimiq/mainnet/", 0, 0, false},
+		{"directory marker with content", "nimiq/mainnet/", 100, 0, false},
+		{"empty placeholder", "nimiq/mainnet/2024-02-01.tar.zst", 0, 0, false},
+		{"in-progress upload", "nimiq/mainnet/2024-03-01.tar.zst.partial", 100, 0, false},
+		{"marked in progress", "nimiq/mainnet/2024-03-01.tar.zst", 100, 0, false},
+		{"latest pointer", "nimiq/mainnet/snapshot-latest.json", 100, 0, false},
+		{"below min_snapshot_size", "nimiq/mainnet/2024-02-01.tar.zst", 100, 1024, false},
+		{"at min_snapshot_size", "nimiq/mainnet/2024-02-01.tar.zst", 1024, 1024, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{MinSnapshotSize: tt.minSize}
+			if got := isSnapshot(tt.key, tt.size, inProgress); got != tt.want {
+				t.Errorf("isSnapshot(%q, %d) = %v, want %v", tt.key, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotObjects(t *testing.T) {
+	config = &Config{}
+	object := func(key string, size int64) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size)}
+	}
+	objects := []*s3.Object{
+		object("nimiq/mainnet/", 0),
+		object("nimiq/mainnet/2024-01-01.tar.zst", 10),
+		object("nimiq/mainnet/2024-02-01.tar.zst", 10),
+		object("nimiq/mainnet/2024-03-01.tar.zst", 10),
+		object("nimiq/mainnet/2024-03-01.tar.zst.partial", 0),
+		object("nimiq/mainnet/2024-04-01.tar.zst", 0),
+		object("nimiq/mainnet/snapshot-latest.json", 10),
+	}
+	want := []string{"nimiq/mainnet/2024-01-01.tar.zst", "nimiq/mainnet/2024-02-01.tar.zst"}
+
+	got := snapshotObjects(objects)
+	if len(got) != len(want) {
+		t.Fatalf("got %d snapshots, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i].Key != want[i] {
+			t.Errorf("snapshot %d is %s, want %s", i, *got[i].Key, want[i])
+		}
+	}
+}
+
+func TestFindLatest(t *testing.T) {
+	tests := []struct {
+		name string
+		// objects are added to the seeded 2024-01-01 and 2024-02-01 snapshots
+		objects map[string]string
+		network string
+		want    string
+	}{
+		{"newest key", nil, "mainnet", "nimiq/mainnet/2024-02-01.tar.zst"},
+		{"newer snapshot", map[string]string{"nimiq/mainnet/2024-03-01.tar.zst": "data"}, "mainnet", "nimiq/mainnet/2024-03-01.tar.zst"},
+		{"newer placeholder", map[string]string{"nimiq/mainnet/2024-03-01.tar.zst": ""}, "mainnet", "nimiq/mainnet/2024-02-01.tar.zst"},
+		{"newer in-progress upload", map[string]string{"nimiq/mainnet/2024-03-01.tar.zst.partial": "data"}, "mainnet", "nimiq/mainnet/2024-02-01.tar.zst"},
+		{"newer snapshot being written", map[string]string{
+			"nimiq/mainnet/2024-03-01.tar.zst":         "data",
+			"nimiq/mainnet/2024-03-01.tar.zst.partial": "",
+		}, "mainnet", "nimiq/mainnet/2024-02-01.tar.zst"},
+		{"nested directory marker", map[string]string{"nimiq/mainnet/zz/": ""}, "mainnet", "nimiq/mainnet/2024-02-01.tar.zst"},
+		{"unknown network", nil, "testnet", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, storage := newTestAPI(t)
+			for key, data := range tt.objects {
+				storage.put(key, data, newerTime)
+			}
+			latest, err := findLatest(context.Background(), "nimiq", tt.network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := aws.StringValue(keyOf(latest)); got != tt.want {
+				t.Errorf("latest is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// keyOf returns the key of object, nil if there is none
+func keyOf(object *s3.Object) *string {
+	if object == nil {
+		return nil
+	}
+	return object.Key
+}
+
+func TestInventoryWithNewerKeys(t *testing.T) {
+	_, storage := newTestAPI(t)
+	idx := &inventoryIndex{}
+	for _, key := range []string{"nimiq/mainnet/2024-01-01.tar.zst", "nimiq/mainnet/2024-02-01.tar.zst"} {
+		idx.objects = append(idx.objects, inventoryObject{key: key, size: 14, lastModified: olderTime.Unix()})
+	}
+	inventory.Store(idx)
+	t.Cleanup(func() { inventory.Store(nil) })
+
+	// Uploaded after the report was written
+	storage.put("nimiq/mainnet/2024-03-01.tar.zst", "new snapshot", newerTime)
+	storage.put("nimiq/testnet/2024-03-01.tar.zst", "new network", newerTime)
+
+	objects, err := listObjects(context.Background(), storage, "nimiq/mainnet/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, o := range objects {
+		keys = append(keys, *o.Key)
+	}
+	want := []string{"nimiq/mainnet/2024-01-01.tar.zst", "nimiq/mainnet/2024-02-01.tar.zst", "nimiq/mainnet/2024-03-01.tar.zst", "nimiq/mainnet/snapshot-latest.json"}
+	if strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Errorf("listed %v, want %v", keys, want)
+	}
+
+	latest, err := findLatest(context.Background(), "nimiq", "mainnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.StringValue(keyOf(latest)); got != "nimiq/mainnet/2024-03-01.tar.zst" {
+		t.Errorf("latest is %q, want the snapshot uploaded after the report", got)
+	}
+
+	prefixes, err := listCommonPrefixes(context.Background(), storage, "nimiq/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(prefixes, " ") != "nimiq/mainnet/ nimiq/testnet/" {
+		t.Errorf("networks %v, want the one created after the report too", prefixes)
+	}
+}
+
+func TestListKeyRanges(t *testing.T) {
+	_, storage := newTestAPI(t)
+	defer func(size int64) { listPageSize = size }(listPageSize)
+	listPageSize = 5
+
+	want := []string{"nimiq/mainnet/snapshot-latest.json"}
+	for day := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC); day.Year() < 2025; day = day.AddDate(0, 0, 3) {
+		want = append(want, "nimiq/mainnet/"+day.Format("2006-01-02")+".tar.zst")
+	}
+	storage.objects = map[string]fakeObject{}
+	for _, key := range want {
+		storage.put(key, "snapshot", newerTime)
+	}
+	storage.put("nimiq/testnet/2024-01-01.tar.zst", "other network", newerTime)
+	sort.Strings(want)
+
+	storage.calls = 0
+	objects, err := listBucketObjects(context.Background(), storage, config.BucketName, "nimiq/mainnet/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(objects))
+	for i, o := range objects {
+		got[i] = *o.Key
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("listed %d keys, want %d:\n%v", len(got), len(want), got)
+	}
+	// Split into ranges, more calls than pages but far fewer than one per key
+	if storage.calls < len(want)/5 || storage.calls > len(want) {
+		t.Errorf("%d calls for %d keys", storage.calls, len(want))
+	}
+}
+
+func TestSplitKeyRange(t *testing.T) {
+	ranges := splitKeyRange("n/m/2024-01-01", "n/m/2024-01-07", "")
+	want := []keyRange{{"n/m/2024-01-07\x00", "n/m/2024-01-08"}, {"n/m/2024-01-08", "n/m/2024-01-09"}, {"n/m/2024-01-09", "n/m/2024-01-0:"}, {"n/m/2024-01-0:", ""}}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("ranges %q, want %q", ranges, want)
+	}
+	if ranges := splitKeyRange("n/m/2024-01-01", "n/m/2024-01-07", "n/m/2024-01-09"); len(ranges) != 2 || ranges[1].to != "n/m/2024-01-09" {
+		t.Errorf("bounded ranges %q", ranges)
+	}
+	if before("n/m/b") >= "n/m/b" || before("n/m/b") <= "n/m/a~" {
+		t.Errorf("before %q", before("n/m/b"))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logger is the structured logger of the service. It logs at info level in text
+// format until the configuration is loaded.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// newLogger creates the logger from the log_level and log_format settings
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log_level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid log_format %q", format)
+	}
+
+	shipping, err := logShippingHandlers(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(shipping) > 0 {
+		handler = append(multiHandler{handler}, shipping...)
+	}
+	return slog.New(handler), nil
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	flushLogs()
+	os.Exit(1)
+}
+
+// requestLoggerKey is the gin context key of the request-scoped logger
+const requestLoggerKey = "logger"
+
+// requestLogging assigns the request an ID, honoring the X-Request-ID header, and attaches a logger carrying the
+// request's fields to the context
+func requestLogging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(requestIDKey, incomingRequestID(c.Request.Header))
+		c.Header(requestIDHeader, requestID(c))
+		c.Set(requestLoggerKey, logger.With(
+			"request_id", requestID(c),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"client_ip", c.ClientIP(),
+		))
+		c.Next()
+	}
+}
+
+// requestLogger returns the logger of the request, or the global logger outside of requests
+func requestLogger(c *gin.Context) *slog.Logger {
+	if l, ok := c.Get(requestLoggerKey); ok {
+		return l.(*slog.Logger)
+	}
+	return logger
+}
+
+// respondInternalError logs err with the request's fields and responds with a 500, or
+// a 504 if the storage backend didn't answer within the request timeout
+func respondInternalError(c *gin.Context, err error) {
+	if isTimeout(err) {
+		requestLogger(c).Warn("Request timed out", "error", err)
+		respondError(c, http.StatusGatewayTimeout, codeStorageTimeout, "storage backend timed out")
+		return
+	}
+	requestLogger(c).Error("Request failed", "error", err)
+	reportError(c, err)
+	code := codeInternalError
+	if isStorageFailure(err) {
+		code = codeStorageUnavailable
+	}
+	respondError(c, http.StatusInternalServerError, code, err.Error())
+}
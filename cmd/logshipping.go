@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSyslogTag is used when syslog_tag is not set in the config
+	defaultSyslogTag = "snapshot-service-api"
+	// lokiFlushInterval is how often buffered log lines are pushed to Loki
+	lokiFlushInterval = 2 * time.Second
+	// lokiMaxBatch is how many lines are buffered before they are pushed right away
+	lokiMaxBatch = 1000
+)
+
+// flushLogs pushes log lines still buffered for shipping, it is replaced when a
+// buffering sink is configured
+var flushLogs = func() {}
+
+// multiHandler hands every record to all of its handlers
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if herr := h.Handle(ctx, r.Clone()); herr != nil {
+				err = herr
+			}
+		}
+	}
+	return err
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// lineSink receives log records formatted as JSON lines
+type lineSink interface {
+	writeLine(level slog.Level, t time.Time, line []byte) error
+}
+
+// lineWriter passes the lines of a JSON handler on to a sink, together with the
+// level and time of the record being written
+type lineWriter struct {
+	mu    sync.Mutex
+	sink  lineSink
+	level slog.Level
+	time  time.Time
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	return len(p), w.sink.writeLine(w.level, w.time, bytes.TrimRight(p, "\n"))
+}
+
+// lineHandler formats records as JSON lines for a sink
+type lineHandler struct {
+	slog.Handler
+	w *lineWriter
+}
+
+func newLineHandler(sink lineSink, opts *slog.HandlerOptions) *lineHandler {
+	w := &lineWriter{sink: sink}
+	return &lineHandler{Handler: slog.NewJSONHandler(w, opts), w: w}
+}
+
+func (h *lineHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.level, h.w.time = r.Level, r.Time
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &lineHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w}
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	return &lineHandler{Handler: h.Handler.WithGroup(name), w: h.w}
+}
+
+// syslogSink writes lines to syslog with the severity of their level
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s syslogSink) writeLine(level slog.Level, _ time.Time, line []byte) error {
+	switch {
+	case level >= slog.LevelError:
+		return s.w.Err(string(line))
+	case level >= slog.LevelWarn:
+		return s.w.Warning(string(line))
+	case level >= slog.LevelInfo:
+		return s.w.Info(string(line))
+	default:
+		return s.w.Debug(string(line))
+	}
+}
+
+// lokiSink buffers lines and pushes them to the Loki push API in batches, one
+// stream per level
+type lokiSink struct {
+	url    string
+	labels map[string]string
+
+	mu      sync.Mutex
+	pending map[slog.Level][][2]string
+	lines   int
+}
+
+func newLokiSink(url string, labels map[string]string) *lokiSink {
+	s := &lokiSink{url: url, labels: labels, pending: make(map[slog.Level][][2]string)}
+	go func() {
+		for range time.Tick(lokiFlushInterval) {
+			s.flush()
+		}
+	}()
+	return s
+}
+
+func (s *lokiSink) writeLine(level slog.Level, t time.Time, line []byte) error {
+	s.mu.Lock()
+	s.pending[level] = append(s.pending[level], [2]string{strconv.FormatInt(t.UnixNano(), 10), string(line)})
+	s.lines++
+	full := s.lines >= lokiMaxBatch
+	s.mu.Unlock()
+	if full {
+		go s.flush()
+	}
+	return nil
+}
+
+// flush pushes the buffered lines. Failures are reported on stderr only, logging
+// them would feed the lines back into the sink.
+func (s *lokiSink) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending, s.lines = make(map[slog.Level][][2]string), 0
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	var push struct {
+		Streams []stream `json:"streams"`
+	}
+	for level, values := range pending {
+		labels := map[string]string{"level": strings.ToLower(level.String())}
+		for k, v := range s.labels {
+			labels[k] = v
+		}
+		push.Streams = append(push.Streams, stream{Stream: labels, Values: values})
+	}
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		return
+	}
+	resp, err := notifyClient.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error pushing logs to Loki:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "Error pushing logs to Loki:", resp.Status)
+	}
+}
+
+// logShippingHandlers returns the handlers for the syslog and Loki sinks in the config
+func logShippingHandlers(opts *slog.HandlerOptions) ([]slog.Handler, error) {
+	var handlers []slog.Handler
+	if config.SyslogAddress != "" {
+		tag := config.SyslogTag
+		if tag == "" {
+			tag = defaultSyslogTag
+		}
+		// The local syslog daemon is used for the address "local"
+		network, address := config.SyslogNetwork, config.SyslogAddress
+		if address == "local" {
+			network, address = "", ""
+		} else if network == "" {
+			network = "udp"
+		}
+		w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to syslog: %w", err)
+		}
+		handlers = append(handlers, newLineHandler(syslogSink{w}, opts))
+	}
+	if config.LokiURL != "" {
+		sink := newLokiSink(config.LokiURL, config.LokiLabels)
+		flushLogs = sink.flush
+		handlers = append(handlers, newLineHandler(sink, opts))
+	}
+	return handlers, nil
+}
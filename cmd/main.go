@@ -1,27 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/gin-contrib/cors"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/gin-gonic/gin"
 
-	_ "github.com/maestroi/snapshot-service-api/docs"
+	"github.com/maestroi/snapshot-service-api/docs"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
@@ -36,30 +42,375 @@ type Config struct {
 	SecretKey  string `json:"secret_key"`
 	Endpoint   string `json:"endpoint"`
 	Region     string `json:"region"`
+	// ForcePathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint.
+	// It defaults to true, as most S3-compatible stores need it.
+	ForcePathStyle *bool `json:"force_path_style"`
+	// Buckets overrides the endpoint, region, addressing style and TLS verification
+	// per bucket name, for buckets held by different S3-compatible stores
+	Buckets map[string]BucketSettings `json:"buckets"`
+	// DetectBucketRegions looks up the region of every bucket without a region in
+	// buckets with GetBucketLocation, so that buckets in any region can be used
+	// together. Region is then only used for the lookup.
+	DetectBucketRegions bool `json:"detect_bucket_regions"`
+
+	// ListConcurrency bounds how many key ranges of a network are listed in parallel
+	ListConcurrency int `json:"list_concurrency"`
+	// MinSnapshotSize is the size in bytes below which objects are never picked as a
+	// snapshot, e.g. placeholders written by uploaders. It defaults to 1 byte.
+	MinSnapshotSize int64 `json:"min_snapshot_size"`
+
+	// CDN maps bucket prefixes to the CDN base URL serving the objects below them
+	CDN map[string]string `json:"cdn"`
+	// Mirrors maps bucket prefixes to the mirrors holding copies of the objects below them,
+	// their health is reported by /mirrors
+	Mirrors map[string][]Mirror `json:"mirrors"`
+	// GeoIPDatabase is a "start,end,country" CSV of IP ranges, like the DB-IP country lite
+	// database, used to redirect /download to the mirror of the region of the client
+	GeoIPDatabase string `json:"geoip_database"`
+	// Public maps bucket prefixes, e.g. "protocol/network/" of a network, to whether the
+	// objects below them are world-readable. Their plain S3 URLs are returned instead of
+	// presigned ones and their CDN URLs aren't signed. The longest matching prefix wins.
+	Public map[string]bool `json:"public"`
+	// CDNIncludePresigned also returns the S3 URLs as presigned_url next to CDN URLs,
+	// for clients that don't know that url is the S3 URL since cdn_url was added
+	CDNIncludePresigned bool `json:"cdn_include_presigned"`
+	// CloudFrontKeyPairID and CloudFrontPrivateKey (path to a PEM file) enable CloudFront signed CDN URLs
+	CloudFrontKeyPairID  string `json:"cloudfront_key_pair_id"`
+	CloudFrontPrivateKey string `json:"cloudfront_private_key"`
+
+	// PresignTTLSeconds is how long the download URLs handed out by the API are valid,
+	// 15 minutes for the latest snapshot and 30 for listings if it is not set.
+	// PresignTTLPerRoute overrides it per route path and PresignTTLPerNetwork per
+	// protocol/network, which wins over both, e.g. for multi-TB archive snapshots.
+	PresignTTLSeconds    int            `json:"presign_ttl_seconds"`
+	PresignTTLPerRoute   map[string]int `json:"presign_ttl_per_route"`
+	PresignTTLPerNetwork map[string]int `json:"presign_ttl_per_network"`
+
+	// CacheControl maps endpoint groups (listings, latest, info) to a Cache-Control header value
+	CacheControl map[string]string `json:"cache_control"`
+
+	// InfoCacheTTLSeconds is how long snapshot info is served without revalidating it
+	InfoCacheTTLSeconds int `json:"info_cache_ttl_seconds"`
+	// NegativeCacheTTLSeconds is how long a network without snapshots or without a
+	// snapshot-latest.json is reported as such without asking S3 again. It defaults
+	// to 30 seconds, a negative value disables it.
+	NegativeCacheTTLSeconds int `json:"negative_cache_ttl_seconds"`
+	// StaleAfterSeconds maps protocol/network (or "*" for all networks) to the age after which a snapshot is stale
+	StaleAfterSeconds map[string]int `json:"stale_after_seconds"`
+
+	// ProxyPartSizeMB and ProxyConcurrency control the ranged parts fetched by the download proxy
+	ProxyPartSizeMB  int `json:"proxy_part_size_mb"`
+	ProxyConcurrency int `json:"proxy_concurrency"`
+
+	// Warmup pre-populates the listing and info caches on startup
+	Warmup bool `json:"warmup"`
+	// Networks is the allowlist of the protocol/network pairs served. Other networks,
+	// in the bucket or not, are answered with a 404 listing the valid ones. All networks
+	// in the bucket are served if it is empty.
+	Networks []string `json:"networks"`
+
+	// WarmupNetworks lists the protocol/network pairs to warm up, all networks in the bucket if empty
+	WarmupNetworks []string `json:"warmup_networks"`
+
+	// AdminToken is the bearer token protecting the /admin routes, which are disabled when it is empty
+	AdminToken string `json:"admin_token"`
+
+	// WorkerPoolSize bounds the number of background jobs running at the same time
+	WorkerPoolSize int `json:"worker_pool_size"`
+
+	// S3MaxRetries is the number of retries of failed S3 calls, 3 if not set and none if negative
+	S3MaxRetries int `json:"s3_max_retries"`
+	// The backoff between retries, for regular errors and for throttling (including SlowDown)
+	S3MinRetryDelayMs    int `json:"s3_min_retry_delay_ms"`
+	S3MaxRetryDelayMs    int `json:"s3_max_retry_delay_ms"`
+	S3MinThrottleDelayMs int `json:"s3_min_throttle_delay_ms"`
+	S3MaxThrottleDelayMs int `json:"s3_max_throttle_delay_ms"`
+	// S3TimeoutSeconds bounds how long S3 may take to start responding to a call
+	S3TimeoutSeconds int `json:"s3_timeout_seconds"`
+	// S3RequestPricePer1000 is the price of 1000 requests per pricing tier (A, B), for the estimated S3 cost metric
+	S3RequestPricePer1000 map[string]float64 `json:"s3_request_price_per_1000"`
+
+	// BreakerFailureThreshold consecutive S3 failures open the circuit breaker for BreakerOpenSeconds
+	BreakerFailureThreshold int `json:"breaker_failure_threshold"`
+	BreakerOpenSeconds      int `json:"breaker_open_seconds"`
+
+	// HTTP transport settings of the S3 client
+	S3MaxIdleConnsPerHost        int  `json:"s3_max_idle_conns_per_host"`
+	S3DialTimeoutSeconds         int  `json:"s3_dial_timeout_seconds"`
+	S3TLSHandshakeTimeoutSeconds int  `json:"s3_tls_handshake_timeout_seconds"`
+	S3DisableHTTP2               bool `json:"s3_disable_http2"`
+	// S3InsecureSkipVerify accepts any TLS certificate of the storage backend, for lab
+	// stores with self-signed certificates only
+	S3InsecureSkipVerify bool `json:"s3_insecure_skip_verify"`
+
+	// RequestTimeoutSeconds bounds the work done for a request, S3 calls included, except
+	// for streaming the body of proxied downloads and event streams
+	RequestTimeoutSeconds int `json:"request_timeout_seconds"`
+
+	// GinMode is the mode gin runs in: release, the default, debug or test
+	GinMode string `json:"gin_mode"`
+	// Middleware is the global middleware installed, in order, out of recovery, cors,
+	// access_log, metrics, error_reporting, load_shedding and deadline. All of them if
+	// empty. Admin routes require the admin token regardless.
+	Middleware []string `json:"middleware"`
+	// CORSAllowOrigins are the origins browsers may call the API from
+	CORSAllowOrigins []string `json:"cors_allow_origins"`
+	// TrustedProxies are the IPs and CIDRs of the load balancers whose X-Forwarded-For
+	// and X-Real-IP headers are honored for the client IP. None are trusted if empty.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// MaxInFlight limits the requests served at the same time, MaxInFlightPerRoute does so per route path.
+	// Limits of 0 are no limits.
+	MaxInFlight           int            `json:"max_in_flight"`
+	MaxInFlightPerRoute   map[string]int `json:"max_in_flight_per_route"`
+	ShedRetryAfterSeconds int            `json:"shed_retry_after_seconds"`
+
+	// LogLevel is one of debug, info, warn or error and LogFormat one of json or text
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+
+	// SyslogAddress ships logs to syslog at this host:port over SyslogNetwork (udp, tcp), or to the local daemon for "local"
+	SyslogAddress string `json:"syslog_address"`
+	SyslogNetwork string `json:"syslog_network"`
+	SyslogTag     string `json:"syslog_tag"`
+
+	// LokiURL ships logs to this Loki push endpoint, e.g. http://loki:3100/loki/api/v1/push, with LokiLabels on every stream
+	LokiURL    string            `json:"loki_url"`
+	LokiLabels map[string]string `json:"loki_labels"`
+
+	// SentryDSN enables reporting of panics and 5xx errors to Sentry
+	SentryDSN         string `json:"sentry_dsn"`
+	SentryEnvironment string `json:"sentry_environment"`
+
+	// AccessLog is where access log lines are written: stdout (default), stderr, off or a file path
+	AccessLog string `json:"access_log"`
+	// AccessLogExclude are the route paths not access logged, /healthz, /readyz and /metrics
+	// if not set, so probes and scrapes don't flood the log. An empty list logs every request.
+	AccessLogExclude []string `json:"access_log_exclude"`
+
+	// AnalyticsPath names the files download events are stored in, one per UTC day like
+	// analytics.2024-01-31.jsonl for analytics.jsonl. Analytics are disabled when empty.
+	AnalyticsPath string `json:"analytics_path"`
+	// Costs are the prices the spend of the networks is estimated with at /admin/costs,
+	// which is disabled without any
+	Costs CostSettings `json:"costs"`
+
+	// CatalogDSN is the PostgreSQL connection string of the snapshot catalog, e.g.
+	// postgres://snapshots@db/snapshots?sslmode=require. The catalog, with the protocols and
+	// networks registered at /admin/protocols and /admin/networks, is disabled when empty.
+	CatalogDSN string `json:"catalog_dsn"`
+	// CatalogSyncIntervalSeconds is how often the catalog is synced with the whole bucket,
+	// networks are synced on their snapshot events too
+	CatalogSyncIntervalSeconds int `json:"catalog_sync_interval_seconds"`
+
+	// ExpectedIntervalSeconds maps protocol/network (or "*" for all networks) to how often a new snapshot is expected
+	ExpectedIntervalSeconds map[string]int `json:"expected_interval_seconds"`
+	// FreshnessCheckIntervalSeconds is how often the freshness of all networks is checked in the background
+	FreshnessCheckIntervalSeconds int `json:"freshness_check_interval_seconds"`
+
+	// AlertNotifiers are notified when a network exceeds its stale_after_seconds threshold
+	AlertNotifiers []NotifierConfig `json:"alert_notifiers"`
+	// SnapshotNotifiers (slack or discord) are notified about every new snapshot
+	SnapshotNotifiers []NotifierConfig `json:"snapshot_notifiers"`
+
+	// TelegramBotToken enables the Telegram bot, TelegramChatIDs are always sent announcements
+	TelegramBotToken string  `json:"telegram_bot_token"`
+	TelegramChatIDs  []int64 `json:"telegram_chat_ids"`
+
+	// SQSQueueURL is the SQS queue S3 bucket notifications are delivered to, directly or through SNS
+	SQSQueueURL string `json:"sqs_queue_url"`
+
+	// ShutdownDrainSeconds keeps serving this long after SIGTERM with readiness failing, so
+	// load balancers stop routing here before the listener closes. ShutdownTimeoutSeconds then
+	// bounds how long requests in flight may take to finish.
+	ShutdownDrainSeconds   int `json:"shutdown_drain_seconds"`
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+
+	// PublicURL is the base URL clients reach the API at, e.g. https://api.example.com
+	PublicURL string `json:"public_url"`
+	// BasePath is the path prefix all routes are served under, e.g. /snapshots-api, for
+	// running behind a shared ingress that doesn't rewrite paths. Links under public_url
+	// get the prefix too, unless public_url already ends with it.
+	BasePath string `json:"base_path"`
+
+	// DerivedCachePath is where files derived from snapshots, like torrent piece hashes, are kept,
+	// a temporary directory if empty
+	DerivedCachePath string   `json:"derived_cache_path"`
+	TorrentTrackers  []string `json:"torrent_trackers"`
+
+	// StaticExportPrefix enables rendering the catalog into this top-level prefix of the bucket, a single
+	// segment ending in a slash like "site/", every StaticExportIntervalSeconds
+	StaticExportPrefix          string `json:"static_export_prefix"`
+	StaticExportIntervalSeconds int    `json:"static_export_interval_seconds"`
+
+	// DryRun makes destructive operations only log and report what they would do, like the --dry-run flag
+	DryRun bool `json:"dry_run"`
+
+	// ChainRPC maps "protocol/network" to the RPC endpoint of its chain, to record the block
+	// height snapshots are registered at and report how far behind they are
+	ChainRPC map[string]ChainRPC `json:"chain_rpc"`
+
+	// InventoryPrefix enables serving the catalog from the S3 Inventory reports of the bucket
+	// below this prefix, "<destination prefix>/<bucket>/<inventory id>/", instead of listing it.
+	// Only the keys after the last one of the report are listed, to find the newer snapshots.
+	// The reports are delivered to InventoryBucket, the bucket itself if it is empty, and
+	// checked for a new one every InventoryRefreshSeconds.
+	InventoryPrefix         string `json:"inventory_prefix"`
+	InventoryBucket         string `json:"inventory_bucket"`
+	InventoryRefreshSeconds int    `json:"inventory_refresh_seconds"`
+
+	// Peers are other instances of this service whose networks are merged into /keys,
+	// with /latest answered by them for the networks not hosted here. Their catalogs are
+	// fetched every PeerRefreshSeconds.
+	Peers              []Peer `json:"peers"`
+	PeerRefreshSeconds int    `json:"peer_refresh_seconds"`
+
+	// Tenants are served from their own buckets under /t/<tenant>/, with their own API
+	// keys and quotas, by tenant name
+	Tenants map[string]TenantSettings `json:"tenants"`
+
+	// Jobs are the background jobs by name (reindex, prune, replicate, freshness-check,
+	// static-export or abort-uploads), run on their cron schedules and on demand at /admin/jobs
+	Jobs map[string]JobSettings `json:"jobs"`
+
+	// ExporterOnly serves only the metrics, health and version endpoints and runs the
+	// freshness checks, like the --exporter-only flag
+	ExporterOnly bool `json:"exporter_only"`
+
+	// WebhooksPath is the file registered webhooks are persisted in, they are kept in memory only if empty
+	WebhooksPath string `json:"webhooks_path"`
+
+	// Snapshotters create the snapshots of the networks when a job is created at
+	// /admin/snapshot-jobs, by protocol/network or "*" for all networks
+	Snapshotters map[string]Snapshotter `json:"snapshotters"`
+	// SnapshotJobsPath is the file snapshot jobs are persisted in, they are kept in memory only if empty
+	SnapshotJobsPath string `json:"snapshot_jobs_path"`
+	// TaskWorkers is how many of the long operations queued through the API, like
+	// copies and restores, run at once, 2 if 0
+	TaskWorkers int `json:"task_workers"`
 }
 
-func init() {
+// defaultShutdownTimeout is used when shutdown_timeout_seconds is not set in the config
+const defaultShutdownTimeout = 30 * time.Second
+
+// setup runs the subcommands, or parses the flags and loads the configuration
+// and everything derived from it for serving the API
+func setup() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "download":
+			runDownloader(os.Args[2:])
+		case "upload":
+			runUploader(os.Args[2:])
+		case "openapi":
+			runOpenAPI()
+		}
+	}
+
 	var configFilePath string
+	var check, dryRunFlag, exporterOnly bool
 	flag.StringVar(&configFilePath, "config", "", "Path to the configuration file")
+	flag.BoolVar(&check, "check", false, "Validate the configuration, credentials and signing keys, print a report and exit")
+	flag.BoolVar(&dryRunFlag, "dry-run", false, "Only log and report destructive operations instead of executing them")
+	flag.BoolVar(&exporterOnly, "exporter-only", false, "Only serve metrics and run the freshness checks, without the public API")
 	flag.Parse()
 
+	if check {
+		if configFilePath == "" {
+			fatal("No configuration file provided")
+		}
+		runSelfCheck(configFilePath)
+	}
+
 	var err error
 	if configFilePath != "" {
 		config, err = loadConfig(configFilePath)
 		if err != nil {
-			log.Fatalf("Error loading configuration from file: %v", err)
+			fatal("Error loading configuration from file", "error", err)
 		}
 	} else {
-		log.Fatalf("No configuration file provided")
+		fatal("No configuration file provided")
 	}
-	sess, err = session.NewSession(&aws.Config{
-		Region:           aws.String(config.Region),
-		Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
-		Endpoint:         aws.String(config.Endpoint),
-		S3ForcePathStyle: aws.Bool(true),
-	})
+	if dryRunFlag {
+		config.DryRun = true
+	}
+	if exporterOnly {
+		config.ExporterOnly = true
+	}
+	docs.SwaggerInfo.BasePath = basePath()
+	logger, err = newLogger(config.LogLevel, config.LogFormat)
+	if err != nil {
+		fatal("Error configuring logging", "error", err)
+	}
+	if err := setGinMode(config.GinMode); err != nil {
+		fatal("Error configuring gin", "error", err)
+	}
+	if err := checkMiddleware(config.Middleware); err != nil {
+		fatal("Error configuring middleware", "error", err)
+	}
+	if err := checkTrustedProxies(config.TrustedProxies); err != nil {
+		fatal("Error configuring trusted proxies", "error", err)
+	}
+	if err := checkNotifiers(config.AlertNotifiers, alertNotifierTypes); err != nil {
+		fatal("Error configuring alert notifiers", "error", err)
+	}
+	if err := checkNotifiers(config.SnapshotNotifiers, announcementNotifierTypes); err != nil {
+		fatal("Error configuring snapshot notifiers", "error", err)
+	}
+	if err := checkStaticExportPrefix(config.StaticExportPrefix); err != nil {
+		fatal("Error configuring the static export", "error", err)
+	}
+	sess, err = newSession()
+	if err != nil {
+		fatal("Error creating session", "error", err)
+	}
+	scheduledJobs, err = loadScheduledJobs(config.Jobs)
 	if err != nil {
-		log.Fatalf("Error creating session: %v", err)
+		fatal("Error configuring jobs", "error", err)
+	}
+	cloudFrontSigner, err = loadCloudFrontSigner(config.CloudFrontKeyPairID, config.CloudFrontPrivateKey)
+	if err != nil {
+		fatal("Error loading CloudFront key pair", "error", err)
+	}
+	geoIP, err = loadGeoIP(config.GeoIPDatabase)
+	if err != nil {
+		fatal("Error loading GeoIP database", "error", err)
+	}
+	backgroundJobs = newWorkerPool(config.WorkerPoolSize)
+	if config.AnalyticsPath != "" {
+		analytics, err = openAnalyticsStore(config.AnalyticsPath)
+		if err != nil {
+			fatal("Error opening analytics store", "error", err)
+		}
+	}
+	if config.CatalogDSN != "" {
+		catalog, err = openCatalog(config.CatalogDSN)
+		if err != nil {
+			fatal("Error opening catalog", "error", err)
+		}
+		if err := reloadRegistry(context.Background()); err != nil {
+			fatal("Error loading the network registry", "error", err)
+		}
+	}
+	if config.WebhooksPath != "" {
+		if err := webhooks.load(config.WebhooksPath); err != nil {
+			fatal("Error loading webhooks", "error", err)
+		}
+	}
+	if err := checkSnapshotters(config.Snapshotters); err != nil {
+		fatal("Error configuring snapshotters", "error", err)
+	}
+	if config.SnapshotJobsPath != "" {
+		if err := snapshotJobs.load(config.SnapshotJobsPath); err != nil {
+			fatal("Error loading snapshot jobs", "error", err)
+		}
+	}
+	tasks = newTaskQueue(config.TaskWorkers)
+	if config.SentryDSN != "" {
+		errorReporter, err = newSentryReporter(config.SentryDSN, config.SentryEnvironment)
+		if err != nil {
+			fatal("Error configuring Sentry", "error", err)
+		}
 	}
 }
 
@@ -92,208 +443,896 @@ type cacheItem struct {
 // Define the cache
 var cache = sync.Map{}
 
+// infoCacheItem holds a parsed snapshot-latest.json together with the ETag it was read at
+type infoCacheItem struct {
+	etag         string
+	lastModified time.Time
+	content      interface{}
+	// checked is when the ETag was last compared against the bucket
+	checked time.Time
+}
+
+// Define the snapshot info cache, keyed by protocol/network
+var infoCache = sync.Map{}
+
+// Define the cache of the last good latest snapshot, keyed by prefix. It is only
+// used while the storage backend is failing.
+var latestCache = sync.Map{}
+
+// newRouter creates the handler serving the API with all middleware, writing the
+// access log to accessLogWriter
+func newRouter(accessLogWriter io.Writer) http.Handler {
+	r := gin.New()
+	// Validated by setup
+	_ = r.SetTrustedProxies(config.TrustedProxies)
+	// Request IDs are part of every error response, so they are always assigned
+	r.Use(requestLogging())
+	for _, name := range middlewareNames() {
+		r.Use(globalMiddleware[name](accessLogWriter))
+	}
+
+	registerRoutes(r)
+	return stripBasePath(basePath(), trimTrailingSlash(r))
+}
+
+// getOrHead are the methods of read-only routes. HEAD gets the status and headers
+// of GET, answered from the caches or the HEAD of a single object, see isHead.
+var getOrHead = []string{http.MethodGet, http.MethodHead}
+
 func registerRoutes(router *gin.Engine) {
-	router.GET("/keys", listKeys)
-	router.GET("/files/:protocol/:network", listFiles)
-	router.GET("/files/:protocol/:network/latest", latestSnapshot)
-	router.GET("/files/:protocol/:network/info", snapshotInfo)
+	router.Match(getOrHead, "/metrics", serveMetrics)
+	router.Match(getOrHead, "/healthz", healthz)
+	router.Match(getOrHead, "/readyz", readyz)
+	router.Match(getOrHead, "/version", getVersion)
+	router.Match(getOrHead, "/openapi.json", serveOpenAPI)
+	router.NoRoute(routeNotFound)
+	// Monitoring only, nothing of the bucket is exposed
+	if config.ExporterOnly {
+		return
+	}
+
+	router.Match(getOrHead, "/keys", cacheControl("listings"), listKeys)
+	router.Match(getOrHead, "/stats", cacheControl("listings"), getStats)
+	// Paths naming a network in the wrong case are served as the network in the bucket
+	networks := router.Group("", canonicalNetwork)
+	networks.Match(getOrHead, "/files/:protocol/:network", cacheControl("listings"), listFiles)
+	networks.Match(getOrHead, "/files/:protocol/:network/latest", cacheControl("latest"), latestSnapshot)
+	networks.Match(getOrHead, "/files/:protocol/:network/latest/script", bootstrapScript)
+	networks.Match(getOrHead, "/files/:protocol/:network/info", cacheControl("info"), snapshotInfo)
+	networks.Match(getOrHead, "/files/:protocol/:network/checksums.txt", cacheControl("listings"), networkChecksums)
+	networks.Match(getOrHead, "/files/:protocol/:network/:filename/torrent", torrentFile)
+	networks.Match(getOrHead, "/files/:protocol/:network/:filename/metalink", getMetalink)
+	networks.Match(getOrHead, "/files/:protocol/:network/:filename/zsync", getZsync)
+	networks.Match(getOrHead, "/files/:protocol/:network/:filename/contents", snapshotContents)
+	networks.Match(getOrHead, "/download/:protocol/:network/latest", downloadLatest)
+	networks.Match(getOrHead, "/download/:protocol/:network/:filename", downloadFile)
+	networks.Match(getOrHead, "/mirrors/:protocol/:network", getMirrors)
+
+	registerTenantRoutes(router)
+	registerAdminRoutes(router)
+	registerWebhookRoutes(router)
+	router.POST("/graphql", graphQL)
+	router.GET("/events", streamEvents)
+	router.GET("/events/ws", streamEventsWebSocket)
+
+	// Swagger UI of the generated docs
+	router.GET("/docs", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, basePath()+"/docs/index.html")
+	})
+	router.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+}
 
-	// Use the generated docs
-	router.NoRoute(ginSwagger.WrapHandler(swaggerFiles.Handler))
+// routeNotFound answers requests for paths no route is registered for
+func routeNotFound(c *gin.Context) {
+	respondError(c, http.StatusNotFound, codeRouteNotFound, "no route for "+c.Request.Method+" "+c.Request.URL.Path)
 }
 
 // @Summary List files in S3 bucket
 // @Description Get presigned URLs of files in S3 bucket
 // @Accept  json
 // @Produce  json
+// @Param cursor query string false "Cursor from the X-Next-Cursor header of the previous page"
+// @Param limit query int false "Maximum number of files to return"
+// @Param offset query int false "Number of files to skip, instead of a cursor"
+// @Param order query string false "asc for oldest first, the default, or desc for newest first, instead of a cursor"
+// @Param urls query bool false "Set to false to omit download URLs"
+// @Param format query string false "Only files in this compression: zst, lz4, gz, xz, bz2, zip or none"
+// @Param envelope query bool false "Set to true to wrap the files in an object with the totals of the listing"
 // @Success 200 {object} map[string]string
 // @Router /files/{protocol}/{network} [get]
 func listFiles(c *gin.Context) {
 	protocol := c.Param("protocol")
 	network := c.Param("network")
+
+	paging, err := parseFilesPaging(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	format := c.Query("format")
+	compression, ok := parseCompression(format)
+	if format != "" && !ok {
+		respondError(c, http.StatusBadRequest, codeUnknownFormat, "unknown format "+format)
+		return
+	}
+	if isHead(c) {
+		respondListingHead(c)
+		return
+	}
+
+	ctx := withRequestID(c.Request.Context(), c)
+	files, err := loadFiles(ctx, protocol, network)
+	if err != nil {
+		// Serve the last good listing, however old, while the backend is failing
+		v, ok := cache.Load(protocol + "/" + network)
+		if !ok || !isStorageFailure(err) {
+			respondInternalError(c, err)
+			return
+		}
+		markStale(c)
+		files = v.(cacheItem).content
+	}
+
+	if format != "" {
+		files = filterCompression(ctx, files, compression)
+	}
+	paging.respond(c, files)
+}
+
+// loadFiles returns the files of a network, from the cache if it is less than
+// 5 minutes old
+func loadFiles(ctx context.Context, protocol, network string) ([]map[string]interface{}, error) {
 	cacheKey := protocol + "/" + network
 
 	// Check if the data is in the cache
 	if v, ok := cache.Load(cacheKey); ok {
 		// If data is in cache and is less than 5 minutes old, use it
 		if time.Since(v.(cacheItem).timestamp) < 5*time.Minute {
-			c.JSON(http.StatusOK, v.(cacheItem).content)
-			return
+			observeCache("files", true)
+			return v.(cacheItem).content, nil
 		}
 	}
+	observeCache("files", false)
 
-	svc := s3.New(sess)
-	req := &s3.ListObjectsV2Input{
-		Bucket: aws.String(config.BucketName),
-		Prefix: aws.String(fmt.Sprintf("%s/%s/", protocol, network)), // change prefix to match new structure
-	}
-	resp, err := svc.ListObjectsV2(req)
+	// Page through all objects of the network, or read them from the inventory. The
+	// listing is shared with findLatest.
+	prefix := fmt.Sprintf("%s/%s/", protocol, network)
+	v, err := sharedStorageCall(ctx, "list:"+prefix, func(ctx context.Context) (interface{}, error) {
+		return listObjects(ctx, storageClient(), prefix)
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 
 	files := make([]map[string]interface{}, 0)
-	for _, item := range resp.Contents {
+	for _, item := range v.([]*s3.Object) {
 		if strings.Contains(*item.Key, protocol) && strings.Contains(*item.Key, network) {
-			req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
-				Bucket: aws.String(config.BucketName),
-				Key:    item.Key,
-			})
-			urlStr, err := req.Presign(30 * time.Minute)
+			files = append(files, fileEntry(item))
+		}
+	}
+
+	previous, seen := cache.Swap(cacheKey, cacheItem{content: files, timestamp: time.Now()})
+	if seen {
+		publishDeletions(protocol, network, previous.(cacheItem).content, files)
+	}
+
+	return files, nil
+}
+
+// fileEntry returns the listing entry of object, without download URLs
+func fileEntry(object *s3.Object) map[string]interface{} {
+	return map[string]interface{}{
+		"last_modified": utcTime(object.LastModified),
+		"size":          *object.Size,
+		"size_human":    humanSize(*object.Size),
+		"filename":      *object.Key,
+		"extension":     fileExtension(*object.Key),
+		"type":          snapshotType(*object.Key),
+		"compression":   nameCompression(*object.Key),
+	}
+}
+
+// publishDeletions publishes a snapshot.deleted event for every file of the
+// previous listing that is missing from the current one
+func publishDeletions(protocol, network string, previous, current []map[string]interface{}) {
+	remaining := make(map[string]bool, len(current))
+	for _, f := range current {
+		remaining[f["filename"].(string)] = true
+	}
+	for _, f := range previous {
+		key := f["filename"].(string)
+		if remaining[key] {
+			continue
+		}
+		event := snapshotEvent{Type: eventSnapshotDeleted, Protocol: protocol, Network: network, Key: key, Size: f["size"].(int64)}
+		if lastModified, ok := f["last_modified"].(*time.Time); ok && lastModified != nil {
+			event.LastModified = *lastModified
+		}
+		publishEvent(event)
+	}
+}
+
+// filesEnvelope is a page of a listing with the totals of the whole listing,
+// returned instead of the plain array for envelope=true
+type filesEnvelope struct {
+	Files []map[string]interface{} `json:"files"`
+	filesTotals
+}
+
+// filesTotals are the fields of a filesEnvelope besides the files
+type filesTotals struct {
+	TotalCount     int   `json:"total_count"`
+	TotalSizeBytes int64 `json:"total_size_bytes"`
+	// Truncated is set when more files follow the page
+	Truncated  bool   `json:"truncated"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	NextOffset *int   `json:"next_offset,omitempty"`
+}
+
+// fileURLsFunc returns the origin and CDN download URLs of a listed file valid for ttl
+type fileURLsFunc func(key string, ttl time.Duration) (origin, cdn string, err error)
+
+// fileURLsKey is the gin context key of the fileURLsFunc of a listing served from
+// another bucket than the bucket of the snapshots
+const fileURLsKey = "fileURLs"
+
+// respondFilesPage writes the page of a listing following the file named after.
+// The listing stays a plain array, the cursor of the next page is returned in the
+// X-Next-Cursor header. Download URLs are only generated for the files on the page,
+// and not at all when the client passes urls=false.
+func respondFilesPage(c *gin.Context, files []map[string]interface{}, after string, limit int) {
+	totals := filesTotals{TotalCount: len(files), TotalSizeBytes: totalSize(files)}
+	start := sort.Search(len(files), func(i int) bool { return files[i]["filename"].(string) > after })
+	page := files[start:]
+
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+		totals.Truncated = true
+		totals.NextCursor = encodeCursor(page[limit-1]["filename"].(string))
+		c.Header("X-Next-Cursor", totals.NextCursor)
+	}
+	respondFiles(c, page, totals)
+}
+
+// respondFilesOffset writes the page of a listing starting offset files in, newest
+// first if desc is set. The offset of the next page is returned in the X-Next-Offset
+// header.
+func respondFilesOffset(c *gin.Context, files []map[string]interface{}, offset, limit int, desc bool) {
+	totals := filesTotals{TotalCount: len(files), TotalSizeBytes: totalSize(files)}
+	if desc {
+		files = newestFirst(files)
+	}
+	files = files[min(offset, len(files)):]
+
+	if limit > 0 && len(files) > limit {
+		files = files[:limit]
+		next := offset + limit
+		totals.Truncated = true
+		totals.NextOffset = &next
+		c.Header("X-Next-Offset", strconv.Itoa(next))
+	}
+	respondFiles(c, files, totals)
+}
+
+// newestFirst orders the snapshots of a listing newest first, the way newestSnapshot
+// picks the latest, followed by the other files, like snapshot-latest.json, in order
+func newestFirst(files []map[string]interface{}) []map[string]interface{} {
+	snapshots := snapshotFiles(files)
+	ordered := make([]map[string]interface{}, 0, len(files))
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		ordered = append(ordered, snapshots[i])
+	}
+	isSnapshot := make(map[string]bool, len(snapshots))
+	for _, f := range snapshots {
+		isSnapshot[f["filename"].(string)] = true
+	}
+	for _, f := range files {
+		if !isSnapshot[f["filename"].(string)] {
+			ordered = append(ordered, f)
+		}
+	}
+	return ordered
+}
+
+// totalSize returns the size of all files of a listing in bytes
+func totalSize(files []map[string]interface{}) int64 {
+	var total int64
+	for _, f := range files {
+		size, _ := f["size"].(int64)
+		total += size
+	}
+	return total
+}
+
+// respondFiles writes a page of a listing, with the download URLs of its files
+// unless the client passes urls=false. For envelope=true the page is wrapped in
+// an object with totals. JSON is streamed file by file, so large pages are never
+// held in memory as a whole.
+func respondFiles(c *gin.Context, files []map[string]interface{}, totals filesTotals) {
+	urls := c.Query("urls") != "false"
+	ttl := presignTTL(c.FullPath(), c.Param("protocol"), c.Param("network"), defaultListingPresignTTL)
+	v, _ := c.Get(fileURLsKey)
+	fileURLs, _ := v.(fileURLsFunc)
+	if fileURLs == nil {
+		svc := storageClient()
+		fileURLs = func(key string, ttl time.Duration) (string, string, error) {
+			return downloadURLs(svc, key, ttl)
+		}
+	}
+	now := time.Now()
+	entry := func(i int) (interface{}, error) {
+		f := files[i]
+		// The cached entries are shared between requests, so copy before adding to them
+		file := make(map[string]interface{}, len(f)+4)
+		for k, v := range f {
+			file[k] = v
+		}
+		lastModified, _ := f["last_modified"].(*time.Time)
+		if age, ok := objectAgeSeconds(lastModified, now); ok {
+			file["age_seconds"] = age
+		}
+		if !urls {
+			return file, nil
+		}
+
+		origin, cdn, err := fileURLs(f["filename"].(string), ttl)
+		if err != nil {
+			return nil, err
+		}
+		file["url"] = origin
+		if cdn != "" {
+			file["cdn_url"] = cdn
+			if config.CDNIncludePresigned {
+				file["presigned_url"] = origin
+			}
+		}
+		return file, nil
+	}
+	envelope := c.Query("envelope") == "true"
+
+	if _, h := listingEncoding(c); h == nil {
+		var prefix, suffix []byte
+		if envelope {
+			t, err := json.Marshal(totals)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				respondInternalError(c, err)
 				return
 			}
-			file := map[string]interface{}{
-				"last_modified": item.LastModified,
-				"size":          *item.Size,
-				"filename":      *item.Key,
-				"url":           urlStr,
-			}
-			files = append(files, file)
+			prefix = []byte(`{"files":`)
+			suffix = append([]byte{','}, t[1:]...)
 		}
+		streamJSON(c, prefix, len(files), entry, suffix)
+		return
 	}
 
-	cache.Store(cacheKey, cacheItem{content: files, timestamp: time.Now()})
-
-	c.JSON(http.StatusOK, files)
+	page := make([]map[string]interface{}, 0, len(files))
+	for i := range files {
+		file, err := entry(i)
+		if err != nil {
+			respondInternalError(c, err)
+			return
+		}
+		page = append(page, file.(map[string]interface{}))
+	}
+	if envelope {
+		respondListing(c, http.StatusOK, filesEnvelope{Files: page, filesTotals: totals})
+		return
+	}
+	respondListing(c, http.StatusOK, page)
 }
 
 func listKeys(c *gin.Context) {
-	// Create a session using the default configuration
-	sess, _ := session.NewSession()
-
-	// Create a new instance of S3 service
-	s3Svc := s3.New(sess)
+	after, limit, err := pageParams(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if isHead(c) {
+		respondListingHead(c)
+		return
+	}
 
-	// Call S3 to list current objects
-	resp, _ := s3Svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(config.BucketName),
+	// List the networks below every protocol with the shared session, so that
+	// the configured endpoint and credentials are used
+	ctx := withRequestID(c.Request.Context(), c)
+	v, err := sharedStorageCall(ctx, "keys", func(ctx context.Context) (interface{}, error) {
+		return discoverNetworks(ctx)
 	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	dirs := append(make([]string, 0), v.([]string)...)
 
-	fmt.Printf("ListObjectsV2 response: %+v\n", resp)
-	// Prepare a map to hold the unique directories
-	dirMap := make(map[string]bool)
+	// Present the networks of the peers too, unless a peer is asking
+	if !isFederated(c) {
+		dirs = mergePeerDirs(dirs)
+	}
 
-	// For each item in the bucket, parse the key and extract directories
-	for _, item := range resp.Contents {
-		key := *item.Key
-		splitKey := strings.Split(key, "/")
+	// Return the requested page of directories as a JSON response
+	dirs, nextCursor := paginateStrings(dirs, after, limit)
+	response := gin.H{"dirs": dirs}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	respondListing(c, http.StatusOK, response)
+}
 
-		// Check if the key has at least two segments
-		if len(splitKey) >= 2 {
-			dir := splitKey[0] + "/" + splitKey[1]
-			dirMap[dir] = true
-		}
+// latestResponse is the schema of /latest. It is kept stable for provisioning tools,
+// fields are only ever added.
+type latestResponse struct {
+	SchemaVersion int    `json:"schema_version"`
+	Filename      string `json:"filename"`
+	Key           string `json:"key"`
+	// URL is the S3 URL of the snapshot, presigned unless it is public
+	URL string `json:"url"`
+	// CDNURL is the CDN URL of the snapshot, to be preferred over URL, if a CDN is configured
+	CDNURL string `json:"cdn_url,omitempty"`
+	// PresignedURL repeats URL for clients older than schema version 2, if cdn_include_presigned is set
+	PresignedURL string `json:"presigned_url,omitempty"`
+	Size         int64  `json:"size"`
+	// SizeHuman is the size in binary units, e.g. "1.5 GiB"
+	SizeHuman string `json:"size_human"`
+	// LastModified is when the snapshot was uploaded, in UTC
+	LastModified *time.Time `json:"last_modified"`
+	// AgeSeconds is how long ago the snapshot was uploaded, omitted if the backend
+	// doesn't report when
+	AgeSeconds *int64 `json:"age_seconds,omitempty"`
+	// Extension is the file extension of the snapshot, e.g. ".tar.zst"
+	Extension string `json:"extension"`
+	// Type is archive, pruned, full, light or state, inferred from the file name, or unknown
+	Type string `json:"type"`
+	// SHA256 is the hex checksum of the snapshot, null if none is published
+	SHA256 *string `json:"sha256"`
+	// Compression is gzip, zstd, lz4, xz, bzip2, zip, none or unknown, from the file name or the first bytes
+	Compression string `json:"compression"`
+	// Archive is tar, zip or none
+	Archive string `json:"archive"`
+	// DecompressCommand extracts the snapshot into the current directory, null if it isn't an archive
+	DecompressCommand *string `json:"decompress_command"`
+	// EstimatedDiskBytes is the disk space needed to download and extract the snapshot,
+	// from the typical compression ratio of its format until it is measured
+	EstimatedDiskBytes int64 `json:"estimated_disk_bytes"`
+	// UncompressedSize is the size of the snapshot once decompressed, null until it
+	// is measured in the background after its upload, event or catalog sync
+	UncompressedSize *int64 `json:"uncompressed_size"`
+	// BlockHeight and AppHash are the head of the chain when the snapshot was
+	// registered, null without a chain RPC for the network
+	BlockHeight *int64  `json:"block_height"`
+	AppHash     *string `json:"app_hash"`
+	// ChainHeight is the current height of the chain and BlocksBehind how far the
+	// snapshot is behind it, null if either height is unknown
+	ChainHeight  *int64 `json:"chain_height"`
+	BlocksBehind *int64 `json:"blocks_behind"`
+	Stale        bool   `json:"stale,omitempty"`
+	// Provider is the name of the peer hosting the snapshot, empty if it is hosted here
+	Provider string `json:"provider,omitempty"`
+}
+
+// utcTime returns t in UTC at second precision, so all timestamps of the API are
+// formatted alike, e.g. 2024-01-01T12:00:00Z
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
 	}
+	utc := t.UTC().Truncate(time.Second)
+	return &utc
+}
+
+// ageSeconds returns how many seconds before now t was, never less than 0
+func ageSeconds(t, now time.Time) int64 {
+	return max(int64(now.Sub(t)/time.Second), 0)
+}
 
-	// Convert the map keys to a slice
-	dirs := make([]string, 0, len(dirMap))
-	for dir := range dirMap {
-		dirs = append(dirs, dir)
+// objectAgeSeconds returns the age of an object last modified at t, false if the
+// backend didn't report it, like some S3-compatible ones and inventory rows
+func objectAgeSeconds(t *time.Time, now time.Time) (int64, bool) {
+	if t == nil || t.IsZero() {
+		return 0, false
+	}
+	return ageSeconds(*t, now), true
+}
+
+// latestSchemaVersion is bumped when the meaning of a latestResponse field changes.
+// Version 2 moved the CDN URL from url to cdn_url.
+const latestSchemaVersion = 2
+
+// describeLatest builds the /latest response of a snapshot with download URLs valid for ttl
+func describeLatest(ctx context.Context, svc s3iface.S3API, object *s3.Object, ttl time.Duration, log *slog.Logger) (latestResponse, error) {
+	origin, cdn, err := downloadURLs(svc, *object.Key, ttl)
+	if err != nil {
+		return latestResponse{}, err
+	}
+	var presignedURL string
+	if cdn != "" && config.CDNIncludePresigned {
+		presignedURL = origin
+	}
+
+	format := detectFormat(*object.Key)
+	response := latestResponse{
+		SchemaVersion:      latestSchemaVersion,
+		Filename:           path.Base(*object.Key),
+		Key:                *object.Key,
+		URL:                origin,
+		CDNURL:             cdn,
+		PresignedURL:       presignedURL,
+		Size:               *object.Size,
+		SizeHuman:          humanSize(*object.Size),
+		LastModified:       utcTime(object.LastModified),
+		Extension:          fileExtension(*object.Key),
+		Type:               snapshotType(*object.Key),
+		Compression:        snapshotCompression(ctx, svc, object),
+		Archive:            format.Archive,
+		EstimatedDiskBytes: format.estimatedDiskBytes(*object.Size),
+	}
+	if age, ok := objectAgeSeconds(object.LastModified, time.Now()); ok {
+		response.AgeSeconds = &age
+	}
+	if format.Extract != "" {
+		command := format.Extract + " " + shellQuote(response.Filename)
+		response.DecompressCommand = &command
+	}
+	// A missing checksum shouldn't keep anyone from downloading
+	if sum, err := snapshotSHA256(ctx, svc, object); err != nil {
+		log.Warn("Error looking up snapshot checksum", "key", *object.Key, "error", err)
+	} else if sum != "" {
+		response.SHA256 = &sum
+	}
+
+	if m, ok := measuredSnapshot(*object.Key, aws.StringValue(object.ETag)); ok {
+		response.UncompressedSize = m.UncompressedSize
+		if m.UncompressedSize != nil && format.Archive != "none" {
+			response.EstimatedDiskBytes = *object.Size + *m.UncompressedSize
+		}
+		if response.SHA256 == nil && m.SHA256 != "" {
+			response.SHA256 = &m.SHA256
+		}
 	}
 
-	// Return the directories as a JSON response
-	c.JSON(http.StatusOK, gin.H{"dirs": dirs})
+	if parts := strings.SplitN(*object.Key, "/", 3); len(parts) == 3 {
+		if height, appHash, ok := snapshotBlockHeight(ctx, parts[0], parts[1], *object.Key); ok {
+			response.BlockHeight = &height
+			if appHash != "" {
+				response.AppHash = &appHash
+			}
+		}
+		if _, ok := chainRPC(parts[0], parts[1]); ok {
+			if head, err := currentChainHead(ctx, parts[0], parts[1]); err != nil {
+				log.Warn("Error getting chain height", "protocol", parts[0], "network", parts[1], "error", err)
+			} else {
+				response.ChainHeight = &head.Height
+				if response.BlockHeight != nil {
+					behind := head.Height - *response.BlockHeight
+					response.BlocksBehind = &behind
+				}
+			}
+		}
+	}
+	return response, nil
 }
 
+// @Summary Get the latest snapshot of a network
+// @Description Get the latest snapshot of a network with its download URL, checksum, compression format, decompress command and estimated disk requirement. The schema is stable, fields are only added.
+// @Produce json
+// @Success 200 {object} latestResponse
+// @Param format query string false "Only snapshots in this compression: zst, lz4, gz, xz, bz2, zip or none"
+// @Router /files/{protocol}/{network}/latest [get]
 func latestSnapshot(c *gin.Context) {
 	protocol := c.Param("protocol")
 	network := c.Param("network")
+	if isHead(c) {
+		if _, ok := parseCompression(c.Query("format")); c.Query("format") != "" && !ok {
+			respondError(c, http.StatusBadRequest, codeUnknownFormat, "unknown format "+c.Query("format"))
+			return
+		}
+		respondSnapshotsHead(c, http.StatusOK, jsonContentType)
+		return
+	}
 
-	svc := s3.New(sess)
+	svc := storageClient()
+	ctx := withRequestID(c.Request.Context(), c)
 	prefix := fmt.Sprintf("%s/%s/", protocol, network)
 
-	// Assume the files are named with a timestamp as the prefix
 	var latestObject *s3.Object
+	var err error
+	if format := c.Query("format"); format != "" {
+		compression, ok := parseCompression(format)
+		if !ok {
+			respondError(c, http.StatusBadRequest, codeUnknownFormat, "unknown format "+format)
+			return
+		}
+		latestObject, err = findLatestCompression(ctx, svc, protocol, network, compression)
+	} else {
+		latestObject, err = findLatest(ctx, protocol, network)
+	}
+	stale := false
+	if err != nil {
+		// Serve the last good latest snapshot while the backend is failing
+		cached, ok := latestCache.Load(prefix)
+		if !ok || !isStorageFailure(err) || c.Query("format") != "" {
+			respondInternalError(c, err)
+			return
+		}
+		latestObject, stale = cached.(*s3.Object), true
+	}
 
-	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-		Bucket: aws.String(config.BucketName),
-		Prefix: aws.String(prefix),
-	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-		for _, item := range page.Contents {
-			if *item.Key != prefix+"snapshot-latest.json" && (latestObject == nil || *item.Key > *latestObject.Key) {
-				latestObject = item
+	if latestObject == nil {
+		// The network may be hosted by a peer instead
+		if c.Query("format") == "" && !isFederated(c) {
+			if response, ok := peerLatest(c.Request.Context(), protocol, network); ok {
+				c.JSON(http.StatusOK, response)
+				return
 			}
 		}
-		return true // return false to stop iterating
-	})
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
 
+	ttl := presignTTL(c.FullPath(), protocol, network, defaultPresignTTL)
+	response, err := describeLatest(ctx, svc, latestObject, ttl, requestLogger(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondInternalError(c, err)
 		return
 	}
+	response.Stale = stale
+	if stale {
+		markStale(c)
+	}
+	recordDownload(c, "latest", protocol, network, *latestObject.Key, *latestObject.Size, false)
+	c.JSON(http.StatusOK, response)
+}
 
-	if latestObject == nil {
-		c.JSON(http.StatusNotFound, gin.H{"message": "No snapshots found"})
+func snapshotInfo(c *gin.Context) {
+	protocol := c.Param("protocol")
+	network := c.Param("network")
+	cacheKey := protocol + "/" + network
+	ctx := withRequestID(c.Request.Context(), c)
+	if isHead(c) {
+		respondInfoHead(c)
 		return
 	}
 
-	// Get presigned URL of the latest snapshot
-	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(config.BucketName),
-		Key:    latestObject.Key,
+	v, err := sharedStorageCall(ctx, "info:"+cacheKey, func(ctx context.Context) (interface{}, error) {
+		return loadSnapshotInfo(ctx, protocol, network)
 	})
-	urlStr, err := req.Presign(15 * time.Minute)
+	stale := false
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		// Serve the last good snapshot info while the backend is failing
+		cached, ok := infoCache.Load(cacheKey)
+		if !ok || !isStorageFailure(err) {
+			respondSnapshotInfoError(c, err)
+			return
+		}
+		v, stale = cached, true
+		markStale(c)
+	}
+	item := v.(infoCacheItem)
+
+	// Enrich JSON objects with freshness fields, computed per request
+	content, ok := item.content.(map[string]interface{})
+	if !ok {
+		c.JSON(http.StatusOK, item.content)
 		return
 	}
+	data := make(map[string]interface{}, len(content)+2)
+	for k, v := range content {
+		data[k] = v
+	}
+	if age, ok := objectAgeSeconds(&item.lastModified, time.Now()); ok {
+		data["age_seconds"] = age
+		if threshold, ok := staleThreshold(protocol, network); ok {
+			data["is_stale"] = time.Duration(age)*time.Second > threshold
+		}
+	}
+	if stale {
+		data["stale"] = true
+	}
 
-	c.JSON(http.StatusOK, gin.H{"url": urlStr, "size": *latestObject.Size, "last_modified": latestObject.LastModified})
+	c.JSON(http.StatusOK, data)
 }
 
-func snapshotInfo(c *gin.Context) {
-	protocol := c.Param("protocol")
-	network := c.Param("network")
+// loadSnapshotInfo returns the parsed snapshot-latest.json of a network. A memoized
+// copy is served for info_cache_ttl_seconds, after that the object is only fetched
+// again when its ETag changed.
+func loadSnapshotInfo(ctx context.Context, protocol, network string) (infoCacheItem, error) {
+	cacheKey := protocol + "/" + network
+	key := aws.String(fmt.Sprintf("%s/%s/snapshot-latest.json", protocol, network))
 
-	// Get the snapshot-latest.json
-	svc := s3.New(sess)
-	result, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(config.BucketName),
-		Key:    aws.String(fmt.Sprintf("%s/%s/snapshot-latest.json", protocol, network)),
+	cached, hasCached := infoCache.Load(cacheKey)
+	if hasCached && time.Since(cached.(infoCacheItem).checked) < infoCacheTTL() {
+		observeCache("info", true)
+		return cached.(infoCacheItem), nil
+	}
+	observeCache("info", false)
+	if !hasCached && knownMissing("info:"+cacheKey) {
+		return infoCacheItem{}, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "")
+	}
+
+	svc, bucket := keyClient(storageClient(), *key)
+
+	// HEAD the snapshot-latest.json first, it is much cheaper than fetching the body
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    key,
 	})
 	if err != nil {
-		// Cast err to awserr.Error
-		if aerr, ok := err.(awserr.Error); ok {
-			// If error is due to key not found, respond with default message
-			if aerr.Code() == s3.ErrCodeNoSuchKey {
-				c.JSON(http.StatusNotFound, gin.H{"message": "Snapshot not found"})
-				return
-			}
+		if isNotFound(err) {
+			rememberMissing("info:" + cacheKey)
 		}
-		// If error is of another type, respond with error message
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return infoCacheItem{}, err
+	}
+
+	// If the ETag did not change since we last read the object, serve it from the cache
+	if hasCached && head.ETag != nil && cached.(infoCacheItem).etag == *head.ETag {
+		item := cached.(infoCacheItem)
+		item.checked = time.Now()
+		infoCache.Store(cacheKey, item)
+		return item, nil
+	}
+
+	// Get the snapshot-latest.json
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    key,
+	})
+	if err != nil {
+		return infoCacheItem{}, err
 	}
 
 	defer result.Body.Close()
 	body, err := ioutil.ReadAll(result.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return infoCacheItem{}, err
 	}
 
 	var data interface{}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return infoCacheItem{}, err
 	}
 
-	c.JSON(http.StatusOK, data)
+	item := infoCacheItem{content: data, checked: time.Now()}
+	if result.LastModified != nil {
+		item.lastModified = *result.LastModified
+	}
+	if result.ETag != nil {
+		item.etag = *result.ETag
+		infoCache.Store(cacheKey, item)
+	}
+
+	return item, nil
+}
+
+// findLatest returns the latest snapshot of a network, the newest one unless an
+// older one was promoted, or nil if it has none
+func findLatest(ctx context.Context, protocol, network string) (*s3.Object, error) {
+	prefix := fmt.Sprintf("%s/%s/", protocol, network)
+	if knownMissing("latest:" + prefix) {
+		return nil, nil
+	}
+
+	v, err := sharedStorageCall(ctx, "list:"+prefix, func(ctx context.Context) (interface{}, error) {
+		return listObjects(ctx, storageClient(), prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	latestObject := newestSnapshot(v.([]*s3.Object))
+	if promoted := promotedSnapshot(ctx, protocol, network, v.([]*s3.Object)); promoted != nil {
+		latestObject = promoted
+	}
+	if latestObject == nil {
+		rememberMissing("latest:" + prefix)
+	} else {
+		previous, seen := latestCache.Swap(prefix, latestObject)
+		if age, ok := objectAgeSeconds(latestObject.LastModified, time.Now()); ok {
+			snapshotAge.Set(float64(age), protocol, network)
+		}
+
+		// Announce new snapshots, but not the ones we see for the first time after a restart
+		if seen && *previous.(*s3.Object).Key != *latestObject.Key {
+			event := snapshotEvent{
+				Protocol:     protocol,
+				Network:      network,
+				Key:          *latestObject.Key,
+				Size:         *latestObject.Size,
+				LastModified: aws.TimeValue(latestObject.LastModified),
+			}
+			event.Type = eventSnapshotPublished
+			publishEvent(event)
+			event.Type = eventLatestChanged
+			publishEvent(event)
+		}
+	}
+	return latestObject, nil
+}
+
+// respondSnapshotInfoError writes the response for a failed read of snapshot-latest.json
+func respondSnapshotInfoError(c *gin.Context, err error) {
+	// Cast err to awserr.Error
+	if aerr, ok := err.(awserr.Error); ok {
+		// If error is due to key not found, respond with default message.
+		// HeadObject has no body to carry an error code, so it reports a plain NotFound.
+		if aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound" {
+			respondError(c, http.StatusNotFound, codeSnapshotNotFound, "Snapshot not found")
+			return
+		}
+	}
+	// If error is of another type, respond with error message
+	respondInternalError(c, err)
 }
 
 func main() {
-	r := gin.Default()
+	setup()
+
+	if config.Warmup {
+		go warmCaches()
+	} else {
+		cacheWarm.Store(true)
+	}
 
-	// Configure CORS
-	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"http://localhost:8080", "http://localhost:8081", "http://cryptosnapshotservice.com", "http://api.cryptoservice.com"}
-	r.Use(cors.New(config))
+	accessLogWriter, err := openAccessLog(config.AccessLog)
+	if err != nil {
+		fatal("Error opening access log", "error", err)
+	}
 
-	registerRoutes(r)
+	r := newRouter(accessLogWriter)
 
-	r.Run() // listen and serve on 0.0.0.0:8080
+	go sweepPresignCache(time.Minute)
+	go sweepMissingCache(time.Minute)
+	startBucketEvents()
+	go runInventory()
+	go runFederation()
+	go monitorFreshness()
+	go runCatalogSync()
+	runScheduler()
+	if !config.ExporterOnly {
+		subscribeEvents("announcements", announceSnapshots)
+		subscribeEvents("webhooks", deliverWebhooks)
+		subscribeEvents("snapshot_jobs", completeSnapshotJobs)
+		go monitorSnapshotJobs()
+		startTelegramBot()
+		go runStaticExport()
+	}
+
+	// listen and serve on 0.0.0.0:8080, or the port in $PORT like gin does
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+	srv := &http.Server{Addr: addr, Handler: r}
+	srv.RegisterOnShutdown(closeEventStreams)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("Error starting server", "error", err)
+		}
+	}()
+	go notifySystemd(addr)
+
+	// Fail readiness as soon as we are asked to stop, then finish the requests in flight
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	shuttingDown.Store(true)
+	shutdownInProgress.Set(1)
+	sdNotify("STOPPING=1")
+
+	// Keep accepting connections while the endpoint is removed from load balancers,
+	// but ask clients to reconnect elsewhere
+	drain := time.Duration(config.ShutdownDrainSeconds) * time.Second
+	logger.Info("Shutting down", "drain", drain)
+	srv.SetKeepAlivesEnabled(false)
+	time.Sleep(drain)
+
+	timeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Error shutting down server", "error", err)
+	}
+	flushLogs()
 }
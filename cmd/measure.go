@@ -0,0 +1,215 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// snapshotMeasurement is what is learned about a snapshot by reading it once: its
+// checksum and how big it is once decompressed
+type snapshotMeasurement struct {
+	SHA256 string `json:"sha256"`
+	// UncompressedSize is nil if the compression can't be read here
+	UncompressedSize *int64 `json:"uncompressed_size"`
+}
+
+// externalDecompressors decompress the formats the standard library can't read
+// from stdin to stdout, they are used if installed
+var externalDecompressors = map[string][]string{
+	"zstd": {"zstd", "-dc"},
+	"lz4":  {"lz4", "-dc"},
+	"xz":   {"xz", "-dc"},
+}
+
+// measuredSnapshot returns the measurement of a snapshot version, if it was
+// measured already. It never reads the snapshot itself, see measureInBackground.
+func measuredSnapshot(key, etag string) (snapshotMeasurement, bool) {
+	data, err := os.ReadFile(derivedCachePath(key, etag, ".measure"))
+	if err != nil {
+		return snapshotMeasurement{}, false
+	}
+	var m snapshotMeasurement
+	if err := json.Unmarshal(data, &m); err != nil {
+		return snapshotMeasurement{}, false
+	}
+	return m, true
+}
+
+// runningMeasurement is a measurement in progress of a snapshot key
+type runningMeasurement struct {
+	cancel context.CancelFunc
+}
+
+// measurements are the measurements in progress, keyed by snapshot key
+var measurements = sync.Map{}
+
+// measureInBackground measures a snapshot version on the background worker pool,
+// unless it is measured or being measured already. The contents of tar archives
+// are indexed in the same pass. A measurement of a version the key held before
+// is canceled, that version was replaced. It never waits for a worker: when they
+// are all busy the measurement is left to the next upload, refresh or catalog sync.
+func measureInBackground(key, etag string) {
+	path := derivedCachePath(key, etag, ".measure")
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	if _, running := derivedJobs.LoadOrStore(path, true); running {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	current := &runningMeasurement{cancel: cancel}
+	if previous, ok := measurements.Swap(key, current); ok {
+		previous.(*runningMeasurement).cancel()
+	}
+	done := func() {
+		cancel()
+		measurements.CompareAndDelete(key, current)
+		derivedJobs.Delete(path)
+	}
+	submitted := backgroundJobs.TrySubmit(func() {
+		defer done()
+		data, err := generateMeasurement(ctx, key, etag)
+		if err == nil {
+			err = writeDerived(path, data)
+		}
+		if err != nil {
+			logger.Error("Error measuring snapshot", "key", key, "error", err)
+		}
+	})
+	if !submitted {
+		done()
+		logger.Info("Workers busy, measuring the snapshot later", "key", key)
+	}
+}
+
+// generateMeasurement measures a snapshot version and returns the derived .measure
+// file, writing the index of its contents if it is a tar archive
+func generateMeasurement(ctx context.Context, key, etag string) ([]byte, error) {
+	m, contents, err := measureSnapshot(ctx, key, etag)
+	if err != nil {
+		return nil, err
+	}
+	if contents != nil {
+		if err := writeDerived(derivedCachePath(key, etag, ".contents"), contents); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(m)
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// measureSnapshot reads a snapshot once, hashing it and counting its decompressed
+// bytes. The JSON index of its contents is returned too if it is a tar archive.
+func measureSnapshot(ctx context.Context, key, etag string) (snapshotMeasurement, []byte, error) {
+	start := time.Now()
+	svc, bucket := keyClient(storageClient(), key)
+	out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return snapshotMeasurement{}, nil, err
+	}
+	defer out.Body.Close()
+
+	hash := sha256.New()
+	body := io.TeeReader(out.Body, hash)
+	var uncompressed countingWriter
+	measured := true
+	format := detectFormat(key)
+
+	// The decompressed bytes are also fed to the tar indexer, which must read all
+	// of them for the writes not to block
+	var dst io.Writer = &uncompressed
+	var indexer *tarIndexer
+	if format.Archive == "tar" {
+		indexer = newTarIndexer()
+		dst = io.MultiWriter(&uncompressed, indexer)
+		defer indexer.Close()
+	}
+
+	switch compression := format.Compression; compression {
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return snapshotMeasurement{}, nil, err
+		}
+		if _, err := io.Copy(dst, gz); err != nil {
+			return snapshotMeasurement{}, nil, err
+		}
+	case "bzip2":
+		if _, err := io.Copy(dst, bzip2.NewReader(body)); err != nil {
+			return snapshotMeasurement{}, nil, err
+		}
+	case "none":
+		if _, err := io.Copy(dst, body); err != nil {
+			return snapshotMeasurement{}, nil, err
+		}
+	default:
+		args, ok := externalDecompressors[compression]
+		if ok {
+			_, err = exec.LookPath(args[0])
+			ok = err == nil
+		}
+		if !ok {
+			// Still hash the snapshot
+			measured = false
+			if _, err := io.Copy(io.Discard, body); err != nil {
+				return snapshotMeasurement{}, nil, err
+			}
+			break
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = body
+		cmd.Stdout = dst
+		if err := cmd.Run(); err != nil {
+			return snapshotMeasurement{}, nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+	// Decompressors may stop at the end of the stream, the checksum needs all of it
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return snapshotMeasurement{}, nil, err
+	}
+
+	m := snapshotMeasurement{SHA256: hex.EncodeToString(hash.Sum(nil))}
+	var contents []byte
+	if measured {
+		size := int64(uncompressed)
+		m.UncompressedSize = &size
+	}
+	if indexer != nil {
+		// A null index records that the contents can't be read, rather than
+		// reading the snapshot again on every request for them
+		contents = []byte("null")
+		if measured {
+			if index, err := indexer.finish(); err == nil {
+				contents = index
+			} else {
+				logger.Warn("Error indexing snapshot contents", "key", key, "error", err)
+			}
+		}
+	}
+	logger.Info("Measured snapshot", "key", key, "uncompressed_size", int64(uncompressed), "decompressed", measured, "duration", time.Since(start))
+	return m, contents, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gin-gonic/gin"
+)
+
+// metalinkURLTTL is how long the signed URLs in a metalink are valid
+const metalinkURLTTL = 24 * time.Hour
+
+// RFC 5854 metalink document
+type metalink struct {
+	XMLName   xml.Name       `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+	Generator string         `xml:"generator"`
+	Published string         `xml:"published,omitempty"`
+	Files     []metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string          `xml:"name,attr"`
+	Size   int64           `xml:"size"`
+	Hashes []metalinkHash  `xml:"hash"`
+	Pieces *metalinkPieces `xml:"pieces,omitempty"`
+	URLs   []metalinkURL   `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Length int64    `xml:"length,attr"`
+	Type   string   `xml:"type,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Priority int    `xml:"priority,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// objectSHA256 returns the hex SHA-256 of the object at key if it is known, from
+// the sha256 user metadata, a full object S3 checksum or the snapshot-latest.json
+// it was registered with by an upload
+func objectSHA256(ctx context.Context, key string, head *s3.HeadObjectOutput) string {
+	if v := aws.StringValue(head.Metadata["Sha256"]); v != "" {
+		return strings.ToLower(v)
+	}
+	// Checksums of multipart uploads are checksums of the part checksums, marked with a -N suffix
+	if v := aws.StringValue(head.ChecksumSHA256); v != "" && !strings.Contains(v, "-") {
+		if sum, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return hex.EncodeToString(sum)
+		}
+	}
+	if parts := strings.SplitN(key, "/", 3); len(parts) == 3 {
+		if item, err := loadSnapshotInfo(ctx, parts[0], parts[1]); err == nil {
+			if doc, ok := item.content.(map[string]interface{}); ok && doc["filename"] == key {
+				if sum, ok := doc["sha256"].(string); ok {
+					return strings.ToLower(sum)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// bdecodeString reads a bencoded byte string at the start of b
+func bdecodeString(b []byte) ([]byte, []byte, error) {
+	colon := bytes.IndexByte(b, ':')
+	if colon < 0 {
+		return nil, nil, errors.New("bencode: invalid string")
+	}
+	n, err := strconv.Atoi(string(b[:colon]))
+	if err != nil || n < 0 || colon+1+n > len(b) {
+		return nil, nil, errors.New("bencode: invalid string length")
+	}
+	return b[colon+1 : colon+1+n], b[colon+1+n:], nil
+}
+
+// torrentPieces returns the piece length and SHA-1 piece hashes from a cached
+// torrent info dictionary, which only holds integers and strings
+func torrentPieces(info []byte) (int64, []byte, error) {
+	if len(info) == 0 || info[0] != 'd' {
+		return 0, nil, errors.New("bencode: info is not a dictionary")
+	}
+	var pieceLength int64
+	var pieces []byte
+	rest := info[1:]
+	for len(rest) > 0 && rest[0] != 'e' {
+		key, r, err := bdecodeString(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		rest = r
+		if len(rest) > 0 && rest[0] == 'i' {
+			end := bytes.IndexByte(rest, 'e')
+			if end < 0 {
+				return 0, nil, errors.New("bencode: invalid integer")
+			}
+			n, err := strconv.ParseInt(string(rest[1:end]), 10, 64)
+			if err != nil {
+				return 0, nil, err
+			}
+			if string(key) == "piece length" {
+				pieceLength = n
+			}
+			rest = rest[end+1:]
+			continue
+		}
+		value, r, err := bdecodeString(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		if string(key) == "pieces" {
+			pieces = value
+		}
+		rest = r
+	}
+	return pieceLength, pieces, nil
+}
+
+// metalinkURLs returns the mirrors of key, best first: the CDN, S3 directly and
+// the proxied download under public_url
+func metalinkURLs(svc s3iface.S3API, key string) ([]metalinkURL, error) {
+	var urls []metalinkURL
+	if u, ok, err := signedCDNURL(key, metalinkURLTTL); err != nil {
+		return nil, err
+	} else if ok {
+		urls = append(urls, metalinkURL{Value: u})
+	}
+	origin, err := objectURL(svc, key, metalinkURLTTL)
+	if err != nil {
+		return nil, err
+	}
+	urls = append(urls, metalinkURL{Value: origin})
+	if config.PublicURL != "" {
+		urls = append(urls, metalinkURL{Value: publicURL("/download/" + key)})
+	}
+	for i := range urls {
+		urls[i].Priority = i + 1
+	}
+	return urls, nil
+}
+
+// @Summary Get the metalink of a snapshot
+// @Description Get an RFC 5854 metalink (meta4) of a snapshot listing all mirrors, its size and the checksums known for it
+// @Produce application/metalink4+xml
+// @Success 200 {file} binary
+// @Router /files/{protocol}/{network}/{filename}/metalink [get]
+func getMetalink(c *gin.Context) {
+	filename := c.Param("filename")
+	key := fmt.Sprintf("%s/%s/%s", c.Param("protocol"), c.Param("network"), filename)
+	svc, bucket := keyClient(storageClient(), key)
+
+	ctx := withRequestID(c.Request.Context(), c)
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		respondDownloadError(c, err)
+		return
+	}
+	if isHead(c) {
+		respondHead(c, http.StatusOK, "application/metalink4+xml")
+		return
+	}
+
+	file := metalinkFile{Name: path.Base(key), Size: aws.Int64Value(head.ContentLength)}
+	if sum := objectSHA256(ctx, key, head); sum != "" {
+		file.Hashes = append(file.Hashes, metalinkHash{Type: "sha-256", Value: sum})
+	}
+	// Reuse the piece hashes of the torrent if it was generated, so aria2 can verify
+	// and repair chunks even without a whole file checksum
+	if info, err := os.ReadFile(derivedCachePath(key, aws.StringValue(head.ETag), ".torrent-info")); err == nil {
+		if length, pieces, err := torrentPieces(info); err == nil && length > 0 {
+			p := &metalinkPieces{Length: length, Type: "sha-1"}
+			for i := 0; i+20 <= len(pieces); i += 20 {
+				p.Hashes = append(p.Hashes, hex.EncodeToString(pieces[i:i+20]))
+			}
+			file.Pieces = p
+		}
+	}
+	if file.URLs, err = metalinkURLs(svc, key); err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	doc := metalink{Generator: "snapshot-service-api/" + version, Files: []metalinkFile{file}}
+	if head.LastModified != nil {
+		doc.Published = head.LastModified.UTC().Format(time.RFC3339)
+	}
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".meta4"))
+	c.Data(http.StatusOK, "application/metalink4+xml", append([]byte(xml.Header), body...))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultBuckets are the histogram buckets used for latencies, in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricSeries is the state of one label combination of a metric
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// Only used by histograms
+	buckets []uint64
+	count   uint64
+}
+
+// metric is a counter, gauge or histogram with a fixed set of labels, exposed in
+// the Prometheus text format
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// Define the metrics registry, in the order the metrics are exposed
+var metrics []*metric
+
+func newMetric(kind, name, help string, buckets []float64, labels ...string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, nil, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric("gauge", name, help, nil, labels...)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return newMetric("histogram", name, help, buckets, labels...)
+}
+
+// with returns the series of the given label values, the caller must hold m.mu
+func (m *metric) with(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add adds v to a counter or gauge
+func (m *metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value += v
+}
+
+// Inc adds one to a counter or gauge
+func (m *metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Set sets a gauge to v
+func (m *metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value = v
+}
+
+// Observe records v in a histogram
+func (m *metric) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.with(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Value returns the current value of a counter or gauge
+func (m *metric) Value(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.with(labelValues).value
+}
+
+// write writes the metric in the Prometheus text exposition format
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatValue(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// formatLabels renders a label set, optionally with one extra label appended
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extraName, strconv.Quote(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	httpRequests        = newCounter("http_requests_total", "HTTP requests served.", "route", "method", "status")
+	httpRequestDuration = newHistogram("http_request_duration_seconds", "Latency of HTTP requests, by route.", defaultBuckets, "route", "method")
+	s3Calls             = newCounter("s3_calls_total", "S3 API calls.", "operation")
+	s3Errors            = newCounter("s3_errors_total", "Failed S3 API calls.", "operation")
+	s3Requests          = newCounter("s3_requests_total", "Billed S3 requests including retries, by request type (LIST, GET, HEAD, PUT, DELETE, OTHER) and pricing tier.", "type", "tier")
+	s3EstimatedCost     = newCounter("s3_estimated_request_cost_total", "Estimated cost of the S3 requests from s3_request_price_per_1000, by pricing tier.", "tier")
+	s3CallDuration      = newHistogram("s3_call_duration_seconds", "Latency of S3 API calls, including retries.", defaultBuckets, "operation")
+	cacheLookups        = newCounter("cache_lookups_total", "Cache lookups, by cache and result (hit or miss).", "cache", "result")
+	presignsIssued      = newCounter("presigns_issued_total", "Download URLs signed, by signer (s3 or cloudfront).", "signer")
+	snapshotAge         = newGauge("snapshot_age_seconds", "Age of the latest snapshot of a network when it was last looked up.", "protocol", "network")
+
+	snapshotExpectedInterval = newGauge("snapshot_expected_interval_seconds", "Configured interval in which a network is expected to publish a new snapshot.", "protocol", "network")
+	snapshotOverdue          = newGauge("snapshot_overdue", "1 if the latest snapshot of a network is older than its expected interval.", "protocol", "network")
+	shutdownInProgress       = newGauge("shutdown_in_progress", "1 while the server is draining after a termination signal.")
+	buildInfo                = newGauge("build_info", "Always 1, labeled with the version of the running service.", "version", "commit", "go_version")
+	eventStreams             = newGauge("event_streams", "Clients connected to the event stream, by transport.", "transport")
+	inventoryObjects         = newGauge("inventory_objects", "Objects in the loaded S3 Inventory report.")
+	inventoryReportTimestamp = newGauge("inventory_report_timestamp_seconds", "Creation time of the loaded S3 Inventory report.")
+	jobRuns                  = newCounter("job_runs_total", "Runs of the background jobs, by job and status (succeeded or failed).", "job", "status")
+	jobLastSuccess           = newGauge("job_last_success_timestamp_seconds", "Time the last successful run of a background job finished.", "job")
+	abortedUploads           = newCounter("aborted_uploads_total", "Incomplete multipart uploads aborted by the abort-uploads job, by bucket.", "bucket")
+	abortedUploadBytes       = newCounter("aborted_upload_bytes_total", "Bytes of the parts of the uploads aborted by the abort-uploads job, by bucket.", "bucket")
+	eventsDropped            = newCounter("events_dropped_total", "Events dropped for a subscriber whose buffer was full, by subscriber.", "subscriber")
+	taskRuns                 = newCounter("task_runs_total", "Tasks started through the API that finished, by kind and state (succeeded, failed or canceled).", "kind", "state")
+	mirrorRedirects          = newCounter("mirror_redirects_total", "Downloads redirected to the mirror of the region of the client, by mirror.", "mirror")
+)
+
+// observeCache counts a cache lookup
+func observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.Inc(cache, result)
+}
+
+// instrumentStorage counts every S3 call made through the session
+func instrumentStorage(handlers *request.Handlers) {
+	handlers.Complete.PushBack(func(r *request.Request) {
+		operation := r.Operation.Name
+		s3Calls.Inc(operation)
+		s3CallDuration.Observe(time.Since(r.Time).Seconds(), operation)
+		if r.Error != nil {
+			s3Errors.Inc(operation)
+		}
+		if r.ClientInfo.ServiceName == "s3" {
+			countS3Requests(operation, 1+r.RetryCount)
+		}
+	})
+}
+
+// s3RequestTypes maps S3 operations to the request types S3 bills by
+var s3RequestTypes = map[string]string{
+	"ListObjects":             "LIST",
+	"ListObjectsV2":           "LIST",
+	"ListObjectVersions":      "LIST",
+	"ListMultipartUploads":    "LIST",
+	"ListParts":               "LIST",
+	"ListBuckets":             "LIST",
+	"GetObject":               "GET",
+	"HeadObject":              "HEAD",
+	"HeadBucket":              "HEAD",
+	"PutObject":               "PUT",
+	"CopyObject":              "PUT",
+	"CreateMultipartUpload":   "PUT",
+	"UploadPart":              "PUT",
+	"UploadPartCopy":          "PUT",
+	"CompleteMultipartUpload": "PUT",
+	"DeleteObject":            "DELETE",
+	"DeleteObjects":           "DELETE",
+	"AbortMultipartUpload":    "DELETE",
+}
+
+// s3RequestTiers are the pricing tiers of the request types: tier A requests cost
+// about ten times as much as tier B ones, deletes are free
+var s3RequestTiers = map[string]string{
+	"LIST":   "A",
+	"PUT":    "A",
+	"GET":    "B",
+	"HEAD":   "B",
+	"OTHER":  "B",
+	"DELETE": "free",
+}
+
+// countS3Requests counts n billed requests of an S3 operation, every retry is billed again
+func countS3Requests(operation string, n int) {
+	requestType, ok := s3RequestTypes[operation]
+	if !ok {
+		requestType = "OTHER"
+	}
+	tier := s3RequestTiers[requestType]
+	s3Requests.Add(float64(n), requestType, tier)
+	if price := config.S3RequestPricePer1000[tier]; price > 0 {
+		s3EstimatedCost.Add(float64(n)*price/1000, tier)
+	}
+}
+
+// metricsMiddleware records the count and latency of every request by route
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.Inc(route, c.Request.Method, strconv.Itoa(c.Writer.Status()))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, c.Request.Method)
+	}
+}
+
+// serveMetrics exposes all metrics in the Prometheus text format
+func serveMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(200)
+	for _, m := range metrics {
+		m.write(c.Writer)
+	}
+}
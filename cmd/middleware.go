@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// setGinMode runs gin in mode, in release mode if it is empty and the GIN_MODE
+// environment variable isn't set either
+func setGinMode(mode string) error {
+	switch mode {
+	case "":
+		if os.Getenv(gin.EnvGinMode) == "" {
+			gin.SetMode(gin.ReleaseMode)
+		}
+	case gin.ReleaseMode, gin.DebugMode, gin.TestMode:
+		gin.SetMode(mode)
+	default:
+		return fmt.Errorf("invalid gin_mode %q", mode)
+	}
+	return nil
+}
+
+// checkTrustedProxies returns an error for trusted proxies that are neither an IP nor a CIDR
+func checkTrustedProxies(proxies []string) error {
+	for _, proxy := range proxies {
+		if _, err := netip.ParsePrefix(proxy); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(proxy); err != nil {
+			return fmt.Errorf("trusted proxy %q is neither an IP nor a CIDR", proxy)
+		}
+	}
+	return nil
+}
+
+// defaultMiddleware is the global middleware installed when the config doesn't list any
+var defaultMiddleware = []string{"recovery", "cors", "access_log", "metrics", "error_reporting", "load_shedding", "deadline"}
+
+// globalMiddleware maps the names of the middleware config to the middleware they install
+var globalMiddleware = map[string]func(accessLogWriter io.Writer) gin.HandlerFunc{
+	"recovery":        func(io.Writer) gin.HandlerFunc { return gin.Recovery() },
+	"cors":            func(io.Writer) gin.HandlerFunc { return corsMiddleware() },
+	"access_log":      accessLog,
+	"metrics":         func(io.Writer) gin.HandlerFunc { return metricsMiddleware() },
+	"error_reporting": func(io.Writer) gin.HandlerFunc { return errorReportingRecovery() },
+	"load_shedding":   func(io.Writer) gin.HandlerFunc { return loadShedding() },
+	"deadline":        func(io.Writer) gin.HandlerFunc { return requestDeadline() },
+}
+
+// middlewareNames returns the global middleware to install, in order
+func middlewareNames() []string {
+	if len(config.Middleware) == 0 {
+		return defaultMiddleware
+	}
+	return config.Middleware
+}
+
+// checkMiddleware returns an error for names that aren't global middleware or are listed twice
+func checkMiddleware(names []string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := globalMiddleware[name]; !ok {
+			return fmt.Errorf("unknown middleware %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("middleware %q is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// defaultCORSOrigins are the origins allowed when cors_allow_origins is not set in the config
+var defaultCORSOrigins = []string{"http://localhost:8080", "http://localhost:8081", "http://cryptosnapshotservice.com", "http://api.cryptoservice.com"}
+
+// corsMiddleware answers CORS requests from the configured origins
+func corsMiddleware() gin.HandlerFunc {
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOrigins = defaultCORSOrigins
+	if len(config.CORSAllowOrigins) > 0 {
+		corsConfig.AllowOrigins = config.CORSAllowOrigins
+	}
+	return cors.New(corsConfig)
+}
+
+var maxAgePattern = regexp.MustCompile(`max-age=(\d+)`)
+
+// cacheControlWriter sets the Cache-Control and Expires headers once the handler
+// decided on a successful status, so errors are never cached by an upstream CDN
+type cacheControlWriter struct {
+	gin.ResponseWriter
+	value string
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if code >= http.StatusOK && code < http.StatusMultipleChoices {
+		w.Header().Set("Cache-Control", w.value)
+		if m := maxAgePattern.FindStringSubmatch(w.value); m != nil {
+			maxAge, _ := strconv.Atoi(m[1])
+			w.Header().Set("Expires", time.Now().Add(time.Duration(maxAge)*time.Second).UTC().Format(http.TimeFormat))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// cacheControl applies the Cache-Control header configured for an endpoint group
+func cacheControl(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if value, ok := config.CacheControl[group]; ok {
+			c.Writer = &cacheControlWriter{ResponseWriter: c.Writer, value: value}
+		}
+		c.Next()
+	}
+}
+
+// defaultRequestTimeout is used when request_timeout_seconds is not set in the config
+const defaultRequestTimeout = 30 * time.Second
+
+// requestTimeout returns how long a request may wait for the storage backend
+func requestTimeout() time.Duration {
+	if config.RequestTimeoutSeconds > 0 {
+		return time.Duration(config.RequestTimeoutSeconds) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+// streamingRoutes send bodies of unbounded length, only their storage calls are
+// bounded by the request timeout, by the handlers themselves
+var streamingRoutes = map[string]bool{
+	"/download/:protocol/:network/:filename": true,
+	"/events":                                true,
+	"/events/ws":                             true,
+}
+
+// requestDeadline bounds the work done for a request, so that a hung backend can't
+// pile up requests. Client disconnects cancel the request context too.
+func requestDeadline() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if streamingRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout())
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// defaultShedRetryAfter is used when shed_retry_after_seconds is not set in the config
+const defaultShedRetryAfter = 1
+
+// longLivedRoutes are routes holding their connection open indefinitely. They
+// are exempt from the global in-flight limit, which bounds concurrent work
+// rather than connections, but can be capped with a per-route limit.
+var longLivedRoutes = map[string]bool{
+	"/events":    true,
+	"/events/ws": true,
+}
+
+// loadShedding rejects requests with a 503 once max_in_flight requests, or the
+// limit configured for the route in max_in_flight_per_route, are being served
+func loadShedding() gin.HandlerFunc {
+	var global chan struct{}
+	if config.MaxInFlight > 0 {
+		global = make(chan struct{}, config.MaxInFlight)
+	}
+	perRoute := make(map[string]chan struct{}, len(config.MaxInFlightPerRoute))
+	for route, limit := range config.MaxInFlightPerRoute {
+		// Like max_in_flight, a limit of 0 is no limit rather than shedding every request
+		if limit > 0 {
+			perRoute[route] = make(chan struct{}, limit)
+		}
+	}
+	retryAfter := config.ShedRetryAfterSeconds
+	if retryAfter <= 0 {
+		retryAfter = defaultShedRetryAfter
+	}
+
+	shed := func(c *gin.Context) {
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		abortWithError(c, http.StatusServiceUnavailable, codeOverloaded, "server is overloaded, retry later")
+	}
+
+	return func(c *gin.Context) {
+		if global != nil && !longLivedRoutes[c.FullPath()] {
+			select {
+			case global <- struct{}{}:
+				defer func() { <-global }()
+			default:
+				shed(c)
+				return
+			}
+		}
+		if route, ok := perRoute[c.FullPath()]; ok {
+			select {
+			case route <- struct{}{}:
+				defer func() { <-route }()
+			default:
+				shed(c)
+				return
+			}
+		}
+		c.Next()
+	}
+}
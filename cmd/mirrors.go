@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// mirrorProbeTTL is how long the probed state of the mirrors of a network is reported
+	mirrorProbeTTL = time.Minute
+	// mirrorProbeTimeout bounds the probe of one mirror
+	mirrorProbeTimeout = 5 * time.Second
+)
+
+// Mirror is a server holding a copy of the snapshots below a bucket prefix
+type Mirror struct {
+	Name string `json:"name"`
+	// URL replaces the prefix in the keys of the snapshots, like the CDN base URLs
+	URL string `json:"url"`
+	// Regions are the country and continent codes, e.g. "DE" or "EU", of the clients
+	// /download redirects to the mirror
+	Regions []string `json:"regions"`
+}
+
+// mirrorStatus is the probed state of a mirror of a network
+type mirrorStatus struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Available bool   `json:"available"`
+	// InSync is whether the mirror has the latest snapshot of the network
+	InSync bool `json:"in_sync"`
+	// LastSync is when the mirror's copy of the latest snapshot was written
+	LastSync  *time.Time `json:"last_sync,omitempty"`
+	LatencyMS int64      `json:"latency_ms"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// mirrorReport is the probed state of all mirrors of a network
+type mirrorReport struct {
+	LatestKey string         `json:"latest_key"`
+	Checked   time.Time      `json:"checked"`
+	Mirrors   []mirrorStatus `json:"mirrors"`
+}
+
+var (
+	// mirrorReports caches the mirror reports by protocol/network
+	mirrorReports sync.Map
+	mirrorFlight  flightGroup
+)
+
+// mirrorsOf returns the configured mirrors of key with the URL of key on each, the
+// longest matching prefix wins like for the CDN
+func mirrorsOf(key string) []Mirror {
+	var match string
+	for prefix := range config.Mirrors {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(match) {
+			match = prefix
+		}
+	}
+	var mirrors []Mirror
+	for _, m := range config.Mirrors[match] {
+		m.URL = strings.TrimSuffix(m.URL, "/") + "/" + strings.TrimPrefix(key[len(match):], "/")
+		mirrors = append(mirrors, m)
+	}
+	return mirrors
+}
+
+// closestMirror returns the mirror serving the region of the client, preferring
+// one serving its country over one serving its continent. Mirrors last probed
+// without the snapshot are skipped.
+func closestMirror(c *gin.Context, protocol, network, key string) (Mirror, bool) {
+	country, ok := clientCountry(c)
+	if !ok {
+		return Mirror{}, false
+	}
+	continent := countryContinent[country]
+
+	var report mirrorReport
+	if v, ok := mirrorReports.Load(protocol + "/" + network); ok {
+		report = v.(mirrorReport)
+	}
+	outOfSync := func(name string) bool {
+		if report.LatestKey != key {
+			return false
+		}
+		for _, m := range report.Mirrors {
+			if m.Name == name {
+				return !m.InSync
+			}
+		}
+		return false
+	}
+
+	var best Mirror
+	found := false
+	for _, m := range mirrorsOf(key) {
+		for _, region := range m.Regions {
+			region = strings.ToUpper(region)
+			if region == country && !outOfSync(m.Name) {
+				return m, true
+			}
+			if region == continent && !found && !outOfSync(m.Name) {
+				best, found = m, true
+			}
+		}
+	}
+	return best, found
+}
+
+// probeMirrors checks every mirror of a network for its latest snapshot: the
+// bucket itself, the CDN and the configured mirrors, all at once
+func probeMirrors(ctx context.Context, protocol, network string) (mirrorReport, error) {
+	latest, err := findLatest(ctx, protocol, network)
+	if err != nil {
+		return mirrorReport{}, err
+	}
+	report := mirrorReport{Checked: time.Now().UTC()}
+	if latest == nil {
+		return report, nil
+	}
+	key := *latest.Key
+	report.LatestKey = key
+
+	mirrors := []mirrorStatus{{Name: "s3", URL: "s3://" + keyBucket(key) + "/" + key}}
+	if u, ok := cdnURL(key); ok {
+		mirrors = append(mirrors, mirrorStatus{Name: "cdn", URL: u})
+	}
+	for _, m := range mirrorsOf(key) {
+		mirrors = append(mirrors, mirrorStatus{Name: m.Name, URL: m.URL})
+	}
+
+	var wg sync.WaitGroup
+	for i := range mirrors {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, mirrorProbeTimeout)
+			defer cancel()
+			probeMirror(ctx, &mirrors[i], latest)
+		}()
+	}
+	wg.Wait()
+
+	// Best first: in sync, then available, then fastest
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		a, b := mirrors[i], mirrors[j]
+		if a.InSync != b.InSync {
+			return a.InSync
+		}
+		if a.Available != b.Available {
+			return a.Available
+		}
+		return a.LatencyMS < b.LatencyMS
+	})
+	report.Mirrors = mirrors
+	return report, nil
+}
+
+// probeMirror HEADs the latest snapshot on a mirror, recording whether it answers,
+// how fast, and whether its copy matches the bucket
+func probeMirror(ctx context.Context, m *mirrorStatus, latest *s3.Object) {
+	start := time.Now()
+	var status int
+	var lastModified *time.Time
+	var size int64
+	var err error
+
+	if m.Name == "s3" {
+		var head *s3.HeadObjectOutput
+		svc, bucket := keyClient(storageClient(), *latest.Key)
+		head, err = svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    latest.Key,
+		})
+		if err == nil {
+			status, lastModified, size = http.StatusOK, head.LastModified, aws.Int64Value(head.ContentLength)
+		} else if isNotFound(err) {
+			status, err = http.StatusNotFound, nil
+		}
+	} else {
+		u := m.URL
+		if m.Name == "cdn" {
+			u, err = signCDNURL(u, time.Minute)
+		}
+		var req *http.Request
+		if err == nil {
+			req, err = http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+		}
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.DefaultClient.Do(req)
+		}
+		if err == nil {
+			resp.Body.Close()
+			status, size = resp.StatusCode, resp.ContentLength
+			if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+				lastModified = &t
+			}
+		}
+	}
+	m.LatencyMS = time.Since(start).Milliseconds()
+
+	if err != nil {
+		m.Error = err.Error()
+		return
+	}
+	// A mirror answering at all is available, even if it lacks the snapshot
+	m.Available = status < http.StatusInternalServerError
+	m.InSync = status == http.StatusOK && size == aws.Int64Value(latest.Size)
+	m.LastSync = lastModified
+	if status != http.StatusOK {
+		m.Error = http.StatusText(status)
+	}
+}
+
+// @Summary Get the health of the mirrors of a network
+// @Description Get the availability, latency and last sync time of every mirror of the latest snapshot of a network, best first
+// @Produce json
+// @Success 200 {object} mirrorReport
+// @Router /mirrors/{protocol}/{network} [get]
+func getMirrors(c *gin.Context) {
+	protocol, network := c.Param("protocol"), c.Param("network")
+	cacheKey := protocol + "/" + network
+
+	if v, ok := mirrorReports.Load(cacheKey); ok && time.Since(v.(mirrorReport).Checked) < mirrorProbeTTL {
+		c.JSON(http.StatusOK, v)
+		return
+	}
+	v, err := mirrorFlight.DoContext(c.Request.Context(), cacheKey, func(ctx context.Context) (interface{}, error) {
+		return probeMirrors(ctx, protocol, network)
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	report := v.(mirrorReport)
+	if report.LatestKey == "" {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+	mirrorReports.Store(cacheKey, report)
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultNegativeCacheTTL is used when negative_cache_ttl_seconds is not set in the config
+const defaultNegativeCacheTTL = 30 * time.Second
+
+// missingCache holds when a lookup last found nothing, by "latest:<prefix>" for
+// networks without snapshots and "info:<protocol>/<network>" for networks without
+// a snapshot-latest.json, so that scrapers probing networks that don't exist don't
+// cause one S3 call per request
+var missingCache sync.Map
+
+// negativeCacheTTL returns how long a lookup that found nothing is answered from
+// missingCache, 0 if negative caching is disabled
+func negativeCacheTTL() time.Duration {
+	switch {
+	case config.NegativeCacheTTLSeconds < 0:
+		return 0
+	case config.NegativeCacheTTLSeconds == 0:
+		return defaultNegativeCacheTTL
+	}
+	return time.Duration(config.NegativeCacheTTLSeconds) * time.Second
+}
+
+// rememberMissing records that the lookup of key found nothing
+func rememberMissing(key string) {
+	if negativeCacheTTL() > 0 {
+		missingCache.Store(key, time.Now())
+	}
+}
+
+// knownMissing reports whether the lookup of key found nothing within the negative cache TTL
+func knownMissing(key string) bool {
+	v, ok := missingCache.Load(key)
+	hit := ok && time.Since(v.(time.Time)) < negativeCacheTTL()
+	observeCache("negative", hit)
+	return hit
+}
+
+// forgetMissing drops the lookups of a network that found nothing, once it changed
+func forgetMissing(protocol, network string) {
+	missingCache.Delete("latest:" + protocol + "/" + network + "/")
+	missingCache.Delete("info:" + protocol + "/" + network)
+}
+
+// sweepMissingCache periodically drops expired entries, so the names probed by
+// scrapers don't stay in memory forever
+func sweepMissingCache(interval time.Duration) {
+	for range time.Tick(interval) {
+		ttl := negativeCacheTTL()
+		missingCache.Range(func(k, v interface{}) bool {
+			if time.Since(v.(time.Time)) >= ttl {
+				missingCache.Delete(k)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// notifyClient is the HTTP client used for all outgoing notifications
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// NotifierConfig configures one notification target
+type NotifierConfig struct {
+	// Type is one of webhook, slack, discord or pagerduty
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// RoutingKey is the PagerDuty Events API v2 integration key
+	RoutingKey string `json:"routing_key"`
+}
+
+// The notifier types stale alerts and new snapshot announcements can be sent to
+var (
+	alertNotifierTypes        = []string{"webhook", "slack", "discord", "pagerduty"}
+	announcementNotifierTypes = []string{"slack", "discord"}
+)
+
+// checkNotifiers returns an error for notifiers of other types than types or
+// without the settings their type needs
+func checkNotifiers(notifiers []NotifierConfig, types []string) error {
+	for i, n := range notifiers {
+		switch {
+		case !slices.Contains(types, n.Type):
+			return fmt.Errorf("notifier %d: unknown type %q, must be one of %s", i, n.Type, strings.Join(types, ", "))
+		case n.Type == "pagerduty" && n.RoutingKey == "":
+			return fmt.Errorf("notifier %d: routing_key is required", i)
+		case n.Type != "pagerduty" && n.URL == "":
+			return fmt.Errorf("notifier %d: url is required", i)
+		}
+	}
+	return nil
+}
+
+// postJSON posts body as JSON to target and fails on non-2xx responses. The URL
+// of a webhook is its credential, so it is left out of the errors.
+func postJSON(target string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(target, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notifier responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// withoutURL strips the URL from an error of an HTTP client, for URLs carrying
+// credentials that must not end up in the logs
+func withoutURL(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return fmt.Errorf("%s: %w", uerr.Op, uerr.Err)
+	}
+	return err
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listedFile is an entry of a network listing, only used to document it
+type listedFile struct {
+	Filename     string     `json:"filename"`
+	Size         int64      `json:"size"`
+	SizeHuman    string     `json:"size_human"`
+	LastModified *time.Time `json:"last_modified"`
+	AgeSeconds   int64      `json:"age_seconds,omitempty"`
+	Extension    string     `json:"extension"`
+	Type         string     `json:"type"`
+	URL          string     `json:"url,omitempty"`
+	CDNURL       string     `json:"cdn_url,omitempty"`
+	PresignedURL string     `json:"presigned_url,omitempty"`
+	Compression  string     `json:"compression"`
+}
+
+// apiParam is a parameter of an apiOperation, path parameters are taken from the path
+type apiParam struct {
+	name        string
+	in          string
+	typ         string
+	description string
+}
+
+// apiOperation documents one route of the API in the OpenAPI document
+type apiOperation struct {
+	method      string
+	path        string
+	summary     string
+	description string
+	params      []apiParam
+	// body is the type of the JSON request body, nil for none
+	body reflect.Type
+	// response is the type of the JSON response, nil for a non-JSON or empty one
+	response reflect.Type
+	// contentType is the content type of a non-JSON response
+	contentType string
+	status      int
+	admin       bool
+	// tenant operations need an API key of the tenant and count against its quota
+	tenant bool
+	// listing responses can also be encoded as MessagePack or CBOR, see respondListing
+	listing bool
+}
+
+var (
+	apiPageParams = []apiParam{
+		{"cursor", "query", "string", "Cursor from the previous page"},
+		{"limit", "query", "integer", "Maximum number of entries to return"},
+	}
+	apiOffsetParams = []apiParam{
+		{"offset", "query", "integer", "Number of entries to skip, instead of a cursor, the next offset is in the X-Next-Offset header"},
+		{"order", "query", "string", "asc for oldest first, the default, or desc for newest first, instead of a cursor"},
+	}
+	apiNetworkParams = []apiParam{
+		{"protocol", "path", "string", ""},
+		{"network", "path", "string", ""},
+	}
+	apiFormatParam  = apiParam{"format", "query", "string", "Only snapshots in this compression: zst, lz4, gz, xz, bz2, zip or none"}
+	apiFileParams   = append(apiNetworkParams[:2:2], apiParam{"filename", "path", "string", ""})
+	apiTenantParams = append([]apiParam{{"tenant", "path", "string", ""}}, apiNetworkParams...)
+)
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// apiOperations lists every documented route, keep it in step with registerRoutes
+var apiOperations = []apiOperation{
+	{method: "get", path: "/keys", summary: "List networks", description: "List the protocol/network directories of the bucket",
+		params: apiPageParams, listing: true, response: typeOf[struct {
+			Dirs       []string `json:"dirs"`
+			NextCursor string   `json:"next_cursor,omitempty"`
+		}]()},
+	{method: "get", path: "/stats", summary: "Get the statistics of the networks", description: "Snapshot counts, total sizes and the newest and oldest snapshot of every network, paged by network name",
+		params: apiPageParams, listing: true, response: typeOf[struct {
+			Networks   []networkStats `json:"networks"`
+			NextCursor string         `json:"next_cursor,omitempty"`
+		}]()},
+	{method: "get", path: "/files/{protocol}/{network}", summary: "List the files of a network", description: "List the files of a network with their download URLs, the next page cursor is in the X-Next-Cursor header. With envelope=true the files are wrapped in an object with total_count, total_size_bytes and truncated.",
+		params: append(append(append(apiNetworkParams[:2:2], apiPageParams...), apiOffsetParams...), apiParam{"urls", "query", "boolean", "Set to false to omit download URLs"}, apiFormatParam,
+			apiParam{"envelope", "query", "boolean", "Set to true to wrap the files in an object with the totals of the listing"}), listing: true, response: typeOf[[]listedFile]()},
+	{method: "get", path: "/files/{protocol}/{network}/latest", summary: "Get the latest snapshot of a network", description: "The schema is stable, fields are only added",
+		params: append(apiNetworkParams[:2:2], apiFormatParam), response: typeOf[latestResponse]()},
+	{method: "get", path: "/files/{protocol}/{network}/latest/script", summary: "Get a bootstrap script for the latest snapshot",
+		params: apiNetworkParams, contentType: "text/x-shellscript"},
+	{method: "get", path: "/files/{protocol}/{network}/info", summary: "Get the snapshot-latest.json of a network",
+		params: apiNetworkParams, response: typeOf[map[string]interface{}]()},
+	{method: "get", path: "/files/{protocol}/{network}/checksums.txt", summary: "Get the checksums of a network", description: "Known SHA-256 checksums of all snapshots of the network in the format of sha256sum -c",
+		params: apiNetworkParams, contentType: "text/plain"},
+	{method: "get", path: "/files/{protocol}/{network}/{filename}/torrent", summary: "Get a .torrent of a snapshot", description: "Generated on first request, until it is ready 202 is returned, or 503 when the server is too busy to start generating it",
+		params: apiFileParams, contentType: "application/x-bittorrent"},
+	{method: "get", path: "/files/{protocol}/{network}/{filename}/metalink", summary: "Get the RFC 5854 metalink of a snapshot",
+		params: apiFileParams, contentType: "application/metalink4+xml"},
+	{method: "get", path: "/files/{protocol}/{network}/{filename}/zsync", summary: "Get the zsync control file of a snapshot", description: "Generated on first request, until it is ready 202 is returned, or 503 when the server is too busy to start generating it",
+		params: apiFileParams, contentType: "application/x-zsync"},
+	{method: "get", path: "/files/{protocol}/{network}/{filename}/contents", summary: "List the contents of a snapshot", description: "Files of a tar snapshot with their sizes and offsets in the decompressed archive, indexed when the snapshot is measured. Until the index is ready 202 is returned, or 503 when the server is too busy to start indexing it.",
+		params:   append(apiFileParams[:3:3], apiParam{"prefix", "query", "string", "Only paths starting with this prefix"}, apiParam{"depth", "query", "integer", "Roll the contents of deeper directories up into their ancestor at this depth"}),
+		response: typeOf[[]tarEntry]()},
+	{method: "get", path: "/download/{protocol}/{network}/latest", summary: "Redirect to the latest snapshot", description: "Redirects to the download URL of the latest snapshot, e.g. for wget --content-disposition",
+		params: append(apiNetworkParams[:2:2], apiFormatParam), status: http.StatusFound},
+	{method: "get", path: "/download/{protocol}/{network}/{filename}", summary: "Download a snapshot through the API", description: "Range and If-Range requests are supported",
+		params: apiFileParams, contentType: "application/octet-stream"},
+	{method: "get", path: "/mirrors/{protocol}/{network}", summary: "Get the health of the mirrors of a network", description: "Availability, latency and last sync time of every mirror of the latest snapshot, best first",
+		params: apiNetworkParams, response: typeOf[mirrorReport]()},
+	{method: "get", path: "/t/{tenant}/files/{protocol}/{network}", summary: "List the files of a network of a tenant", description: "Like /files/{protocol}/{network}, from the bucket of the tenant",
+		params: append(append(append(apiTenantParams[:3:3], apiPageParams...), apiOffsetParams...), apiParam{"urls", "query", "boolean", "Set to false to omit download URLs"}, apiFormatParam,
+			apiParam{"envelope", "query", "boolean", "Set to true to wrap the files in an object with the totals of the listing"}), tenant: true, listing: true, response: typeOf[[]listedFile]()},
+	{method: "get", path: "/t/{tenant}/files/{protocol}/{network}/latest", summary: "Get the latest snapshot of a network of a tenant",
+		params: apiTenantParams, tenant: true, response: typeOf[listedFile]()},
+	{method: "get", path: "/t/{tenant}/download/{protocol}/{network}/latest", summary: "Redirect to the latest snapshot of a network of a tenant",
+		params: apiTenantParams, tenant: true, status: http.StatusFound},
+	{method: "get", path: "/metrics", summary: "Get Prometheus metrics", contentType: "text/plain"},
+	{method: "get", path: "/healthz", summary: "Liveness check", response: typeOf[map[string]string]()},
+	{method: "get", path: "/readyz", summary: "Readiness check", response: typeOf[map[string]string]()},
+	{method: "get", path: "/version", summary: "Get the version and enabled features", response: typeOf[map[string]interface{}]()},
+	{method: "get", path: "/openapi.json", summary: "Get this OpenAPI document", response: typeOf[map[string]interface{}]()},
+	{method: "post", path: "/graphql", summary: "Query protocols, networks and snapshots with GraphQL",
+		body: typeOf[struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName,omitempty"`
+			Variables     map[string]interface{} `json:"variables,omitempty"`
+		}](), response: typeOf[map[string]interface{}]()},
+	{method: "get", path: "/events", summary: "Stream snapshot events as server-sent events",
+		params: []apiParam{{"protocol", "query", "string", "Only events of this protocol"}, {"network", "query", "string", "Only events of this network"}}, contentType: "text/event-stream"},
+	{method: "get", path: "/events/ws", summary: "Stream snapshot events over a WebSocket", status: http.StatusSwitchingProtocols},
+
+	{method: "get", path: "/webhooks", summary: "List webhooks", admin: true, response: typeOf[[]webhook]()},
+	{method: "post", path: "/webhooks", summary: "Register a webhook", admin: true, body: typeOf[webhook](), response: typeOf[webhook](), status: http.StatusCreated},
+	{method: "get", path: "/webhooks/{id}", summary: "Get a webhook", admin: true, params: []apiParam{{"id", "path", "string", ""}}, response: typeOf[webhook]()},
+	{method: "put", path: "/webhooks/{id}", summary: "Replace a webhook", admin: true, params: []apiParam{{"id", "path", "string", ""}}, body: typeOf[webhook](), response: typeOf[webhook]()},
+	{method: "delete", path: "/webhooks/{id}", summary: "Delete a webhook", description: "A dry run only checks that the webhook exists and answers 200", admin: true, params: []apiParam{{"id", "path", "string", ""}}, status: http.StatusNoContent},
+
+	{method: "get", path: "/admin/analytics", summary: "Query download analytics", admin: true,
+		params:   []apiParam{{"from", "query", "string", "First day, YYYY-MM-DD"}, {"to", "query", "string", "Last day, YYYY-MM-DD"}, {"group_by", "query", "string", "Comma separated dimensions"}, {"format", "query", "string", "csv for CSV"}},
+		response: typeOf[map[string]interface{}]()},
+	{method: "get", path: "/admin/catalog/snapshots", summary: "Search the snapshot catalog", admin: true,
+		description: "Snapshots of the catalog database, current and deleted, ordered by key",
+		params: append(apiPageParams[:2:2], apiParam{"protocol", "query", "string", ""}, apiParam{"network", "query", "string", ""},
+			apiParam{"state", "query", "string", "in_progress, available or deleted"}, apiParam{"q", "query", "string", "Part of the key"}),
+		response: typeOf[struct {
+			Snapshots  []catalogSnapshot `json:"snapshots"`
+			NextCursor string            `json:"next_cursor,omitempty"`
+		}]()},
+	{method: "get", path: "/admin/protocols", summary: "List registered protocols", admin: true,
+		response: typeOf[struct {
+			Protocols []registeredProtocol `json:"protocols"`
+		}]()},
+	{method: "post", path: "/admin/protocols", summary: "Register a protocol", admin: true, body: typeOf[registeredProtocol](), response: typeOf[registeredProtocol](), status: http.StatusCreated},
+	{method: "get", path: "/admin/protocols/{name}", summary: "Get a registered protocol", admin: true, params: []apiParam{{"name", "path", "string", ""}}, response: typeOf[registeredProtocol]()},
+	{method: "put", path: "/admin/protocols/{name}", summary: "Replace a registered protocol", admin: true, params: []apiParam{{"name", "path", "string", ""}}, body: typeOf[registeredProtocol](), response: typeOf[registeredProtocol]()},
+	{method: "delete", path: "/admin/protocols/{name}", summary: "Delete a registered protocol", description: "Only protocols without registered networks can be deleted. A dry run only checks that it could be and answers 200.",
+		admin: true, params: []apiParam{{"name", "path", "string", ""}}, status: http.StatusNoContent},
+	{method: "get", path: "/admin/networks", summary: "List registered networks", admin: true,
+		description: "Once any network is registered, only registered networks are served instead of every network found in the bucket",
+		params:      []apiParam{{"protocol", "query", "string", "Only networks of this protocol"}},
+		response: typeOf[struct {
+			Networks []registeredNetwork `json:"networks"`
+		}]()},
+	{method: "post", path: "/admin/networks", summary: "Register a network", admin: true, body: typeOf[registeredNetwork](), response: typeOf[registeredNetwork](), status: http.StatusCreated},
+	{method: "get", path: "/admin/networks/{protocol}/{network}", summary: "Get a registered network", admin: true, params: apiNetworkParams, response: typeOf[registeredNetwork]()},
+	{method: "put", path: "/admin/networks/{protocol}/{network}", summary: "Replace a registered network", admin: true, params: apiNetworkParams, body: typeOf[registeredNetwork](), response: typeOf[registeredNetwork]()},
+	{method: "delete", path: "/admin/networks/{protocol}/{network}", summary: "Delete a registered network", description: "Its snapshots stay in the catalog. A dry run only checks that the network is registered and answers 200.",
+		admin: true, params: apiNetworkParams, status: http.StatusNoContent},
+	{method: "get", path: "/admin/reports/usage", summary: "Get the monthly usage report", admin: true,
+		params: []apiParam{{"month", "query", "string", "YYYY-MM"}, {"format", "query", "string", "csv for CSV"}}, response: typeOf[map[string]interface{}]()},
+	{method: "get", path: "/admin/costs", summary: "Estimate the monthly cost of every network", admin: true,
+		description: "Storage of the objects in the bucket of each network and egress of the downloads of the last days projected to 30 days, priced with the costs of the config. Egress is 0 without analytics.",
+		params:      []apiParam{{"days", "query", "integer", "Days of downloads to project the egress from, 30 by default"}},
+		response: typeOf[struct {
+			Currency      string                 `json:"currency"`
+			WindowDays    int                    `json:"window_days"`
+			EgressTracked bool                   `json:"egress_tracked"`
+			Networks      []networkCost          `json:"networks"`
+			Total         map[string]interface{} `json:"total"`
+		}]()},
+	{method: "post", path: "/admin/export", summary: "Export the static site now", admin: true,
+		description: "Queues the export, it can be followed at the job in the Location header", response: typeOf[taskInfo](), status: http.StatusAccepted},
+	{method: "post", path: "/admin/networks/{protocol}/{network}/checksums", summary: "Compute the missing checksums of a network", admin: true,
+		description: "Queues reading every snapshot without a known checksum, the result of the job maps the filenames to their SHA-256",
+		params:      apiNetworkParams, response: typeOf[taskInfo](), status: http.StatusAccepted},
+	{method: "post", path: "/admin/copy", summary: "Copy an object", admin: true,
+		description: "Queues a server-side copy, in parts for objects over 5 GiB. The destination defaults to the bucket and key of the source, one must differ. A dry run only checks the source exists.",
+		body: typeOf[struct {
+			Key               string `json:"key"`
+			DestinationBucket string `json:"destination_bucket,omitempty"`
+			DestinationKey    string `json:"destination_key,omitempty"`
+		}](), response: typeOf[taskInfo](), status: http.StatusAccepted},
+	{method: "post", path: "/admin/restore", summary: "Restore an archived object", admin: true,
+		description: "Queues restoring an object from Glacier for days (7 by default) with the Expedited, Standard (default) or Bulk tier. The job succeeds once the restored copy can be downloaded. A dry run only checks the object exists.",
+		body: typeOf[struct {
+			Key  string `json:"key"`
+			Days int64  `json:"days,omitempty"`
+			Tier string `json:"tier,omitempty"`
+		}](), response: typeOf[taskInfo](), status: http.StatusAccepted},
+	{method: "get", path: "/jobs", summary: "List queued jobs", admin: true,
+		description: "The long operations started through the API newest first, without their logs. Finished jobs are kept for 24 hours.",
+		params:      []apiParam{{"kind", "query", "string", "static-export, checksums, copy or restore"}, {"state", "query", "string", "queued, running, succeeded, failed or canceled"}},
+		response: typeOf[struct {
+			Jobs []taskInfo `json:"jobs"`
+		}]()},
+	{method: "get", path: "/jobs/{id}", summary: "Get a queued job", description: "Its state, progress, logs and result", admin: true,
+		params: []apiParam{{"id", "path", "string", ""}}, response: typeOf[taskInfo]()},
+	{method: "delete", path: "/jobs/{id}", summary: "Cancel a queued job", description: "409 if it finished already", admin: true,
+		params: []apiParam{{"id", "path", "string", ""}}, response: typeOf[taskInfo](), status: http.StatusAccepted},
+	{method: "get", path: "/admin/jobs", summary: "List the background jobs", admin: true,
+		description: "The configured jobs with their schedule, next run and the outcome of their last run",
+		response: typeOf[struct {
+			Jobs []jobStatus `json:"jobs"`
+		}]()},
+	{method: "get", path: "/admin/jobs/{name}", summary: "Get a background job", admin: true, params: []apiParam{{"name", "path", "string", ""}}, response: typeOf[jobStatus]()},
+	{method: "post", path: "/admin/jobs/{name}/run", summary: "Run a background job now", admin: true,
+		description: "Starts the job in the background, 409 if it is running already. Its outcome is reported as last_run. A dry run only logs what the job would change.",
+		params:      []apiParam{{"name", "path", "string", ""}}, response: typeOf[jobStatus](), status: http.StatusAccepted},
+	{method: "get", path: "/admin/snapshot-jobs", summary: "List snapshot jobs", admin: true, description: "Newest first",
+		params: []apiParam{{"protocol", "query", "string", ""}, {"network", "query", "string", ""}, {"state", "query", "string", "pending, running, uploading, published or failed"}},
+		response: typeOf[struct {
+			SnapshotJobs []snapshotJob `json:"snapshot_jobs"`
+		}]()},
+	{method: "post", path: "/admin/snapshot-jobs", summary: "Create a snapshot of a network", admin: true,
+		description: "Triggers the snapshotter of the network, 409 while a job of the network is active. The job is published once a snapshot written after its creation is seen in the bucket.",
+		body: typeOf[struct {
+			Protocol string `json:"protocol"`
+			Network  string `json:"network"`
+		}](), response: typeOf[snapshotJob](), status: http.StatusCreated},
+	{method: "get", path: "/admin/snapshot-jobs/{id}", summary: "Get a snapshot job", admin: true, params: []apiParam{{"id", "path", "string", ""}}, response: typeOf[snapshotJob]()},
+	{method: "post", path: "/snapshot-jobs/{id}/progress", summary: "Report the progress of a snapshot job",
+		description: "Called by snapshotters with the SNAPSHOT_CALLBACK_TOKEN of the job as bearer token",
+		params:      []apiParam{{"id", "path", "string", ""}},
+		body: typeOf[struct {
+			State    string  `json:"state"`
+			Progress float64 `json:"progress,omitempty"`
+			Message  string  `json:"message,omitempty"`
+			Error    string  `json:"error,omitempty"`
+		}](), response: typeOf[snapshotJob]()},
+	{method: "get", path: "/admin/diagnostics", summary: "Check the storage backend", admin: true,
+		description: "Run live checks of the storage backend: reachability, credentials, list and get permissions, clock skew and a presigned download",
+		response:    typeOf[diagnosticsReport]()},
+	{method: "get", path: "/admin/overview", summary: "Get the dashboard overview", admin: true, response: typeOf[map[string]interface{}]()},
+	{method: "post", path: "/admin/networks/{protocol}/{network}/invalidate", summary: "Drop the caches of a network", admin: true, params: apiNetworkParams, status: http.StatusNoContent},
+	{method: "post", path: "/admin/networks/{protocol}/{network}/prune", summary: "Delete all but the newest snapshots of a network", admin: true,
+		description: "The snapshot snapshot-latest.json points at is never deleted",
+		params:      append(apiNetworkParams[:2:2], apiParam{"keep", "query", "integer", "Number of snapshots to keep"}), response: typeOf[map[string]interface{}]()},
+	{method: "post", path: "/admin/networks/{protocol}/{network}/promote", summary: "Point snapshot-latest.json at a snapshot", admin: true,
+		description: "The promoted snapshot is the latest one until a snapshot is uploaded after the promotion",
+		params:      append(apiNetworkParams[:2:2], apiParam{"key", "query", "string", "Key of the snapshot"}), response: typeOf[map[string]interface{}]()},
+	{method: "post", path: "/admin/uploads", summary: "Start a multipart upload of a snapshot", admin: true,
+		body: typeOf[createUploadRequest](), response: typeOf[map[string]interface{}](), status: http.StatusCreated},
+	{method: "post", path: "/admin/uploads/{upload_id}/parts", summary: "Get presigned URLs for parts of an upload", admin: true,
+		params: []apiParam{{"upload_id", "path", "string", ""}}, body: typeOf[uploadPartsRequest](), response: typeOf[map[string]interface{}]()},
+	{method: "post", path: "/admin/uploads/{upload_id}/complete", summary: "Complete an upload and register the snapshot", admin: true,
+		params: []apiParam{{"upload_id", "path", "string", ""}}, body: typeOf[completeUploadRequest](), response: typeOf[map[string]interface{}]()},
+	{method: "delete", path: "/admin/uploads/{upload_id}", summary: "Abort an upload", description: "A dry run only checks that the upload exists and answers 200", admin: true,
+		params: []apiParam{{"upload_id", "path", "string", ""}, {"key", "query", "string", "Key of the upload"}}, status: http.StatusNoContent},
+}
+
+// openAPISchemas collects the schemas of named types for the components section
+type openAPISchemas map[string]interface{}
+
+// schemaOf returns the JSON schema of t as encoding/json marshals it, named
+// structs are put in the components and referenced
+func (s openAPISchemas) schemaOf(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == typeOf[time.Time]():
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		schema := s.schemaOf(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return map[string]interface{}{"type": "object", "additionalProperties": true}
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() != "" {
+			if _, ok := s[t.Name()]; !ok {
+				// Reserve the name first, types may refer to themselves
+				s[t.Name()] = nil
+				s[t.Name()] = s.structSchema(t)
+			}
+			return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		}
+		return s.structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func (s openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = s.schemaOf(f.Type)
+		if strings.Contains(f.Tag.Get("binding"), "required") || (!strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr) {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// buildOpenAPI renders apiOperations as an OpenAPI 3 document, with serverURL as server if it is set
+func buildOpenAPI(serverURL string) map[string]interface{} {
+	schemas := openAPISchemas{}
+	errorSchema := schemas.schemaOf(typeOf[apiError]())
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": errorSchema}},
+		}
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		operation := map[string]interface{}{"summary": op.summary}
+		if op.description != "" {
+			operation["description"] = op.description
+		}
+
+		var params []interface{}
+		for _, p := range op.params {
+			param := map[string]interface{}{"name": p.name, "in": p.in, "required": p.in == "path", "schema": map[string]interface{}{"type": p.typ}}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schemas.schemaOf(op.body)}},
+			}
+		}
+
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case op.response != nil:
+			content := map[string]interface{}{"application/json": map[string]interface{}{"schema": schemas.schemaOf(op.response)}}
+			if op.listing {
+				for mediaType := range listingEncodings {
+					content[mediaType] = content["application/json"]
+				}
+			}
+			success["content"] = content
+		case op.contentType != "":
+			success["content"] = map[string]interface{}{op.contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}
+		}
+		responses := map[string]interface{}{strconv.Itoa(status): success}
+		if len(op.params) > 0 {
+			responses["404"] = errorResponse("Not found")
+		}
+		if op.admin {
+			responses["401"] = errorResponse("Invalid admin token")
+			operation["security"] = []interface{}{map[string]interface{}{"adminToken": []interface{}{}}}
+			operation["tags"] = []string{"admin"}
+		}
+		if op.tenant {
+			responses["401"] = errorResponse("Invalid API key")
+			responses["429"] = errorResponse("Daily quota of the tenant exceeded")
+			operation["security"] = []interface{}{map[string]interface{}{"tenantAPIKey": []interface{}{}}}
+			operation["tags"] = []string{"tenants"}
+		}
+		responses["500"] = errorResponse("Internal error")
+		operation["responses"] = responses
+
+		item, _ := paths[op.path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[op.path] = item
+		}
+		item[op.method] = operation
+		if op.method == "get" && !op.admin && !longLivedRoutes[op.path] {
+			item["head"] = headOperation(operation)
+		}
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Snapshot service API",
+			"description": "Lists, describes and serves blockchain node snapshots stored in an S3 bucket",
+			"version":     version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"adminToken":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"tenantAPIKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+	if serverURL != "" {
+		doc["servers"] = []interface{}{map[string]interface{}{"url": serverURL}}
+	}
+	return doc
+}
+
+// headOperation documents HEAD of a GET operation, which has the same responses
+// without their bodies
+func headOperation(get map[string]interface{}) map[string]interface{} {
+	head := make(map[string]interface{}, len(get))
+	for k, v := range get {
+		head[k] = v
+	}
+	head["summary"] = get["summary"].(string) + ", headers only"
+	responses := map[string]interface{}{}
+	for status, response := range get["responses"].(map[string]interface{}) {
+		responses[status] = map[string]interface{}{"description": response.(map[string]interface{})["description"]}
+	}
+	head["responses"] = responses
+	return head
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// @Summary Get the OpenAPI 3 document
+// @Description Get an OpenAPI 3 document describing all endpoints, for generating clients
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /openapi.json [get]
+func serveOpenAPI(c *gin.Context) {
+	openAPIOnce.Do(func() {
+		// Without a public URL the server is relative to the host, under the base path
+		serverURL := publicURL("")
+		if serverURL == "" {
+			serverURL = basePath()
+		}
+		openAPIJSON, _ = json.MarshalIndent(buildOpenAPI(serverURL), "", "  ")
+	})
+	c.Data(http.StatusOK, "application/json", openAPIJSON)
+}
+
+// runOpenAPI implements the openapi subcommand, it prints the OpenAPI document
+// without a server so it can be checked in and fed to client generators
+func runOpenAPI() {
+	out, err := json.MarshalIndent(buildOpenAPI(""), "", "  ")
+	if err != nil {
+		fatal("Error rendering OpenAPI document", "error", err)
+	}
+	os.Stdout.Write(append(out, '\n'))
+	os.Exit(0)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPageLimit caps the limit query parameter of paginated endpoints
+const maxPageLimit = 1000
+
+// errInvalidCursor is returned for cursors that weren't issued by this API
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor turns the last item of a page into an opaque cursor
+func encodeCursor(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// decodeCursor returns the item a cursor was created from
+func decodeCursor(cursor string) (string, error) {
+	last, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", errInvalidCursor
+	}
+	return string(last), nil
+}
+
+// pageParams reads the cursor and limit query parameters. A limit of 0 means the
+// client did not ask for pagination.
+func pageParams(c *gin.Context) (after string, limit int, err error) {
+	if cursor := c.Query("cursor"); cursor != "" {
+		if after, err = decodeCursor(cursor); err != nil {
+			return "", 0, err
+		}
+	}
+	if l := c.Query("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return "", 0, errors.New("limit must be a positive integer")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+	return after, limit, nil
+}
+
+// offsetParams reads the offset and order query parameters of listings that can be
+// paged by offset as well. desc is set for order=desc, newest first.
+func offsetParams(c *gin.Context) (offset int, desc bool, err error) {
+	if o := c.Query("offset"); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			return 0, false, errors.New("offset must be a non-negative integer")
+		}
+	}
+	switch order := c.Query("order"); order {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return 0, false, errors.New("order must be asc or desc")
+	}
+	return offset, desc, nil
+}
+
+// filesPaging is how a client pages through a listing: by cursor, or by offset and order
+type filesPaging struct {
+	after  string
+	limit  int
+	offset int
+	desc   bool
+	// byOffset is set when the client passed an offset or an order
+	byOffset bool
+}
+
+// parseFilesPaging reads the paging query parameters of a listing
+func parseFilesPaging(c *gin.Context) (filesPaging, error) {
+	var p filesPaging
+	var err error
+	if p.after, p.limit, err = pageParams(c); err != nil {
+		return p, err
+	}
+	if p.offset, p.desc, err = offsetParams(c); err != nil {
+		return p, err
+	}
+	// Offsets are meant for small networks, cursors for walking large ones
+	p.byOffset = c.Query("offset") != "" || p.desc
+	if p.byOffset && c.Query("cursor") != "" {
+		return p, errors.New("cursor can't be combined with offset or order")
+	}
+	return p, nil
+}
+
+// respond writes the page of files the client asked for
+func (p filesPaging) respond(c *gin.Context, files []map[string]interface{}) {
+	if p.byOffset {
+		respondFilesOffset(c, files, p.offset, p.limit, p.desc)
+		return
+	}
+	respondFilesPage(c, files, p.after, p.limit)
+}
+
+// paginateStrings sorts items and returns the page following after, together with
+// the cursor of the next page, which is empty on the last page
+func paginateStrings(items []string, after string, limit int) ([]string, string) {
+	sort.Strings(items)
+	start := sort.SearchStrings(items, after)
+	if after != "" && start < len(items) && items[start] == after {
+		start++
+	}
+	items = items[start:]
+
+	if limit == 0 || len(items) <= limit {
+		return items, ""
+	}
+	return items[:limit], encodeCursor(items[limit-1])
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// networkListTTL is how long the networks found in the bucket are used to
+	// resolve the protocol and network of paths
+	networkListTTL = 5 * time.Minute
+	// maxSuggestions bounds the close matches suggested for an unknown network
+	maxSuggestions = 5
+)
+
+// networkList is the protocol/network pairs of the bucket and its peers
+type networkList struct {
+	networks []string
+	listed   time.Time
+}
+
+var knownNetworks atomic.Pointer[networkList]
+
+// loadNetworks returns the protocol/network pairs of the bucket and its peers,
+// listed at most networkListTTL ago. The last list is kept while the storage
+// backend is failing.
+func loadNetworks(ctx context.Context) ([]string, error) {
+	list := knownNetworks.Load()
+	if list != nil && time.Since(list.listed) < networkListTTL {
+		return list.networks, nil
+	}
+	v, err := sharedStorageCall(ctx, "keys", func(ctx context.Context) (interface{}, error) {
+		return discoverNetworks(ctx)
+	})
+	if err != nil {
+		if list != nil {
+			return list.networks, nil
+		}
+		return nil, err
+	}
+	networks := mergePeerDirs(append(make([]string, 0), v.([]string)...))
+	knownNetworks.Store(&networkList{networks: networks, listed: time.Now()})
+	return networks, nil
+}
+
+// networkAllowed reports whether the protocol/network pair name is served
+func networkAllowed(name string) bool {
+	if len(config.Networks) == 0 {
+		return true
+	}
+	for _, n := range config.Networks {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// servedNetworks returns the registered networks, or else the allowlisted ones.
+// Empty means every network of the bucket is served.
+func servedNetworks() []string {
+	// Registered networks are served like allowlisted ones
+	if registered, ok := registeredNetworkNames(); ok {
+		return registered
+	}
+	return config.Networks
+}
+
+// matchNetwork returns the network of networks that name refers to, ignoring case
+func matchNetwork(name string, networks []string) (string, bool) {
+	for _, n := range networks {
+		if n == name {
+			return n, true
+		}
+	}
+	for _, n := range networks {
+		if strings.EqualFold(n, name) {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// canonicalNetwork resolves the protocol and network of the path case-insensitively
+// to the registered or allowlisted ones or else the ones in the bucket, e.g. Ethereum/Mainnet
+// to ethereum/mainnet. Networks not registered or allowlisted are answered with a 404 listing the
+// valid ones. Without an allowlist, unknown networks close to known ones are answered
+// with a 404 suggesting them, others are left to the handler.
+func canonicalNetwork(c *gin.Context) {
+	name := c.Param("protocol") + "/" + c.Param("network")
+	served := servedNetworks()
+	networks := served
+	if len(networks) == 0 && isHead(c) {
+		// HEAD requests never list the bucket, the networks seen last will do
+		list := knownNetworks.Load()
+		if list == nil {
+			return
+		}
+		networks = list.networks
+	}
+	if len(networks) == 0 {
+		var err error
+		if networks, err = loadNetworks(withRequestID(c.Request.Context(), c)); err != nil {
+			// The handler reports the failing backend
+			return
+		}
+	}
+
+	if n, ok := matchNetwork(name, networks); ok {
+		protocol, network, _ := strings.Cut(n, "/")
+		for i := range c.Params {
+			switch c.Params[i].Key {
+			case "protocol":
+				c.Params[i].Value = protocol
+			case "network":
+				c.Params[i].Value = network
+			}
+		}
+		return
+	}
+
+	if len(served) > 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, apiError{
+			Code:          codeNetworkNotFound,
+			Error:         fmt.Sprintf("network %s is not served, see valid_networks", name),
+			RequestID:     requestID(c),
+			Suggestions:   closeNetworks(name, served),
+			ValidNetworks: served,
+		})
+		return
+	}
+	if suggestions := closeNetworks(name, networks); len(suggestions) > 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, apiError{
+			Code:        codeNetworkNotFound,
+			Error:       fmt.Sprintf("network %s not found, did you mean %s?", name, strings.Join(suggestions, " or ")),
+			RequestID:   requestID(c),
+			Suggestions: suggestions,
+		})
+	}
+}
+
+// closeNetworks returns the networks within a few typos of name, closest first
+func closeNetworks(name string, networks []string) []string {
+	name = strings.ToLower(name)
+	maxDistance := max(2, len(name)/4)
+
+	type match struct {
+		network  string
+		distance int
+	}
+	var matches []match
+	for _, n := range networks {
+		if d := editDistance(name, strings.ToLower(n)); d <= maxDistance {
+			matches = append(matches, match{n, d})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+
+	var suggestions []string
+	for _, m := range matches[:min(len(matches), maxSuggestions)] {
+		suggestions = append(suggestions, m.network)
+	}
+	return suggestions
+}
+
+// editDistance returns the Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// trimTrailingSlash serves paths with trailing slashes like the paths without them,
+// instead of redirecting, which many clients don't follow
+func trimTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimRight(r.URL.Path, "/")
+		if p == r.URL.Path || p == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = strings.TrimRight(r.URL.RawPath, "/")
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// basePath returns the base_path routes are served under, with a leading and
+// without a trailing slash, empty if routes are served at the root
+func basePath() string {
+	p := strings.Trim(config.BasePath, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// publicURL returns the URL of path under public_url and the base path, empty if
+// public_url is not set
+func publicURL(path string) string {
+	if config.PublicURL == "" {
+		return ""
+	}
+	base := strings.TrimSuffix(config.PublicURL, "/")
+	if prefix := basePath(); !strings.HasSuffix(base, prefix) {
+		base += prefix
+	}
+	return base + path
+}
+
+// stripBasePath serves the paths under prefix as the paths without it, so routes
+// are registered without it, and answers all other paths with a JSON 404
+func stripBasePath(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if p == r.URL.Path || (p != "" && p[0] != '/') {
+			// Outside of the router, the request gets its ID here
+			id := incomingRequestID(r.Header)
+			w.Header().Set(requestIDHeader, id)
+			w.Header().Set("Content-Type", jsonContentType)
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(apiError{Code: codeRouteNotFound, Error: "no route for " + r.Method + " " + r.URL.Path + ", the API is served under " + prefix, RequestID: id})
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + strings.TrimPrefix(p, "/")
+		r2.URL.RawPath = ""
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.RawPath, prefix), "/")
+		}
+		// The Swagger UI resolves its files from the request URI
+		r2.RequestURI = r2.URL.RequestURI()
+		next.ServeHTTP(w, r2)
+	})
+}
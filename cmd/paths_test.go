@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTolerantPaths(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		status      int
+		suggestions []string
+	}{
+		{"canonical", "/files/nimiq/mainnet/latest", http.StatusOK, nil},
+		{"trailing slash", "/files/nimiq/mainnet/latest/", http.StatusOK, nil},
+		{"mixed case", "/files/Nimiq/MainNet/latest", http.StatusOK, nil},
+		{"mixed case and trailing slashes", "/files/NIMIQ/MAINNET//", http.StatusOK, nil},
+		{"typo", "/files/nimiq/mainet/latest", http.StatusNotFound, []string{"nimiq/mainnet"}},
+		{"typo in the protocol", "/download/nimqi/mainnet/latest", http.StatusNotFound, []string{"nimiq/mainnet"}},
+		{"unknown network", "/files/nimiq/testnet/latest", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestAPI(t)
+			w := serve(r, "GET", tt.target, "", false)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusNotFound {
+				return
+			}
+			var body apiError
+			decode(t, w, &body)
+			if body.Code != codeNetworkNotFound {
+				t.Errorf("code %s, want %s", body.Code, codeNetworkNotFound)
+			}
+			if !reflect.DeepEqual(body.Suggestions, tt.suggestions) {
+				t.Errorf("suggestions %v, want %v", body.Suggestions, tt.suggestions)
+			}
+		})
+	}
+}
+
+func TestCloseNetworks(t *testing.T) {
+	networks := []string{"ethereum/mainnet", "ethereum/holesky", "ethereum/sepolia", "nimiq/mainnet", "nimiq/testnet"}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"ethereum/mainet", []string{"ethereum/mainnet"}},
+		{"Etherium/Holesky", []string{"ethereum/holesky"}},
+		{"nimiq/mainnnet", []string{"nimiq/mainnet"}},
+		{"bitcoin/mainnet", nil},
+	}
+	for _, tt := range tests {
+		if got := closeNetworks(tt.name, networks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("closeNetworks(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"mainnet", "mainnet", 0},
+		{"mainnet", "mainet", 1},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNetworkAllowlist(t *testing.T) {
+	r, storage := newTestAPI(t)
+	config.Networks = []string{"nimiq/mainnet", "nimiq/testnet"}
+	storage.put("ethereum/mainnet/2024-02-01.tar.zst", "not allowlisted", newerTime)
+
+	if w := serve(r, "GET", "/files/Nimiq/Testnet", "", false); w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("allowlisted network without snapshots: status %d, body %s", w.Code, w.Body.String())
+	}
+
+	w := serve(r, "GET", "/files/ethereum/mainnet", "", false)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("network not allowlisted: status %d, want 404", w.Code)
+	}
+	var body apiError
+	decode(t, w, &body)
+	if body.Code != codeNetworkNotFound || !reflect.DeepEqual(body.ValidNetworks, config.Networks) {
+		t.Errorf("network not allowlisted: code %s, valid networks %v", body.Code, body.ValidNetworks)
+	}
+
+	var keys struct {
+		Dirs []string `json:"dirs"`
+	}
+	decode(t, serve(r, "GET", "/keys", "", false), &keys)
+	if !reflect.DeepEqual(keys.Dirs, []string{"nimiq/mainnet"}) {
+		t.Errorf("keys lists %v, want only the allowlisted networks in the bucket", keys.Dirs)
+	}
+
+	if reply := latestMessage("ethereum", "mainnet"); strings.Contains(reply, "2024-02-01") {
+		t.Errorf("telegram reply %q for a network not allowlisted", reply)
+	}
+	if reply := latestMessage("Nimiq", "Mainnet"); !strings.Contains(reply, "2024-02-01") {
+		t.Errorf("telegram reply %q, want the latest snapshot of the allowlisted network", reply)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	newTestAPI(t)
+	config.BasePath = "snapshots-api/"
+	config.PublicURL = "https://example.com"
+	r := newRouter(io.Discard)
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/snapshots-api/files/nimiq/mainnet/latest", http.StatusOK},
+		{"/snapshots-api/files/nimiq/mainnet/", http.StatusOK},
+		{"/snapshots-api/healthz", http.StatusOK},
+		{"/files/nimiq/mainnet/latest", http.StatusNotFound},
+		{"/snapshots-apix/files/nimiq/mainnet/latest", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serve(r, "GET", tt.target, "", false); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.status)
+		}
+	}
+	w := serve(r, "GET", "/files/nimiq/mainnet/latest", "", false)
+	var apiErr apiError
+	decode(t, w, &apiErr)
+	if apiErr.Code != codeRouteNotFound || apiErr.RequestID == "" || w.Header().Get(requestIDHeader) != apiErr.RequestID {
+		t.Errorf("404 outside of the base path %+v, X-Request-ID %q", apiErr, w.Header().Get(requestIDHeader))
+	}
+
+	if w := serve(r, "GET", "/snapshots-api/docs/index.html", "", false); !strings.Contains(w.Body.String(), "swagger-ui") {
+		t.Errorf("Swagger UI not served under the base path: %s", w.Body.String())
+	}
+
+	for _, base := range []string{"https://example.com/", "https://example.com/snapshots-api"} {
+		config.PublicURL = base
+		if got, want := publicURL("/download/a"), "https://example.com/snapshots-api/download/a"; got != want {
+			t.Errorf("public_url %s: link %s, want %s", base, got, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// defaultPresignTTL is how long the download URL of the latest snapshot is valid
+	// unless configured otherwise
+	defaultPresignTTL = 15 * time.Minute
+	// defaultListingPresignTTL is the same for the download URLs of a listing
+	defaultListingPresignTTL = 30 * time.Minute
+	// maxPresignTTL is the longest validity S3 accepts for a presigned URL
+	maxPresignTTL = 7 * 24 * time.Hour
+)
+
+// presignTTL returns how long the download URLs handed out by route for a network
+// are valid: presign_ttl_per_network for the network, else presign_ttl_per_route
+// for the route, else presign_ttl_seconds, else fallback
+func presignTTL(route, protocol, network string, fallback time.Duration) time.Duration {
+	seconds := config.PresignTTLSeconds
+	if s, ok := config.PresignTTLPerRoute[route]; ok {
+		seconds = s
+	}
+	if s, ok := config.PresignTTLPerNetwork[protocol+"/"+network]; ok {
+		seconds = s
+	}
+	if seconds <= 0 {
+		return fallback
+	}
+	return min(time.Duration(seconds)*time.Second, maxPresignTTL)
+}
+
+// presignReuseFraction is the share of a presigned URL's lifetime during which it is
+// handed out again instead of signing a new one. Clients always get at least the
+// remaining 20% of the TTL to start their download.
+const presignReuseFraction = 0.8
+
+// presignedURL is a cached presigned GetObject URL
+type presignedURL struct {
+	url        string
+	reuseUntil time.Time
+}
+
+// Define the presigned URL cache, keyed by object key and TTL
+var presignCache = sync.Map{}
+
+// presignGetObject returns a presigned GetObject URL for key valid for ttl, reusing
+// a previously signed URL as long as enough of its lifetime is left
+func presignGetObject(svc s3iface.S3API, key string, ttl time.Duration) (string, error) {
+	if bucket := keyBucket(key); bucket != config.BucketName {
+		return presignBucketObject(bucketClient(bucket), bucket, key, ttl)
+	}
+	return presignBucketObject(svc, config.BucketName, key, ttl)
+}
+
+// presignBucketObject returns a presigned GetObject URL for key in bucket like
+// presignGetObject
+func presignBucketObject(svc s3iface.S3API, bucket, key string, ttl time.Duration) (string, error) {
+	name := "s3|" + key
+	if bucket != config.BucketName {
+		name = "s3|" + bucket + "/" + key
+	}
+	return reuseSignedURL(name, ttl, func() (string, error) {
+		req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		presignsIssued.Inc("s3")
+		return req.Presign(ttl)
+	})
+}
+
+// isPublic reports whether key is world-readable according to public, the longest
+// matching prefix wins like for the CDN
+func isPublic(key string) bool {
+	var match string
+	for prefix := range config.Public {
+		if strings.HasPrefix(key, prefix) && len(prefix) >= len(match) {
+			match = prefix
+		}
+	}
+	return config.Public[match]
+}
+
+// publicObjectURL returns the plain, unsigned URL of key in its bucket. svc is
+// used for the configured bucket, the buckets of registered networks get their own
+// client like for presignGetObject.
+func publicObjectURL(svc s3iface.S3API, key string) (string, error) {
+	svc, bucket := keyClient(svc, key)
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	// Building resolves the endpoint and addressing style without signing
+	if err := req.Build(); err != nil {
+		return "", err
+	}
+	return req.HTTPRequest.URL.String(), nil
+}
+
+// objectURL returns the URL of key in the bucket: its plain URL if it is public,
+// a presigned URL valid for ttl otherwise
+func objectURL(svc s3iface.S3API, key string, ttl time.Duration) (string, error) {
+	if isPublic(key) {
+		return publicObjectURL(svc, key)
+	}
+	return presignGetObject(svc, key, ttl)
+}
+
+// reuseSignedURL returns the URL cached for name and ttl, or signs a new one
+func reuseSignedURL(name string, ttl time.Duration, sign func() (string, error)) (string, error) {
+	cacheKey := name + "|" + ttl.String()
+	v, ok := presignCache.Load(cacheKey)
+	hit := ok && time.Now().Before(v.(presignedURL).reuseUntil)
+	observeCache("presign", hit)
+	if hit {
+		return v.(presignedURL).url, nil
+	}
+
+	signedAt := time.Now()
+	urlStr, err := sign()
+	if err != nil {
+		return "", err
+	}
+
+	presignCache.Store(cacheKey, presignedURL{
+		url:        urlStr,
+		reuseUntil: signedAt.Add(time.Duration(float64(ttl) * presignReuseFraction)),
+	})
+	return urlStr, nil
+}
+
+// sweepPresignCache periodically drops cached URLs that may no longer be reused,
+// so objects that disappeared from the bucket don't keep their entries forever
+func sweepPresignCache(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		presignCache.Range(func(k, v interface{}) bool {
+			if now.After(v.(presignedURL).reuseUntil) {
+				presignCache.Delete(k)
+			}
+			return true
+		})
+	}
+}
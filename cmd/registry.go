@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// registrySchema creates the tables of the protocols and networks registered by
+// admins, it is applied on every start with catalogSchema
+const registrySchema = `
+CREATE TABLE IF NOT EXISTS registry_protocols (
+	name         text PRIMARY KEY,
+	display_name text NOT NULL,
+	created_at   timestamptz NOT NULL,
+	updated_at   timestamptz NOT NULL
+);
+CREATE TABLE IF NOT EXISTS registry_networks (
+	protocol                  text NOT NULL REFERENCES registry_protocols (name),
+	network                   text NOT NULL,
+	display_name              text NOT NULL,
+	bucket                    text NOT NULL,
+	expected_interval_seconds integer NOT NULL,
+	flavors                   text[] NOT NULL,
+	created_at                timestamptz NOT NULL,
+	updated_at                timestamptz NOT NULL,
+	PRIMARY KEY (protocol, network)
+);
+`
+
+// registeredProtocol is a protocol registered by an admin
+type registeredProtocol struct {
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// registeredNetwork is a network registered by an admin. Once any network is
+// registered, only registered networks are served instead of every network found
+// in the bucket.
+type registeredNetwork struct {
+	Protocol    string `json:"protocol"`
+	Network     string `json:"network"`
+	DisplayName string `json:"display_name"`
+	// Bucket holds the snapshots of the network, the configured bucket if empty
+	Bucket string `json:"bucket"`
+	// ExpectedIntervalSeconds is how often a new snapshot is expected, overriding
+	// expected_interval_seconds of the config unless 0
+	ExpectedIntervalSeconds int `json:"expected_interval_seconds"`
+	// Flavors are the kinds of snapshots taken of the network, e.g. pruned or archive
+	Flavors   []string  `json:"flavors"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// networkRegistry is the registered networks as last loaded from the catalog
+type networkRegistry struct {
+	// networks are ordered by protocol/network
+	networks []registeredNetwork
+	byName   map[string]registeredNetwork
+}
+
+// registry is nil until loaded, or when the catalog is disabled
+var registry atomic.Pointer[networkRegistry]
+
+var (
+	// registryNamePattern matches protocol, network and flavor names, which are path segments
+	registryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// bucketNamePattern matches S3 bucket names
+	bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+)
+
+var (
+	errRegistryNotFound = errors.New("not registered")
+	errRegistryExists   = errors.New("already registered")
+	errNoProtocol       = errors.New("protocol not registered")
+	errProtocolInUse    = errors.New("protocol has registered networks")
+)
+
+// registeredNetworkNames returns the protocol/network pairs of the registered
+// networks that are served, false if no network is registered
+func registeredNetworkNames() ([]string, bool) {
+	r := registry.Load()
+	if r == nil || len(r.networks) == 0 {
+		return nil, false
+	}
+	names := make([]string, 0, len(r.networks))
+	for _, n := range r.networks {
+		if name := n.Protocol + "/" + n.Network; networkAllowed(name) {
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
+
+// lookupRegisteredNetwork returns the registration of a network, if it is registered
+func lookupRegisteredNetwork(protocol, network string) (registeredNetwork, bool) {
+	r := registry.Load()
+	if r == nil {
+		return registeredNetwork{}, false
+	}
+	n, ok := r.byName[protocol+"/"+network]
+	return n, ok
+}
+
+// keyBucket returns the bucket holding key, or the objects below the prefix key:
+// the bucket of its registered network or else the configured bucket
+func keyBucket(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) == 3 {
+		if n, ok := lookupRegisteredNetwork(parts[0], parts[1]); ok && n.Bucket != "" {
+			return n.Bucket
+		}
+	}
+	return config.BucketName
+}
+
+// snapshotBuckets returns every bucket snapshots are kept in: the configured one and
+// those of the registered networks and the tenants
+func snapshotBuckets() []string {
+	buckets := []string{config.BucketName}
+	seen := map[string]bool{config.BucketName: true}
+	add := func(bucket string) {
+		if bucket != "" && !seen[bucket] {
+			seen[bucket] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	if r := registry.Load(); r != nil {
+		for _, n := range r.networks {
+			add(n.Bucket)
+		}
+	}
+	for _, t := range config.Tenants {
+		add(t.BucketName)
+	}
+	return buckets
+}
+
+// reloadRegistry loads the registered networks from the catalog.
+// Every instance reloads them on each catalog sync, the instance changing them
+// right away.
+func reloadRegistry(ctx context.Context) error {
+	networks, err := catalog.networks(ctx, "")
+	if err != nil {
+		return err
+	}
+	r := &networkRegistry{networks: networks, byName: make(map[string]registeredNetwork, len(networks))}
+	for _, n := range networks {
+		r.byName[n.Protocol+"/"+n.Network] = n
+	}
+	registry.Store(r)
+	// Paths are resolved against the registered networks from now on
+	knownNetworks.Store(nil)
+	return nil
+}
+
+// protocols returns the registered protocols ordered by name
+func (s *catalogStore) protocols(ctx context.Context) ([]registeredProtocol, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, display_name, created_at, updated_at FROM registry_protocols ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	protocols := make([]registeredProtocol, 0)
+	for rows.Next() {
+		var p registeredProtocol
+		if err := rows.Scan(&p.Name, &p.DisplayName, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		protocols = append(protocols, p)
+	}
+	return protocols, rows.Err()
+}
+
+// saveProtocol creates p, or replaces its display name if create is not set
+func (s *catalogStore) saveProtocol(ctx context.Context, p *registeredProtocol, create bool) error {
+	now := time.Now().UTC()
+	if create {
+		_, err := s.db.ExecContext(ctx, `INSERT INTO registry_protocols (name, display_name, created_at, updated_at) VALUES ($1, $2, $3, $3)`,
+			p.Name, p.DisplayName, now)
+		if isUniqueViolation(err) {
+			return errRegistryExists
+		}
+		p.CreatedAt, p.UpdatedAt = now, now
+		return err
+	}
+	err := s.db.QueryRowContext(ctx, `UPDATE registry_protocols SET display_name = $2, updated_at = $3 WHERE name = $1 RETURNING created_at`,
+		p.Name, p.DisplayName, now).Scan(&p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errRegistryNotFound
+	}
+	p.UpdatedAt = now
+	return err
+}
+
+// deleteProtocol deletes a protocol without registered networks. In dry run the
+// deletion is rolled back, so it only reports whether it would succeed.
+func (s *catalogStore) deleteProtocol(ctx context.Context, name string, dry bool) error {
+	return s.deleteRegistration(ctx, dry, `DELETE FROM registry_protocols WHERE name = $1`, name)
+}
+
+// registryNetworkColumns are the columns of registry_networks in the order networks scans them
+const registryNetworkColumns = `protocol, network, display_name, bucket, expected_interval_seconds, flavors, created_at, updated_at`
+
+// networks returns the registered networks of protocol, of all protocols if it is
+// empty, ordered by protocol and network
+func (s *catalogStore) networks(ctx context.Context, protocol string) ([]registeredNetwork, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+registryNetworkColumns+` FROM registry_networks
+WHERE $1 = '' OR protocol = $1 ORDER BY protocol, network`, protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	networks := make([]registeredNetwork, 0)
+	for rows.Next() {
+		var n registeredNetwork
+		err := rows.Scan(&n.Protocol, &n.Network, &n.DisplayName, &n.Bucket, &n.ExpectedIntervalSeconds,
+			pq.Array(&n.Flavors), &n.CreatedAt, &n.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, rows.Err()
+}
+
+// saveNetwork creates n, or replaces everything but its creation time if create is not set
+func (s *catalogStore) saveNetwork(ctx context.Context, n *registeredNetwork, create bool) error {
+	now := time.Now().UTC()
+	if create {
+		_, err := s.db.ExecContext(ctx, `INSERT INTO registry_networks (`+registryNetworkColumns+`)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $7)`,
+			n.Protocol, n.Network, n.DisplayName, n.Bucket, n.ExpectedIntervalSeconds, pq.Array(n.Flavors), now)
+		switch {
+		case isUniqueViolation(err):
+			return errRegistryExists
+		case isForeignKeyViolation(err):
+			return errNoProtocol
+		}
+		n.CreatedAt, n.UpdatedAt = now, now
+		return err
+	}
+	err := s.db.QueryRowContext(ctx, `UPDATE registry_networks
+SET display_name = $3, bucket = $4, expected_interval_seconds = $5, flavors = $6, updated_at = $7
+WHERE protocol = $1 AND network = $2 RETURNING created_at`,
+		n.Protocol, n.Network, n.DisplayName, n.Bucket, n.ExpectedIntervalSeconds, pq.Array(n.Flavors), now).Scan(&n.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errRegistryNotFound
+	}
+	n.UpdatedAt = now
+	return err
+}
+
+// deleteNetwork deletes the registration of a network, its snapshots stay in the
+// catalog. In dry run the deletion is rolled back.
+func (s *catalogStore) deleteNetwork(ctx context.Context, protocol, network string, dry bool) error {
+	return s.deleteRegistration(ctx, dry, `DELETE FROM registry_networks WHERE protocol = $1 AND network = $2`, protocol, network)
+}
+
+// deleteRegistration runs a DELETE of a registration in a transaction that is only
+// committed if dry is not set
+func (s *catalogStore) deleteRegistration(ctx context.Context, dry bool, query string, args ...interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if isForeignKeyViolation(err) {
+		return errProtocolInUse
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errRegistryNotFound
+	}
+	if dry {
+		return nil
+	}
+	return tx.Commit()
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// validateProtocol checks a protocol submitted by a client, the display name defaults to its name
+func validateProtocol(p *registeredProtocol) error {
+	if !registryNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("name must be letters, digits, dots, dashes and underscores")
+	}
+	if p.DisplayName == "" {
+		p.DisplayName = p.Name
+	}
+	return nil
+}
+
+// validateNetwork checks a network submitted by a client, the display name defaults to its name
+func validateNetwork(n *registeredNetwork) error {
+	if !registryNamePattern.MatchString(n.Protocol) || !registryNamePattern.MatchString(n.Network) {
+		return fmt.Errorf("protocol and network must be letters, digits, dots, dashes and underscores")
+	}
+	if n.Bucket != "" && !bucketNamePattern.MatchString(n.Bucket) {
+		return fmt.Errorf("bucket %q is not a valid bucket name", n.Bucket)
+	}
+	if n.ExpectedIntervalSeconds < 0 {
+		return fmt.Errorf("expected_interval_seconds must not be negative")
+	}
+	seen := make(map[string]bool, len(n.Flavors))
+	for _, f := range n.Flavors {
+		if !registryNamePattern.MatchString(f) {
+			return fmt.Errorf("flavor %q must be letters, digits, dots, dashes and underscores", f)
+		}
+		if seen[f] {
+			return fmt.Errorf("flavor %q is listed twice", f)
+		}
+		seen[f] = true
+	}
+	if n.Flavors == nil {
+		n.Flavors = []string{}
+	}
+	sort.Strings(n.Flavors)
+	if n.DisplayName == "" {
+		n.DisplayName = n.Network
+	}
+	return nil
+}
+
+// registryEnabled answers 404 and returns false when the catalog is disabled
+func registryEnabled(c *gin.Context) bool {
+	if catalog == nil {
+		respondError(c, http.StatusNotFound, codeFeatureDisabled, "Catalog is disabled")
+		return false
+	}
+	return true
+}
+
+// respondRegistryError answers a failed change of the registry, which is reloaded after every successful one
+func respondRegistryError(c *gin.Context, err error, notFoundCode, what string) {
+	switch {
+	case errors.Is(err, errRegistryNotFound):
+		respondError(c, http.StatusNotFound, notFoundCode, what+" is not registered")
+	case errors.Is(err, errNoProtocol):
+		respondError(c, http.StatusNotFound, codeProtocolNotFound, "Register the protocol of the network first")
+	case errors.Is(err, errRegistryExists):
+		respondError(c, http.StatusConflict, codeAlreadyExists, what+" is already registered")
+	case errors.Is(err, errProtocolInUse):
+		respondError(c, http.StatusConflict, codeProtocolInUse, "Delete the networks of the protocol first")
+	default:
+		respondInternalError(c, err)
+	}
+}
+
+// reloadRegistryAfterChange reloads the registry after c changed it, failures only
+// delay the change until the next catalog sync
+func reloadRegistryAfterChange(c *gin.Context) {
+	if err := reloadRegistry(withRequestID(c.Request.Context(), c)); err != nil {
+		logger.Error("Reloading the network registry failed", "error", err)
+	}
+}
+
+func listProtocols(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	protocols, err := catalog.protocols(withRequestID(c.Request.Context(), c))
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"protocols": protocols})
+}
+
+func getProtocol(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	protocols, err := catalog.protocols(withRequestID(c.Request.Context(), c))
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	for _, p := range protocols {
+		if p.Name == c.Param("name") {
+			c.JSON(http.StatusOK, p)
+			return
+		}
+	}
+	respondError(c, http.StatusNotFound, codeProtocolNotFound, "Protocol not registered")
+}
+
+// createProtocol registers a protocol, networks can only be registered for registered protocols
+func createProtocol(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	var p registeredProtocol
+	if err := c.ShouldBindJSON(&p); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateProtocol(&p); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := catalog.saveProtocol(withRequestID(c.Request.Context(), c), &p, true); err != nil {
+		respondRegistryError(c, err, codeProtocolNotFound, "Protocol "+p.Name)
+		return
+	}
+	reloadRegistryAfterChange(c)
+	c.JSON(http.StatusCreated, p)
+}
+
+// updateProtocol replaces the display name of a protocol
+func updateProtocol(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	var p registeredProtocol
+	if err := c.ShouldBindJSON(&p); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	p.Name = c.Param("name")
+	if err := validateProtocol(&p); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := catalog.saveProtocol(withRequestID(c.Request.Context(), c), &p, false); err != nil {
+		respondRegistryError(c, err, codeProtocolNotFound, "Protocol "+p.Name)
+		return
+	}
+	reloadRegistryAfterChange(c)
+	c.JSON(http.StatusOK, p)
+}
+
+// deleteProtocol deletes a protocol, which must have no registered networks left
+func deleteProtocol(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	dry := dryRun(c)
+	if err := catalog.deleteProtocol(withRequestID(c.Request.Context(), c), c.Param("name"), dry); err != nil {
+		respondRegistryError(c, err, codeProtocolNotFound, "Protocol "+c.Param("name"))
+		return
+	}
+	if dry {
+		logDryRun(c, "protocol deletion", "protocol", c.Param("name"))
+		c.JSON(http.StatusOK, gin.H{"name": c.Param("name"), "dry_run": true})
+		return
+	}
+	reloadRegistryAfterChange(c)
+	c.Status(http.StatusNoContent)
+}
+
+// listRegisteredNetworks returns the registered networks, of the protocol query parameter if given
+func listRegisteredNetworks(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	networks, err := catalog.networks(withRequestID(c.Request.Context(), c), c.Query("protocol"))
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"networks": networks})
+}
+
+func getRegisteredNetwork(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	networks, err := catalog.networks(withRequestID(c.Request.Context(), c), c.Param("protocol"))
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	for _, n := range networks {
+		if n.Network == c.Param("network") {
+			c.JSON(http.StatusOK, n)
+			return
+		}
+	}
+	respondError(c, http.StatusNotFound, codeNetworkNotFound, "Network not registered")
+}
+
+// createRegisteredNetwork registers a network of a registered protocol
+func createRegisteredNetwork(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	var n registeredNetwork
+	if err := c.ShouldBindJSON(&n); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateNetwork(&n); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := catalog.saveNetwork(withRequestID(c.Request.Context(), c), &n, true); err != nil {
+		respondRegistryError(c, err, codeProtocolNotFound, "Network "+n.Protocol+"/"+n.Network)
+		return
+	}
+	reloadRegistryAfterChange(c)
+	c.JSON(http.StatusCreated, n)
+}
+
+// updateRegisteredNetwork replaces the display name, bucket, expected interval and flavors of a network
+func updateRegisteredNetwork(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	var n registeredNetwork
+	if err := c.ShouldBindJSON(&n); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	n.Protocol, n.Network = c.Param("protocol"), c.Param("network")
+	if err := validateNetwork(&n); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := catalog.saveNetwork(withRequestID(c.Request.Context(), c), &n, false); err != nil {
+		respondRegistryError(c, err, codeNetworkNotFound, "Network "+n.Protocol+"/"+n.Network)
+		return
+	}
+	reloadRegistryAfterChange(c)
+	c.JSON(http.StatusOK, n)
+}
+
+// deleteRegisteredNetwork deletes the registration of a network
+func deleteRegisteredNetwork(c *gin.Context) {
+	if !registryEnabled(c) {
+		return
+	}
+	dry := dryRun(c)
+	if err := catalog.deleteNetwork(withRequestID(c.Request.Context(), c), c.Param("protocol"), c.Param("network"), dry); err != nil {
+		respondRegistryError(c, err, codeNetworkNotFound, "Network "+c.Param("protocol")+"/"+c.Param("network"))
+		return
+	}
+	if dry {
+		logDryRun(c, "network deletion", "protocol", c.Param("protocol"), "network", c.Param("network"))
+		c.JSON(http.StatusOK, gin.H{"protocol": c.Param("protocol"), "network": c.Param("network"), "dry_run": true})
+		return
+	}
+	reloadRegistryAfterChange(c)
+	c.Status(http.StatusNoContent)
+}
+
+func registerRegistryRoutes(admin *gin.RouterGroup) {
+	admin.GET("/protocols", listProtocols)
+	admin.POST("/protocols", createProtocol)
+	admin.GET("/protocols/:name", getProtocol)
+	admin.PUT("/protocols/:name", updateProtocol)
+	admin.DELETE("/protocols/:name", deleteProtocol)
+	admin.GET("/networks", listRegisteredNetworks)
+	admin.POST("/networks", createRegisteredNetwork)
+	admin.GET("/networks/:protocol/:network", getRegisteredNetwork)
+	admin.PUT("/networks/:protocol/:network", updateRegisteredNetwork)
+	admin.DELETE("/networks/:protocol/:network", deleteRegisteredNetwork)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// networkUsage is the usage of one network in a month
+type networkUsage struct {
+	Network           string `json:"network"`
+	Downloads         int    `json:"downloads"`
+	BytesPresigned    int64  `json:"bytes_presigned"`
+	BytesServed       int64  `json:"bytes_served"`
+	StorageBytes      int64  `json:"storage_bytes"`
+	StorageAddedBytes int64  `json:"storage_added_bytes"`
+	FilesAdded        int    `json:"files_added"`
+}
+
+// usageColumns are the CSV columns of the usage report, in the order of networkUsage
+var usageColumns = []string{"network", "downloads", "bytes_presigned", "bytes_served", "storage_bytes", "storage_added_bytes", "files_added"}
+
+func (u *networkUsage) record() []string {
+	return []string{
+		u.Network,
+		strconv.Itoa(u.Downloads),
+		strconv.FormatInt(u.BytesPresigned, 10),
+		strconv.FormatInt(u.BytesServed, 10),
+		strconv.FormatInt(u.StorageBytes, 10),
+		strconv.FormatInt(u.StorageAddedBytes, 10),
+		strconv.Itoa(u.FilesAdded),
+	}
+}
+
+// parseMonth parses the YYYY-MM month query parameter into a half-open time
+// range, defaulting to the current month
+func parseMonth(param string) (time.Time, time.Time, error) {
+	if param == "" {
+		param = time.Now().UTC().Format("2006-01")
+	}
+	from, err := time.Parse("2006-01", param)
+	if err != nil {
+		return from, from, fmt.Errorf("invalid month %q", param)
+	}
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+// getUsageReport summarizes downloads, bytes presigned and served, and storage
+// growth per network for the month given as YYYY-MM, as JSON or as CSV with
+// format=csv. Storage is derived from the objects currently in the bucket, so
+// objects deleted since do not count towards past months.
+func getUsageReport(c *gin.Context) {
+	from, to, err := parseMonth(c.Query("month"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	ctx := withRequestID(c.Request.Context(), c)
+	names, err := discoverNetworks(ctx)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	usage := make(map[string]*networkUsage, len(names))
+	for _, n := range names {
+		usage[n] = &networkUsage{Network: n}
+	}
+
+	var mu sync.Mutex
+	err = fanOut(ctx, len(names), requestFanOut, func(i int) {
+		n := names[i]
+		protocol, network, _ := strings.Cut(n, "/")
+		files, err := loadFiles(ctx, protocol, network)
+		if err != nil {
+			requestLogger(c).Warn("Usage report failed to list network", "protocol", protocol, "network", network, "error", err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		u := usage[n]
+		for _, f := range files {
+			lastModified, _ := f["last_modified"].(*time.Time)
+			if lastModified == nil || !lastModified.Before(to) {
+				continue
+			}
+			size := f["size"].(int64)
+			u.StorageBytes += size
+			if !lastModified.Before(from) {
+				u.StorageAddedBytes += size
+				u.FilesAdded++
+			}
+		}
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	if analytics != nil {
+		err = analytics.scan(from, to, func(e downloadEvent) {
+			n := e.Protocol + "/" + e.Network
+			u, ok := usage[n]
+			if !ok {
+				u = &networkUsage{Network: n}
+				usage[n] = u
+			}
+			if !e.Resumed {
+				u.Downloads++
+			}
+			if e.Kind == "proxy" {
+				u.BytesServed += e.Bytes
+			} else {
+				u.BytesPresigned += e.Bytes
+			}
+		})
+		if err != nil {
+			respondInternalError(c, err)
+			return
+		}
+	}
+
+	rows := make([]*networkUsage, 0, len(usage))
+	for _, u := range usage {
+		rows = append(rows, u)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Network < rows[j].Network })
+
+	month := from.Format("2006-01")
+	if c.Query("format") == "csv" {
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, month))
+		w := csv.NewWriter(c.Writer)
+		w.Write(usageColumns)
+		for _, u := range rows {
+			w.Write(u.record())
+		}
+		w.Flush()
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"month": month, "networks": rows})
+}
+
+// bytesPerGB is the size of the GB storage and egress are billed by, a GiB like S3 counts
+const bytesPerGB = 1 << 30
+
+// defaultCostWindowDays is how many days of downloads the egress is projected from
+// unless days is set
+const defaultCostWindowDays = 30
+
+// CostPrices are the prices of a bucket, in the currency of the cost settings
+type CostPrices struct {
+	StoragePerGBMonth float64 `json:"storage_per_gb_month"`
+	EgressPerGB       float64 `json:"egress_per_gb"`
+}
+
+// CostSettings are the prices the spend of the networks is estimated with
+type CostSettings struct {
+	// Currency is only reported, e.g. USD
+	Currency string `json:"currency"`
+	CostPrices
+	// Buckets are the prices of the buckets of registered networks or tenants that
+	// differ, by bucket name
+	Buckets map[string]CostPrices `json:"buckets"`
+}
+
+// costsEnabled reports whether any price is configured
+func costsEnabled() bool {
+	return config.Costs.CostPrices != (CostPrices{}) || len(config.Costs.Buckets) > 0
+}
+
+// bucketPrices returns the prices of a bucket
+func bucketPrices(bucket string) CostPrices {
+	if prices, ok := config.Costs.Buckets[bucket]; ok {
+		return prices
+	}
+	return config.Costs.CostPrices
+}
+
+// networkCost is the estimated monthly spend of one network
+type networkCost struct {
+	Network      string `json:"network"`
+	Bucket       string `json:"bucket"`
+	StorageBytes int64  `json:"storage_bytes"`
+	// MonthlyEgressBytes are the bytes downloaded over the window, projected to 30 days
+	MonthlyEgressBytes int64   `json:"monthly_egress_bytes"`
+	StorageCost        float64 `json:"storage_cost"`
+	EgressCost         float64 `json:"egress_cost"`
+	TotalCost          float64 `json:"total_cost"`
+}
+
+// roundCents rounds a cost to two decimals
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// getCostEstimate estimates the monthly storage and egress cost of every network
+// from the objects in its bucket and the downloads of the last days, 30 by default,
+// with the configured prices. Egress counts the presigned and proxied bytes, so it
+// is 0 without analytics.
+func getCostEstimate(c *gin.Context) {
+	if !costsEnabled() {
+		respondError(c, http.StatusNotFound, codeFeatureDisabled, "Cost estimation is disabled")
+		return
+	}
+	days := defaultCostWindowDays
+	if param := c.Query("days"); param != "" {
+		var err error
+		if days, err = strconv.Atoi(param); err != nil || days < 1 || days > 366 {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "days must be between 1 and 366")
+			return
+		}
+	}
+
+	ctx := withRequestID(c.Request.Context(), c)
+	names, err := discoverNetworks(ctx)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	costs := make(map[string]*networkCost, len(names))
+	for _, n := range names {
+		costs[n] = &networkCost{Network: n}
+	}
+
+	var mu sync.Mutex
+	err = fanOut(ctx, len(names), requestFanOut, func(i int) {
+		n := names[i]
+		protocol, network, _ := strings.Cut(n, "/")
+		files, err := loadFiles(ctx, protocol, network)
+		if err != nil {
+			requestLogger(c).Warn("Cost estimate failed to list network", "protocol", protocol, "network", network, "error", err)
+			return
+		}
+		var size int64
+		for _, f := range files {
+			size += f["size"].(int64)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		costs[n].StorageBytes = size
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	egress := map[string]int64{}
+	if analytics != nil {
+		now := time.Now()
+		err = analytics.scan(now.AddDate(0, 0, -days), now, func(e downloadEvent) {
+			n := e.Protocol + "/" + e.Network
+			if _, ok := costs[n]; !ok {
+				costs[n] = &networkCost{Network: n}
+			}
+			egress[n] += e.Bytes
+		})
+		if err != nil {
+			respondInternalError(c, err)
+			return
+		}
+	}
+
+	rows := make([]*networkCost, 0, len(costs))
+	var storageBytes, egressBytes int64
+	var storageCost, egressCost float64
+	for n, cost := range costs {
+		cost.Bucket = keyBucket(n + "/")
+		prices := bucketPrices(cost.Bucket)
+		cost.MonthlyEgressBytes = egress[n] * 30 / int64(days)
+		cost.StorageCost = roundCents(float64(cost.StorageBytes) / bytesPerGB * prices.StoragePerGBMonth)
+		cost.EgressCost = roundCents(float64(cost.MonthlyEgressBytes) / bytesPerGB * prices.EgressPerGB)
+		cost.TotalCost = roundCents(cost.StorageCost + cost.EgressCost)
+		storageBytes += cost.StorageBytes
+		egressBytes += cost.MonthlyEgressBytes
+		storageCost += cost.StorageCost
+		egressCost += cost.EgressCost
+		rows = append(rows, cost)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].TotalCost > rows[j].TotalCost || rows[i].TotalCost == rows[j].TotalCost && rows[i].Network < rows[j].Network
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"currency":       config.Costs.Currency,
+		"window_days":    days,
+		"egress_tracked": analytics != nil,
+		"networks":       rows,
+		"total": gin.H{
+			"storage_bytes":        storageBytes,
+			"monthly_egress_bytes": egressBytes,
+			"storage_cost":         roundCents(storageCost),
+			"egress_cost":          roundCents(egressCost),
+			"total_cost":           roundCents(storageCost + egressCost),
+		},
+	})
+}
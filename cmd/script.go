@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// bootstrapURLTTL is how long the download URL in a bootstrap script is valid
+// when there is no stable URL, long enough for a slow download to be resumed
+const bootstrapURLTTL = 24 * time.Hour
+
+// shellQuote quotes s as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellComment makes s safe to put in a shell comment, a line break in a key
+// would otherwise end the comment and run the rest of the key
+func shellComment(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+var bootstrapTemplate = template.Must(template.New("bootstrap").Funcs(template.FuncMap{"quote": shellQuote, "comment": shellComment}).Parse(`#!/bin/sh
+# Downloads, verifies and extracts the latest {{comment .Protocol}}/{{comment .Network}} snapshot.
+# Generated {{.Generated.Format "2006-01-02T15:04:05Z07:00"}} for {{comment .Key}}
+#
+# Usage: sh script.sh [target directory]
+# Re-running it resumes an interrupted download.
+set -eu
+
+TARGET_DIR="${1:-.}"
+FILENAME={{quote .Filename}}
+URL={{quote .URL}}
+SIZE={{.Size}}
+SHA256={{quote .SHA256}}
+
+mkdir -p "$TARGET_DIR"
+cd "$TARGET_DIR"
+
+echo "Downloading $FILENAME ($SIZE bytes)"
+if command -v curl >/dev/null 2>&1; then
+	curl -fL --retry 5 -C - -o "$FILENAME" "$URL"
+else
+	wget -c --tries=5 -O "$FILENAME" "$URL"
+fi
+
+if [ -n "$SHA256" ]; then
+	echo "Verifying checksum"
+	if command -v sha256sum >/dev/null 2>&1; then
+		echo "$SHA256  $FILENAME" | sha256sum -c -
+	else
+		echo "$SHA256  $FILENAME" | shasum -a 256 -c -
+	fi
+else
+	echo "No checksum is published for $FILENAME, skipping verification" >&2
+fi
+{{if .Extract}}
+echo "Extracting $FILENAME"
+{{.Extract}} "$FILENAME"
+rm -f "$FILENAME"
+{{end}}
+echo "Done"
+`))
+
+// @Summary Get a bootstrap script for the latest snapshot
+// @Description Get a shell script that downloads the latest snapshot of a network (resumable), verifies its checksum and extracts it to the directory given as its first argument
+// @Produce text/x-shellscript
+// @Success 200 {string} string
+// @Router /files/{protocol}/{network}/latest/script [get]
+func bootstrapScript(c *gin.Context) {
+	protocol := c.Param("protocol")
+	network := c.Param("network")
+	ctx := withRequestID(c.Request.Context(), c)
+
+	latest, err := findLatest(ctx, protocol, network)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	if latest == nil {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+	key := *latest.Key
+
+	svc, bucket := keyClient(storageClient(), key)
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		respondDownloadError(c, err)
+		return
+	}
+
+	// Scripts end up in runbooks, so prefer a URL that doesn't expire
+	u := stableURL(key)
+	if u == "" {
+		if u, err = downloadURL(svc, key, bootstrapURLTTL); err != nil {
+			respondInternalError(c, err)
+			return
+		}
+	}
+
+	extract := detectFormat(key).Extract
+	var body bytes.Buffer
+	err = bootstrapTemplate.Execute(&body, map[string]interface{}{
+		"Protocol":  protocol,
+		"Network":   network,
+		"Key":       key,
+		"Filename":  path.Base(key),
+		"URL":       u,
+		"Size":      aws.Int64Value(head.ContentLength),
+		"SHA256":    objectSHA256(ctx, key, head),
+		"Extract":   extract,
+		"Generated": time.Now().UTC(),
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	recordDownload(c, "script", protocol, network, key, aws.Int64Value(head.ContentLength), false)
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", protocol+"-"+network+"-bootstrap.sh"))
+	c.Data(http.StatusOK, "text/x-shellscript; charset=utf-8", body.Bytes())
+}
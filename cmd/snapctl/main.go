@@ -0,0 +1,468 @@
+// snapctl is a command line client of the snapshot service API: it lists networks
+// and snapshots, shows the latest snapshot of a network and fetches and verifies
+// snapshots with progress and resume.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: snapctl [-api URL] <command> [arguments]
+
+Commands:
+  networks                               List the networks with snapshots
+  files PROTOCOL/NETWORK                 List the snapshots of a network
+  latest PROTOCOL/NETWORK                Show the latest snapshot of a network
+  fetch [-o DIR] PROTOCOL/NETWORK [FILE] Download the latest or the given snapshot, resuming
+                                         a previous attempt, and verify its checksum
+  verify PROTOCOL/NETWORK FILE           Verify a downloaded snapshot against its published checksum
+
+The API URL defaults to $SNAPCTL_API or http://localhost:8080.
+`
+
+// client talks to the snapshot service API at base
+type client struct {
+	base string
+	http *http.Client
+}
+
+// latest is the part of the /latest response snapctl uses
+type latest struct {
+	Filename           string     `json:"filename"`
+	Key                string     `json:"key"`
+	URL                string     `json:"url"`
+	CDNURL             string     `json:"cdn_url"`
+	Size               int64      `json:"size"`
+	LastModified       *time.Time `json:"last_modified"`
+	SHA256             *string    `json:"sha256"`
+	Compression        string     `json:"compression"`
+	DecompressCommand  *string    `json:"decompress_command"`
+	EstimatedDiskBytes int64      `json:"estimated_disk_bytes"`
+	UncompressedSize   *int64     `json:"uncompressed_size"`
+	Stale              bool       `json:"stale"`
+}
+
+// metalink is the part of a metalink document snapctl uses
+type metalink struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Size   int64  `xml:"size"`
+		Hashes []struct {
+			Type  string `xml:"type,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"hash"`
+		URLs []string `xml:"url"`
+	} `xml:"file"`
+}
+
+// snapshot is a file to fetch or verify
+type snapshot struct {
+	name   string
+	url    string
+	size   int64
+	sha256 string
+}
+
+func main() {
+	api := os.Getenv("SNAPCTL_API")
+	if api == "" {
+		api = "http://localhost:8080"
+	}
+	flag.StringVar(&api, "api", api, "Base URL of the snapshot service API")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{base: strings.TrimSuffix(api, "/"), http: &http.Client{}}
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "networks":
+		err = c.networks()
+	case "files":
+		err = withNetwork(args, 1, 1, c.files)
+	case "latest":
+		err = withNetwork(args, 1, 1, c.latest)
+	case "fetch":
+		fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+		dir := fs.String("o", ".", "Directory to download into")
+		fs.Parse(args)
+		err = withNetwork(fs.Args(), 1, 2, func(protocol, network string, rest []string) error {
+			return c.fetch(protocol, network, rest, *dir)
+		})
+	case "verify":
+		err = withNetwork(args, 2, 2, c.verify)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "snapctl:", err)
+		os.Exit(1)
+	}
+}
+
+// withNetwork splits the PROTOCOL/NETWORK argument and checks the argument count
+func withNetwork(args []string, minArgs, maxArgs int, run func(protocol, network string, rest []string) error) error {
+	if len(args) < minArgs || len(args) > maxArgs {
+		flag.Usage()
+		os.Exit(2)
+	}
+	protocol, network, ok := strings.Cut(args[0], "/")
+	if !ok || protocol == "" || network == "" {
+		return fmt.Errorf("%q is not PROTOCOL/NETWORK", args[0])
+	}
+	return run(protocol, network, args[1:])
+}
+
+// get fetches path from the API and returns the response if it is a 200
+func (c *client) get(path string) (*http.Response, error) {
+	resp, err := c.http.Get(c.base + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		// Servers before error codes were introduced sent a message instead of an error
+		var body struct {
+			Message   string `json:"message"`
+			Error     string `json:"error"`
+			RequestID string `json:"request_id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if msg := body.Message + body.Error; msg != "" {
+			if body.RequestID != "" {
+				return nil, fmt.Errorf("%s: %s (request %s)", resp.Status, msg, body.RequestID)
+			}
+			return nil, fmt.Errorf("%s: %s", resp.Status, msg)
+		}
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// getJSON fetches path from the API and decodes the JSON response into v
+func (c *client) getJSON(path string, v interface{}) (*http.Response, error) {
+	resp, err := c.get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return resp, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func networkPath(protocol, network string) string {
+	return "/files/" + url.PathEscape(protocol) + "/" + url.PathEscape(network)
+}
+
+func (c *client) networks() error {
+	cursor := ""
+	for {
+		var page struct {
+			Dirs       []string `json:"dirs"`
+			NextCursor string   `json:"next_cursor"`
+		}
+		if _, err := c.getJSON("/keys?cursor="+url.QueryEscape(cursor), &page); err != nil {
+			return err
+		}
+		for _, d := range page.Dirs {
+			fmt.Println(d)
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func (c *client) files(protocol, network string, _ []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSIZE\tLAST MODIFIED")
+	cursor := ""
+	for {
+		var files []struct {
+			Filename     string     `json:"filename"`
+			Size         int64      `json:"size"`
+			LastModified *time.Time `json:"last_modified"`
+		}
+		resp, err := c.getJSON(networkPath(protocol, network)+"?urls=false&cursor="+url.QueryEscape(cursor), &files)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", filepath.Base(f.Filename), humanSize(f.Size), formatTime(f.LastModified))
+		}
+		if cursor = resp.Header.Get("X-Next-Cursor"); cursor == "" {
+			return w.Flush()
+		}
+	}
+}
+
+func (c *client) latest(protocol, network string, _ []string) error {
+	var l latest
+	if _, err := c.getJSON(networkPath(protocol, network)+"/latest", &l); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "File:\t%s\n", l.Filename)
+	fmt.Fprintf(w, "Size:\t%s (%d bytes)\n", humanSize(l.Size), l.Size)
+	fmt.Fprintf(w, "Last modified:\t%s\n", formatTime(l.LastModified))
+	if l.SHA256 != nil {
+		fmt.Fprintf(w, "SHA-256:\t%s\n", *l.SHA256)
+	}
+	fmt.Fprintf(w, "Compression:\t%s\n", l.Compression)
+	if l.DecompressCommand != nil {
+		fmt.Fprintf(w, "Extract with:\t%s\n", *l.DecompressCommand)
+	}
+	if l.UncompressedSize != nil {
+		fmt.Fprintf(w, "Uncompressed:\t%s\n", humanSize(*l.UncompressedSize))
+	}
+	if l.EstimatedDiskBytes > 0 {
+		fmt.Fprintf(w, "Disk needed:\t~%s\n", humanSize(l.EstimatedDiskBytes))
+	}
+	if l.Stale {
+		fmt.Fprintf(w, "Warning:\tthe API could not reach storage, this may not be the latest snapshot\n")
+	}
+	fmt.Fprintf(w, "URL:\t%s\n", l.URL)
+	if l.CDNURL != "" {
+		fmt.Fprintf(w, "CDN URL:\t%s\n", l.CDNURL)
+	}
+	return w.Flush()
+}
+
+// lookup returns the latest snapshot of a network, or the named one if rest holds a file name
+func (c *client) lookup(protocol, network string, rest []string) (snapshot, error) {
+	if len(rest) == 0 {
+		var l latest
+		if _, err := c.getJSON(networkPath(protocol, network)+"/latest", &l); err != nil {
+			return snapshot{}, err
+		}
+		s := snapshot{name: l.Filename, url: l.URL, size: l.Size}
+		if l.CDNURL != "" {
+			s.url = l.CDNURL
+		}
+		if l.SHA256 != nil {
+			s.sha256 = *l.SHA256
+		}
+		return s, nil
+	}
+
+	// The metalink has the checksum and mirrors of any snapshot
+	name := filepath.Base(rest[0])
+	resp, err := c.get(networkPath(protocol, network) + "/" + url.PathEscape(name) + "/metalink")
+	if err != nil {
+		return snapshot{}, err
+	}
+	defer resp.Body.Close()
+	var doc metalink
+	if err := xml.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return snapshot{}, err
+	}
+	if len(doc.Files) == 0 || len(doc.Files[0].URLs) == 0 {
+		return snapshot{}, errors.New("metalink lists no mirrors")
+	}
+	f := doc.Files[0]
+	s := snapshot{name: f.Name, url: strings.TrimSpace(f.URLs[0]), size: f.Size}
+	for _, h := range f.Hashes {
+		if h.Type == "sha-256" {
+			s.sha256 = strings.TrimSpace(h.Value)
+		}
+	}
+	return s, nil
+}
+
+// localName is the file a snapshot named name by the server is saved as, without
+// any directories so it can't be written outside the destination
+func localName(name string) (string, error) {
+	base := filepath.Base(name)
+	if name == "" || base == "." || base == ".." || base == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return base, nil
+}
+
+func (c *client) fetch(protocol, network string, rest []string, dir string) error {
+	s, err := c.lookup(protocol, network, rest)
+	if err != nil {
+		return err
+	}
+	name, err := localName(s.name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	dest := filepath.Join(dir, name)
+	partial := dest + ".part"
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > s.size {
+		offset = 0
+	}
+
+	if offset < s.size {
+		req, err := http.NewRequest(http.MethodGet, s.url, nil)
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			fmt.Fprintf(os.Stderr, "Resuming %s at %s\n", name, humanSize(offset))
+		case http.StatusOK:
+			offset = 0
+		default:
+			return fmt.Errorf("download: %s", resp.Status)
+		}
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		p := &progress{name: name, done: offset, total: s.size, start: time.Now(), startDone: offset}
+		_, err = io.Copy(io.MultiWriter(f, p), resp.Body)
+		p.finish()
+		if err != nil {
+			return fmt.Errorf("download broke off, run the same command again to resume: %w", err)
+		}
+		if p.done != s.size {
+			return fmt.Errorf("download broke off at %s of %s, run the same command again to resume", humanSize(p.done), humanSize(s.size))
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if s.sha256 != "" {
+		if err := verifyFile(partial, s.sha256); err != nil {
+			os.Remove(partial)
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Checksum OK")
+	} else {
+		fmt.Fprintln(os.Stderr, "No checksum is published, not verified")
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		return err
+	}
+	fmt.Println(dest)
+	return nil
+}
+
+func (c *client) verify(protocol, network string, rest []string) error {
+	s, err := c.lookup(protocol, network, rest)
+	if err != nil {
+		return err
+	}
+	if s.sha256 == "" {
+		return fmt.Errorf("no checksum is published for %s", s.name)
+	}
+	if err := verifyFile(rest[0], s.sha256); err != nil {
+		return err
+	}
+	fmt.Printf("%s: OK\n", rest[0])
+	return nil
+}
+
+// verifyFile checks the SHA-256 of the file at path against the hex checksum want
+func verifyFile(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != strings.ToLower(want) {
+		return fmt.Errorf("%s: checksum mismatch: got %s, want %s", path, got, want)
+	}
+	return nil
+}
+
+// progress prints a progress line to stderr as bytes are written to it
+type progress struct {
+	name        string
+	done, total int64
+	start       time.Time
+	startDone   int64
+	lastPrint   time.Time
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.lastPrint) >= 500*time.Millisecond {
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *progress) print() {
+	p.lastPrint = time.Now()
+	rate := float64(p.done-p.startDone) / time.Since(p.start).Seconds()
+	percent := 100.0
+	if p.total > 0 {
+		percent = 100 * float64(p.done) / float64(p.total)
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %s / %s (%.1f%%) %s/s   ", p.name, humanSize(p.done), humanSize(p.total), percent, humanSize(int64(rate)))
+}
+
+func (p *progress) finish() {
+	p.print()
+	fmt.Fprintln(os.Stderr)
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
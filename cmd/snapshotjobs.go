@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// States of snapshot jobs. Published and failed jobs are finished and never change again.
+const (
+	snapshotJobPending   = "pending"
+	snapshotJobRunning   = "running"
+	snapshotJobUploading = "uploading"
+	snapshotJobPublished = "published"
+	snapshotJobFailed    = "failed"
+)
+
+const (
+	// defaultSnapshotJobTimeout fails jobs not published in time unless the
+	// snapshotter has a timeout_seconds
+	defaultSnapshotJobTimeout = 6 * time.Hour
+	// snapshotterTimeout bounds triggering a snapshotter
+	snapshotterTimeout = 30 * time.Second
+	// serviceAccountDir holds the credentials of the pod's service account in Kubernetes
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// Snapshotter triggers the creation of a snapshot of a network. It gets the job in
+// SNAPSHOT_* variables, or as JSON body for webhooks, and reports its progress to
+// SNAPSHOT_CALLBACK_URL with SNAPSHOT_CALLBACK_TOKEN as bearer token.
+type Snapshotter struct {
+	// Type is webhook, ssh or kubernetes
+	Type string `json:"type"`
+	// URL receives the job as POST for webhook snapshotters, signed with Secret like webhooks
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Host (host:port) is logged in to as User with the private key at KeyPath for ssh
+	// snapshotters, HostKey is its public key in authorized_keys format. Command must
+	// return once the snapshot is started, e.g. by starting a systemd unit.
+	Host    string `json:"host"`
+	User    string `json:"user"`
+	KeyPath string `json:"key_path"`
+	HostKey string `json:"host_key"`
+	Command string `json:"command"`
+	// JobTemplate is the path of a batch/v1 Job manifest in JSON, created in Namespace
+	// for kubernetes snapshotters with the job in the environment of its containers.
+	// The service runs in the cluster with a service account allowed to create jobs.
+	Namespace   string `json:"namespace"`
+	JobTemplate string `json:"job_template"`
+	// TimeoutSeconds fails jobs not published within it, 6 hours if 0
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// snapshotJob is the creation of a snapshot of a network by a snapshotter
+type snapshotJob struct {
+	ID       string `json:"id"`
+	Protocol string `json:"protocol"`
+	Network  string `json:"network"`
+	// Snapshotter is the type of the snapshotter triggered
+	Snapshotter string `json:"snapshotter"`
+	State       string `json:"state"`
+	// Progress is the share of the snapshot done from 0 to 1, as reported by the snapshotter
+	Progress float64 `json:"progress"`
+	Message  string  `json:"message,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	// Key is the published snapshot
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Token authenticates the progress reports of the snapshotter
+	Token string `json:"token,omitempty"`
+}
+
+func (j *snapshotJob) finished() bool {
+	return j.State == snapshotJobPublished || j.State == snapshotJobFailed
+}
+
+// finish moves the job to a final state, the caller must hold the store's lock
+func (j *snapshotJob) finish(state string, now time.Time) {
+	j.State, j.UpdatedAt, j.FinishedAt = state, now, &now
+	if state == snapshotJobPublished {
+		j.Progress = 1
+	}
+}
+
+// withoutToken returns a copy of j that is safe to return from the API
+func withoutToken(j *snapshotJob) *snapshotJob {
+	c := *j
+	c.Token = ""
+	return &c
+}
+
+// snapshotJobStore holds the snapshot jobs, persisted to a JSON file if a path is set
+type snapshotJobStore struct {
+	mu   sync.Mutex
+	path string
+	jobs map[string]*snapshotJob
+}
+
+// Define the snapshot job store
+var snapshotJobs = &snapshotJobStore{jobs: make(map[string]*snapshotJob)}
+
+// load reads the jobs persisted at path, a missing file is an empty store
+func (s *snapshotJobStore) load(path string) error {
+	s.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []*snapshotJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		s.jobs[j.ID] = j
+	}
+	return nil
+}
+
+// save persists the jobs, the caller must hold s.mu
+func (s *snapshotJobStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// list returns all jobs newest first, the caller must hold s.mu
+func (s *snapshotJobStore) list() []*snapshotJob {
+	jobs := make([]*snapshotJob, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].CreatedAt.After(jobs[k].CreatedAt) })
+	return jobs
+}
+
+// active returns the unfinished job of a network, the caller must hold s.mu
+func (s *snapshotJobStore) active(protocol, network string) *snapshotJob {
+	for _, j := range s.jobs {
+		if j.Protocol == protocol && j.Network == network && !j.finished() {
+			return j
+		}
+	}
+	return nil
+}
+
+// update changes a job with fn and persists it, failures to persist are logged as
+// the state is still right in memory
+func (s *snapshotJobStore) update(id string, fn func(j *snapshotJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	fn(j)
+	if err := s.save(); err != nil {
+		logger.Error("Error saving snapshot jobs", "error", err)
+	}
+}
+
+// networkSnapshotter returns the snapshotter of a network, the "*" one for
+// networks without their own
+func networkSnapshotter(protocol, network string) (Snapshotter, bool) {
+	s, ok := config.Snapshotters[protocol+"/"+network]
+	if !ok {
+		s, ok = config.Snapshotters["*"]
+	}
+	return s, ok
+}
+
+// checkSnapshotters validates the configured snapshotters
+func checkSnapshotters(snapshotters map[string]Snapshotter) error {
+	if len(snapshotters) > 0 && config.PublicURL == "" {
+		return fmt.Errorf("snapshotters need public_url to report their progress to")
+	}
+	for name, s := range snapshotters {
+		var err error
+		switch s.Type {
+		case "webhook":
+			if u, parseErr := url.Parse(s.URL); parseErr != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				err = fmt.Errorf("url must be an absolute http(s) URL")
+			}
+		case "ssh":
+			if s.Host == "" || s.User == "" || s.KeyPath == "" || s.HostKey == "" || s.Command == "" {
+				err = fmt.Errorf("host, user, key_path, host_key and command are required")
+			} else if _, _, _, _, parseErr := ssh.ParseAuthorizedKey([]byte(s.HostKey)); parseErr != nil {
+				err = fmt.Errorf("host_key: %w", parseErr)
+			}
+		case "kubernetes":
+			if s.Namespace == "" || s.JobTemplate == "" {
+				err = fmt.Errorf("namespace and job_template are required")
+			} else {
+				_, err = loadJobTemplate(s.JobTemplate)
+			}
+		default:
+			err = fmt.Errorf("unknown type %q, must be webhook, ssh or kubernetes", s.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("snapshotter %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// snapshotJobEnv returns the variables describing a job to its snapshotter
+func snapshotJobEnv(j *snapshotJob) map[string]string {
+	prefix := j.Protocol + "/" + j.Network + "/"
+	return map[string]string{
+		"SNAPSHOT_JOB_ID":         j.ID,
+		"SNAPSHOT_PROTOCOL":       j.Protocol,
+		"SNAPSHOT_NETWORK":        j.Network,
+		"SNAPSHOT_BUCKET":         keyBucket(prefix),
+		"SNAPSHOT_PREFIX":         prefix,
+		"SNAPSHOT_CALLBACK_URL":   publicURL("/snapshot-jobs/" + j.ID + "/progress"),
+		"SNAPSHOT_CALLBACK_TOKEN": j.Token,
+	}
+}
+
+// triggerSnapshotter starts the snapshotter of a job, which is running once it is started
+func triggerSnapshotter(s Snapshotter, j snapshotJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotterTimeout)
+	defer cancel()
+
+	env := snapshotJobEnv(&j)
+	var err error
+	switch s.Type {
+	case "webhook":
+		err = triggerWebhookSnapshotter(ctx, s, env)
+	case "ssh":
+		err = triggerSSHSnapshotter(s, env)
+	case "kubernetes":
+		err = triggerKubernetesSnapshotter(ctx, s, &j, env)
+	}
+
+	snapshotJobs.update(j.ID, func(job *snapshotJob) {
+		if job.State != snapshotJobPending {
+			return
+		}
+		now := time.Now().UTC()
+		if err != nil {
+			job.Error = "triggering the snapshotter: " + err.Error()
+			job.finish(snapshotJobFailed, now)
+			return
+		}
+		job.State, job.UpdatedAt = snapshotJobRunning, now
+	})
+	if err != nil {
+		logger.Error("Error triggering snapshotter", "job", j.ID, "protocol", j.Protocol, "network", j.Network, "type", s.Type, "error", err)
+		return
+	}
+	logger.Info("Triggered snapshotter", "job", j.ID, "protocol", j.Protocol, "network", j.Network, "type", s.Type)
+}
+
+// triggerWebhookSnapshotter posts the job variables, lower-cased without the
+// SNAPSHOT_ prefix, to the URL of the snapshotter
+func triggerWebhookSnapshotter(ctx context.Context, s Snapshotter, env map[string]string) error {
+	payload := make(map[string]string, len(env))
+	for k, v := range env {
+		payload[strings.ToLower(strings.TrimPrefix(k, "SNAPSHOT_"))] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	// The errors end up in the job, which is shown to every admin, so they leave
+	// out the URL and any token in it
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Signature", webhookSignature(s.Secret, body))
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("snapshotter responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// triggerSSHSnapshotter runs the command of the snapshotter on its host with the
+// job variables set. Servers rarely accept environment variables from clients, so
+// they are set in the command.
+func triggerSSHSnapshotter(s Snapshotter, env map[string]string) error {
+	key, err := os.ReadFile(s.KeyPath)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HostKey))
+	if err != nil {
+		return err
+	}
+	client, err := ssh.Dial("tcp", s.Host, &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         snapshotterTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var command strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&command, "%s=%s ", name, shellQuote(env[name]))
+	}
+	command.WriteString(s.Command)
+
+	if output, err := session.CombinedOutput(command.String()); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// loadJobTemplate reads a Job manifest
+func loadJobTemplate(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("job_template: %w", err)
+	}
+	if _, ok := jobContainers(manifest); !ok {
+		return nil, fmt.Errorf("job_template has no spec.template.spec.containers")
+	}
+	return manifest, nil
+}
+
+// jobContainers returns the containers of a Job manifest
+func jobContainers(manifest map[string]interface{}) ([]interface{}, bool) {
+	spec, _ := manifest["spec"].(map[string]interface{})
+	template, _ := spec["template"].(map[string]interface{})
+	podSpec, _ := template["spec"].(map[string]interface{})
+	containers, ok := podSpec["containers"].([]interface{})
+	return containers, ok && len(containers) > 0
+}
+
+// triggerKubernetesSnapshotter creates a Job from the template of the snapshotter,
+// named after the snapshot job and with its variables in every container
+func triggerKubernetesSnapshotter(ctx context.Context, s Snapshotter, j *snapshotJob, env map[string]string) error {
+	manifest, err := loadJobTemplate(s.JobTemplate)
+	if err != nil {
+		return err
+	}
+	metadata, _ := manifest["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		manifest["metadata"] = metadata
+	}
+	delete(metadata, "generateName")
+	metadata["name"] = "snapshot-" + j.ID[:16]
+	labels, _ := metadata["labels"].(map[string]interface{})
+	if labels == nil {
+		labels = map[string]interface{}{}
+		metadata["labels"] = labels
+	}
+	labels["snapshot-job-id"] = j.ID
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	containers, _ := jobContainers(manifest)
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		vars, _ := container["env"].([]interface{})
+		for _, name := range names {
+			vars = append(vars, map[string]interface{}{"name": name, "value": env[name]})
+		}
+		container["env"] = vars
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	endpoint := "https://" + host + "/apis/batch/v1/namespaces/" + url.PathEscape(s.Namespace) + "/jobs"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("creating the job responded with %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// completeSnapshotJobs publishes the active job of a network when a snapshot
+// written after the job was created is published
+func completeSnapshotJobs(e snapshotEvent) {
+	if e.Type != eventSnapshotPublished {
+		return
+	}
+	snapshotJobs.mu.Lock()
+	defer snapshotJobs.mu.Unlock()
+	j := snapshotJobs.active(e.Protocol, e.Network)
+	if j == nil || e.LastModified.Before(j.CreatedAt) {
+		return
+	}
+	j.Key = e.Key
+	j.finish(snapshotJobPublished, time.Now().UTC())
+	if err := snapshotJobs.save(); err != nil {
+		logger.Error("Error saving snapshot jobs", "error", err)
+	}
+	logger.Info("Snapshot job published", "job", j.ID, "key", e.Key)
+}
+
+// monitorSnapshotJobs fails the jobs whose snapshotter didn't publish a snapshot
+// within its timeout
+func monitorSnapshotJobs() {
+	if len(config.Snapshotters) == 0 {
+		return
+	}
+	for ; ; time.Sleep(time.Minute) {
+		now := time.Now().UTC()
+		snapshotJobs.mu.Lock()
+		changed := false
+		for _, j := range snapshotJobs.jobs {
+			if j.finished() {
+				continue
+			}
+			timeout := defaultSnapshotJobTimeout
+			if s, ok := networkSnapshotter(j.Protocol, j.Network); ok && s.TimeoutSeconds > 0 {
+				timeout = time.Duration(s.TimeoutSeconds) * time.Second
+			}
+			if now.Sub(j.CreatedAt) > timeout {
+				j.Error = fmt.Sprintf("no snapshot published within %s", timeout)
+				j.finish(snapshotJobFailed, now)
+				changed = true
+				logger.Warn("Snapshot job timed out", "job", j.ID, "protocol", j.Protocol, "network", j.Network)
+			}
+		}
+		if changed {
+			if err := snapshotJobs.save(); err != nil {
+				logger.Error("Error saving snapshot jobs", "error", err)
+			}
+		}
+		snapshotJobs.mu.Unlock()
+	}
+}
+
+// listSnapshotJobs returns the snapshot jobs newest first, filtered by the protocol,
+// network and state query parameters
+func listSnapshotJobs(c *gin.Context) {
+	snapshotJobs.mu.Lock()
+	defer snapshotJobs.mu.Unlock()
+
+	jobs := make([]*snapshotJob, 0)
+	for _, j := range snapshotJobs.list() {
+		if p := c.Query("protocol"); p != "" && p != j.Protocol {
+			continue
+		}
+		if n := c.Query("network"); n != "" && n != j.Network {
+			continue
+		}
+		if s := c.Query("state"); s != "" && s != j.State {
+			continue
+		}
+		jobs = append(jobs, withoutToken(j))
+	}
+	c.JSON(http.StatusOK, gin.H{"snapshot_jobs": jobs})
+}
+
+func getSnapshotJob(c *gin.Context) {
+	snapshotJobs.mu.Lock()
+	defer snapshotJobs.mu.Unlock()
+
+	j, ok := snapshotJobs.jobs[c.Param("id")]
+	if !ok {
+		respondError(c, http.StatusNotFound, codeSnapshotJobNotFound, "Snapshot job not found")
+		return
+	}
+	c.JSON(http.StatusOK, withoutToken(j))
+}
+
+// createSnapshotJob triggers the snapshotter of a network, unless a job of the
+// network is still active
+func createSnapshotJob(c *gin.Context) {
+	var request struct {
+		Protocol string `json:"protocol" binding:"required"`
+		Network  string `json:"network" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	s, ok := networkSnapshotter(request.Protocol, request.Network)
+	if !ok {
+		respondError(c, http.StatusNotFound, codeFeatureDisabled, "No snapshotter configured for "+request.Protocol+"/"+request.Network)
+		return
+	}
+
+	now := time.Now().UTC()
+	j := &snapshotJob{
+		ID:          newRequestID(),
+		Protocol:    request.Protocol,
+		Network:     request.Network,
+		Snapshotter: s.Type,
+		State:       snapshotJobPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Token:       newRequestID() + newRequestID(),
+	}
+
+	snapshotJobs.mu.Lock()
+	defer snapshotJobs.mu.Unlock()
+	if active := snapshotJobs.active(j.Protocol, j.Network); active != nil {
+		respondError(c, http.StatusConflict, codeJobRunning, "Snapshot job "+active.ID+" of the network is still "+active.State)
+		return
+	}
+	snapshotJobs.jobs[j.ID] = j
+	if err := snapshotJobs.save(); err != nil {
+		delete(snapshotJobs.jobs, j.ID)
+		respondInternalError(c, err)
+		return
+	}
+	requestLogger(c).Info("Snapshot job created", "job", j.ID, "protocol", j.Protocol, "network", j.Network)
+	go triggerSnapshotter(s, *j)
+	c.JSON(http.StatusCreated, withoutToken(j))
+}
+
+// @Summary Report the progress of a snapshot job
+// @Description Called by snapshotters with the SNAPSHOT_CALLBACK_TOKEN of the job as bearer token
+// @Accept json
+// @Produce json
+// @Param id path string true "Snapshot job ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /snapshot-jobs/{id}/progress [post]
+func reportSnapshotJobProgress(c *gin.Context) {
+	var report struct {
+		// State is running, uploading or failed, published is only set once the
+		// snapshot is seen in the bucket
+		State    string   `json:"state" binding:"required"`
+		Progress *float64 `json:"progress"`
+		Message  string   `json:"message"`
+		Error    string   `json:"error"`
+	}
+	if err := c.ShouldBindJSON(&report); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	switch report.State {
+	case snapshotJobRunning, snapshotJobUploading, snapshotJobFailed:
+	default:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "state must be running, uploading or failed")
+		return
+	}
+	if report.Progress != nil && (*report.Progress < 0 || *report.Progress > 1) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "progress must be between 0 and 1")
+		return
+	}
+
+	snapshotJobs.mu.Lock()
+	defer snapshotJobs.mu.Unlock()
+	j, ok := snapshotJobs.jobs[c.Param("id")]
+	token, bearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || !bearer || subtle.ConstantTimeCompare([]byte(token), []byte(j.Token)) != 1 {
+		respondError(c, http.StatusUnauthorized, codeUnauthorized, "invalid job token")
+		return
+	}
+	if j.finished() {
+		respondError(c, http.StatusConflict, codeJobFinished, "Snapshot job is "+j.State)
+		return
+	}
+
+	previous := *j
+	now := time.Now().UTC()
+	j.State, j.UpdatedAt, j.Message = report.State, now, report.Message
+	if report.Progress != nil {
+		j.Progress = *report.Progress
+	}
+	if report.State == snapshotJobFailed {
+		j.Error = report.Error
+		j.finish(snapshotJobFailed, now)
+	}
+	if err := snapshotJobs.save(); err != nil {
+		*j = previous
+		respondInternalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, withoutToken(j))
+}
+
+func registerSnapshotJobRoutes(router *gin.Engine, admin *gin.RouterGroup) {
+	admin.GET("/snapshot-jobs", listSnapshotJobs)
+	admin.POST("/snapshot-jobs", createSnapshotJob)
+	admin.GET("/snapshot-jobs/:id", getSnapshotJob)
+	router.POST("/snapshot-jobs/:id/progress", reportSnapshotJobProgress)
+}
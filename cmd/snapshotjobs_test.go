@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotJobs(t *testing.T) {
+	triggered := make(chan map[string]string, 1)
+	snapshotter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		triggered <- payload
+	}))
+	defer snapshotter.Close()
+
+	r, _ := newTestAPI(t)
+	config.PublicURL = "https://api.example.com"
+	config.Snapshotters = map[string]Snapshotter{"*": {Type: "webhook", URL: snapshotter.URL}}
+	if err := checkSnapshotters(config.Snapshotters); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(r, "POST", "/admin/snapshot-jobs", `{"protocol": "nimiq", "network": "mainnet"}`, true)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var job snapshotJob
+	decode(t, w, &job)
+	if job.State != snapshotJobPending || job.Token != "" {
+		t.Errorf("created job %+v", job)
+	}
+
+	var payload map[string]string
+	select {
+	case payload = <-triggered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("snapshotter not triggered")
+	}
+	if payload["job_id"] != job.ID || payload["callback_url"] != "https://api.example.com/snapshot-jobs/"+job.ID+"/progress" || payload["callback_token"] == "" {
+		t.Errorf("payload %v", payload)
+	}
+	for deadline := time.Now().Add(5 * time.Second); job.State == snapshotJobPending && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		decode(t, serve(r, "GET", "/admin/snapshot-jobs/"+job.ID, "", true), &job)
+	}
+	if job.State != snapshotJobRunning {
+		t.Fatalf("state %s, want running", job.State)
+	}
+
+	if w := serve(r, "POST", "/admin/snapshot-jobs", `{"protocol": "nimiq", "network": "mainnet"}`, true); w.Code != http.StatusConflict {
+		t.Errorf("second job of the network: status %d, want 409", w.Code)
+	}
+
+	reportWith := func(authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/snapshot-jobs/"+job.ID+"/progress", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	report := func(token, body string) *httptest.ResponseRecorder {
+		return reportWith("Bearer "+token, body)
+	}
+	if w := report("wrong", `{"state": "uploading"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d, want 401", w.Code)
+	}
+	if w := reportWith(payload["callback_token"], `{"state": "uploading"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("token without Bearer: status %d, want 401", w.Code)
+	}
+	w = report(payload["callback_token"], `{"state": "uploading", "progress": 0.5, "message": "uploading part 3 of 6"}`)
+	decode(t, w, &job)
+	if job.State != snapshotJobUploading || job.Progress != 0.5 {
+		t.Errorf("after progress report %+v", job)
+	}
+
+	completeSnapshotJobs(snapshotEvent{Type: eventSnapshotPublished, Protocol: "nimiq", Network: "mainnet", Key: "nimiq/mainnet/2024-03-01.tar.zst", LastModified: time.Now()})
+	decode(t, serve(r, "GET", "/admin/snapshot-jobs/"+job.ID, "", true), &job)
+	if job.State != snapshotJobPublished || job.Key != "nimiq/mainnet/2024-03-01.tar.zst" || job.FinishedAt == nil {
+		t.Errorf("after publishing %+v", job)
+	}
+	if w := report(payload["callback_token"], `{"state": "running"}`); w.Code != http.StatusConflict {
+		t.Errorf("report for a finished job: status %d, want 409", w.Code)
+	}
+}
+
+func TestWebhookSnapshotterErrors(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	// The errors are kept in the job, so they must not carry the token of the URL
+	for _, u := range []string{failing.URL + "/hooks/secret-token", "http://127.0.0.1:1/hooks/secret-token"} {
+		err := triggerWebhookSnapshotter(context.Background(), Snapshotter{Type: "webhook", URL: u}, nil)
+		if err == nil || strings.Contains(err.Error(), "secret-token") {
+			t.Errorf("%s: error %v, want one without the URL", u, err)
+		}
+	}
+}
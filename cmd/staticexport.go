@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultStaticExportInterval is used when static_export_interval_seconds is not set in the config
+	defaultStaticExportInterval = 5 * time.Minute
+	// staticExportCacheControl is the Cache-Control of exported files, they are
+	// replaced on every export
+	staticExportCacheControl = "public, max-age=60"
+)
+
+// checkStaticExportPrefix checks that prefix is empty or a single top-level
+// segment ending in a slash like "site/", the only form hidden from the catalog
+func checkStaticExportPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	name, rest, ok := strings.Cut(prefix, "/")
+	if !ok || rest != "" || name == "" || name == "." || name == ".." {
+		return fmt.Errorf("static_export_prefix %q must be a single segment ending in /, like \"site/\"", prefix)
+	}
+	return nil
+}
+
+// exportedFile is a snapshot in the static export
+type exportedFile struct {
+	Filename     string     `json:"filename"`
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	URL          string     `json:"url,omitempty"`
+}
+
+// exportedNetwork is a network in the static export
+type exportedNetwork struct {
+	Protocol string         `json:"protocol"`
+	Network  string         `json:"network"`
+	Latest   *exportedFile  `json:"latest,omitempty"`
+	Files    []exportedFile `json:"files,omitempty"`
+}
+
+// stableURL returns a download URL for key that doesn't expire, the static export
+// outlives any presigned URL. Without an unsigned CDN, a public key or public_url
+// there is none.
+func stableURL(key string) string {
+	public := isPublic(key)
+	if u, ok := cdnURL(key); ok && (cloudFrontSigner == nil || public) {
+		return u
+	}
+	if public {
+		if u, err := publicObjectURL(storageClient(), key); err == nil {
+			return u
+		}
+	}
+	if config.PublicURL != "" {
+		return publicURL("/download/" + key)
+	}
+	return ""
+}
+
+var staticIndexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{"size": humanSize}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Networks}}<table>
+<tr><th>Network</th><th>Latest snapshot</th><th>Size</th><th>Published</th></tr>
+{{range .Networks}}<tr><td><a href="{{.Protocol}}/{{.Network}}/index.html">{{.Protocol}}/{{.Network}}</a></td>{{with .Latest}}<td>{{if .URL}}<a href="{{.URL}}">{{.Filename}}</a>{{else}}{{.Filename}}{{end}}</td><td>{{size .Size}}</td><td>{{if .LastModified}}{{.LastModified.UTC.Format "2006-01-02 15:04 MST"}}{{end}}</td>{{else}}<td colspan="3">no snapshots</td>{{end}}</tr>
+{{end}}</table>{{end}}
+{{if .Files}}<p><a href="../../index.html">All networks</a> · <a href="latest.json">latest.json</a> · <a href="index.json">index.json</a></p>
+<table>
+<tr><th>File</th><th>Size</th><th>Published</th></tr>
+{{range .Files}}<tr><td>{{if .URL}}<a href="{{.URL}}">{{.Filename}}</a>{{else}}{{.Filename}}{{end}}</td><td>{{size .Size}}</td><td>{{if .LastModified}}{{.LastModified.UTC.Format "2006-01-02 15:04 MST"}}{{end}}</td></tr>
+{{end}}</table>{{end}}
+<p>Generated {{.Generated.Format "2006-01-02 15:04 MST"}}</p>
+</body>
+</html>
+`))
+
+// staticExportMu serializes exports, a scheduled and a manual one may overlap
+var staticExportMu sync.Mutex
+
+// exportStaticSite renders the catalog into the static export prefix of the bucket:
+// index.json and index.html for all networks, and index.json, latest.json and
+// index.html per network
+func exportStaticSite(ctx context.Context) error {
+	staticExportMu.Lock()
+	defer staticExportMu.Unlock()
+
+	start := time.Now()
+	prefix := config.StaticExportPrefix
+	svc := storageClient()
+	put := func(name, contentType string, body []byte) error {
+		_, err := svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:       aws.String(config.BucketName),
+			Key:          aws.String(prefix + name),
+			Body:         bytes.NewReader(body),
+			ContentType:  aws.String(contentType),
+			CacheControl: aws.String(staticExportCacheControl),
+		})
+		return err
+	}
+	putJSON := func(name string, v interface{}) error {
+		body, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return put(name, "application/json", body)
+	}
+	putHTML := func(name string, data interface{}) error {
+		var body bytes.Buffer
+		if err := staticIndexTemplate.Execute(&body, data); err != nil {
+			return err
+		}
+		return put(name, "text/html; charset=utf-8", body.Bytes())
+	}
+
+	names, err := discoverNetworks(ctx)
+	if err != nil {
+		return err
+	}
+	networks := make([]exportedNetwork, 0, len(names))
+	for _, n := range names {
+		protocol, network, _ := strings.Cut(n, "/")
+		files, err := loadFiles(ctx, protocol, network)
+		if err != nil {
+			return err
+		}
+
+		exported := exportedNetwork{Protocol: protocol, Network: network, Files: make([]exportedFile, 0, len(files))}
+		for _, f := range snapshotFiles(files) {
+			key := f["filename"].(string)
+			file := exportedFile{Filename: path.Base(key), Key: key, Size: f["size"].(int64), URL: stableURL(key)}
+			file.LastModified, _ = f["last_modified"].(*time.Time)
+			exported.Files = append(exported.Files, file)
+			// Snapshots are named with a timestamp prefix, so the newest sorts last
+			if exported.Latest == nil || key > exported.Latest.Key {
+				latest := file
+				exported.Latest = &latest
+			}
+		}
+
+		dir := protocol + "/" + network + "/"
+		if err := putJSON(dir+"index.json", exported); err != nil {
+			return err
+		}
+		if exported.Latest != nil {
+			if err := putJSON(dir+"latest.json", exported.Latest); err != nil {
+				return err
+			}
+		}
+		if err := putHTML(dir+"index.html", gin.H{"Title": protocol + "/" + network, "Files": exported.Files, "Generated": start.UTC()}); err != nil {
+			return err
+		}
+
+		exported.Files = nil
+		networks = append(networks, exported)
+	}
+
+	if err := putJSON("index.json", gin.H{"generated": start.UTC(), "networks": networks}); err != nil {
+		return err
+	}
+	if err := putHTML("index.html", gin.H{"Title": "Snapshots", "Networks": networks, "Generated": start.UTC()}); err != nil {
+		return err
+	}
+	logger.Info("Exported static site", "prefix", prefix, "networks", len(networks), "duration", time.Since(start))
+	return nil
+}
+
+// runStaticExport exports the static site at the configured interval, if an export
+// prefix is set and the static-export job isn't scheduled
+func runStaticExport() {
+	if config.StaticExportPrefix == "" || jobScheduled("static-export") {
+		return
+	}
+	interval := time.Duration(config.StaticExportIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultStaticExportInterval
+	}
+	for ; ; time.Sleep(interval) {
+		if err := exportStaticSite(context.Background()); err != nil {
+			logger.Error("Static export failed", "error", err)
+		}
+	}
+}
+
+// triggerStaticExport queues a static export right away
+func triggerStaticExport(c *gin.Context) {
+	if config.StaticExportPrefix == "" {
+		respondError(c, http.StatusNotFound, codeFeatureDisabled, "Static export is disabled")
+		return
+	}
+	t := tasks.enqueue("static-export", func(ctx context.Context, t *asyncTask) (interface{}, error) {
+		return nil, exportStaticSite(ctx)
+	})
+	respondTask(c, t)
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestCheckStaticExportPrefix(t *testing.T) {
+	for _, prefix := range []string{"", "site/", "_export/"} {
+		if err := checkStaticExportPrefix(prefix); err != nil {
+			t.Errorf("%q: %v", prefix, err)
+		}
+	}
+	// Only a single top-level segment is hidden from the catalog
+	for _, prefix := range []string{"site", "/", "site/pages/", "/site/", "./", "../", "site//"} {
+		if err := checkStaticExportPrefix(prefix); err == nil {
+			t.Errorf("%q accepted", prefix)
+		}
+	}
+}
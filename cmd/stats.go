@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// networkStats are the aggregates of the snapshots of one network
+type networkStats struct {
+	// Network is protocol/network
+	Network    string `json:"network"`
+	Snapshots  int    `json:"snapshots"`
+	TotalBytes int64  `json:"total_bytes"`
+	// TotalSizeHuman is the total size in binary units, e.g. "1.5 TiB"
+	TotalSizeHuman string     `json:"total_size_human"`
+	Latest         string     `json:"latest,omitempty"`
+	LatestModified *time.Time `json:"latest_modified,omitempty"`
+	OldestModified *time.Time `json:"oldest_modified,omitempty"`
+	// Error is set if the network couldn't be listed, its counts are then 0
+	Error string `json:"error,omitempty"`
+}
+
+// @Summary Get the statistics of the networks
+// @Description Snapshot counts, total sizes and the newest and oldest snapshot of every network, paged by network name
+// @Produce json
+// @Param cursor query string false "Cursor from the previous page"
+// @Param limit query int false "Maximum number of networks to return"
+// @Success 200 {object} map[string]interface{}
+// @Router /stats [get]
+func getStats(c *gin.Context) {
+	after, limit, err := pageParams(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if isHead(c) {
+		respondHead(c, http.StatusOK, jsonContentType)
+		return
+	}
+
+	ctx := withRequestID(c.Request.Context(), c)
+	v, err := sharedStorageCall(ctx, "keys", func(ctx context.Context) (interface{}, error) {
+		return discoverNetworks(ctx)
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	// Only the networks of the page are listed
+	names, nextCursor := paginateStrings(append(make([]string, 0), v.([]string)...), after, limit)
+
+	stats := make([]networkStats, len(names))
+	err = fanOut(ctx, len(names), requestFanOut, func(i int) {
+		protocol, network, _ := strings.Cut(names[i], "/")
+		stats[i] = statsNetwork(ctx, protocol, network)
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	response := gin.H{"networks": stats}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	respondListing(c, http.StatusOK, response)
+}
+
+// statsNetwork aggregates the snapshots of a network from its cached listing
+func statsNetwork(ctx context.Context, protocol, network string) networkStats {
+	s := networkStats{Network: protocol + "/" + network}
+	files, err := loadFiles(ctx, protocol, network)
+	if err != nil {
+		s.Error = "listing failed"
+		logger.Warn("Stats failed to list network", "protocol", protocol, "network", network, "error", err)
+	}
+	for _, f := range snapshotFiles(files) {
+		s.Snapshots++
+		s.TotalBytes += f["size"].(int64)
+		if key := f["filename"].(string); key > s.Latest {
+			s.Latest = key
+			s.LatestModified, _ = f["last_modified"].(*time.Time)
+		}
+		if modified, _ := f["last_modified"].(*time.Time); modified != nil && (s.OldestModified == nil || modified.Before(*s.OldestModified)) {
+			s.OldestModified = modified
+		}
+	}
+	s.TotalSizeHuman = humanSize(s.TotalBytes)
+	return s
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// storageClient returns the client of the bucket of the snapshots. Tests replace it
+// with an in-memory fake.
+var storageClient = func() s3iface.S3API {
+	return s3.New(bucketSession(config.BucketName))
+}
+
+// bucketClient returns the client of bucket, with the settings of the bucket in
+// buckets if there are any. Tests replace it to fake other buckets.
+var bucketClient = defaultBucketClient
+
+func defaultBucketClient(bucket string) s3iface.S3API {
+	if bucket == config.BucketName {
+		return storageClient()
+	}
+	return s3.New(bucketSession(bucket))
+}
+
+// keyClient returns the bucket key is kept in, see keyBucket, and the client to
+// reach it with: svc for the configured bucket, the client of the bucket otherwise
+func keyClient(svc s3iface.S3API, key string) (s3iface.S3API, string) {
+	bucket := keyBucket(key)
+	if bucket != config.BucketName {
+		svc = bucketClient(bucket)
+	}
+	return svc, bucket
+}
+
+// bucketEndpoint returns the endpoint bucket is reached at
+func bucketEndpoint(bucket string) string {
+	return aws.StringValue(bucketSession(bucket).Config.Endpoint)
+}
+
+// BucketSettings overrides the global storage settings for one bucket, unset
+// fields keep the global value
+type BucketSettings struct {
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	// ForcePathStyle addresses the bucket as endpoint/bucket instead of bucket.endpoint
+	ForcePathStyle *bool `json:"force_path_style"`
+	// InsecureSkipVerify accepts any TLS certificate of the endpoint, e.g. self-signed
+	// ones of a lab MinIO. Never enable it for a store reached over the internet.
+	InsecureSkipVerify *bool `json:"insecure_skip_verify"`
+}
+
+// bucketSessions caches the sessions of the buckets with their own settings or a
+// detected region by bucket name, so that their connections are reused
+var bucketSessions sync.Map
+
+// bucketSession returns the session to reach bucket with: the global session, unless
+// buckets has settings for the bucket or its region is detected
+func bucketSession(bucket string) *session.Session {
+	if v, ok := bucketSessions.Load(bucket); ok {
+		return v.(*session.Session)
+	}
+	settings, ok := config.Buckets[bucket]
+	detect := config.DetectBucketRegions && settings.Region == ""
+	if !ok && !detect {
+		return sess
+	}
+
+	s := sess
+	if ok {
+		s = sess.Copy(bucketConfig(bucket, settings))
+	}
+	if detect {
+		region, err := bucketRegion(s, bucket)
+		if err != nil {
+			// Try the configured region until the lookup is retried
+			return s
+		}
+		if ok {
+			s = s.Copy(&aws.Config{Region: aws.String(region)})
+		} else {
+			s = regionSession(region)
+		}
+	}
+	v, _ := bucketSessions.LoadOrStore(bucket, s)
+	return v.(*session.Session)
+}
+
+// bucketConfig returns the overrides of the global session for the settings of bucket
+func bucketConfig(bucket string, settings BucketSettings) *aws.Config {
+	awsConfig := &aws.Config{}
+	if settings.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(settings.Endpoint)
+	}
+	if settings.Region != "" {
+		awsConfig.Region = aws.String(settings.Region)
+	}
+	if settings.ForcePathStyle != nil {
+		awsConfig.S3ForcePathStyle = settings.ForcePathStyle
+	}
+	if settings.InsecureSkipVerify != nil {
+		awsConfig.HTTPClient = &http.Client{Transport: newStorageTransport(*settings.InsecureSkipVerify)}
+		if *settings.InsecureSkipVerify {
+			logger.Warn("TLS certificates of the storage backend are not verified", "bucket", bucket)
+		}
+	}
+	return awsConfig
+}
+
+const (
+	// bucketRegionTimeout bounds the lookup of the region of a bucket
+	bucketRegionTimeout = 5 * time.Second
+	// bucketRegionRetry is how long a failed lookup of the region of a bucket is
+	// remembered before it is retried
+	bucketRegionRetry = time.Minute
+)
+
+// regionLookup is the result of looking up the region of a bucket
+type regionLookup struct {
+	region string
+	err    error
+	at     time.Time
+}
+
+var (
+	// bucketRegions caches the regionLookup of the buckets by bucket name
+	bucketRegions sync.Map
+	regionFlight  flightGroup
+	// regionSessions caches the sessions of the regions other than the configured one,
+	// shared by the buckets without settings of their own
+	regionSessions sync.Map
+)
+
+// bucketRegion returns the region of bucket as reported by GetBucketLocation
+func bucketRegion(s *session.Session, bucket string) (string, error) {
+	if v, ok := bucketRegions.Load(bucket); ok {
+		if l := v.(regionLookup); l.err == nil || time.Since(l.at) < bucketRegionRetry {
+			return l.region, l.err
+		}
+	}
+	v, _ := regionFlight.Do(bucket, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), bucketRegionTimeout)
+		defer cancel()
+		out, err := s3.New(s).GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+		l := regionLookup{err: err, at: time.Now()}
+		if err == nil {
+			// Buckets in us-east-1 have no location constraint, old ones in eu-west-1 have "EU"
+			l.region = s3.NormalizeBucketLocation(aws.StringValue(out.LocationConstraint))
+			logger.Info("Detected the region of bucket", "bucket", bucket, "region", l.region)
+		} else {
+			logger.Warn("Error detecting the region of bucket", "bucket", bucket, "error", err)
+		}
+		bucketRegions.Store(bucket, l)
+		return l, nil
+	})
+	l := v.(regionLookup)
+	return l.region, l.err
+}
+
+// regionSession returns the global session for region
+func regionSession(region string) *session.Session {
+	if region == aws.StringValue(sess.Config.Region) {
+		return sess
+	}
+	if v, ok := regionSessions.Load(region); ok {
+		return v.(*session.Session)
+	}
+	v, _ := regionSessions.LoadOrStore(region, sess.Copy(&aws.Config{Region: aws.String(region)}))
+	return v.(*session.Session)
+}
+
+// newSession creates the AWS session all S3 clients are created from
+func newSession() (*session.Session, error) {
+	awsConfig := &aws.Config{
+		Region:      aws.String(config.Region),
+		Credentials: credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
+		Endpoint:    aws.String(config.Endpoint),
+		// Most S3-compatible stores only support path-style addressing
+		S3ForcePathStyle: aws.Bool(config.ForcePathStyle == nil || *config.ForcePathStyle),
+	}
+
+	maxRetries := config.S3MaxRetries
+	if maxRetries == 0 {
+		maxRetries = client.DefaultRetryerMaxNumRetries
+	}
+	awsConfig.Retryer = storageRetryer{client.DefaultRetryer{
+		NumMaxRetries:    maxRetries,
+		MinRetryDelay:    time.Duration(config.S3MinRetryDelayMs) * time.Millisecond,
+		MaxRetryDelay:    time.Duration(config.S3MaxRetryDelayMs) * time.Millisecond,
+		MinThrottleDelay: time.Duration(config.S3MinThrottleDelayMs) * time.Millisecond,
+		MaxThrottleDelay: time.Duration(config.S3MaxThrottleDelayMs) * time.Millisecond,
+	}}
+
+	awsConfig.HTTPClient = &http.Client{Transport: newStorageTransport(config.S3InsecureSkipVerify)}
+	if config.S3InsecureSkipVerify {
+		logger.Warn("TLS certificates of the storage backend are not verified")
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	instrumentStorage(&sess.Handlers)
+	sess.Handlers.Build.PushBack(tagRequestID)
+	sess.Handlers.Complete.PushBack(logStorageError)
+	return sess, nil
+}
+
+// tagRequestID forwards the ID of the request an S3 call is made for, so it shows
+// up in S3 server access logs and can be correlated with our own logs
+func tagRequestID(r *request.Request) {
+	if id := contextRequestID(r.Context()); id != "" {
+		r.HTTPRequest.Header.Set(requestIDHeader, id)
+	}
+}
+
+// logStorageError logs failed S3 calls together with the ID of the request they were made for
+func logStorageError(r *request.Request) {
+	if r.Error == nil {
+		return
+	}
+	l := logger.With("operation", r.Operation.Name, "error", r.Error)
+	if id := contextRequestID(r.Context()); id != "" {
+		l = l.With("request_id", id)
+	}
+	if id := r.RequestID; id != "" {
+		l = l.With("s3_request_id", id)
+	}
+	l.Warn("S3 call failed")
+}
+
+// defaultMaxIdleConnsPerHost is used when s3_max_idle_conns_per_host is not set in
+// the config. Go's default of 2 makes us reconnect constantly under load, as nearly
+// all of our connections go to the same host.
+const defaultMaxIdleConnsPerHost = 64
+
+// newStorageTransport creates the HTTP transport of the S3 client from the config,
+// accepting any TLS certificate if insecureSkipVerify is set
+func newStorageTransport(insecureSkipVerify bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if config.S3MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.S3MaxIdleConnsPerHost
+	}
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	if config.S3DialTimeoutSeconds > 0 {
+		dialer := &net.Dialer{
+			Timeout:   time.Duration(config.S3DialTimeoutSeconds) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if config.S3TLSHandshakeTimeoutSeconds > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(config.S3TLSHandshakeTimeoutSeconds) * time.Second
+	}
+	if config.S3DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	// Bound the time S3 may take to start answering a call. The body isn't covered,
+	// streaming a large object is allowed to take as long as it takes.
+	if config.S3TimeoutSeconds > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(config.S3TimeoutSeconds) * time.Second
+	}
+
+	return transport
+}
+
+// storageRetryer is the SDK's default retryer, which additionally treats S3's
+// SlowDown responses as throttling: they are always retried, with the throttle
+// delays and full jitter, instead of being surfaced to clients as 503s.
+type storageRetryer struct {
+	client.DefaultRetryer
+}
+
+// ShouldRetry retries SlowDown responses and defers to the default retryer for everything else
+func (r storageRetryer) ShouldRetry(req *request.Request) bool {
+	if isSlowDown(req.Error) {
+		return true
+	}
+	return r.DefaultRetryer.ShouldRetry(req)
+}
+
+// RetryRules backs off exponentially with full jitter between the throttle delays for SlowDown responses
+func (r storageRetryer) RetryRules(req *request.Request) time.Duration {
+	if !isSlowDown(req.Error) {
+		return r.DefaultRetryer.RetryRules(req)
+	}
+
+	minDelay, maxDelay := r.MinThrottleDelay, r.MaxThrottleDelay
+	if minDelay == 0 {
+		minDelay = client.DefaultRetryerMinThrottleDelay
+	}
+	if maxDelay == 0 {
+		maxDelay = client.DefaultRetryerMaxThrottleDelay
+	}
+	delay := minDelay << uint(req.RetryCount)
+	if delay <= 0 || delay > maxDelay {
+		delay = maxDelay
+	}
+	return minDelay + time.Duration(rand.Int63n(int64(delay-minDelay)+1))
+}
+
+// isSlowDown reports whether err is S3 asking us to reduce the request rate
+func isSlowDown(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "SlowDown"
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeObject is an object stored in a fakeStorage
+type fakeObject struct {
+	data         []byte
+	lastModified time.Time
+	contentType  string
+	metadata     map[string]*string
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// fakeStorage is an in-memory bucket. The calls the API makes are answered from
+// memory, presigning goes through the embedded client, which is never sent anything.
+type fakeStorage struct {
+	*s3.S3
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// uploads are the parts of the multipart uploads in progress by upload ID
+	uploads map[string]*fakeUpload
+	// err is returned by every call while it is set, to simulate an outage
+	err error
+	// calls counts the calls answered, including failed ones
+	calls int
+	// reads counts the GetObject calls answered by key
+	reads map[string]int
+	// lists counts the ListObjectsV2 calls answered
+	lists int
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{S3: s3.New(sess), objects: map[string]fakeObject{}, uploads: map[string]*fakeUpload{}, reads: map[string]int{}}
+}
+
+// fakeUpload is a multipart upload in progress
+type fakeUpload struct {
+	key       string
+	parts     map[int64][]byte
+	initiated time.Time
+}
+
+// put stores an object, modified at the given time
+func (f *fakeStorage) put(key, data string, lastModified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = fakeObject{data: []byte(data), lastModified: lastModified}
+}
+
+// fail makes every following call fail with err, nil ends the outage
+func (f *fakeStorage) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// call counts a call and returns the simulated outage, if any
+func (f *fakeStorage) call() error {
+	f.calls++
+	return f.err
+}
+
+func noSuchKey(key string) error {
+	return awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist: "+key, nil), 404, "")
+}
+
+// list returns the objects and common prefixes below prefix, like one page of ListObjectsV2
+func (f *fakeStorage) list(in *s3.ListObjectsV2Input) *s3.ListObjectsV2Output {
+	prefix, delimiter := aws.StringValue(in.Prefix), aws.StringValue(in.Delimiter)
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > aws.StringValue(in.StartAfter) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{Prefix: in.Prefix, IsTruncated: aws.Bool(false)}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if in.MaxKeys != nil && int64(len(out.Contents)+len(out.CommonPrefixes)) >= *in.MaxKeys {
+			out.IsTruncated = aws.Bool(true)
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+				}
+				continue
+			}
+		}
+		o := f.objects[key]
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(o.data))),
+			ETag:         aws.String(o.etag()),
+			LastModified: aws.Time(o.lastModified),
+		})
+	}
+	out.KeyCount = aws.Int64(int64(len(out.Contents) + len(out.CommonPrefixes)))
+	return out
+}
+
+func (f *fakeStorage) ListObjectsV2WithContext(_ aws.Context, in *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	return f.list(in), nil
+}
+
+func (f *fakeStorage) ListObjectsV2PagesWithContext(_ aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	f.lists++
+	if err := f.call(); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	page := f.list(&s3.ListObjectsV2Input{Prefix: in.Prefix, Delimiter: in.Delimiter, StartAfter: in.StartAfter})
+	f.mu.Unlock()
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeStorage) HeadBucketWithContext(aws.Context, *s3.HeadBucketInput, ...request.Option) (*s3.HeadBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeStorage) HeadObjectWithContext(_ aws.Context, in *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	o, ok := f.objects[aws.StringValue(in.Key)]
+	if !ok {
+		// HEAD responses have no body to carry an error code
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "")
+	}
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(o.data))),
+		ETag:          aws.String(o.etag()),
+		LastModified:  aws.Time(o.lastModified),
+		Metadata:      o.metadata,
+	}
+	if o.contentType != "" {
+		out.ContentType = aws.String(o.contentType)
+	}
+	return out, nil
+}
+
+func (f *fakeStorage) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	key := aws.StringValue(in.Key)
+	f.reads[key]++
+	o, ok := f.objects[key]
+	if !ok {
+		return nil, noSuchKey(key)
+	}
+	data := o.data
+	if r := aws.StringValue(in.Range); r != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		data = data[start : end+1]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          aws.String(o.etag()),
+		LastModified:  aws.Time(o.lastModified),
+		Metadata:      o.metadata,
+	}, nil
+}
+
+func (f *fakeStorage) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return f.GetObjectWithContext(aws.BackgroundContext(), in)
+}
+
+func (f *fakeStorage) PutObjectWithContext(_ aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	o := fakeObject{data: data, lastModified: time.Now(), contentType: aws.StringValue(in.ContentType), metadata: in.Metadata}
+	f.objects[aws.StringValue(in.Key)] = o
+	return &s3.PutObjectOutput{ETag: aws.String(o.etag())}, nil
+}
+
+func (f *fakeStorage) DeleteObjectsWithContext(_ aws.Context, in *s3.DeleteObjectsInput, _ ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	out := &s3.DeleteObjectsOutput{}
+	for _, id := range in.Delete.Objects {
+		delete(f.objects, aws.StringValue(id.Key))
+		out.Deleted = append(out.Deleted, &s3.DeletedObject{Key: id.Key})
+	}
+	return out, nil
+}
+
+func (f *fakeStorage) CreateMultipartUploadWithContext(_ aws.Context, in *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+	f.uploads[id] = &fakeUpload{key: aws.StringValue(in.Key), parts: map[int64][]byte{}, initiated: time.Now()}
+	return &s3.CreateMultipartUploadOutput{Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+// uploadPart stores a part of an upload, like a client PUTting it to its presigned URL
+func (f *fakeStorage) uploadPart(id string, n int64, data string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploads[id].parts[n] = []byte(data)
+	return fakeObject{data: []byte(data)}.etag()
+}
+
+func (f *fakeStorage) CompleteMultipartUploadWithContext(_ aws.Context, in *s3.CompleteMultipartUploadInput, _ ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	upload, ok := f.uploads[aws.StringValue(in.UploadId)]
+	if !ok || upload.key != aws.StringValue(in.Key) {
+		return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil), 404, "")
+	}
+	var data []byte
+	for _, part := range in.MultipartUpload.Parts {
+		data = append(data, upload.parts[aws.Int64Value(part.PartNumber)]...)
+	}
+	delete(f.uploads, aws.StringValue(in.UploadId))
+	f.objects[upload.key] = fakeObject{data: data, lastModified: time.Now()}
+	return &s3.CompleteMultipartUploadOutput{Key: in.Key}, nil
+}
+
+func (f *fakeStorage) AbortMultipartUploadWithContext(_ aws.Context, in *s3.AbortMultipartUploadInput, _ ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	if _, ok := f.uploads[aws.StringValue(in.UploadId)]; !ok {
+		return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil), 404, "")
+	}
+	delete(f.uploads, aws.StringValue(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeStorage) ListMultipartUploadsPagesWithContext(_ aws.Context, _ *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	if err := f.call(); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	out := &s3.ListMultipartUploadsOutput{}
+	for id, upload := range f.uploads {
+		out.Uploads = append(out.Uploads, &s3.MultipartUpload{Key: aws.String(upload.key), UploadId: aws.String(id), Initiated: aws.Time(upload.initiated)})
+	}
+	f.mu.Unlock()
+	fn(out, true)
+	return nil
+}
+
+func (f *fakeStorage) ListPartsPagesWithContext(_ aws.Context, in *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	if err := f.call(); err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	upload, ok := f.uploads[aws.StringValue(in.UploadId)]
+	if !ok {
+		f.mu.Unlock()
+		return awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil), 404, "")
+	}
+	out := &s3.ListPartsOutput{}
+	for n, data := range upload.parts {
+		out.Parts = append(out.Parts, &s3.Part{PartNumber: aws.Int64(n), Size: aws.Int64(int64(len(data)))})
+	}
+	f.mu.Unlock()
+	fn(out, true)
+	return nil
+}
+
+func TestBucketSession(t *testing.T) {
+	newTestAPI(t)
+	config.Buckets = map[string]BucketSettings{
+		"lab": {Endpoint: "https://minio.lab:9000", ForcePathStyle: aws.Bool(true), InsecureSkipVerify: aws.Bool(true)},
+		"aws": {Region: "eu-central-1", ForcePathStyle: aws.Bool(false)},
+	}
+
+	if got := bucketSession(config.BucketName); got != sess {
+		t.Errorf("bucket without settings got its own session")
+	}
+
+	lab := bucketSession("lab")
+	if got := aws.StringValue(lab.Config.Endpoint); got != "https://minio.lab:9000" {
+		t.Errorf("lab endpoint is %s", got)
+	}
+	if !aws.BoolValue(lab.Config.S3ForcePathStyle) {
+		t.Errorf("lab is not addressed path-style")
+	}
+	transport := lab.Config.HTTPClient.Transport.(*http.Transport)
+	if transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("lab verifies TLS certificates")
+	}
+	if bucketSession("lab") != lab {
+		t.Errorf("lab session is not reused")
+	}
+
+	remote := bucketSession("aws")
+	if got := aws.StringValue(remote.Config.Endpoint); got != config.Endpoint {
+		t.Errorf("aws endpoint is %s, want the global %s", got, config.Endpoint)
+	}
+	if got := aws.StringValue(remote.Config.Region); got != "eu-central-1" {
+		t.Errorf("aws region is %s", got)
+	}
+	if aws.BoolValue(remote.Config.S3ForcePathStyle) {
+		t.Errorf("aws is addressed path-style")
+	}
+	if remote.Config.HTTPClient != sess.Config.HTTPClient {
+		t.Errorf("aws does not share the global HTTP client")
+	}
+}
+
+func TestBucketRegionDetection(t *testing.T) {
+	newTestAPI(t)
+	locations := map[string]string{"eu-bucket": "EU", "virginia-bucket": "", "tokyo-bucket": "ap-northeast-1"}
+	var lookups int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lookups++
+		mu.Unlock()
+		location, ok := locations[strings.Trim(r.URL.Path, "/")]
+		if _, query := r.URL.Query()["location"]; !ok || !query {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>`)
+			return
+		}
+		fmt.Fprintf(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">%s</LocationConstraint>`, location)
+	}))
+	defer server.Close()
+
+	config.Endpoint = server.URL
+	config.DetectBucketRegions = true
+	config.Buckets = map[string]BucketSettings{"tokyo-bucket": {ForcePathStyle: aws.Bool(true)}, "pinned-bucket": {Region: "us-west-2"}}
+	var err error
+	if sess, err = newSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		bucket string
+		want   string
+	}{
+		{"eu-bucket", "eu-west-1"},
+		{"virginia-bucket", "us-east-1"},
+		{"tokyo-bucket", "ap-northeast-1"},
+		{"pinned-bucket", "us-west-2"},
+		// The configured region is used while the lookup fails
+		{"missing-bucket", config.Region},
+	}
+	for _, tt := range tests {
+		if got := aws.StringValue(bucketSession(tt.bucket).Config.Region); got != tt.want {
+			t.Errorf("region of %s is %s, want %s", tt.bucket, got, tt.want)
+		}
+	}
+	if lookups != 4 {
+		t.Errorf("%d lookups, want 4", lookups)
+	}
+	for _, tt := range tests {
+		bucketSession(tt.bucket)
+	}
+	if lookups != 4 {
+		t.Errorf("%d lookups after the regions were detected, want still 4", lookups)
+	}
+	if regionSession("eu-west-1") != bucketSession("eu-bucket") {
+		t.Errorf("buckets without settings don't share the session of their region")
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup
+	_, err := g.Do("key", func() (interface{}, error) { panic("loader bug") })
+	if err == nil || !strings.Contains(err.Error(), "loader bug") {
+		t.Fatalf("error %v", err)
+	}
+	// The key is forgotten, the next call runs again
+	v, err := g.Do("key", func() (interface{}, error) { return 1, nil })
+	if err != nil || v != 1 {
+		t.Errorf("next call %v, %v", v, err)
+	}
+}
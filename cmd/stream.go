@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventStreamKeepAlive is how often a comment is sent on an idle event stream
+// so proxies do not time the connection out
+const eventStreamKeepAlive = 30 * time.Second
+
+// @Summary Stream snapshot events
+// @Description Streams snapshot.published, snapshot.deleted and latest.changed events as Server-Sent Events
+// @Produce text/event-stream
+// @Param protocol query string false "Only stream events of this protocol"
+// @Param network query string false "Only stream events of this network"
+// @Success 200 {object} snapshotEvent
+// @Router /events [get]
+func streamEvents(c *gin.Context) {
+	protocol, network := c.Query("protocol"), c.Query("network")
+
+	events, closeStream := openEventStream()
+	defer closeStream()
+	eventStreams.Inc("sse")
+	defer eventStreams.Add(-1, "sse")
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	// Send the headers right away so clients know the stream is established
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			return true
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			if protocol != "" && e.Protocol != protocol || network != "" && e.Network != network {
+				return true
+			}
+			c.SSEvent(e.Type, e)
+			return true
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state notification to systemd, it does nothing when the
+// service isn't run by systemd with Type=notify
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval systemd expects watchdog pings in, if the
+// watchdog is enabled for this process
+func watchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// notifySystemd tells systemd the service is ready once the caches are warm and
+// then pings the watchdog for as long as the server answers its own health check,
+// so a hung instance is restarted
+func notifySystemd(addr string) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	for !cacheWarm.Load() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("Error notifying systemd", "error", err)
+	}
+
+	interval, ok := watchdogInterval()
+	if !ok {
+		return
+	}
+	// Ping twice per interval, a single late ping must not get us killed
+	healthURL := "http://" + loopbackAddr(addr) + "/healthz"
+	client := &http.Client{Timeout: interval / 4}
+	for range time.Tick(interval / 2) {
+		if shuttingDown.Load() {
+			return
+		}
+		if err := checkHealth(client, healthURL); err != nil {
+			logger.Warn("Skipping watchdog ping, health check failed", "error", err)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// loopbackAddr returns the loopback address of a listen address like :8080
+func loopbackAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
+func checkHealth(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// States of tasks. Succeeded, failed and canceled tasks are finished and never change again.
+const (
+	taskQueued    = "queued"
+	taskRunning   = "running"
+	taskSucceeded = "succeeded"
+	taskFailed    = "failed"
+	taskCanceled  = "canceled"
+)
+
+const (
+	// defaultTaskWorkers is how many tasks run at once unless task_workers is set
+	defaultTaskWorkers = 2
+	// taskRetention is how long finished tasks can be looked up
+	taskRetention = 24 * time.Hour
+	// maxTaskLogLines is how many of the last log lines of a task are kept
+	maxTaskLogLines = 200
+	// restorePollInterval is how often objects being restored from Glacier are checked
+	restorePollInterval = time.Minute
+)
+
+// taskLogLine is a line logged by a task
+type taskLogLine struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// taskInfo is the state of a task as returned by the API
+type taskInfo struct {
+	ID string `json:"id"`
+	// Kind is static-export, checksums, copy or restore
+	Kind  string `json:"kind"`
+	State string `json:"state"`
+	// Progress is the share of the task done from 0 to 1
+	Progress float64       `json:"progress"`
+	Logs     []taskLogLine `json:"logs,omitempty"`
+	// Result is set once the task succeeded, its form depends on the kind
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+func (t *taskInfo) finished() bool {
+	return t.State == taskSucceeded || t.State == taskFailed || t.State == taskCanceled
+}
+
+// asyncTask is a long-running operation started by an API request and run in the
+// background by the task queue
+type asyncTask struct {
+	mu     sync.Mutex
+	info   taskInfo
+	cancel context.CancelFunc
+}
+
+// status returns a copy of the task's state
+func (t *asyncTask) status() taskInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info := t.info
+	info.Logs = append([]taskLogLine{}, t.info.Logs...)
+	return info
+}
+
+// logf adds a line to the log of the task
+func (t *asyncTask) logf(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Logs = append(t.info.Logs, taskLogLine{Time: time.Now().UTC(), Message: fmt.Sprintf(format, args...)})
+	if n := len(t.info.Logs); n > maxTaskLogLines {
+		t.info.Logs = t.info.Logs[n-maxTaskLogLines:]
+	}
+}
+
+// progress records that done of total units of the task are done
+func (t *asyncTask) progress(done, total int64) {
+	if total <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Progress = min(float64(done)/float64(total), 1)
+}
+
+// taskFunc runs a task until it is done or ctx is canceled and returns its result
+type taskFunc func(ctx context.Context, t *asyncTask) (interface{}, error)
+
+// taskQueue runs tasks in the background, a few at a time
+type taskQueue struct {
+	mu    sync.Mutex
+	tasks map[string]*asyncTask
+	// slots limits how many tasks run at once
+	slots chan struct{}
+}
+
+func newTaskQueue(workers int) *taskQueue {
+	if workers <= 0 {
+		workers = defaultTaskWorkers
+	}
+	return &taskQueue{tasks: make(map[string]*asyncTask), slots: make(chan struct{}, workers)}
+}
+
+// Define the task queue, sized by task_workers at startup
+var tasks = newTaskQueue(defaultTaskWorkers)
+
+// enqueue queues a task of a kind running fn and returns it. Tasks finished for
+// longer than the retention are forgotten.
+func (q *taskQueue) enqueue(kind string, fn taskFunc) *asyncTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &asyncTask{
+		info:   taskInfo{ID: newRequestID(), Kind: kind, State: taskQueued, Logs: []taskLogLine{}, CreatedAt: time.Now().UTC()},
+		cancel: cancel,
+	}
+
+	q.mu.Lock()
+	for id, old := range q.tasks {
+		if info := old.status(); info.finished() && time.Since(*info.FinishedAt) > taskRetention {
+			delete(q.tasks, id)
+		}
+	}
+	q.tasks[t.info.ID] = t
+	q.mu.Unlock()
+
+	go q.run(ctx, t, fn)
+	return t
+}
+
+// run waits for a free slot and runs the task
+func (q *taskQueue) run(ctx context.Context, t *asyncTask, fn taskFunc) {
+	defer t.cancel()
+	select {
+	case q.slots <- struct{}{}:
+		defer func() { <-q.slots }()
+	case <-ctx.Done():
+		t.finish(nil, ctx.Err())
+		return
+	}
+
+	now := time.Now().UTC()
+	t.mu.Lock()
+	t.info.State, t.info.StartedAt = taskRunning, &now
+	kind, id := t.info.Kind, t.info.ID
+	t.mu.Unlock()
+	logger.Info("Task started", "task", id, "kind", kind)
+
+	result, err := fn(ctx, t)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	t.finish(result, err)
+	info := t.status()
+	if err != nil && info.State == taskFailed {
+		logger.Error("Task failed", "task", id, "kind", kind, "error", err)
+		return
+	}
+	logger.Info("Task finished", "task", id, "kind", kind, "state", info.State, "duration", info.FinishedAt.Sub(now))
+}
+
+// finish moves the task to a final state
+func (t *asyncTask) finish(result interface{}, err error) {
+	now := time.Now().UTC()
+	t.mu.Lock()
+	defer func() {
+		state := t.info.State
+		t.mu.Unlock()
+		taskRuns.Inc(t.info.Kind, state)
+	}()
+	t.info.FinishedAt = &now
+	switch {
+	case errors.Is(err, context.Canceled):
+		t.info.State = taskCanceled
+	case err != nil:
+		t.info.State, t.info.Error = taskFailed, err.Error()
+	default:
+		t.info.State, t.info.Result, t.info.Progress = taskSucceeded, result, 1
+	}
+}
+
+func (q *taskQueue) get(id string) (*asyncTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.tasks[id]
+	return t, ok
+}
+
+// respondTask answers a request that started a task with its state, pointing to
+// where it can be followed
+func respondTask(c *gin.Context, t *asyncTask) {
+	info := t.status()
+	requestLogger(c).Info("Task queued", "task", info.ID, "kind", info.Kind)
+	c.Header("Location", basePath()+"/jobs/"+info.ID)
+	c.JSON(http.StatusAccepted, info)
+}
+
+// listTasks returns the tasks newest first, filtered by the kind and state query
+// parameters
+func listTasks(c *gin.Context) {
+	tasks.mu.Lock()
+	list := make([]taskInfo, 0, len(tasks.tasks))
+	for _, t := range tasks.tasks {
+		info := t.status()
+		if k := c.Query("kind"); k != "" && k != info.Kind {
+			continue
+		}
+		if s := c.Query("state"); s != "" && s != info.State {
+			continue
+		}
+		// The logs are in the task itself
+		info.Logs = nil
+		list = append(list, info)
+	}
+	tasks.mu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.After(list[k].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"jobs": list})
+}
+
+func getTask(c *gin.Context) {
+	t, ok := tasks.get(c.Param("id"))
+	if !ok {
+		respondError(c, http.StatusNotFound, codeJobNotFound, "Job not found")
+		return
+	}
+	c.JSON(http.StatusOK, t.status())
+}
+
+// cancelTask cancels a queued or running task
+func cancelTask(c *gin.Context) {
+	t, ok := tasks.get(c.Param("id"))
+	if !ok {
+		respondError(c, http.StatusNotFound, codeJobNotFound, "Job not found")
+		return
+	}
+	if info := t.status(); info.finished() {
+		respondError(c, http.StatusConflict, codeJobFinished, "Job is "+info.State)
+		return
+	}
+	t.cancel()
+	requestLogger(c).Info("Task canceled", "task", c.Param("id"))
+	c.JSON(http.StatusAccepted, t.status())
+}
+
+// computeChecksums queues measuring the snapshots of a network without a known
+// checksum, so checksums.txt lists all of them
+func computeChecksums(c *gin.Context) {
+	protocol, network := c.Param("protocol"), c.Param("network")
+	t := tasks.enqueue("checksums", func(ctx context.Context, t *asyncTask) (interface{}, error) {
+		svc := storageClient()
+		objects, err := listObjects(ctx, svc, protocol+"/"+network+"/")
+		if err != nil {
+			return nil, err
+		}
+		objects = snapshotObjects(objects)
+		if len(objects) == 0 {
+			return nil, fmt.Errorf("no snapshots of %s/%s found", protocol, network)
+		}
+
+		sums := make(map[string]string, len(objects))
+		for i, object := range objects {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			sum, err := knownSHA256(ctx, svc, object)
+			if err != nil {
+				return nil, err
+			}
+			if sum == "" {
+				t.logf("Measuring %s", path.Base(*object.Key))
+				etag := aws.StringValue(object.ETag)
+				data, err := generateMeasurement(ctx, *object.Key, etag)
+				if err == nil {
+					err = writeDerived(derivedCachePath(*object.Key, etag, ".measure"), data)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("measuring %s: %w", *object.Key, err)
+				}
+				if sum, err = knownSHA256(ctx, svc, object); err != nil {
+					return nil, err
+				}
+			}
+			sums[path.Base(*object.Key)] = sum
+			t.progress(int64(i+1), int64(len(objects)))
+		}
+		t.logf("Checksums of %d snapshots known", len(sums))
+		return sums, nil
+	})
+	respondTask(c, t)
+}
+
+// copySnapshot queues a server-side copy of an object, in parts if it is large. In
+// dry run the task only checks the source exists.
+func copySnapshot(c *gin.Context) {
+	var request struct {
+		Key string `json:"key" binding:"required"`
+		// DestinationBucket is the bucket of the object if empty
+		DestinationBucket string `json:"destination_bucket"`
+		// DestinationKey is the key of the object if empty
+		DestinationKey string `json:"destination_key"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	srcBucket := keyBucket(request.Key)
+	dstBucket, dstKey := request.DestinationBucket, request.DestinationKey
+	if dstBucket == "" {
+		dstBucket = srcBucket
+	}
+	if dstKey == "" {
+		dstKey = request.Key
+	}
+	if dstBucket == srcBucket && dstKey == request.Key {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "destination_bucket or destination_key must differ from the source")
+		return
+	}
+
+	dry := dryRun(c)
+	t := tasks.enqueue("copy", func(ctx context.Context, t *asyncTask) (interface{}, error) {
+		svc, _ := keyClient(storageClient(), request.Key)
+		head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(srcBucket),
+			Key:    aws.String(request.Key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		size := aws.Int64Value(head.ContentLength)
+		t.logf("Copying %s (%d bytes) to %s/%s", request.Key, size, dstBucket, dstKey)
+		if dry {
+			t.logf("Dry run, skipping the copy")
+			return gin.H{"bucket": dstBucket, "key": dstKey, "size": size, "dry_run": true}, nil
+		}
+		if err := copyObject(ctx, svc, srcBucket, request.Key, dstBucket, dstKey, size, t.progress); err != nil {
+			return nil, err
+		}
+		return gin.H{"bucket": dstBucket, "key": dstKey, "size": size}, nil
+	})
+	respondTask(c, t)
+}
+
+// restoreSnapshot queues restoring an archived object from Glacier, the task is
+// done once the restored copy can be downloaded. In dry run the task only checks
+// the object exists.
+func restoreSnapshot(c *gin.Context) {
+	var request struct {
+		Key string `json:"key" binding:"required"`
+		// Days the restored copy is kept, 7 if 0
+		Days int64 `json:"days"`
+		// Tier is Expedited, Standard, the default, or Bulk
+		Tier string `json:"tier"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if request.Days <= 0 {
+		request.Days = 7
+	}
+	switch request.Tier {
+	case "":
+		request.Tier = s3.TierStandard
+	case s3.TierExpedited, s3.TierStandard, s3.TierBulk:
+	default:
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "tier must be Expedited, Standard or Bulk")
+		return
+	}
+
+	dry := dryRun(c)
+	t := tasks.enqueue("restore", func(ctx context.Context, t *asyncTask) (interface{}, error) {
+		svc, bucket := keyClient(storageClient(), request.Key)
+		if dry {
+			head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(request.Key),
+			})
+			if err != nil {
+				return nil, err
+			}
+			t.logf("Dry run, skipping the restore of %s with tier %s", request.Key, request.Tier)
+			return gin.H{"key": request.Key, "restore": aws.StringValue(head.Restore), "dry_run": true}, nil
+		}
+		_, err := svc.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(request.Key),
+			RestoreRequest: &s3.RestoreRequest{
+				Days:                 aws.Int64(request.Days),
+				GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(request.Tier)},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		t.logf("Restore of %s requested with tier %s", request.Key, request.Tier)
+
+		for {
+			head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(request.Key),
+			})
+			if err != nil {
+				return nil, err
+			}
+			// ongoing-request="false" once restored, with the expiry-date of the copy
+			restore := aws.StringValue(head.Restore)
+			if strings.Contains(restore, `ongoing-request="false"`) {
+				t.logf("Restored: %s", restore)
+				return gin.H{"key": request.Key, "restore": restore}, nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(restorePollInterval):
+			}
+		}
+	})
+	respondTask(c, t)
+}
+
+func registerTaskRoutes(router *gin.Engine, admin *gin.RouterGroup) {
+	jobs := router.Group("/jobs", adminAuth())
+	jobs.GET("", listTasks)
+	jobs.GET("/:id", getTask)
+	jobs.DELETE("/:id", cancelTask)
+
+	admin.POST("/networks/:protocol/:network/checksums", computeChecksums)
+	admin.POST("/copy", copySnapshot)
+	admin.POST("/restore", restoreSnapshot)
+}
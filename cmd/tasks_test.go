@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForTask waits until the task with the ID finished and returns it
+func waitForTask(t *testing.T, id string) taskInfo {
+	t.Helper()
+	task, ok := tasks.get(id)
+	if !ok {
+		t.Fatalf("task %s not found", id)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if info := task.status(); info.finished() {
+			return info
+		}
+	}
+	t.Fatalf("task %s still %s", id, task.status().State)
+	return taskInfo{}
+}
+
+func TestTasks(t *testing.T) {
+	r, storage := newTestAPI(t)
+	// Uncompressed, so they are read without a decompressor
+	storage.put("nimiq/testnet/2024-01-01.tar", "older testnet snapshot", olderTime)
+	storage.put("nimiq/testnet/2024-02-01.tar", "newer testnet snapshot", newerTime)
+
+	w := serve(r, "POST", "/admin/networks/nimiq/testnet/checksums", "", true)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var queued taskInfo
+	decode(t, w, &queued)
+	if w.Header().Get("Location") != "/jobs/"+queued.ID || queued.Kind != "checksums" {
+		t.Errorf("location %q, task %+v", w.Header().Get("Location"), queued)
+	}
+	if info := waitForTask(t, queued.ID); info.State != taskSucceeded || info.Progress != 1 || len(info.Logs) == 0 {
+		t.Fatalf("task %+v", info)
+	}
+
+	w = serve(r, "GET", "/jobs/"+queued.ID, "", true)
+	var done taskInfo
+	decode(t, w, &done)
+	sum := sha256.Sum256([]byte("newer testnet snapshot"))
+	want := hex.EncodeToString(sum[:])
+	if sums, _ := done.Result.(map[string]interface{}); len(sums) != 2 || sums["2024-02-01.tar"] != want {
+		t.Errorf("result %v", done.Result)
+	}
+	w = serve(r, "GET", "/files/nimiq/testnet/checksums.txt", "", false)
+	if got := w.Body.String(); !strings.Contains(got, want+"  2024-02-01.tar\n") {
+		t.Errorf("checksums.txt %q", got)
+	}
+
+	// A dry run copy only checks the source
+	w = serve(r, "POST", "/admin/copy?dry_run=true", `{"key": "nimiq/testnet/2024-02-01.tar", "destination_key": "nimiq/testnet/copy.tar"}`, true)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("copy status %d: %s", w.Code, w.Body.String())
+	}
+	decode(t, w, &queued)
+	if info := waitForTask(t, queued.ID); info.State != taskSucceeded {
+		t.Fatalf("copy task %+v", info)
+	}
+	if _, ok := storage.objects["nimiq/testnet/copy.tar"]; ok {
+		t.Error("dry run copied the snapshot")
+	}
+
+	// A task waiting for its context is canceled
+	running := tasks.enqueue("test", func(ctx context.Context, _ *asyncTask) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	id := running.status().ID
+	if w = serve(r, "DELETE", "/jobs/"+id, "", true); w.Code != http.StatusAccepted {
+		t.Fatalf("cancel status %d: %s", w.Code, w.Body.String())
+	}
+	if info := waitForTask(t, id); info.State != taskCanceled {
+		t.Errorf("state %s, want canceled", info.State)
+	}
+	if w = serve(r, "DELETE", "/jobs/"+id, "", true); w.Code != http.StatusConflict {
+		t.Errorf("cancel finished status %d", w.Code)
+	}
+}
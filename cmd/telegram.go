@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// telegramPollTimeout is the long polling timeout of getUpdates
+const telegramPollTimeout = 50 * time.Second
+
+// telegramBot announces new snapshots to subscribed chats and answers commands
+type telegramBot struct {
+	apiURL string
+	client *http.Client
+
+	mu    sync.Mutex
+	chats map[int64]bool
+}
+
+// telegramUpdate is the part of a Bot API update we use
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// newTelegramBot creates a bot announcing to chatIDs and any chat sending /subscribe
+func newTelegramBot(token string, chatIDs []int64) *telegramBot {
+	b := &telegramBot{
+		apiURL: "https://api.telegram.org/bot" + token + "/",
+		client: &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+		chats:  make(map[int64]bool),
+	}
+	for _, id := range chatIDs {
+		b.chats[id] = true
+	}
+	return b
+}
+
+// call invokes a Bot API method and decodes its result into result
+func (b *telegramBot) call(method string, params url.Values, result interface{}) error {
+	resp, err := b.client.PostForm(b.apiURL+method, params)
+	if err != nil {
+		// The URL carries the bot token
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if !body.OK {
+		return fmt.Errorf("telegram %s failed: %s", method, body.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(body.Result, result)
+	}
+	return nil
+}
+
+func (b *telegramBot) send(chatID int64, text string) error {
+	return b.call("sendMessage", url.Values{
+		"chat_id":                  {fmt.Sprint(chatID)},
+		"text":                     {text},
+		"disable_web_page_preview": {"true"},
+	}, nil)
+}
+
+// run polls for commands until the process exits
+func (b *telegramBot) run() {
+	var offset int64
+	for {
+		var updates []telegramUpdate
+		err := b.call("getUpdates", url.Values{
+			"offset":  {fmt.Sprint(offset)},
+			"timeout": {fmt.Sprint(int(telegramPollTimeout.Seconds()))},
+		}, &updates)
+		if err != nil {
+			logger.Warn("Polling Telegram failed", "error", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				b.handle(u.Message.Chat.ID, u.Message.Text)
+			}
+		}
+	}
+}
+
+// handle answers a command sent to the bot
+func (b *telegramBot) handle(chatID int64, text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return
+	}
+	// Commands in groups may be addressed as /latest@botname
+	command, _, _ := strings.Cut(fields[0], "@")
+
+	var reply string
+	switch command {
+	case "/latest":
+		if len(fields) != 3 {
+			reply = "Usage: /latest <protocol> <network>"
+			break
+		}
+		reply = latestMessage(fields[1], fields[2])
+	case "/subscribe":
+		b.mu.Lock()
+		b.chats[chatID] = true
+		b.mu.Unlock()
+		reply = "Subscribed to new snapshot announcements."
+	case "/unsubscribe":
+		b.mu.Lock()
+		delete(b.chats, chatID)
+		b.mu.Unlock()
+		reply = "Unsubscribed from new snapshot announcements."
+	case "/start", "/help":
+		reply = "/latest <protocol> <network> - show the latest snapshot\n/subscribe - announce new snapshots in this chat\n/unsubscribe - stop announcements"
+	default:
+		return
+	}
+
+	if err := b.send(chatID, reply); err != nil {
+		logger.Warn("Answering Telegram command failed", "command", command, "error", err)
+	}
+}
+
+// announce sends new snapshots to all subscribed chats
+func (b *telegramBot) announce(e snapshotEvent) {
+	if e.Type != eventSnapshotPublished {
+		return
+	}
+	message := snapshotAnnouncement(e)
+
+	b.mu.Lock()
+	chats := make([]int64, 0, len(b.chats))
+	for id := range b.chats {
+		chats = append(chats, id)
+	}
+	b.mu.Unlock()
+
+	for _, id := range chats {
+		if err := b.send(id, message); err != nil {
+			logger.Warn("Announcing new snapshot on Telegram failed", "chat_id", id, "error", err)
+		}
+	}
+}
+
+// latestMessage describes the latest snapshot of a network for chat replies. Like
+// on the API, networks outside of the registry or allowlist are not served.
+func latestMessage(protocol, network string) string {
+	if served := servedNetworks(); len(served) > 0 {
+		name, ok := matchNetwork(protocol+"/"+network, served)
+		if !ok {
+			return fmt.Sprintf("%s/%s is not served.", protocol, network)
+		}
+		protocol, network, _ = strings.Cut(name, "/")
+	}
+	latest, err := findLatest(context.Background(), protocol, network)
+	if err != nil {
+		return "Looking up the latest snapshot failed, please try again later."
+	}
+	if latest == nil {
+		return fmt.Sprintf("No snapshots found for %s/%s.", protocol, network)
+	}
+	return snapshotAnnouncement(snapshotEvent{
+		Protocol:     protocol,
+		Network:      network,
+		Key:          *latest.Key,
+		Size:         *latest.Size,
+		LastModified: aws.TimeValue(latest.LastModified),
+	})
+}
+
+// startTelegramBot starts the bot if a token is configured
+func startTelegramBot() {
+	if config.TelegramBotToken == "" {
+		return
+	}
+	bot := newTelegramBot(config.TelegramBotToken, config.TelegramChatIDs)
+	subscribeEvents("telegram", bot.announce)
+	go bot.run()
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+// TenantSettings configures a tenant, served from its own bucket under /t/<tenant>/
+type TenantSettings struct {
+	// BucketName is the bucket of the snapshots of the tenant, reached with its
+	// settings in buckets if there are any
+	BucketName string `json:"bucket_name"`
+	// APIKeys are the keys the clients of the tenant authenticate with, in the
+	// X-API-Key header or as bearer token
+	APIKeys []string `json:"api_keys"`
+	// QuotaRequestsPerDay limits the requests of the tenant per UTC day, unlimited if 0
+	QuotaRequestsPerDay int `json:"quota_requests_per_day"`
+	// Networks limits the protocol/network pairs served to the tenant, all of its
+	// bucket if empty
+	Networks []string `json:"networks"`
+}
+
+// tenantListingTTL is how long the listing of a network of a tenant is used
+const tenantListingTTL = 5 * time.Minute
+
+// tenantState is what is kept per tenant while serving it. The caches of the
+// bucket of the snapshots are never used for tenants, so tenants can't see each
+// other's snapshots even with the same protocol/network.
+type tenantState struct {
+	mu sync.Mutex
+	// day is the UTC day requests are counted for
+	day      string
+	requests int
+
+	// listings are the objects of the networks of the tenant by protocol/network
+	listings sync.Map
+}
+
+// tenantListing is a cached listing of a network of a tenant
+type tenantListing struct {
+	objects []*s3.Object
+	listed  time.Time
+}
+
+// tenantStates holds the tenantState of every tenant served since the start, by name
+var tenantStates sync.Map
+
+func stateOfTenant(name string) *tenantState {
+	v, _ := tenantStates.LoadOrStore(name, &tenantState{})
+	return v.(*tenantState)
+}
+
+// allow counts a request of the tenant and reports whether it is within quota
+func (s *tenantState) allow(quota int, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != s.day {
+		s.day, s.requests = day, 0
+	}
+	if quota > 0 && s.requests >= quota {
+		return false
+	}
+	s.requests++
+	return true
+}
+
+// tenantKey is the gin context key of the TenantSettings of the request
+const tenantKey = "tenant"
+
+// tenantAuth only lets requests through that carry an API key of the tenant of
+// the path and are within its quota. Unknown tenants are answered like wrong keys,
+// so tenant names can't be probed.
+func tenantAuth(c *gin.Context) {
+	settings, ok := config.Tenants[c.Param("tenant")]
+	key, found := c.GetHeader("X-API-Key"), true
+	if key == "" {
+		key, found = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if !ok || !found || !validAPIKey(key, settings.APIKeys) {
+		abortWithError(c, http.StatusUnauthorized, codeUnauthorized, "invalid API key")
+		return
+	}
+
+	now := time.Now()
+	if !stateOfTenant(c.Param("tenant")).allow(settings.QuotaRequestsPerDay, now) {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		c.Header("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+		abortWithError(c, http.StatusTooManyRequests, codeQuotaExceeded,
+			fmt.Sprintf("quota of %d requests per day exceeded", settings.QuotaRequestsPerDay))
+		return
+	}
+
+	name := c.Param("protocol") + "/" + c.Param("network")
+	if len(settings.Networks) > 0 {
+		n, ok := matchNetwork(name, settings.Networks)
+		if !ok {
+			abortWithError(c, http.StatusNotFound, codeNetworkNotFound, fmt.Sprintf("network %s is not served", name))
+			return
+		}
+		protocol, network, _ := strings.Cut(n, "/")
+		for i := range c.Params {
+			switch c.Params[i].Key {
+			case "protocol":
+				c.Params[i].Value = protocol
+			case "network":
+				c.Params[i].Value = network
+			}
+		}
+	}
+
+	c.Set(tenantKey, settings)
+	c.Next()
+}
+
+// validAPIKey reports whether key is one of keys, in constant time
+func validAPIKey(key string, keys []string) bool {
+	valid := false
+	for _, k := range keys {
+		if k != "" && subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// tenantObjects returns the objects of a network in the bucket of the tenant,
+// listed at most tenantListingTTL ago
+func tenantObjects(ctx context.Context, name string, settings TenantSettings, protocol, network string) ([]*s3.Object, error) {
+	state := stateOfTenant(name)
+	cacheKey := protocol + "/" + network
+	if v, ok := state.listings.Load(cacheKey); ok && time.Since(v.(tenantListing).listed) < tenantListingTTL {
+		observeCache("tenant_files", true)
+		return v.(tenantListing).objects, nil
+	}
+	observeCache("tenant_files", false)
+
+	prefix := cacheKey + "/"
+	v, err := sharedStorageCall(ctx, "tenant:"+name+":list:"+prefix, func(ctx context.Context) (interface{}, error) {
+		return listBucketObjects(ctx, bucketClient(settings.BucketName), settings.BucketName, prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+	objects := v.([]*s3.Object)
+	state.listings.Store(cacheKey, tenantListing{objects: objects, listed: time.Now()})
+	return objects, nil
+}
+
+// tenantFileURLs returns the fileURLsFunc of the bucket of a tenant. Tenants have
+// no CDN, their snapshots are downloaded from their bucket.
+func tenantFileURLs(settings TenantSettings) fileURLsFunc {
+	svc := bucketClient(settings.BucketName)
+	return func(key string, ttl time.Duration) (string, string, error) {
+		u, err := presignBucketObject(svc, settings.BucketName, key, ttl)
+		return u, "", err
+	}
+}
+
+// tenantFiles returns the listing entries of a network of the tenant of the request
+func tenantFiles(c *gin.Context) ([]map[string]interface{}, error) {
+	settings := c.MustGet(tenantKey).(TenantSettings)
+	objects, err := tenantObjects(withRequestID(c.Request.Context(), c), c.Param("tenant"), settings, c.Param("protocol"), c.Param("network"))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]map[string]interface{}, 0, len(objects))
+	for _, object := range objects {
+		files = append(files, fileEntry(object))
+	}
+	return files, nil
+}
+
+// @Summary List the files of a network of a tenant
+// @Description Like /files/{protocol}/{network}, from the bucket of the tenant
+// @Produce json
+// @Param X-API-Key header string true "API key of the tenant"
+// @Success 200 {object} map[string]string
+// @Router /t/{tenant}/files/{protocol}/{network} [get]
+func listTenantFiles(c *gin.Context) {
+	paging, err := parseFilesPaging(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if isHead(c) {
+		respondListingHead(c)
+		return
+	}
+	files, err := tenantFiles(c)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	c.Set(fileURLsKey, tenantFileURLs(c.MustGet(tenantKey).(TenantSettings)))
+	paging.respond(c, files)
+}
+
+// tenantLatest returns the latest snapshot of a network of the tenant of the request,
+// nil if the network has none
+func tenantLatest(c *gin.Context) (*s3.Object, error) {
+	settings := c.MustGet(tenantKey).(TenantSettings)
+	objects, err := tenantObjects(withRequestID(c.Request.Context(), c), c.Param("tenant"), settings, c.Param("protocol"), c.Param("network"))
+	if err != nil {
+		return nil, err
+	}
+	return newestSnapshot(objects), nil
+}
+
+// @Summary Get the latest snapshot of a network of a tenant
+// @Description The listing entry of the latest snapshot of the network, with its download URL
+// @Produce json
+// @Param X-API-Key header string true "API key of the tenant"
+// @Success 200 {object} map[string]interface{}
+// @Router /t/{tenant}/files/{protocol}/{network}/latest [get]
+func tenantLatestSnapshot(c *gin.Context) {
+	if isHead(c) {
+		respondTenantSnapshotsHead(c, http.StatusOK, jsonContentType)
+		return
+	}
+	latest, err := tenantLatest(c)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	if latest == nil {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+
+	ttl := presignTTL(c.FullPath(), c.Param("protocol"), c.Param("network"), defaultPresignTTL)
+	url, _, err := tenantFileURLs(c.MustGet(tenantKey).(TenantSettings))(*latest.Key, ttl)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	file := fileEntry(latest)
+	if age, ok := objectAgeSeconds(latest.LastModified, time.Now()); ok {
+		file["age_seconds"] = age
+	}
+	file["url"] = url
+	c.JSON(http.StatusOK, file)
+}
+
+// @Summary Redirect to the latest snapshot of a network of a tenant
+// @Param X-API-Key header string true "API key of the tenant"
+// @Success 302
+// @Router /t/{tenant}/download/{protocol}/{network}/latest [get]
+func tenantDownloadLatest(c *gin.Context) {
+	if isHead(c) {
+		// The redirect target is presigned, so HEAD only gets the status
+		respondTenantSnapshotsHead(c, http.StatusFound, "")
+		return
+	}
+	latest, err := tenantLatest(c)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	if latest == nil {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+
+	ttl := presignTTL(c.FullPath(), c.Param("protocol"), c.Param("network"), defaultPresignTTL)
+	url, _, err := tenantFileURLs(c.MustGet(tenantKey).(TenantSettings))(*latest.Key, ttl)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, url)
+}
+
+// respondTenantSnapshotsHead answers a HEAD request of a route of a tenant that
+// needs the latest snapshot of a network with status and contentType, like
+// respondSnapshotsHead. The listing of the tenant is used when there is one, even
+// an expired one, else the snapshot-latest.json in its bucket is taken as the sign.
+func respondTenantSnapshotsHead(c *gin.Context, status int, contentType string) {
+	settings := c.MustGet(tenantKey).(TenantSettings)
+	protocol, network := c.Param("protocol"), c.Param("network")
+	var found bool
+	if v, ok := stateOfTenant(c.Param("tenant")).listings.Load(protocol + "/" + network); ok {
+		found = newestSnapshot(v.(tenantListing).objects) != nil
+	} else {
+		_, err := bucketClient(settings.BucketName).HeadObjectWithContext(withRequestID(c.Request.Context(), c), &s3.HeadObjectInput{
+			Bucket: aws.String(settings.BucketName),
+			Key:    aws.String(fmt.Sprintf("%s/%s/snapshot-latest.json", protocol, network)),
+		})
+		if err != nil && !isNotFound(err) {
+			respondInternalError(c, err)
+			return
+		}
+		found = err == nil
+	}
+	if !found {
+		respondError(c, http.StatusNotFound, codeNetworkNotFound, "No snapshots found")
+		return
+	}
+	respondHead(c, status, contentType)
+}
+
+// privateResponse keeps shared caches from storing responses, which depend on the
+// API key of the request, and from serving them to other clients
+func privateResponse(c *gin.Context) {
+	c.Header("Cache-Control", "private, no-store")
+	c.Writer.Header().Add("Vary", "X-API-Key")
+	c.Writer.Header().Add("Vary", "Authorization")
+	c.Next()
+}
+
+// registerTenantRoutes serves the snapshots of every tenant under /t/<tenant>/
+func registerTenantRoutes(router *gin.Engine) {
+	if len(config.Tenants) == 0 {
+		return
+	}
+	tenants := router.Group("/t/:tenant", privateResponse, tenantAuth)
+	tenants.Match(getOrHead, "/files/:protocol/:network", listTenantFiles)
+	tenants.Match(getOrHead, "/files/:protocol/:network/latest", tenantLatestSnapshot)
+	tenants.Match(getOrHead, "/download/:protocol/:network/latest", tenantDownloadLatest)
+}
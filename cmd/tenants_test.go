@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTenantTestAPI serves the bucket of the test as the only bucket of tenant acme
+func newTenantTestAPI(t *testing.T, settings TenantSettings) http.Handler {
+	t.Helper()
+	newTestAPI(t)
+	settings.BucketName = config.BucketName
+	config.Tenants = map[string]TenantSettings{"acme": settings}
+	return newRouter(io.Discard)
+}
+
+func serveTenant(r http.Handler, target string, header, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTenantAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+		value  string
+		status int
+		code   string
+	}{
+		{"api key", "/t/acme/files/nimiq/mainnet", "X-API-Key", "acme-key", http.StatusOK, ""},
+		{"bearer token", "/t/acme/files/nimiq/mainnet", "Authorization", "Bearer acme-key", http.StatusOK, ""},
+		{"bare key as authorization", "/t/acme/files/nimiq/mainnet", "Authorization", "acme-key", http.StatusUnauthorized, codeUnauthorized},
+		{"other authorization scheme", "/t/acme/files/nimiq/mainnet", "Authorization", "Token acme-key", http.StatusUnauthorized, codeUnauthorized},
+		{"no key", "/t/acme/files/nimiq/mainnet", "", "", http.StatusUnauthorized, codeUnauthorized},
+		{"wrong key", "/t/acme/files/nimiq/mainnet", "X-API-Key", "other-key", http.StatusUnauthorized, codeUnauthorized},
+		{"unknown tenant", "/t/other/files/nimiq/mainnet", "X-API-Key", "acme-key", http.StatusUnauthorized, codeUnauthorized},
+		{"network not allowed", "/t/acme/files/ethereum/mainnet", "X-API-Key", "acme-key", http.StatusNotFound, codeNetworkNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTenantTestAPI(t, TenantSettings{APIKeys: []string{"acme-key"}, Networks: []string{"nimiq/mainnet"}})
+			w := serveTenant(r, tt.target, tt.header, tt.value)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.code == "" {
+				return
+			}
+			var body apiError
+			decode(t, w, &body)
+			if body.Code != tt.code {
+				t.Errorf("code %s, want %s", body.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	r := newTenantTestAPI(t, TenantSettings{APIKeys: []string{"acme-key"}, QuotaRequestsPerDay: 2})
+	for i := 0; i < 2; i++ {
+		if w := serveTenant(r, "/t/acme/files/nimiq/mainnet", "X-API-Key", "acme-key"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	w := serveTenant(r, "/t/acme/files/nimiq/mainnet", "X-API-Key", "acme-key")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	var body apiError
+	decode(t, w, &body)
+	if body.Code != codeQuotaExceeded {
+		t.Errorf("code %s, want %s", body.Code, codeQuotaExceeded)
+	}
+}
+
+func TestTenantFiles(t *testing.T) {
+	r := newTenantTestAPI(t, TenantSettings{APIKeys: []string{"acme-key"}})
+
+	w := serveTenant(r, "/t/acme/files/nimiq/mainnet", "X-API-Key", "acme-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var files []listedFile
+	decode(t, w, &files)
+	if len(files) != 3 {
+		t.Fatalf("%d files, want 3", len(files))
+	}
+	for _, f := range files {
+		if f.URL == "" || f.CDNURL != "" {
+			t.Errorf("%s: url %q, cdn_url %q", f.Filename, f.URL, f.CDNURL)
+		}
+	}
+
+	w = serveTenant(r, "/t/acme/files/nimiq/mainnet/latest", "X-API-Key", "acme-key")
+	var latest listedFile
+	decode(t, w, &latest)
+	if latest.Filename != "nimiq/mainnet/2024-02-01.tar.zst" || latest.URL == "" {
+		t.Errorf("latest %+v", latest)
+	}
+
+	w = serveTenant(r, "/t/acme/download/nimiq/mainnet/latest", "X-API-Key", "acme-key")
+	if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Location"), "2024-02-01.tar.zst") {
+		t.Errorf("status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestTenantResponsesPrivate(t *testing.T) {
+	r := newTenantTestAPI(t, TenantSettings{APIKeys: []string{"acme-key"}})
+	// Public cache headers configured for the public routes don't apply
+	config.CacheControl = map[string]string{"listings": "public, max-age=60", "latest": "public, max-age=60"}
+
+	for _, target := range []string{"/t/acme/files/nimiq/mainnet", "/t/acme/files/nimiq/mainnet/latest", "/t/acme/download/nimiq/mainnet/latest"} {
+		w := serveTenant(r, target, "X-API-Key", "acme-key")
+		if got := w.Header().Get("Cache-Control"); got != "private, no-store" {
+			t.Errorf("%s: Cache-Control %q, want private, no-store", target, got)
+		}
+		if vary := w.Header().Values("Vary"); !slices.Contains(vary, "X-API-Key") {
+			t.Errorf("%s: Vary %v, want X-API-Key", target, vary)
+		}
+	}
+}
+
+func TestTenantHead(t *testing.T) {
+	r := newTenantTestAPI(t, TenantSettings{APIKeys: []string{"acme-key"}})
+	storage := storageClient().(*fakeStorage)
+	head := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", target, nil)
+		req.Header.Set("X-API-Key", "acme-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// With cold caches HEAD answers without listing or presigning
+	for target, status := range map[string]int{
+		"/t/acme/files/nimiq/mainnet/latest":    http.StatusOK,
+		"/t/acme/download/nimiq/mainnet/latest": http.StatusFound,
+		"/t/acme/files/nimiq/testnet/latest":    http.StatusNotFound,
+		"/t/acme/download/nimiq/testnet/latest": http.StatusNotFound,
+	} {
+		if w := head(target); w.Code != status {
+			t.Errorf("cold HEAD %s: status %d, want %d", target, w.Code, status)
+		}
+	}
+	storage.mu.Lock()
+	if storage.lists != 0 {
+		t.Errorf("cold HEAD made %d list calls", storage.lists)
+	}
+	storage.mu.Unlock()
+	if w := head("/t/acme/download/nimiq/mainnet/latest"); w.Header().Get("Location") != "" {
+		t.Errorf("HEAD presigned the redirect to %s", w.Header().Get("Location"))
+	}
+
+	// Once listed, HEAD follows the listing of the tenant
+	serveTenant(r, "/t/acme/files/nimiq/mainnet", "X-API-Key", "acme-key")
+	storage.mu.Lock()
+	delete(storage.objects, "nimiq/mainnet/snapshot-latest.json")
+	storage.mu.Unlock()
+	if w := head("/t/acme/files/nimiq/mainnet/latest"); w.Code != http.StatusOK || w.Header().Get("Content-Type") != jsonContentType {
+		t.Errorf("warm HEAD: status %d, content type %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// torrentTargetPieces is roughly how many pieces a torrent is split into
+	torrentTargetPieces = 2000
+	// torrentMinPieceLength and torrentMaxPieceLength bound the piece length
+	torrentMinPieceLength = 256 << 10
+	torrentMaxPieceLength = 16 << 20
+	// torrentWebSeedTTL is how long presigned web seed URLs are valid, the SigV4 maximum
+	torrentWebSeedTTL = 7 * 24 * time.Hour
+)
+
+// bencodeRaw is an already bencoded value
+type bencodeRaw []byte
+
+// bencode writes v in the BitTorrent bencoding
+func bencode(w *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case bencodeRaw:
+		w.Write(v)
+	case string:
+		fmt.Fprintf(w, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(w, "%d:", len(v))
+		w.Write(v)
+	case int:
+		fmt.Fprintf(w, "i%de", v)
+	case int64:
+		fmt.Fprintf(w, "i%de", v)
+	case []interface{}:
+		w.WriteByte('l')
+		for _, item := range v {
+			bencode(w, item)
+		}
+		w.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.WriteByte('d')
+		for _, k := range keys {
+			bencode(w, k)
+			bencode(w, v[k])
+		}
+		w.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// torrentPieceLength picks a power of two piece length giving about torrentTargetPieces pieces
+func torrentPieceLength(size int64) int64 {
+	length := int64(torrentMinPieceLength)
+	for length < torrentMaxPieceLength && size/length > torrentTargetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// generateTorrentInfo hashes the pieces of an object and returns its bencoded info
+// dictionary. The object is read pinned to its ETag so a replaced object fails
+// the generation instead of producing a mixed torrent.
+func generateTorrentInfo(key, etag string, size int64) ([]byte, error) {
+	start := time.Now()
+	svc, bucket := keyClient(storageClient(), key)
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	pieceLength := torrentPieceLength(size)
+	pieces := make([]byte, 0, (size/pieceLength+1)*sha1.Size)
+	buf := make([]byte, pieceLength)
+	var read int64
+	for {
+		n, err := io.ReadFull(out.Body, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			pieces = append(pieces, sum[:]...)
+			read += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if read != size {
+		return nil, fmt.Errorf("read %d bytes of %s, expected %d", read, key, size)
+	}
+
+	var info bytes.Buffer
+	bencode(&info, map[string]interface{}{
+		"name":         filepath.Base(key),
+		"length":       size,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	})
+
+	logger.Info("Generated torrent", "key", key, "pieces", len(pieces)/sha1.Size, "duration", time.Since(start))
+	return info.Bytes(), nil
+}
+
+// torrentWebSeeds returns the BEP 19 web seed URLs of key. Only URLs that stay
+// valid are used: the unsigned CDN URL, the plain S3 URL of public keys, the proxied
+// download URL under public_url, and a week long presigned URL if none is available.
+func torrentWebSeeds(key string) ([]interface{}, error) {
+	var seeds []interface{}
+	public := isPublic(key)
+	if u, ok := cdnURL(key); ok && (cloudFrontSigner == nil || public) {
+		seeds = append(seeds, u)
+	}
+	if public {
+		u, err := publicObjectURL(storageClient(), key)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, u)
+	}
+	if config.PublicURL != "" {
+		seeds = append(seeds, publicURL("/download/"+key))
+	}
+	if len(seeds) == 0 {
+		u, err := presignGetObject(storageClient(), key, torrentWebSeedTTL)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, u)
+	}
+	return seeds, nil
+}
+
+// @Summary Get the torrent of a snapshot
+// @Description Get a .torrent file of a snapshot with its download URLs as web seeds. The torrent is generated on first request, until it is ready 202 is returned.
+// @Produce application/x-bittorrent
+// @Success 200 {file} binary
+// @Success 202 {object} map[string]string
+// @Router /files/{protocol}/{network}/{filename}/torrent [get]
+func torrentFile(c *gin.Context) {
+	filename := c.Param("filename")
+	key := fmt.Sprintf("%s/%s/%s", c.Param("protocol"), c.Param("network"), filename)
+
+	svc, bucket := keyClient(storageClient(), key)
+	head, err := svc.HeadObjectWithContext(withRequestID(c.Request.Context(), c), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		respondDownloadError(c, err)
+		return
+	}
+	etag, size := aws.StringValue(head.ETag), aws.Int64Value(head.ContentLength)
+	if isHead(c) {
+		respondDerivedHead(c, derivedCachePath(key, etag, ".torrent-info"), "Torrent", "application/x-bittorrent")
+		return
+	}
+
+	info, err := readDerived(derivedCachePath(key, etag, ".torrent-info"), func() ([]byte, error) {
+		return generateTorrentInfo(key, etag, size)
+	})
+	if respondDerived(c, "Torrent", err) {
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	seeds, err := torrentWebSeeds(key)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	torrent := map[string]interface{}{
+		"info":          bencodeRaw(info),
+		"url-list":      seeds,
+		"creation date": aws.TimeValue(head.LastModified).Unix(),
+		"created by":    "snapshot-service-api " + version,
+	}
+	if len(config.TorrentTrackers) > 0 {
+		torrent["announce"] = config.TorrentTrackers[0]
+		trackers := make([]interface{}, len(config.TorrentTrackers))
+		for i, t := range config.TorrentTrackers {
+			trackers[i] = []interface{}{t}
+		}
+		torrent["announce-list"] = trackers
+	}
+
+	var body bytes.Buffer
+	bencode(&body, torrent)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".torrent"))
+	c.Header("Content-Length", strconv.Itoa(body.Len()))
+	c.Data(http.StatusOK, "application/x-bittorrent", body.Bytes())
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// uploaderRetries is how often the uploader retries a part before giving up
+	uploaderRetries = 3
+	// uploaderURLBatch is how many part URLs the uploader asks for at once
+	uploaderURLBatch = 100
+)
+
+// uploadClient talks to the upload API of the service at base
+type uploadClient struct {
+	base  string
+	token string
+}
+
+// uploadedPart is a part of an upload that was stored
+type uploadedPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// runUploader implements the upload subcommand: it uploads a snapshot through the
+// presigned part URLs of the upload API, computes its SHA-256 on the way and
+// registers it as the latest snapshot of its network on completion
+func runUploader(args []string) {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	api := fs.String("api", "", "Base URL of the snapshot service API")
+	token := fs.String("token", os.Getenv("SNAPSHOT_ADMIN_TOKEN"), "Admin token of the API, defaults to $SNAPSHOT_ADMIN_TOKEN")
+	protocol := fs.String("protocol", "", "Protocol of the snapshot")
+	network := fs.String("network", "", "Network of the snapshot")
+	file := fs.String("file", "", "Snapshot file to upload")
+	name := fs.String("name", "", "File name in the bucket, defaults to the name of the file")
+	concurrency := fs.Int("concurrency", 4, "Number of parts uploaded at once")
+	noRegister := fs.Bool("no-register", false, "Don't point snapshot-latest.json at the snapshot")
+	fs.Parse(args)
+
+	if *api == "" || *token == "" || *protocol == "" || *network == "" || *file == "" || *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: snapshot-service upload --api URL --token TOKEN --protocol X --network Y --file PATH")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	if *name == "" {
+		*name = filepath.Base(*file)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fatal("Error opening snapshot", "error", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fatal("Error opening snapshot", "error", err)
+	}
+
+	client := &uploadClient{base: strings.TrimSuffix(*api, "/"), token: *token}
+	var upload struct {
+		Key      string `json:"key"`
+		UploadID string `json:"upload_id"`
+		PartSize int64  `json:"part_size"`
+		Parts    int64  `json:"parts"`
+	}
+	err = client.post("/admin/uploads", map[string]interface{}{
+		"protocol": *protocol,
+		"network":  *network,
+		"filename": *name,
+		"size":     info.Size(),
+	}, &upload)
+	if err != nil {
+		fatal("Error starting upload", "error", err)
+	}
+	logger.Info("Started upload", "key", upload.Key, "size", info.Size(), "parts", upload.Parts, "part_size", upload.PartSize)
+
+	parts, sum, err := client.uploadParts(f, upload.UploadID, upload.Key, upload.PartSize, upload.Parts, *concurrency)
+	if err != nil {
+		client.delete("/admin/uploads/" + upload.UploadID + "?key=" + url.QueryEscape(upload.Key))
+		fatal("Error uploading snapshot, the upload was aborted", "key", upload.Key, "error", err)
+	}
+	logger.Info("Uploaded all parts", "sha256", sum)
+
+	var completed map[string]interface{}
+	err = client.post("/admin/uploads/"+upload.UploadID+"/complete", map[string]interface{}{
+		"key":      upload.Key,
+		"parts":    parts,
+		"sha256":   sum,
+		"register": !*noRegister,
+	}, &completed)
+	if err != nil {
+		fatal("Error completing upload", "key", upload.Key, "error", err)
+	}
+	logger.Info("Completed upload", "key", upload.Key, "registered", !*noRegister)
+	os.Exit(0)
+}
+
+// uploadParts reads the snapshot front to back, hashing it, and hands the parts to
+// concurrency workers that PUT them to their presigned URLs. Only concurrency
+// parts are held in memory at a time.
+func (u *uploadClient) uploadParts(r io.Reader, uploadID, key string, partSize, count int64, concurrency int) ([]uploadedPart, string, error) {
+	type job struct {
+		number int64
+		data   []byte
+		url    string
+	}
+	jobs := make(chan job)
+	results := make([]uploadedPart, 0, count)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				etag, err := putPart(j.url, j.data)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("part %d: %w", j.number, err)
+				}
+				results = append(results, uploadedPart{PartNumber: j.number, ETag: etag})
+				mu.Unlock()
+			}
+		}()
+	}
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}
+
+	hash := sha256.New()
+	var urls map[string]string
+	var err error
+	for n := int64(1); n <= count && err == nil && failed() == nil; n++ {
+		if urls[strconv.FormatInt(n, 10)] == "" {
+			if urls, err = u.presignParts(uploadID, key, n, min(n+uploaderURLBatch-1, count)); err != nil {
+				break
+			}
+		}
+		data := make([]byte, partSize)
+		var read int
+		read, err = io.ReadFull(r, data)
+		if err == io.ErrUnexpectedEOF && n == count {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+		hash.Write(data[:read])
+		jobs <- job{number: n, data: data[:read], url: urls[strconv.FormatInt(n, 10)]}
+		if n%10 == 0 || n == count {
+			logger.Info("Upload progress", "parts", n, "of", count)
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		err = firstErr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].PartNumber < results[j].PartNumber })
+	return results, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// presignParts asks for the upload URLs of parts first to last
+func (u *uploadClient) presignParts(uploadID, key string, first, last int64) (map[string]string, error) {
+	numbers := make([]int64, 0, last-first+1)
+	for n := first; n <= last; n++ {
+		numbers = append(numbers, n)
+	}
+	var resp struct {
+		URLs map[string]string `json:"urls"`
+	}
+	err := u.post("/admin/uploads/"+uploadID+"/parts", map[string]interface{}{"key": key, "part_numbers": numbers}, &resp)
+	return resp.URLs, err
+}
+
+// putPart uploads a part to its presigned URL, retrying failures, and returns its ETag
+func putPart(partURL string, data []byte) (string, error) {
+	var err error
+	for attempt := 0; attempt < uploaderRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPut, partURL, bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("PUT: %s", resp.Status)
+			continue
+		}
+		return resp.Header.Get("ETag"), nil
+	}
+	return "", err
+}
+
+// do sends an authenticated request to the API and decodes the JSON response into out
+func (u *uploadClient) do(method, path string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u.base+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+u.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (u *uploadClient) post(path string, body, out interface{}) error {
+	return u.do(http.MethodPost, path, body, out)
+}
+
+func (u *uploadClient) delete(path string) error {
+	return u.do(http.MethodDelete, path, nil, nil)
+}
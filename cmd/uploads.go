@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// minUploadPartSize is the part size of uploads, unless that would need more
+	// parts than S3 allows
+	minUploadPartSize = 64 << 20
+	// maxUploadParts is the most parts S3 accepts in a multipart upload
+	maxUploadParts = 10000
+	// uploadPartURLTTL is how long presigned part upload URLs are valid
+	uploadPartURLTTL = time.Hour
+	// maxPresignedParts is the most part URLs handed out per request
+	maxPresignedParts = 1000
+	// defaultStaleUploadAge is the age of the incomplete uploads the abort-uploads
+	// job aborts unless max_age_hours is set
+	defaultStaleUploadAge = 7 * 24 * time.Hour
+)
+
+// sha256Pattern matches a hex SHA-256
+var sha256Pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+type createUploadRequest struct {
+	Protocol string `json:"protocol" binding:"required"`
+	Network  string `json:"network" binding:"required"`
+	Filename string `json:"filename" binding:"required"`
+	Size     int64  `json:"size" binding:"required"`
+}
+
+type uploadPartsRequest struct {
+	Key         string  `json:"key" binding:"required"`
+	PartNumbers []int64 `json:"part_numbers" binding:"required"`
+}
+
+type completeUploadRequest struct {
+	Key   string `json:"key" binding:"required"`
+	Parts []struct {
+		PartNumber int64  `json:"part_number"`
+		ETag       string `json:"etag"`
+	} `json:"parts" binding:"required"`
+	// SHA256 is the hex checksum of the whole snapshot, it is published in the snapshot-latest.json
+	SHA256 string `json:"sha256"`
+	// Register points the snapshot-latest.json of the network at the snapshot, true if omitted
+	Register *bool `json:"register"`
+}
+
+// uploadPartSize returns the part size for an upload of size bytes, a whole
+// number of MiB so that it fits in maxUploadParts parts
+func uploadPartSize(size int64) int64 {
+	partSize := int64(minUploadPartSize)
+	if needed := (size + maxUploadParts - 1) / maxUploadParts; needed > partSize {
+		partSize = (needed + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	return partSize
+}
+
+// splitUploadKey returns the protocol and network of the key of an upload, which
+// must be protocol/network/filename like the keys createUpload starts uploads of
+func splitUploadKey(key string) (protocol, network string, err error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return "", "", errors.New("key must be protocol/network/filename")
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", "", errors.New("key must be protocol/network/filename")
+		}
+	}
+	if parts[2] == "snapshot-latest.json" {
+		return "", "", errors.New("snapshot-latest.json is written on completion")
+	}
+	return parts[0], parts[1], nil
+}
+
+// createUpload starts a multipart upload of a snapshot. The producer then asks for
+// presigned URLs of its parts, PUTs them to the bucket directly and completes the upload.
+func createUpload(c *gin.Context) {
+	var req createUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	for _, part := range []string{req.Protocol, req.Network, req.Filename} {
+		if strings.Contains(part, "/") || part == "." || part == ".." {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, "protocol, network and filename must not contain slashes")
+			return
+		}
+	}
+	if req.Filename == "snapshot-latest.json" {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "snapshot-latest.json is written on completion")
+		return
+	}
+	partSize := uploadPartSize(req.Size)
+	if req.Size <= 0 || (req.Size+partSize-1)/partSize > maxUploadParts {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "size is out of range")
+		return
+	}
+
+	key := path.Join(req.Protocol, req.Network, req.Filename)
+	svc, bucket := keyClient(storageClient(), key)
+	out, err := svc.CreateMultipartUploadWithContext(c.Request.Context(), &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/octet-stream"),
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	requestLogger(c).Info("Started upload", "key", key, "size", req.Size, "upload_id", aws.StringValue(out.UploadId))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":       key,
+		"upload_id": aws.StringValue(out.UploadId),
+		"part_size": partSize,
+		"parts":     (req.Size + partSize - 1) / partSize,
+	})
+}
+
+// presignUploadParts returns presigned URLs to PUT the given parts of an upload to
+func presignUploadParts(c *gin.Context) {
+	var req uploadPartsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if _, _, err := splitUploadKey(req.Key); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if len(req.PartNumbers) > maxPresignedParts {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("at most %d parts per request", maxPresignedParts))
+		return
+	}
+
+	svc, bucket := keyClient(storageClient(), req.Key)
+	urls := make(map[string]string, len(req.PartNumbers))
+	for _, n := range req.PartNumbers {
+		if n < 1 || n > maxUploadParts {
+			respondError(c, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("part number %d is out of range", n))
+			return
+		}
+		r, _ := svc.UploadPartRequest(&s3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(req.Key),
+			UploadId:   aws.String(c.Param("upload_id")),
+			PartNumber: aws.Int64(n),
+		})
+		u, err := r.Presign(uploadPartURLTTL)
+		if err != nil {
+			respondInternalError(c, err)
+			return
+		}
+		urls[strconv.FormatInt(n, 10)] = u
+	}
+	c.JSON(http.StatusOK, gin.H{"urls": urls, "expires_in": int(uploadPartURLTTL.Seconds())})
+}
+
+// completeUpload completes a multipart upload and, unless told otherwise,
+// registers the snapshot as the latest of its network with its checksum
+func completeUpload(c *gin.Context) {
+	var req completeUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if req.SHA256 != "" && !sha256Pattern.MatchString(req.SHA256) {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "sha256 must be a hex SHA-256")
+		return
+	}
+	protocol, network, err := splitUploadKey(req.Key)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(req.Parts))
+	for _, p := range req.Parts {
+		completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(p.PartNumber), ETag: aws.String(p.ETag)})
+	}
+	svc, bucket := keyClient(storageClient(), req.Key)
+	ctx := c.Request.Context()
+	_, err = svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(req.Key),
+		UploadId:        aws.String(c.Param("upload_id")),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	head, err := svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(req.Key),
+	})
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	requestLogger(c).Info("Completed upload", "key", req.Key, "size", aws.Int64Value(head.ContentLength))
+	// Measure right away, requests for the snapshot only report existing measurements
+	measureInBackground(req.Key, aws.StringValue(head.ETag))
+
+	if req.Register != nil && !*req.Register {
+		refreshNetwork(protocol, network)
+		c.JSON(http.StatusOK, gin.H{"key": req.Key, "size": aws.Int64Value(head.ContentLength)})
+		return
+	}
+
+	// A new upload under the key of the current snapshot replaces it, along with what is known about it
+	doc := latestDocument(ctx, protocol, network, req.Key, head)
+	for _, field := range snapshotFields {
+		delete(doc, field)
+	}
+	doc["uploaded_at"] = time.Now().UTC()
+	recordChainHead(ctx, protocol, network, doc)
+	if req.SHA256 != "" {
+		doc["sha256"] = strings.ToLower(req.SHA256)
+		checksumCache.Store(req.Key+"\x00"+aws.StringValue(head.ETag), doc["sha256"])
+	}
+	if err := putLatestDocument(ctx, svc, protocol, network, doc); err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	requestLogger(c).Info("Registered snapshot", "protocol", protocol, "network", network, "key", req.Key)
+
+	refreshNetwork(protocol, network)
+	c.JSON(http.StatusOK, doc)
+}
+
+// abortUpload aborts a multipart upload, freeing the storage of its parts. A dry
+// run only checks that the upload exists.
+func abortUpload(c *gin.Context) {
+	key, uploadID := c.Query("key"), c.Param("upload_id")
+	if key == "" {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, "key query parameter is required")
+		return
+	}
+	if _, _, err := splitUploadKey(key); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	svc, bucket := keyClient(storageClient(), key)
+	ctx := c.Request.Context()
+
+	var err error
+	if dryRun(c) {
+		err = svc.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+			MaxParts: aws.Int64(1),
+		}, func(*s3.ListPartsOutput, bool) bool { return false })
+	} else {
+		_, err = svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: aws.String(uploadID),
+		})
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		respondError(c, http.StatusNotFound, codeUploadNotFound, "Upload not found")
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	if dryRun(c) {
+		logDryRun(c, "abort upload", "key", key, "upload_id", uploadID)
+		c.JSON(http.StatusOK, gin.H{"key": key, "upload_id": uploadID, "dry_run": true})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// abortStaleUploads aborts the multipart uploads of every snapshot bucket started
+// longer than max_age_hours ago, by producers that crashed or gave up. Their parts
+// are billed as storage but never show up in listings.
+func abortStaleUploads(ctx context.Context, settings JobSettings) error {
+	maxAge := time.Duration(settings.MaxAgeHours) * time.Hour
+	if maxAge <= 0 {
+		maxAge = defaultStaleUploadAge
+	}
+	cutoff := time.Now().Add(-maxAge)
+
+	var errs []error
+	for _, bucket := range snapshotBuckets() {
+		svc := bucketClient(bucket)
+		var stale []*s3.MultipartUpload
+		err := svc.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{Bucket: aws.String(bucket)},
+			func(page *s3.ListMultipartUploadsOutput, _ bool) bool {
+				for _, u := range page.Uploads {
+					if aws.TimeValue(u.Initiated).Before(cutoff) {
+						stale = append(stale, u)
+					}
+				}
+				return true
+			})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing uploads of %s: %w", bucket, err))
+			continue
+		}
+
+		var aborted, freed int64
+		for _, u := range stale {
+			log := logger.With("job", "abort-uploads", "bucket", bucket, "key", aws.StringValue(u.Key), "upload_id", aws.StringValue(u.UploadId),
+				"initiated", aws.TimeValue(u.Initiated))
+			// The size of the parts is what the upload was costing, only reported
+			var size int64
+			err := svc.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{Bucket: aws.String(bucket), Key: u.Key, UploadId: u.UploadId},
+				func(page *s3.ListPartsOutput, _ bool) bool {
+					for _, p := range page.Parts {
+						size += aws.Int64Value(p.Size)
+					}
+					return true
+				})
+			if err != nil {
+				log.Warn("Error listing the parts of a stale upload", "error", err)
+			}
+			if dryRunContext(ctx) {
+				log.Info("Dry run, skipping abort of stale upload", "size", size)
+				continue
+			}
+			_, err = svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String(bucket), Key: u.Key, UploadId: u.UploadId})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("aborting upload of %s in %s: %w", aws.StringValue(u.Key), bucket, err))
+				continue
+			}
+			log.Info("Aborted stale upload", "size", size)
+			aborted++
+			freed += size
+		}
+		abortedUploads.Add(float64(aborted), bucket)
+		abortedUploadBytes.Add(float64(freed), bucket)
+		if len(stale) > 0 {
+			logger.Info("Aborted stale uploads", "bucket", bucket, "stale", len(stale), "aborted", aborted, "bytes", freed, "max_age", maxAge)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func registerUploadRoutes(admin *gin.RouterGroup) {
+	admin.POST("/uploads", createUpload)
+	admin.POST("/uploads/:upload_id/parts", presignUploadParts)
+	admin.POST("/uploads/:upload_id/complete", completeUpload)
+	admin.DELETE("/uploads/:upload_id", abortUpload)
+}
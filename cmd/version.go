@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	// Fall back to the VCS information the go tool records when building from a checkout
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && buildDate == "":
+				buildDate = s.Value
+			}
+		}
+	}
+	buildInfo.Set(1, version, commit, runtime.Version())
+}
+
+// enabledFeatures reports which optional features the configuration turns on
+func enabledFeatures() map[string]bool {
+	return map[string]bool{
+		"cdn":                len(config.CDN) > 0,
+		"cloudfront_signing": cloudFrontSigner != nil,
+		"warmup":             config.Warmup,
+		"admin":              config.AdminToken != "",
+		"access_log":         config.AccessLog != "",
+		"analytics":          analytics != nil,
+		"costs":              costsEnabled(),
+		"catalog":            catalog != nil,
+		"error_reporting":    config.SentryDSN != "",
+		"freshness_alerts":   len(config.AlertNotifiers) > 0,
+		"announcements":      len(config.SnapshotNotifiers) > 0,
+		"telegram":           config.TelegramBotToken != "",
+		"bucket_events":      config.SQSQueueURL != "",
+		"dry_run":            config.DryRun,
+		"exporter_only":      config.ExporterOnly,
+		"inventory":          config.InventoryPrefix != "",
+		"mirrors":            len(config.Mirrors) > 0,
+		"federation":         len(config.Peers) > 0,
+		"geoip":              config.GeoIPDatabase != "",
+		"jobs":               len(scheduledJobs) > 0,
+		"snapshot_jobs":      len(config.Snapshotters) > 0,
+	}
+}
+
+// @Summary Get version
+// @Description Get the version, build information and enabled features of the running service
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /version [get]
+func getVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"go_version": runtime.Version(),
+		"features":   enabledFeatures(),
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmCaches loads the listing and snapshot info of every configured network into
+// the caches on the background worker pool, so the first requests after a deploy
+// don't all hit S3 at once. Warm-up is best effort, the instance reports ready
+// once it is over even if some networks failed.
+func warmCaches() {
+	start := time.Now()
+	defer cacheWarm.Store(true)
+	ctx := context.Background()
+
+	networks := config.WarmupNetworks
+	if len(networks) == 0 {
+		var err error
+		if networks, err = discoverNetworks(ctx); err != nil {
+			logger.Error("Cache warm-up failed to discover networks", "error", err)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, n := range networks {
+		protocol, network, ok := strings.Cut(n, "/")
+		if !ok {
+			logger.Warn("Cache warm-up skipping invalid network", "network", n)
+			continue
+		}
+
+		wg.Add(1)
+		backgroundJobs.Submit(func() {
+			defer wg.Done()
+
+			if _, err := loadFiles(ctx, protocol, network); err != nil {
+				logger.Error("Cache warm-up failed to list network", "protocol", protocol, "network", network, "error", err)
+			}
+			// Not every network publishes a snapshot-latest.json, so errors are expected here
+			sharedStorageCall(ctx, "info:"+protocol+"/"+network, func(ctx context.Context) (interface{}, error) {
+				return loadSnapshotInfo(ctx, protocol, network)
+			})
+		})
+	}
+	wg.Wait()
+
+	logger.Info("Cache warm-up finished", "networks", len(networks), "duration", time.Since(start))
+}
+
+// discoverNetworks returns all protocol/network pairs found in the bucket, or the
+// registered ones once any network is registered, only the allowlisted ones if
+// networks is configured
+func discoverNetworks(ctx context.Context) ([]string, error) {
+	if networks, ok := registeredNetworkNames(); ok {
+		return networks, nil
+	}
+	svc := storageClient()
+	protocols, err := listCommonPrefixes(ctx, svc, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []string
+	for _, protocol := range protocols {
+		prefixes, err := listCommonPrefixes(ctx, svc, protocol)
+		if err != nil {
+			return nil, err
+		}
+		for _, network := range prefixes {
+			if name := strings.TrimSuffix(network, "/"); networkAllowed(name) {
+				networks = append(networks, name)
+			}
+		}
+	}
+	return networks, nil
+}
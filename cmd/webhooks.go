@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookMaxAttempts is how often a delivery is attempted before it is dropped
+const webhookMaxAttempts = 5
+
+// webhookEvents are the event types webhooks can subscribe to
+var webhookEvents = map[string]bool{
+	eventSnapshotPublished: true,
+	eventSnapshotDeleted:   true,
+	eventLatestChanged:     true,
+}
+
+// webhook is a consumer's callback URL
+type webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events"`
+	// Protocol and Network optionally restrict the webhook to one protocol or network
+	Protocol  string    `json:"protocol,omitempty"`
+	Network   string    `json:"network,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// matches reports whether the webhook subscribed to e
+func (w *webhook) matches(e snapshotEvent) bool {
+	if w.Protocol != "" && w.Protocol != e.Protocol || w.Network != "" && w.Network != e.Network {
+		return false
+	}
+	for _, t := range w.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookStore holds the registered webhooks, persisted to a JSON file if a path is set
+type webhookStore struct {
+	mu    sync.RWMutex
+	path  string
+	hooks map[string]*webhook
+}
+
+// Define the webhook store
+var webhooks = &webhookStore{hooks: make(map[string]*webhook)}
+
+// load reads the webhooks persisted at path, a missing file is an empty store
+func (s *webhookStore) load(path string) error {
+	s.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var hooks []*webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		s.hooks[h.ID] = h
+	}
+	return nil
+}
+
+// save persists the webhooks, the caller must hold s.mu
+func (s *webhookStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// list returns all webhooks ordered by creation, the caller must hold s.mu
+func (s *webhookStore) list() []*webhook {
+	hooks := make([]*webhook, 0, len(s.hooks))
+	for _, h := range s.hooks {
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks
+}
+
+// withoutSecret returns a copy of h that is safe to return from list and get
+func withoutSecret(h *webhook) *webhook {
+	c := *h
+	c.Secret = ""
+	return &c
+}
+
+// validateWebhook checks a webhook submitted by a client
+func validateWebhook(h *webhook) error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("events must not be empty")
+	}
+	for _, t := range h.Events {
+		if !webhookEvents[t] {
+			return fmt.Errorf("unknown event %q", t)
+		}
+	}
+	return nil
+}
+
+func listWebhooks(c *gin.Context) {
+	webhooks.mu.RLock()
+	defer webhooks.mu.RUnlock()
+
+	hooks := make([]*webhook, 0, len(webhooks.hooks))
+	for _, h := range webhooks.list() {
+		hooks = append(hooks, withoutSecret(h))
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks})
+}
+
+func getWebhook(c *gin.Context) {
+	webhooks.mu.RLock()
+	defer webhooks.mu.RUnlock()
+
+	h, ok := webhooks.hooks[c.Param("id")]
+	if !ok {
+		respondError(c, http.StatusNotFound, codeWebhookNotFound, "Webhook not found")
+		return
+	}
+	c.JSON(http.StatusOK, withoutSecret(h))
+}
+
+// createWebhook registers a webhook. The signing secret is generated unless the
+// client provides one, and is only ever returned in this response.
+func createWebhook(c *gin.Context) {
+	var h webhook
+	if err := c.ShouldBindJSON(&h); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateWebhook(&h); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	h.ID = newRequestID()
+	h.CreatedAt = time.Now().UTC()
+	if h.Secret == "" {
+		h.Secret = newRequestID() + newRequestID()
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	webhooks.hooks[h.ID] = &h
+	if err := webhooks.save(); err != nil {
+		delete(webhooks.hooks, h.ID)
+		respondInternalError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, &h)
+}
+
+// updateWebhook replaces the URL, events and filters of a webhook, and its secret if one is given
+func updateWebhook(c *gin.Context) {
+	var update webhook
+	if err := c.ShouldBindJSON(&update); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateWebhook(&update); err != nil {
+		respondError(c, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	h, ok := webhooks.hooks[c.Param("id")]
+	if !ok {
+		respondError(c, http.StatusNotFound, codeWebhookNotFound, "Webhook not found")
+		return
+	}
+	previous := *h
+	h.URL, h.Events, h.Protocol, h.Network = update.URL, update.Events, update.Protocol, update.Network
+	if update.Secret != "" {
+		h.Secret = update.Secret
+	}
+	if err := webhooks.save(); err != nil {
+		*h = previous
+		respondInternalError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, withoutSecret(h))
+}
+
+func deleteWebhook(c *gin.Context) {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+
+	h, ok := webhooks.hooks[c.Param("id")]
+	if !ok {
+		respondError(c, http.StatusNotFound, codeWebhookNotFound, "Webhook not found")
+		return
+	}
+	if dryRun(c) {
+		logDryRun(c, "webhook deletion", "id", h.ID)
+		c.JSON(http.StatusOK, gin.H{"id": h.ID, "dry_run": true})
+		return
+	}
+	delete(webhooks.hooks, h.ID)
+	if err := webhooks.save(); err != nil {
+		webhooks.hooks[h.ID] = h
+		respondInternalError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// deliverWebhooks sends e to every webhook subscribed to it
+func deliverWebhooks(e snapshotEvent) {
+	webhooks.mu.RLock()
+	var targets []webhook
+	for _, h := range webhooks.hooks {
+		if h.matches(e) {
+			targets = append(targets, *h)
+		}
+	}
+	webhooks.mu.RUnlock()
+
+	for _, h := range targets {
+		h := h
+		go deliverWebhook(&h, e)
+	}
+}
+
+// deliverWebhook posts e to h, retrying with exponential backoff unless h rejects
+// it with a client error. The payload is signed with the webhook's secret in the
+// X-Webhook-Signature header as sha256=<hex HMAC-SHA256 of the body>.
+func deliverWebhook(h *webhook, e snapshotEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	signature := webhookSignature(h.Secret, body)
+
+	backoff := time.Second
+	attempt := 1
+	for ; ; attempt++ {
+		err = postWebhook(h.URL, e.Type, signature, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookMaxAttempts || errors.Is(err, errWebhookRejected) {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	logger.Warn("Webhook delivery failed", "webhook", h.ID, "event", e.Type, "attempts", attempt, "error", err)
+}
+
+// errWebhookRejected is returned for responses a retry won't change, client errors
+// other than 408 Request Timeout and 429 Too Many Requests
+var errWebhookRejected = errors.New("webhook rejected the event")
+
+// webhookSignature signs body with secret for the X-Webhook-Signature header
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts body to target. Its errors leave out target, callback URLs
+// often carry a token.
+func postWebhook(target, eventType, signature string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", eventType)
+	req.Header.Set("X-Webhook-Signature", signature)
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w with %s", errWebhookRejected, resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func registerWebhookRoutes(router *gin.Engine) {
+	hooks := router.Group("/webhooks", adminAuth())
+	hooks.GET("", listWebhooks)
+	hooks.POST("", createWebhook)
+	hooks.GET("/:id", getWebhook)
+	hooks.PUT("/:id", updateWebhook)
+	hooks.DELETE("/:id", deleteWebhook)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	newTestAPI(t)
+	var requests atomic.Int32
+	status := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// Only the first request gets the status, retries succeed
+		w.WriteHeader(int(status.Swap(http.StatusOK)))
+	}))
+	defer server.Close()
+	h := &webhook{ID: "hook", URL: server.URL + "/hooks/secret-token"}
+
+	// Connection errors name the URL, which carries the credential of the webhook
+	if err := postWebhook("http://127.0.0.1:1/hooks/secret-token", "snapshot.created", "", nil); err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("error %v, want one without the URL", err)
+	}
+
+	status.Store(http.StatusNotFound)
+	err := postWebhook(h.URL, "snapshot.created", "", nil)
+	if err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("error %v, want one without the URL", err)
+	}
+
+	// Client errors aren't retried, except 408 and 429
+	for _, tt := range []struct {
+		status   int32
+		requests int32
+	}{{http.StatusNotFound, 1}, {http.StatusTooManyRequests, 2}} {
+		requests.Store(0)
+		status.Store(tt.status)
+		deliverWebhook(h, snapshotEvent{Type: "snapshot.created"})
+		if n := requests.Load(); n != tt.requests {
+			t.Errorf("%d: %d requests, want %d", tt.status, n, tt.requests)
+		}
+	}
+}
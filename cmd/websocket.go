@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// eventFilter selects events by protocol, network and type, empty fields match anything
+type eventFilter struct {
+	Protocol string   `json:"protocol,omitempty"`
+	Network  string   `json:"network,omitempty"`
+	Events   []string `json:"events,omitempty"`
+}
+
+func (f eventFilter) matches(e snapshotEvent) bool {
+	if f.Protocol != "" && f.Protocol != e.Protocol || f.Network != "" && f.Network != e.Network {
+		return false
+	}
+	if len(f.Events) == 0 {
+		return true
+	}
+	for _, t := range f.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// eventSocketMessage is a message sent by a WebSocket client. Action is subscribe
+// to add a filter or unsubscribe to remove all filters equal to it.
+type eventSocketMessage struct {
+	Action string `json:"action"`
+	eventFilter
+}
+
+const (
+	// maxEventFilters is the number of filters a WebSocket connection can subscribe
+	// to, each is checked for every event
+	maxEventFilters = 32
+	// maxEventSocketMessage is the largest message a WebSocket client can send
+	maxEventSocketMessage = 16 << 10
+)
+
+var (
+	errUnknownAction  = errors.New("action must be subscribe or unsubscribe")
+	errTooManyFilters = fmt.Errorf("at most %d filters can be subscribed to", maxEventFilters)
+)
+
+// eventSubscriptions are the filters of one WebSocket connection. Without any
+// filter the connection receives every event.
+type eventSubscriptions struct {
+	mu      sync.Mutex
+	filters []eventFilter
+}
+
+// apply subscribes or unsubscribes the filter of m. Subscribing to a filter twice
+// keeps one, and subscribing beyond maxEventFilters is refused.
+func (s *eventSubscriptions) apply(m eventSocketMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Action {
+	case "subscribe":
+		for _, f := range s.filters {
+			if equalFilters(f, m.eventFilter) {
+				return nil
+			}
+		}
+		if len(s.filters) >= maxEventFilters {
+			return errTooManyFilters
+		}
+		s.filters = append(s.filters, m.eventFilter)
+	case "unsubscribe":
+		filters := s.filters[:0]
+		for _, f := range s.filters {
+			if !equalFilters(f, m.eventFilter) {
+				filters = append(filters, f)
+			}
+		}
+		s.filters = filters
+	default:
+		return errUnknownAction
+	}
+	return nil
+}
+
+func (s *eventSubscriptions) matches(e snapshotEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.filters) == 0 {
+		return true
+	}
+	for _, f := range s.filters {
+		if f.matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *eventSubscriptions) list() []eventFilter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]eventFilter{}, s.filters...)
+}
+
+func equalFilters(a, b eventFilter) bool {
+	if a.Protocol != b.Protocol || a.Network != b.Network || len(a.Events) != len(b.Events) {
+		return false
+	}
+	for i := range a.Events {
+		if a.Events[i] != b.Events[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidMessage reports whether a receive error is a message that isn't a valid
+// eventSocketMessage, the whole message was read and the connection is fine
+func invalidMessage(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// eventSocket serves the event stream over WebSocket. Events are sent as JSON
+// text messages, clients manage their filters by sending
+// {"action": "subscribe"|"unsubscribe", "protocol": ..., "network": ..., "events": [...]}
+// and receive {"type": "subscriptions", "filters": [...]} in reply. Invalid
+// messages and subscribing beyond maxEventFilters filters are answered with
+// {"type": "error", "error": ...}.
+var eventSocket = websocket.Server{
+	// Accept clients from any origin like the rest of the API, and clients
+	// sending no Origin header at all
+	Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	Handler:   serveEventSocket,
+}
+
+func serveEventSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	// Larger messages fail to be received and close the connection
+	ws.MaxPayloadBytes = maxEventSocketMessage
+
+	subs := &eventSubscriptions{}
+	query := ws.Request().URL.Query()
+	if protocol, network := query.Get("protocol"), query.Get("network"); protocol != "" || network != "" {
+		subs.filters = append(subs.filters, eventFilter{Protocol: protocol, Network: network})
+	}
+
+	events, closeStream := openEventStream()
+	defer closeStream()
+	eventStreams.Inc("websocket")
+	defer eventStreams.Add(-1, "websocket")
+
+	// Writes happen from the event loop and the reader, so they are serialized
+	var writeMu sync.Mutex
+	send := func(v interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return websocket.JSON.Send(ws, v)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var m eventSocketMessage
+			err := websocket.JSON.Receive(ws, &m)
+			if err != nil && !invalidMessage(err) {
+				return
+			}
+			var reply gin.H
+			if err != nil {
+				reply = gin.H{"type": "error", "error": "invalid message: " + err.Error()}
+			} else if err := subs.apply(m); err != nil {
+				reply = gin.H{"type": "error", "error": err.Error()}
+			} else {
+				reply = gin.H{"type": "subscriptions", "filters": subs.list()}
+			}
+			if err := send(reply); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !subs.matches(e) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// @Summary Stream snapshot events over WebSocket
+// @Description Streams the events of /events over WebSocket, with per-connection subscription filters
+// @Param protocol query string false "Initially only stream events of this protocol"
+// @Param network query string false "Initially only stream events of this network"
+// @Success 101
+// @Router /events/ws [get]
+func streamEventsWebSocket(c *gin.Context) {
+	eventSocket.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestEventSubscriptionsLimit(t *testing.T) {
+	subs := &eventSubscriptions{}
+	subscribe := func(network string) error {
+		return subs.apply(eventSocketMessage{Action: "subscribe", eventFilter: eventFilter{Protocol: "nimiq", Network: network}})
+	}
+	for i := 0; i < maxEventFilters; i++ {
+		if err := subscribe(fmt.Sprint("net-", i)); err != nil {
+			t.Fatalf("filter %d: %v", i, err)
+		}
+	}
+	// Subscribing again to a filter is no new filter
+	if err := subscribe("net-0"); err != nil {
+		t.Errorf("repeated filter: %v", err)
+	}
+	if err := subscribe("one-too-many"); !errors.Is(err, errTooManyFilters) {
+		t.Errorf("filter beyond the limit: %v", err)
+	}
+	if n := len(subs.list()); n != maxEventFilters {
+		t.Errorf("%d filters, want %d", n, maxEventFilters)
+	}
+
+	// Unsubscribing makes room again
+	if err := subs.apply(eventSocketMessage{Action: "unsubscribe", eventFilter: eventFilter{Protocol: "nimiq", Network: "net-0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscribe("one-too-many"); err != nil {
+		t.Errorf("filter after unsubscribing: %v", err)
+	}
+	if err := subs.apply(eventSocketMessage{Action: "watch"}); !errors.Is(err, errUnknownAction) {
+		t.Errorf("unknown action: %v", err)
+	}
+}
+
+func TestEventSocketInvalidMessages(t *testing.T) {
+	r, _ := newTestAPI(t)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/events/ws", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Invalid messages are answered with an error and the connection stays open
+	for _, message := range []string{`not json`, `{"action": "subscribe", "events": "x"}`, `{"action": "watch"}`, `{"action": "subscribe", "protocol": "nimiq"}`} {
+		if err := websocket.Message.Send(ws, message); err != nil {
+			t.Fatalf("%s: %v", message, err)
+		}
+		var reply struct {
+			Type  string `json:"type"`
+			Error string `json:"error"`
+		}
+		if err := websocket.JSON.Receive(ws, &reply); err != nil {
+			t.Fatalf("%s: %v", message, err)
+		}
+		want := "error"
+		if strings.Contains(message, "nimiq") {
+			want = "subscriptions"
+		}
+		if reply.Type != want {
+			t.Errorf("%s: reply %+v, want %s", message, reply, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultWorkerPoolSize is used when worker_pool_size is not set in the config
+const defaultWorkerPoolSize = 8
+
+// workerPool runs background jobs on a fixed number of goroutines, so background
+// work can't spawn unbounded goroutines or exceed our S3 concurrency budget
+type workerPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+// newWorkerPool starts a pool with size workers
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		size = defaultWorkerPoolSize
+	}
+	p := &workerPool{jobs: make(chan func())}
+	for i := 0; i < size; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues job, blocking until a worker is free to take it
+func (p *workerPool) Submit(job func()) {
+	p.jobs <- job
+}
+
+// TrySubmit hands job to an idle worker, returning false instead of blocking when
+// every worker is busy
+func (p *workerPool) TrySubmit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop waits for the running jobs to finish and stops the workers
+func (p *workerPool) Stop() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// requestFanOut bounds the goroutines a request spreads its work over, see fanOut
+const requestFanOut = 8
+
+// fanOut calls fn for 0 to n-1 on at most limit goroutines at once. It is for the
+// work of requests, which must not queue behind long background jobs on the pool:
+// once ctx is done no more calls are started, and ctx's error is returned after
+// the started ones returned.
+func fanOut(ctx context.Context, n, limit int, fn func(i int)) error {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := ctx.Err(); err != nil {
+			<-sem
+			return err
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	return ctx.Err()
+}
+
+// Define the pool shared by all background jobs
+var backgroundJobs *workerPool
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	// zsyncMinBlockSize is the block size zsyncmake uses for large files
+	zsyncMinBlockSize = 4096
+	// zsyncMaxBlocks bounds the number of blocks, and so the size of the control
+	// file, by growing the block size for very large snapshots
+	zsyncMaxBlocks = 1 << 20
+)
+
+// zsyncBlockSize returns the power of two block size for an object of size bytes
+func zsyncBlockSize(size int64) int64 {
+	blockSize := int64(zsyncMinBlockSize)
+	for size/blockSize > zsyncMaxBlocks {
+		blockSize *= 2
+	}
+	return blockSize
+}
+
+// zsyncHashLengths returns the number of sequential matches and the lengths of the
+// rolling and strong checksums stored per block, as zsyncmake computes them
+func zsyncHashLengths(size, blockSize int64) (seqMatches, rsumBytes, checksumBytes int) {
+	seqMatches = 1
+	if size > blockSize {
+		seqMatches = 2
+	}
+	l, bs, blocks := float64(size), float64(blockSize), float64(size/blockSize)
+
+	rsumBytes = int(math.Ceil(((math.Log(l)+math.Log(bs))/math.Log(2) - 8.6) / float64(seqMatches) / 8))
+	rsumBytes = min(max(rsumBytes, 2), 4)
+
+	checksumBytes = int(math.Ceil((20 + (math.Log(l)+math.Log(1+blocks))/math.Log(2)) / float64(seqMatches) / 8))
+	checksumBytes = max(checksumBytes, int((7.9+(20+math.Log(1+blocks)/math.Log(2)))/8))
+	checksumBytes = min(checksumBytes, 16)
+	return seqMatches, rsumBytes, checksumBytes
+}
+
+// zsyncRollingSum is the rolling checksum of a block as zsync computes it
+func zsyncRollingSum(block []byte) [4]byte {
+	var a, b uint16
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(len(block)-i) * uint16(c)
+	}
+	return [4]byte{byte(a >> 8), byte(a), byte(b >> 8), byte(b)}
+}
+
+// generateZsyncIndex reads an object and returns the part of its zsync control
+// file that does not depend on where it is downloaded from: the size headers,
+// the SHA-1 and the block checksums
+func generateZsyncIndex(key, etag string, size int64) ([]byte, error) {
+	start := time.Now()
+	svc, bucket := keyClient(storageClient(), key)
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		IfMatch: aws.String(etag),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	blockSize := zsyncBlockSize(size)
+	seqMatches, rsumBytes, checksumBytes := zsyncHashLengths(size, blockSize)
+
+	var sums bytes.Buffer
+	whole := sha1.New()
+	block := make([]byte, blockSize)
+	var read int64
+	for {
+		n, err := io.ReadFull(out.Body, block)
+		if n > 0 {
+			whole.Write(block[:n])
+			read += int64(n)
+			// The last block is padded with zeros
+			clear(block[n:])
+			rsum := zsyncRollingSum(block)
+			sums.Write(rsum[4-rsumBytes:])
+			strong := md4.New()
+			strong.Write(block)
+			sums.Write(strong.Sum(nil)[:checksumBytes])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if read != size {
+		return nil, fmt.Errorf("read %d bytes of %s, expected %d", read, key, size)
+	}
+
+	var index bytes.Buffer
+	fmt.Fprintf(&index, "Blocksize: %d\nLength: %d\nHash-Lengths: %d,%d,%d\nSHA-1: %s\n\n",
+		blockSize, size, seqMatches, rsumBytes, checksumBytes, hex.EncodeToString(whole.Sum(nil)))
+	index.Write(sums.Bytes())
+	logger.Info("Generated zsync index", "key", key, "block_size", blockSize, "duration", time.Since(start))
+	return index.Bytes(), nil
+}
+
+// zsyncURL returns the URL the zsync client fetches blocks from: the proxied
+// download under public_url, which doesn't expire, or else a week long download URL
+func zsyncURL(key string) (string, error) {
+	if config.PublicURL != "" {
+		return publicURL("/download/" + key), nil
+	}
+	u, err := downloadURL(storageClient(), key, torrentWebSeedTTL)
+	return u, err
+}
+
+// @Summary Get the zsync control file of a snapshot
+// @Description Get a zsync control file so clients holding an older snapshot only download the changed blocks. It is generated on first request, until it is ready 202 is returned.
+// @Produce application/x-zsync
+// @Success 200 {file} binary
+// @Success 202 {object} map[string]string
+// @Router /files/{protocol}/{network}/{filename}/zsync [get]
+func getZsync(c *gin.Context) {
+	filename := c.Param("filename")
+	key := fmt.Sprintf("%s/%s/%s", c.Param("protocol"), c.Param("network"), filename)
+
+	svc, bucket := keyClient(storageClient(), key)
+	head, err := svc.HeadObjectWithContext(withRequestID(c.Request.Context(), c), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		respondDownloadError(c, err)
+		return
+	}
+	etag, size := aws.StringValue(head.ETag), aws.Int64Value(head.ContentLength)
+	if isHead(c) {
+		respondDerivedHead(c, derivedCachePath(key, etag, ".zsync-index"), "zsync control file", "application/x-zsync")
+		return
+	}
+
+	index, err := readDerived(derivedCachePath(key, etag, ".zsync-index"), func() ([]byte, error) {
+		return generateZsyncIndex(key, etag, size)
+	})
+	if respondDerived(c, "zsync control file", err) {
+		return
+	}
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+	u, err := zsyncURL(key)
+	if err != nil {
+		respondInternalError(c, err)
+		return
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "zsync: 0.6.2\nFilename: %s\n", path.Base(key))
+	if head.LastModified != nil {
+		fmt.Fprintf(&body, "MTime: %s\n", head.LastModified.UTC().Format(time.RFC1123Z))
+	}
+	fmt.Fprintf(&body, "URL: %s\n", u)
+	body.Write(index)
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".zsync"))
+	c.Data(http.StatusOK, "application/x-zsync", body.Bytes())
+}